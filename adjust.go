@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// POST /admin/adjust の理由の長さの上限 (文字数)
+const maxAdjustReasonLength = 500
+
+// POST /admin/adjust のボディの上限
+const maxAdjustBodyBytes = 16 << 10
+
+// POST /admin/adjust のリクエスト形式
+type AdjustCountsRequest struct {
+	Deltas map[string]int `json:"deltas"` // 選択肢ごとの増減 (例: {"hot": -3})
+	Reason string         `json:"reason"` // 直した理由 (監査ログに残す。必須)
+}
+
+// POST /admin/adjust のレスポンス形式
+type AdjustCountsResponse struct {
+	Counts     map[string]int `json:"counts"`     // 直した後の票数
+	AdjustedAt string         `json:"adjustedAt"` // RFC3339, UTC
+}
+
+// POST /admin/adjust?roomId= エンドポイントの処理 (後から分かったボットの票を取り除くときなど)
+// 選択肢ごとの増減を票数と重み付きの票数の両方に足す。0未満になる選択肢は0にする
+// ユーザーごとの投票は変えないので、票数が投票しているユーザーの数と合わなくなる (意図したもの)
+// 直した後の GET /results には adjustedAt が付く。リセットするまで残り、SQLite ではイベントとして再起動後も残る
+func adminAdjustHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	var req AdjustCountsRequest
+	if err := decodeJSONBody(w, r, &req, maxAdjustBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	switch {
+	case req.Reason == "":
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "reason is required")
+		return
+	case utf8.RuneCountInString(req.Reason) > maxAdjustReasonLength:
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("reason must be at most %d characters", maxAdjustReasonLength))
+		return
+	case strings.IndexFunc(req.Reason, func(r rune) bool { return unicode.IsControl(r) && r != '\n' }) >= 0:
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "reason must not contain control characters")
+		return
+	}
+	maps.DeleteFunc(req.Deltas, func(_ string, delta int) bool { return delta == 0 })
+	if len(req.Deltas) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "deltas is required")
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	set := rm.optionSet()
+	for option := range req.Deltas {
+		if !set.has(option) {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidOption, fmt.Sprintf("Invalid vote option %q", option))
+			return
+		}
+	}
+
+	rm.freezeIfClosed(time.Now())
+	if !rm.checkNotFinal(w) {
+		return
+	}
+
+	now := time.Now()
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := adjustStoreCounts(ctx, rm.store, req.Deltas, now); err != nil {
+		slog.ErrorContext(r.Context(), "failed to adjust vote counts", "event", "adjust", "roomId", rm.id, "error", err)
+		writeStoreError(w, err, "Failed to adjust vote counts")
+		return
+	}
+	rm.notifySubscribers()
+
+	recordAudit(AuditEntry{
+		Action:    "adjust",
+		RoomID:    rm.id,
+		Deltas:    req.Deltas,
+		Reason:    req.Reason,
+		RemoteIP:  remoteIP(r),
+		RequestID: requestIDFromContext(r.Context()),
+	})
+
+	counts := rm.store.Counts()
+	rm.updateVoteGauges(counts)
+	slog.WarnContext(r.Context(), "vote counts adjusted", "event", "adjust", "roomId", rm.id, "deltas", req.Deltas, "reason", req.Reason, "counts", counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(AdjustCountsResponse{Counts: counts, AdjustedAt: now.UTC().Format(time.RFC3339)})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 管理用エンドポイントの共有シークレット (ADMIN_KEY)
+// 空のときは管理用エンドポイントはすべて 401 になる
+var adminKey string
+
+// X-Admin-Key ヘッダーが管理用キーと一致するか (比較にかかる時間から推測されないよう定数時間で比べる)
+// ブラウザの管理ページ (GET /admin) からは、ログインで付けた Cookie でもよい
+func isAdmin(r *http.Request) bool {
+	if adminKey == "" {
+		return false
+	}
+	key := r.Header.Get("X-Admin-Key")
+	return subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 || hasAdminCookie(r)
+}
+
+// 管理用キーが無いリクエストを 401 で断るミドルウェア
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			slog.WarnContext(r.Context(), "admin authentication failed", "event", "admin_auth", "path", r.URL.Path)
+			writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// 管理用エンドポイントの対象の部屋 (?roomId= が無ければ既定の投票)
+func adminTargetRoom(w http.ResponseWriter, r *http.Request) *room {
+	roomID := r.URL.Query().Get("roomId")
+	if roomID == "" {
+		return defaultRoom
+	}
+	if !roomIDPattern.MatchString(roomID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		return nil
+	}
+	rm, err := getRoom(roomID, false)
+	if errors.Is(err, errRoomNotFound) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Room not found")
+		return nil
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to open room", "roomId", roomID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to open room")
+		return nil
+	}
+	return rm
+}
+
+// POST /admin/reset エンドポイントの処理
+// 次のグループのために票数をすべて0にし、ユーザーごとの投票を消す
+// 終了して結果が確定した投票はリセットできない (POST /admin/reopen で再開してから)
+func adminResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rm.freezeIfClosed(time.Now())
+	if !rm.checkNotFinal(w) {
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := rm.store.Reset(ctx); err != nil {
+		slog.ErrorContext(r.Context(), "failed to reset votes", "event", "reset", "roomId", rm.id, "error", err)
+		writeStoreError(w, err, "Failed to reset votes")
+		return
+	}
+	rm.thresholdsFired = nil
+	clear(rm.deviceVotes)
+	clear(rm.pendingVotes)
+	closeViewers.take(rm.id)
+	clear(rm.comments)
+	rm.transitions = nil
+	rm.userCohorts = nil
+	rm.cohortCounts = nil
+	rm.throughput.reset(time.Now())
+	rm.dropAllReceipts()
+	rm.notifySubscribers()
+
+	recordAudit(AuditEntry{Action: "reset", RoomID: rm.id, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+
+	counts := rm.store.Counts()
+	rm.updateVoteGauges(counts)
+	slog.WarnContext(r.Context(), "votes reset", "event", "reset", "roomId", rm.id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(counts)
+}
+
+// GET /results/{option}/voters の件数の既定値と上限
+const (
+	defaultVotersLimit = 100
+	maxVotersLimit     = 1000
+)
+
+// GET /results/{option}/voters のレスポンス形式
+type VotersResponse struct {
+	Option string   `json:"option"`
+	Total  int      `json:"total"`  // その選択肢に投票しているユーザーの数
+	Limit  int      `json:"limit"`  // このページの最大件数
+	Offset int      `json:"offset"` // このページの先頭の位置
+	Voters []string `json:"voters"` // ユーザーID (名前順)
+}
+
+// GET /results/{option}/voters?limit=&offset= エンドポイントの処理 (管理用)
+// その選択肢に現在投票しているユーザーIDを返す。ユーザーの情報なので管理用キーが必要
+func (rm *room) votersHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	option, ok := rm.optionSet().canonical(r.PathValue("option"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOption, "Invalid vote option")
+		return
+	}
+	limit, ok := parseIntParam(w, r, "limit", defaultVotersLimit, 1, maxVotersLimit)
+	if !ok {
+		return
+	}
+	offset, ok := parseIntParam(w, r, "offset", 0, 0, math.MaxInt)
+	if !ok {
+		return
+	}
+
+	rm.mutex.RLock()
+	var voters []string
+	for userID, record := range rm.store.UserVotes() {
+		if record.Vote == option {
+			// 複数選択モードの選択は「ユーザーID + 区切り + 選択肢」で保存している
+			userID, _, _ = strings.Cut(userID, selectionSeparator)
+			voters = append(voters, userID)
+		}
+	}
+	rm.mutex.RUnlock()
+
+	// ページをまたいでも同じ順序になるよう名前順にする
+	slices.Sort(voters)
+	res := VotersResponse{Option: option, Total: len(voters), Limit: limit, Offset: offset, Voters: []string{}}
+	if offset < len(voters) {
+		res.Voters = voters[offset:min(offset+limit, len(voters))]
+	}
+
+	slog.WarnContext(r.Context(), "voters listed", "event", "voters", "roomId", rm.id, "option", option, "remoteIp", remoteIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// クエリパラメータを min 以上 max 以下の整数として読む。不正ならエラーレスポンスを書いて false を返す
+func parseIntParam(w http.ResponseWriter, r *http.Request, name string, def, minValue, maxValue int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minValue || n > maxValue {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid "+name)
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// GET /admin でログインしたときに付ける Cookie の名前
+const adminCookieName = "admin_session"
+
+// ログインの Cookie の有効期間
+const adminCookieMaxAge = 12 * time.Hour
+
+// ログインのフォームのボディの上限
+const maxAdminLoginBytes = 4 << 10
+
+// ログインの Cookie の値 (管理用キーそのものは Cookie に入れず、キーから作った HMAC を入れる)
+// ADMIN_KEY を変えると、それまでの Cookie はすべて使えなくなる
+func adminSessionToken() string {
+	mac := hmac.New(sha256.New, []byte(adminKey))
+	mac.Write([]byte("admin-session"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ログインの Cookie が管理用キーから作ったものか
+// Cookie はブラウザが勝手に送るので、GET 以外は別のオリジンのページからのリクエストでないことも確かめる
+func hasAdminCookie(r *http.Request) bool {
+	c, err := r.Cookie(adminCookieName)
+	if err != nil {
+		return false
+	}
+	if !isGetOrHead(r) && !sameOrigin(r) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(adminSessionToken())) == 1
+}
+
+// Origin ヘッダーが無いか、このサーバーと同じホストか
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// GET /admin のテンプレートに渡す値
+type adminPage struct {
+	LoggedIn   bool
+	LoginError string
+	RoomID     string
+	Status     string
+	OpensAt    string // 終了させるときに受付開始の時刻を変えないように渡す (未設定なら空文字)
+	Rows       []dashboardRow
+	Total      int
+	StreamURL  string
+	AdminURL   string // 管理用エンドポイントの接頭辞
+}
+
+// 運用者向けの管理ページ (ログインしていなければログインのフォーム)
+// ボタンは既存の管理用エンドポイントを fetch で呼び、票数は SSE (results/stream) で書き換える
+var adminTemplate = template.Must(template.New("admin").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>管理</title>
+<style>
+body { font-family: system-ui, "Hiragino Sans", "Noto Sans JP", sans-serif; margin: 2rem; max-width: 48rem; }
+table { border-collapse: collapse; margin: 1rem 0; }
+td { padding: .25rem .75rem; }
+td.count { text-align: right; font-variant-numeric: tabular-nums; }
+section { margin: 1.5rem 0; }
+button { margin-right: .5rem; }
+#message { white-space: pre-wrap; color: #555; }
+</style>
+</head>
+<body>
+{{if .LoggedIn}}
+<h1>管理{{if .RoomID}} - {{.RoomID}}{{end}}</h1>
+<p>受付状態: <span id="status">{{.Status}}</span> · 合計 <span id="total">{{.Total}}</span> 票</p>
+<table>
+{{range .Rows}}<tr data-key="{{.Key}}"><td>{{.Label}}</td><td class="count">{{.Count}}</td></tr>
+{{end}}</table>
+<section>
+<button id="reset">票をリセット</button>
+<button id="close">今すぐ終了</button>
+<button id="reopen">再開</button>
+</section>
+<section>
+<form id="add-option">
+<input name="key" placeholder="キー (例: warm)" required>
+<input name="ja" placeholder="表示名 (ja)">
+<input name="en" placeholder="表示名 (en)">
+<button type="submit">選択肢を追加</button>
+</form>
+</section>
+<p id="message"></p>
+<form method="post" action="/admin/logout"><button type="submit">ログアウト</button></form>
+<script>
+(function () {
+  var room = {{.RoomID}}, opensAt = {{.OpensAt}};
+  var message = document.getElementById("message");
+  var call = function (path, body, reload) {
+    var init = { method: "POST", credentials: "same-origin", headers: {} };
+    if (body !== undefined) {
+      init.headers["Content-Type"] = "application/json";
+      init.body = JSON.stringify(body);
+    }
+    fetch({{.AdminURL}} + path + (room ? "?roomId=" + encodeURIComponent(room) : ""), init)
+      .then(function (res) { return res.text().then(function (text) { message.textContent = res.status + " " + text; return res.ok; }); })
+      .then(function (ok) { if (ok && reload) { location.reload(); } })
+      .catch(function (err) { message.textContent = String(err); });
+  };
+  document.getElementById("reset").onclick = function () {
+    if (confirm("すべての票を0に戻します。よろしいですか?")) { call("/reset", undefined, true); }
+  };
+  document.getElementById("close").onclick = function () {
+    if (confirm("投票を終了します。よろしいですか?")) { call("/schedule", { opensAt: opensAt || null, closesAt: new Date().toISOString() }, true); }
+  };
+  document.getElementById("reopen").onclick = function () { call("/reopen", undefined, true); };
+  document.getElementById("add-option").onsubmit = function (e) {
+    e.preventDefault();
+    var f = e.target, labels = {};
+    if (f.ja.value) { labels.ja = f.ja.value; }
+    if (f.en.value) { labels.en = f.en.value; }
+    call("/options", { key: f.key.value, labels: labels }, true);
+  };
+  if (!window.EventSource) { return; }
+  var source = new EventSource({{.StreamURL}});
+  source.onmessage = function (e) {
+    var counts = JSON.parse(e.data), total = 0, key;
+    for (key in counts) { total += counts[key]; }
+    document.querySelectorAll("tr[data-key]").forEach(function (row) {
+      row.querySelector(".count").textContent = counts[row.dataset.key] || 0;
+    });
+    document.getElementById("total").textContent = total;
+  };
+})();
+</script>
+{{else}}
+<h1>管理</h1>
+{{if .LoginError}}<p>{{.LoginError}}</p>{{end}}
+<form method="post" action="/admin/login">
+<input type="password" name="key" placeholder="ADMIN_KEY" autocomplete="current-password" required>
+<button type="submit">ログイン</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// GET /admin?roomId= エンドポイントの処理 (curl を使わずに、リセットや終了、選択肢の追加と票数の確認をできるように)
+// 管理用キー (X-Admin-Key ヘッダーか、ログインの Cookie) が無ければログインのフォームを 401 で返す
+func adminPageHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if !isAdmin(r) {
+		writeAdminPage(w, r, http.StatusUnauthorized, adminPage{})
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	now := time.Now()
+	rm.ensureFinal(now)
+	snap := rm.snapshotResults(now, false)
+	res := buildResults(snap.set, snap.counts, snap.weighted, defaultLabelLanguage)
+
+	page := adminPage{
+		LoggedIn:  true,
+		RoomID:    rm.id,
+		Status:    snap.status,
+		Total:     res.Total,
+		StreamURL: "/v1/results/stream",
+		AdminURL:  "/v1/admin",
+	}
+	if rm.id != "" {
+		page.StreamURL = "/v1/rooms/" + rm.id + "/results/stream"
+	}
+	rm.mutex.RLock()
+	if rm.schedule.OpensAt != nil {
+		page.OpensAt = rm.schedule.OpensAt.UTC().Format(time.RFC3339)
+	}
+	rm.mutex.RUnlock()
+	for _, key := range snap.set.keys {
+		o := res.Options[key]
+		page.Rows = append(page.Rows, dashboardRow{Key: key, Label: o.Label, Count: o.Count, Percentage: o.Percentage})
+	}
+	writeAdminPage(w, r, http.StatusOK, page)
+}
+
+func writeAdminPage(w http.ResponseWriter, r *http.Request, status int, page adminPage) {
+	var buf bytes.Buffer
+	if err := adminTemplate.Execute(&buf, page); err != nil {
+		slog.ErrorContext(r.Context(), "failed to render admin page", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to render admin page")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// 別のサイトの iframe に埋め込んでボタンを押させないようにする
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// POST /admin/login エンドポイントの処理 (フォームの key が管理用キーと一致すれば Cookie を付けて /admin に戻す)
+// Cookie は HttpOnly かつ SameSite=Strict で、別のサイトからのリクエストには付かない
+func adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAdminLoginBytes)
+	if err := r.ParseForm(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "Invalid form")
+		return
+	}
+	key := r.PostForm.Get("key")
+	if adminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 || !sameOrigin(r) {
+		slog.WarnContext(r.Context(), "admin authentication failed", "event", "admin_auth", "path", r.URL.Path)
+		writeAdminPage(w, r, http.StatusUnauthorized, adminPage{LoginError: "管理用キーが違います"})
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin logged in", "event", "admin_login", "remoteIp", remoteIP(r))
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    adminSessionToken(),
+		Path:     "/",
+		MaxAge:   int(adminCookieMaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// POST /admin/logout エンドポイントの処理 (ログインの Cookie を消して /admin に戻す)
+func adminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,58 @@
+package main
+
+import "sync"
+
+// 部屋ごとに覚えておく集計の結果の数の上限 (?lang= ごとに別に覚えるので、知らない言語を並べられても増えすぎないように)
+const maxAggregateEntries = 32
+
+// 集計の結果がどの状態から作られたか
+// 投票が反映されるたびに version が増え、終了して確定した票数に切り替わると final が、選択肢が変わると set が変わる
+type aggregateVersion struct {
+	version uint64
+	final   bool
+	set     *optionSet
+}
+
+// 票数から作った集計の結果 (GET /results/stats など) を、票数が変わるまで覚えておく
+// 同じバージョンの読み出しが続くあいだは、マップを数え直さずに前の結果を返す
+type aggregateCache struct {
+	mu      sync.Mutex
+	version aggregateVersion
+	entries map[string]any
+}
+
+// version の key の結果。無ければ compute で作って覚える (覚えた値は呼び出し側で書き換えないこと)
+// version が変わっていれば、前のバージョンの結果はすべて捨てる
+func (c *aggregateCache) get(version aggregateVersion, key string, compute func() any) any {
+	c.mu.Lock()
+	if c.version == version {
+		if value, ok := c.entries[key]; ok {
+			c.mu.Unlock()
+			return value
+		}
+	}
+	c.mu.Unlock()
+
+	// 作るあいだはロックを外す (同時に作っても結果は同じ)
+	value := compute()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || c.version != version {
+		c.version = version
+		c.entries = make(map[string]any)
+	}
+	if len(c.entries) < maxAggregateEntries {
+		c.entries[key] = value
+	}
+	return value
+}
+
+// スナップショットの集計の key の結果を返す (覚えていなければ compute で作る)
+// Redis の票数は他のインスタンスの投票でも変わり、この部屋のバージョンでは分からないので、覚えずに毎回作る
+func (rm *room) cachedAggregate(snap resultsSnapshot, key string, compute func() any) any {
+	if storeBackend == "redis" {
+		return compute()
+	}
+	return rm.aggregates.get(snap.aggregateVersion, key, compute)
+}
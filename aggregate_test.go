@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAggregateCache(t *testing.T) {
+	var c aggregateCache
+	var computed atomic.Int64
+	compute := func(v int) func() any {
+		return func() any {
+			computed.Add(1)
+			return v
+		}
+	}
+	v1 := aggregateVersion{version: 1}
+	v2 := aggregateVersion{version: 2}
+
+	if got := c.get(v1, "stats", compute(1)); got != 1 {
+		t.Fatalf("first get %v", got)
+	}
+	if got := c.get(v1, "stats", compute(99)); got != 1 || computed.Load() != 1 {
+		t.Errorf("same version: %v, computed %d times, want cached 1", got, computed.Load())
+	}
+	// 別の key は別に作る
+	if got := c.get(v1, "list", compute(3)); got != 3 || computed.Load() != 2 {
+		t.Errorf("other key: %v, computed %d times", got, computed.Load())
+	}
+	// バージョンが変われば作り直し、前のバージョンの結果は捨てる
+	if got := c.get(v2, "stats", compute(2)); got != 2 || computed.Load() != 3 {
+		t.Errorf("new version: %v, computed %d times", got, computed.Load())
+	}
+	if len(c.entries) != 1 {
+		t.Errorf("entries after version change: %d, want 1", len(c.entries))
+	}
+	// 終了して確定したら、同じ version でも別の結果
+	if got := c.get(aggregateVersion{version: 2, final: true}, "stats", compute(4)); got != 4 {
+		t.Errorf("final: %v, want 4", got)
+	}
+}
+
+// 覚える結果の数は maxAggregateEntries で頭打ちになる (それを超えた key は毎回作る)
+func TestAggregateCacheBounded(t *testing.T) {
+	var c aggregateCache
+	v := aggregateVersion{version: 1}
+	for i := range maxAggregateEntries * 2 {
+		c.get(v, fmt.Sprintf("results:%d", i), func() any { return i })
+	}
+	if len(c.entries) != maxAggregateEntries {
+		t.Errorf("entries %d, want %d", len(c.entries), maxAggregateEntries)
+	}
+	computed := false
+	c.get(v, fmt.Sprintf("results:%d", maxAggregateEntries), func() any { computed = true; return 0 })
+	if !computed {
+		t.Error("key past the limit was cached")
+	}
+}
+
+// 同時に読み書きしても、返す結果はそのバージョンのもの (go test -race で競合も見る)
+func TestAggregateCacheConcurrent(t *testing.T) {
+	var c aggregateCache
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			version := uint64(i % 5)
+			got := c.get(aggregateVersion{version: version}, "stats", func() any { return version })
+			if got != version {
+				t.Errorf("version %d: got %v", version, got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// 投票が反映されたら、覚えていた結果ではなく新しい票数を返す
+func TestResultsCacheInvalidatedByVote(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	for _, path := range []string{"/v1/results", "/v1/results?format=list", "/v1/results/stats"} {
+		srv.do(t, http.MethodGet, path, nil)
+	}
+
+	srv.vote(t, "/v1/vote", "u2", "cold", http.StatusOK)
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, map[string]int{"hot": 1, "cold": 1}) {
+		t.Errorf("results after vote %v", got)
+	}
+	var stats StatsResponse
+	_, data := srv.do(t, http.MethodGet, "/v1/results/stats", nil)
+	decodeJSON(t, data, &stats)
+	if stats.Total != 2 {
+		t.Errorf("stats after vote: %s", data)
+	}
+}
+
+// 同じバージョンを読み続けるとき、集計を覚えておく場合と毎回作る場合を比べる
+func BenchmarkResultsAggregate(b *testing.B) {
+	newTestServer(b)
+	rm := defaultRoom
+	for i := range 1000 {
+		rm.store.RecordVote(b.Context(), fmt.Sprintf("u%d", i), defaultVoteOptions[i%3].Key, 1, time.Now())
+	}
+	b.Run("Uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				snap := rm.snapshotResults(time.Now(), false)
+				buildResults(snap.set, snap.counts, snap.weighted, defaultLabelLanguage)
+			}
+		})
+	})
+	b.Run("Cached", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				snap := rm.snapshotResults(time.Now(), false)
+				rm.cachedAggregate(snap, "results:"+defaultLabelLanguage, func() any {
+					return buildResults(snap.set, snap.counts, snap.weighted, defaultLabelLanguage)
+				})
+			}
+		})
+	})
+}
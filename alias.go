@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// VOTE_ALIASES で設定した、投票の値から選択肢のキーへの対応
+// 表示名 (あつい など) は設定しなくても読み替えるので、ここにはそれ以外の古いクライアントが送る値 (暑い など) を書く
+var voteAliases map[string]string
+
+// 投票で表示名や VOTE_ALIASES の値を受け付けるか (ACCEPT_VOTE_ALIASES。既定は true)
+// すべてのクライアントがキーで送るようになったら false にして、キー以外の投票を 400 にする
+var acceptVoteAliases = true
+
+// VOTE_ALIASES ("値=選択肢" のカンマ区切り。例: 暑い=hot,寒い=cold) と ACCEPT_VOTE_ALIASES を読む
+// 選択肢は表示名でもよい。選択肢を読み込んだ後に呼ぶこと
+// 同じ値を別々の選択肢に読み替えるもの、選択肢のキーと同じ値、別の選択肢の表示名と同じ値はエラー (どちらの票か決まらないため)
+func loadVoteAliases() error {
+	var err error
+	if acceptVoteAliases, err = envBool("ACCEPT_VOTE_ALIASES", true); err != nil {
+		return err
+	}
+
+	set := currentOptions.Load()
+	voteAliases = make(map[string]string)
+	for _, item := range envList("VOTE_ALIASES", nil) {
+		alias, name, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid VOTE_ALIASES entry %q: want alias=option", item)
+		}
+		alias = normalizeVote(alias)
+		if alias == "" {
+			return fmt.Errorf("invalid VOTE_ALIASES entry %q: empty alias", item)
+		}
+		key, ok := set.canonical(name)
+		if !ok {
+			return fmt.Errorf("invalid VOTE_ALIASES entry %q: unknown vote option", item)
+		}
+		if set.has(alias) {
+			return fmt.Errorf("invalid VOTE_ALIASES entry %q: %q is already a vote option", item, alias)
+		}
+		if other, ok := set.aliases[alias]; ok && other != key {
+			return fmt.Errorf("invalid VOTE_ALIASES entry %q: %q is a label of %q", item, alias, other)
+		}
+		if other, ok := voteAliases[alias]; ok && other != key {
+			return fmt.Errorf("invalid VOTE_ALIASES entry %q: %q is also aliased to %q", item, alias, other)
+		}
+		voteAliases[alias] = key
+	}
+	return nil
+}
+
+// 投票の値を選択肢のキーにする。キーでなく表示名か VOTE_ALIASES の値で読み替えたときは aliased が true
+// ACCEPT_VOTE_ALIASES=false ならキーのほかは受け付けない
+// 読み替えは キー > 表示名 > VOTE_ALIASES の順 (VOTE_ALIASES は読み替え先がこの一式にある選択肢のときだけ)
+func (s *optionSet) resolveVote(vote string) (key string, aliased, ok bool) {
+	vote = normalizeVote(vote)
+	if s.has(vote) {
+		return vote, false, true
+	}
+	if !acceptVoteAliases {
+		return "", false, false
+	}
+	if key, ok := s.aliases[vote]; ok {
+		return key, true, true
+	}
+	if key, ok := voteAliases[vote]; ok && s.has(key) {
+		return key, true, true
+	}
+	return "", false, false
+}
+
+// 投票の値を選択肢のキーにし、読み替えたときはログに残す (クライアントがキーで送るように移行できたかを追うため)
+func resolveVoteLogged(set *optionSet, vote string) (string, bool) {
+	key, aliased, ok := set.resolveVote(vote)
+	if aliased {
+		slog.Info("vote alias used", "event", "vote_alias", "alias", sanitizeLogValue(vote), "option", key)
+	}
+	return key, ok
+}
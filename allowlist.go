@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// 投票できるユーザーIDの一覧 (非公開の投票で、招待したユーザーだけに投票させる)
+// nil なら誰でも投票できる。読み込み直すときはマップごと差し替えるので、読む側はロックを取らない
+var allowedUsers atomic.Pointer[map[string]struct{}]
+
+// ALLOWED_USERS_FILE のパス (空なら SIGHUP で読み込み直さない)
+var allowedUsersFile string
+
+// ユーザーが投票できるか (一覧が無ければ誰でも投票できる)
+func userAllowed(userID string) bool {
+	allowed := allowedUsers.Load()
+	if allowed == nil {
+		return true
+	}
+	_, ok := (*allowed)[userID]
+	return ok
+}
+
+// ALLOWED_USERS_FILE (1行に1つのユーザーID。# から後はコメント) と ALLOWED_USERS (カンマ区切り) を読む
+// 両方あれば合わせたものにする。どちらも空なら一覧を外して、誰でも投票できるようにする
+func loadAllowedUsers() error {
+	users := make(map[string]struct{})
+	for _, userID := range envList("ALLOWED_USERS", nil) {
+		users[userID] = struct{}{}
+	}
+	if allowedUsersFile != "" {
+		fromFile, err := readAllowedUsersFile(allowedUsersFile)
+		if err != nil {
+			return err
+		}
+		maps.Copy(users, fromFile)
+	}
+
+	if len(users) == 0 {
+		allowedUsers.Store(nil)
+		return nil
+	}
+	allowedUsers.Store(&users)
+	return nil
+}
+
+func readAllowedUsersFile(path string) (map[string]struct{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if userID := strings.TrimSpace(line); userID != "" {
+			users[userID] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return users, nil
+}
+
+// 投票できるユーザーの数 (一覧が無ければ 0)
+func allowedUserCount() int {
+	if allowed := allowedUsers.Load(); allowed != nil {
+		return len(*allowed)
+	}
+	return 0
+}
+
+// SIGHUP を受けたら ALLOWED_USERS_FILE を読み込み直す (再起動せずに招待したユーザーを足せるように)
+// 読めなかったときは前の一覧のまま。サーバーが終了すると止まる
+func startAllowedUsersReloader() {
+	if allowedUsersFile == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := loadAllowedUsers(); err != nil {
+					slog.Error("failed to reload allowed users; keeping the previous list", "path", allowedUsersFile, "error", err)
+					continue
+				}
+				if count := allowedUserCount(); count > 0 {
+					slog.Info("allowed users reloaded", "path", allowedUsersFile, "users", count)
+				} else {
+					slog.Warn("allowed users list is empty; voting is open to everyone", "path", allowedUsersFile)
+				}
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// 一覧に無いユーザーなら 403 を書いて false を返す
+func checkUserAllowed(w http.ResponseWriter, userID string) bool {
+	if userAllowed(userID) {
+		return true
+	}
+	writeJSONError(w, http.StatusForbidden, errCodeForbidden, "User is not allowed to vote")
+	return false
+}
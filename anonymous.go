@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// 匿名投票モード (ANONYMOUS_VOTING=true)
+// 票数だけを増やし、誰が何に投票したかは保存しない。そのため以前の投票を確かめられず、
+// 投票の変更・取り消し、同じユーザーの重複の排除、人数の上限、nonce による再送の検出は使えない
+var anonymousVoting bool
+
+// ANONYMOUS_VOTING を読む。ユーザーごとの投票を前提にする設定と一緒に使われていたらエラー
+// 他の設定を読んだ後に呼ぶ
+func loadAnonymousVoting() error {
+	var err error
+	if anonymousVoting, err = envBool("ANONYMOUS_VOTING", false); err != nil || !anonymousVoting {
+		return err
+	}
+	if os.Getenv("ALLOW_VOTE_CHANGE") != "" && allowVoteChange {
+		return errors.New("ALLOW_VOTE_CHANGE cannot be enabled with ANONYMOUS_VOTING")
+	}
+	if maxVoters > 0 {
+		return errors.New("MAX_VOTERS cannot be used with ANONYMOUS_VOTING")
+	}
+	if voteNonces != nil {
+		return errors.New("VOTE_NONCE_TTL cannot be used with ANONYMOUS_VOTING")
+	}
+	allowVoteChange = false
+	return nil
+}
+
+// 匿名投票モードの POST /vote の処理 (voteHandler から呼ぶ)
+// 以前の投票は見ずに、毎回新しい1票として数える
+func (rm *room) anonymousVoteHandler(w http.ResponseWriter, r *http.Request, user authUser, vote, cohort string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if !rm.checkVotingOpen(w) {
+		return
+	}
+	if !rm.checkOptionCap(w, false, "", vote) {
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := rm.recordAnonymousVote(ctx, vote, voteWeight(user.UID, user.Role)); err != nil {
+		slog.ErrorContext(r.Context(), "failed to save anonymous vote", "event", "vote", "roomId", rm.id, "error", err)
+		writeStoreError(w, err, "Failed to save vote")
+		return
+	}
+	rm.tallyCohort("", cohort, "", false, vote)
+
+	counts := rm.voteRecorded(r, "", "", vote, voteStatusNew)
+	writeVoteResponse(w, voteStatusNew, rm.visibleCounts(r, counts), "")
+}
+
+// 匿名投票モードでは投票を変えたり取り消したりできないので 403 を返す
+func writeAnonymousVoteChange(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusForbidden, errCodeForbidden, "Votes cannot be changed in anonymous mode")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// 匿名投票モードでは誰が何に投票したかを残さず、同じユーザーの投票も毎回1票として数える
+func TestAnonymousVoting(t *testing.T) {
+	srv := newTestServer(t, "ANONYMOUS_VOTING=true")
+
+	for _, vote := range []string{"hot", "hot", "cold"} {
+		if res := srv.vote(t, "/v1/vote", "u1", vote, http.StatusOK); res.Status != voteStatusNew {
+			t.Errorf("vote %s: status %q, want %q", vote, res.Status, voteStatusNew)
+		}
+	}
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, map[string]int{"hot": 2, "cold": 1}) {
+		t.Errorf("counts %v, want hot=2 cold=1", got)
+	}
+
+	if votes := defaultRoom.store.UserVotes(); len(votes) != 0 {
+		t.Errorf("user votes kept: %v", votes)
+	}
+	if n := defaultRoom.store.VoterCount(); n != 0 {
+		t.Errorf("voter count %d, want 0", n)
+	}
+	if res, data := srv.do(t, http.MethodGet, "/v1/vote/u1", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /vote/u1: status %d, want 404: %s", res.StatusCode, data)
+	}
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		if res, data := srv.do(t, method, "/v1/vote?userId=u1", VoteRequest{UserID: "u1", Vote: "ok"}); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s /vote: status %d, want 403: %s", method, res.StatusCode, data)
+		}
+	}
+}
+
+// ユーザーごとの投票を前提にする設定とは一緒に使えない
+func TestAnonymousVotingConflicts(t *testing.T) {
+	for _, env := range []string{"ALLOW_VOTE_CHANGE=true", "MAX_VOTERS=10", "VOTE_NONCE_TTL=1m"} {
+		t.Run(env, func(t *testing.T) {
+			newTestServer(t, env)
+			t.Setenv("ANONYMOUS_VOTING", "true")
+			if err := loadAnonymousVoting(); err == nil {
+				t.Errorf("ANONYMOUS_VOTING with %s: no error", env)
+			}
+		})
+	}
+}
+
+// ダンプのユーザーごとの投票は、戻しても取り込んでも匿名の票として数え、ユーザーIDを残さない
+func TestAnonymousRestoreAndMerge(t *testing.T) {
+	srv := newTestServer(t, "ANONYMOUS_VOTING=true")
+	srv.vote(t, "/v1/vote", "u9", "cold", http.StatusOK)
+
+	restore := `{"counts":{"hot":3},"userVotes":{"u1":{"vote":"hot","weight":2},"u2":{"vote":"hot"}}}`
+	if res, data := srv.do(t, http.MethodPost, "/v1/admin/restore", restore, adminHeader); res.StatusCode != http.StatusOK {
+		t.Fatalf("restore: status %d: %s", res.StatusCode, data)
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 3}; !sameCounts(got, want) {
+		t.Errorf("counts after restore %v, want %v", got, want)
+	}
+	if got := defaultRoom.store.WeightedCounts()["hot"]; got != 4 {
+		t.Errorf("weighted hot %d after restore, want 4", got)
+	}
+
+	merge := `{"userVotes":{"u1":{"vote":"cold"},"u3":{"vote":"ok"}}}`
+	res, data := srv.do(t, http.MethodPost, "/v1/admin/merge", merge, adminHeader)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("merge: status %d: %s", res.StatusCode, data)
+	}
+	var merged MergeResponse
+	decodeJSON(t, data, &merged)
+	if want := map[string]int{"hot": 3, "cold": 1, "ok": 1}; !sameCounts(merged.Counts, want) || merged.Added != 2 {
+		t.Errorf("merge %s, want counts %v added 2", data, want)
+	}
+
+	if votes := defaultRoom.store.UserVotes(); len(votes) != 0 {
+		t.Errorf("user votes kept: %v", votes)
+	}
+	if len(defaultRoom.transitions) != 0 {
+		t.Errorf("transitions kept: %v", defaultRoom.transitions)
+	}
+	if res, data := srv.do(t, http.MethodGet, "/v1/vote/u1", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /vote/u1: status %d, want 404: %s", res.StatusCode, data)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// AUDIT_LOG_MAX_BYTES が未設定のときの、監査ログを切り替えるサイズ
+const defaultAuditLogMaxBytes = 10 << 20
+
+// 書き込み待ちの監査ログの数
+// 溢れたときは書き込みを待つ (記録を捨てないことを優先する)
+const auditLogBufferSize = 1024
+
+// 監査ログの1行
+type AuditEntry struct {
+	Time      time.Time      `json:"time"`
+	Action    string         `json:"action"` // "vote", "retract" など
+	RoomID    string         `json:"roomId,omitempty"`
+	UserID    string         `json:"userId,omitempty"`
+	OldVote   string         `json:"oldVote,omitempty"`
+	NewVote   string         `json:"newVote,omitempty"`
+	Deltas    map[string]int `json:"deltas,omitempty"` // 手で直した票数の増減 (action が "adjust" か、誰の票か分からない票を足した "merge" のとき)
+	Reason    string         `json:"reason,omitempty"` // 手で直した理由 (action が "adjust" のとき)
+	RemoteIP  string         `json:"remoteIp,omitempty"`
+	RequestID string         `json:"requestId,omitempty"`
+}
+
+// 投票の変更を1行ずつJSONで追記する監査ログ
+// 書き込みは専用のゴルーチンが行うので、投票のロック中に呼んでもファイルの書き込みを待たない
+type auditLogger struct {
+	path     string
+	maxBytes int64
+
+	file *os.File
+	size int64
+
+	entries chan AuditEntry
+	done    chan struct{}
+}
+
+// 監査ログを開き、書き込み用のゴルーチンを始める
+// maxBytes を超えたら path.1 に移して新しいファイルに書く (古い path.1 は消える)
+func openAuditLog(path string, maxBytes int64) (*auditLogger, error) {
+	a := &auditLogger{
+		path:     path,
+		maxBytes: maxBytes,
+		entries:  make(chan AuditEntry, auditLogBufferSize),
+		done:     make(chan struct{}),
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *auditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLogger) run() {
+	defer close(a.done)
+	for entry := range a.entries {
+		if err := a.write(entry); err != nil {
+			slog.Error("failed to write audit log", "path", a.path, "error", err)
+		}
+	}
+	if err := a.file.Close(); err != nil {
+		slog.Error("failed to close audit log", "path", a.path, "error", err)
+	}
+}
+
+func (a *auditLogger) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if a.maxBytes > 0 && a.size+int64(len(line)) > a.maxBytes && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditLogger) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// 1行を書き込み待ちに入れる
+func (a *auditLogger) Log(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	a.entries <- entry
+}
+
+// 書き込み待ちの行をすべて書いてからファイルを閉じる
+func (a *auditLogger) Close() {
+	close(a.entries)
+	<-a.done
+}
+
+// 使用中の監査ログ (nilなら記録しない。AUDIT_LOG_PATH で有効にする)
+var auditLog *auditLogger
+
+// 監査ログが有効なら1行記録する
+func recordAudit(entry AuditEntry) {
+	if auditLog != nil {
+		auditLog.Log(entry)
+	}
+}
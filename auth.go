@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
+)
+
+// IDトークンを検証してユーザーID(UID)とクレームを返すもの
+// テストでは偽物の実装に差し替えられるようにインターフェースにしている
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, idToken string) (authUser, error)
+}
+
+// 検証済みのトークンから分かるユーザーの情報
+type authUser struct {
+	UID    string
+	Role   string // カスタムクレーム "role" (票の重みに使う。無ければ空文字)
+	Cohort string // カスタムクレーム "cohort" (階数など。無ければ空文字)
+}
+
+// Firebase Admin SDK を使った TokenVerifier
+type firebaseVerifier struct {
+	client *auth.Client
+}
+
+// 認証情報は GOOGLE_APPLICATION_CREDENTIALS などの標準の方法で読み込まれる
+func newFirebaseVerifier(ctx context.Context) (*firebaseVerifier, error) {
+	app, err := firebase.NewApp(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	client, err := app.Auth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &firebaseVerifier{client: client}, nil
+}
+
+func (v *firebaseVerifier) VerifyToken(ctx context.Context, idToken string) (authUser, error) {
+	token, err := v.client.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return authUser{}, err
+	}
+	role, _ := token.Claims["role"].(string)
+	return authUser{UID: token.UID, Role: role, Cohort: cohortClaim(token.Claims["cohort"])}, nil
+}
+
+// 使用中の検証器 (nilのときは認証しない。DISABLE_AUTH=true のローカル開発用)
+var verifier TokenVerifier
+
+var errMissingToken = errors.New("missing bearer token")
+
+// Authorization: Bearer <token> ヘッダーを検証してUIDを返す
+// 認証が無効なときは空文字を返すので、呼び出し側はボディのUserIDを使う
+func authenticate(r *http.Request) (string, error) {
+	user, err := authenticateUser(r)
+	return user.UID, err
+}
+
+// authenticate と同じだが、トークンのクレームも返す
+func authenticateUser(r *http.Request) (authUser, error) {
+	if verifier == nil {
+		return authUser{}, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		return authUser{}, errMissingToken
+	}
+
+	return verifier.VerifyToken(r.Context(), strings.TrimSpace(token))
+}
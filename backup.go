@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// POST /admin/restore のボディの大きさの上限
+const maxRestoreBodyBytes = 32 << 20
+
+// GET /admin/backup が返し、POST /admin/restore と --restore が読むファイルの形式 (1つの部屋の分)
+type backupFile struct {
+	SavedAt time.Time `json:"savedAt"`
+	RoomID  string    `json:"roomId"` // 既定の投票は空文字
+	roomSnapshot
+}
+
+// ダンプの中身がおかしい (400 で返す)
+type invalidBackupError struct {
+	msg string
+}
+
+func (e *invalidBackupError) Error() string { return e.msg }
+
+// 部屋の選択肢に照らしてダンプを確かめる (呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) validateBackup(b backupFile) error {
+	set := rm.optionSet()
+	for option, count := range b.Counts {
+		if !set.has(option) {
+			return &invalidBackupError{fmt.Sprintf("unknown option %q in counts", option)}
+		}
+		if count < 0 {
+			return &invalidBackupError{fmt.Sprintf("negative count for %q", option)}
+		}
+	}
+	for option := range b.WeightedCounts {
+		if !set.has(option) {
+			return &invalidBackupError{fmt.Sprintf("unknown option %q in weightedCounts", option)}
+		}
+	}
+	for userID, v := range b.UserVotes {
+		// 投票 (POST /vote) や移行と同じく、制御文字を含むものや長すぎるものは受け付けない
+		if reason, ok := validateUserID(userID); !ok {
+			return &invalidBackupError{"userVotes: " + reason}
+		}
+		if !set.has(v.Vote) {
+			return &invalidBackupError{fmt.Sprintf("unknown option %q for user %q", v.Vote, userID)}
+		}
+	}
+	return nil
+}
+
+// 部屋の投票をダンプの内容で置き換える (呼び出し側で書き込みロックを取っておくこと)
+// 票数はユーザーごとの投票から数え直す。匿名投票モードでは、ユーザーごとの投票もユーザーIDを残さずに匿名の票として数え、
+// 票数のうちユーザーの投票で説明できない分も匿名の票として足す
+// 保存先への書き込みごとに newContext で期限を付ける (票が多くても全体で STORE_TIMEOUT を超えないように)
+// 書き込みが途中で失敗すると一部だけ戻った状態になるので、もう一度 restore し直すこと
+func (rm *room) restoreBackup(newContext func() (context.Context, context.CancelFunc), b backupFile) error {
+	if err := rm.validateBackup(b); err != nil {
+		return err
+	}
+	ctx, cancel := newContext()
+	err := rm.store.Reset(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for userID, v := range b.UserVotes {
+		ctx, cancel := newContext()
+		var err error
+		if anonymousVoting {
+			at := v.VotedAt
+			if at.IsZero() {
+				at = now
+			}
+			err = rm.store.RecordAnonymousVote(ctx, v.Vote, normalizeWeight(v.Weight), at)
+		} else {
+			err = rm.store.RecordVote(ctx, userID, v.Vote, normalizeWeight(v.Weight), v.VotedAt)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if anonymousVoting {
+		if err := rm.restoreAnonymousVotes(newContext, b.roomSnapshot); err != nil {
+			return err
+		}
+	}
+
+	rm.thresholdsFired = nil
+	clear(rm.deviceVotes)
+	clear(rm.pendingVotes)
+	clear(rm.comments)
+	rm.transitions = nil
+	rm.userCohorts = nil
+	rm.cohortCounts = nil
+	rm.dropAllReceipts()
+	rm.notifySubscribers()
+	rm.updateVoteGauges(rm.store.Counts())
+	return nil
+}
+
+// ダンプの票数のうちユーザーの投票で説明できない分を、匿名の票として1票ずつ記録する
+// 重み付きの票数の差は各票に均等に分け、余りは最初の票に載せる
+func (rm *room) restoreAnonymousVotes(newContext func() (context.Context, context.CancelFunc), snap roomSnapshot) error {
+	counts := rm.store.Counts()
+	weighted := rm.store.WeightedCounts()
+	now := time.Now()
+	for option, count := range snap.Counts {
+		extra := count - counts[option]
+		if extra <= 0 {
+			continue
+		}
+		extraWeight := extra
+		if w, ok := snap.WeightedCounts[option]; ok {
+			extraWeight = max(w-weighted[option], extra)
+		}
+		for i := range extra {
+			weight := extraWeight / extra
+			if i == 0 {
+				weight += extraWeight % extra
+			}
+			ctx, cancel := newContext()
+			err := rm.store.RecordAnonymousVote(ctx, option, weight, now)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GET /admin/backup?roomId= エンドポイントの処理 (管理用)
+// 部屋の票数とユーザーごとの投票をまとめて JSON で返す。そのまま POST /admin/restore や --restore に渡せる
+// 形式はユーザーに投票が1つだけあるものなので、複数選択モードでは 403
+func adminBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if multiSelectVoting {
+		writeMultiSelectUnsupported(w)
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+	b := backupFile{SavedAt: time.Now().UTC(), RoomID: rm.id, roomSnapshot: rm.snapshot()}
+
+	slog.WarnContext(r.Context(), "backup taken", "event", "backup", "roomId", rm.id, "voters", len(b.UserVotes), "remoteIp", remoteIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="backup.json"`)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(b)
+}
+
+// POST /admin/restore?roomId= エンドポイントの処理 (管理用)
+// 部屋の投票を GET /admin/backup のダンプで置き換える。現在の選択肢に無い票を含むダンプは 400
+// ダンプの roomId は見ない (別の部屋のダンプを戻すこともできる)
+// 終了して結果が確定した投票には戻せない (POST /admin/reopen で再開してから)。複数選択モードでは 403
+func adminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if multiSelectVoting {
+		writeMultiSelectUnsupported(w)
+		return
+	}
+
+	var b backupFile
+	if err := decodeJSONBody(w, r, &b, maxRestoreBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rm.freezeIfClosed(time.Now())
+	if !rm.checkNotFinal(w) {
+		return
+	}
+
+	newContext := func() (context.Context, context.CancelFunc) { return storeContext(r) }
+	if err := rm.restoreBackup(newContext, b); err != nil {
+		var invalid *invalidBackupError
+		if errors.As(err, &invalid) {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, invalid.Error())
+			return
+		}
+		slog.ErrorContext(r.Context(), "failed to restore votes", "event", "restore", "roomId", rm.id, "error", err)
+		writeStoreError(w, err, "Failed to restore votes")
+		return
+	}
+
+	recordAudit(AuditEntry{Action: "restore", RoomID: rm.id, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+
+	counts := rm.store.Counts()
+	slog.WarnContext(r.Context(), "votes restored", "event", "restore", "roomId", rm.id, "voters", len(b.UserVotes))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(counts)
+}
+
+// 起動時に --restore で渡されたダンプを、ダンプの roomId の部屋に戻す
+func restoreFromFile(path string) error {
+	if multiSelectVoting {
+		return errors.New("--restore cannot be used with VOTE_MODE=multi")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var b backupFile
+	if err := json.Unmarshal(data, &b); err != nil {
+		return fmt.Errorf("parse backup: %w", err)
+	}
+
+	rm := defaultRoom
+	if b.RoomID != "" {
+		if !roomIDPattern.MatchString(b.RoomID) {
+			return fmt.Errorf("invalid room id %q", b.RoomID)
+		}
+		if rm, err = getRoom(b.RoomID, true); err != nil {
+			return err
+		}
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	newContext := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), storeTimeout)
+	}
+	if err := rm.restoreBackup(newContext, b); err != nil {
+		return err
+	}
+	slog.Warn("votes restored", "event", "restore", "path", path, "roomId", rm.id, "voters", len(b.UserVotes))
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// 投票では使えないユーザーIDを含むダンプは 400 で、今の投票は変えない
+func TestRestoreRejectsInvalidUserIDs(t *testing.T) {
+	srv := newTestServer(t, "MAX_USER_ID_LENGTH=16")
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+
+	for name, userID := range map[string]string{
+		"empty":               "",
+		"control character":   "a\nb",
+		"selection separator": "a" + selectionSeparator + "hot",
+		"too long":            strings.Repeat("a", 17),
+	} {
+		body := backupFile{roomSnapshot: roomSnapshot{UserVotes: map[string]snapshotVote{
+			"u2":   {Vote: "cold"},
+			userID: {Vote: "ok"},
+		}}}
+		res, data := srv.do(t, http.MethodPost, "/v1/admin/restore", body, adminHeader)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", name, res.StatusCode, data)
+		} else if code := errorCode(t, data); code != errCodeInvalidBody {
+			t.Errorf("%s: code %q, want %q", name, code, errCodeInvalidBody)
+		}
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// POST /vote/batch で1回に送れる投票の数
+const maxVoteBatchSize = 100
+
+// POST /vote/batch の1件ごとの結果
+type BatchVoteResult struct {
+	Index  int    `json:"index"`            // リクエストの配列での位置
+	Status string `json:"status,omitempty"` // 成功したときの voteStatusNew などのいずれか
+	// 成功したときの受付番号 (同じユーザーの投票が続くと、最後のもの以外は使えなくなる)
+	ReceiptID string       `json:"receiptId,omitempty"`
+	Error     *ErrorDetail `json:"error,omitempty"` // 失敗したときの理由
+}
+
+// POST /vote/batch のレスポンス形式
+type BatchVoteResponse struct {
+	Results []BatchVoteResult `json:"results"`
+	Counts  map[string]int    `json:"counts"` // すべての投票を反映した集計 (MIN_REVEAL で結果を隠している間は null)
+}
+
+// POST /vote/batch エンドポイントの処理 (オフライン中に溜めた投票をまとめて送る)
+// 配列の順に1件ずつ適用し、1件ごとに成功か失敗かを返す
+// 全体で1つの処理ではないので、失敗した投票があっても他の投票は反映される
+// ロックは最初から最後まで1回だけ取るので、途中に他のリクエストの投票は入らない
+func (rm *room) batchVoteHandler(w http.ResponseWriter, r *http.Request) {
+	user, device, reqs, ok := parseVoteBatch(w, r)
+	if !ok {
+		return
+	}
+	rm.applyVoteBatch(w, r, user, device, reqs)
+}
+
+// POST /vote/batch のリクエストを読んで確かめる (認証、端末、ボディ、件数)
+// 部屋の状態は見ないので、部屋を作る前にも呼べる。だめならエラーを書いて ok=false を返す
+func parseVoteBatch(w http.ResponseWriter, r *http.Request) (user authUser, device string, reqs []VoteRequest, ok bool) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return user, "", nil, false
+	}
+
+	if multiSelectVoting {
+		writeMultiSelectUnsupported(w)
+		return user, "", nil, false
+	}
+
+	user, err := authenticateUser(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return user, "", nil, false
+	}
+
+	if device, ok = requestDevice(w, r); !ok {
+		return user, "", nil, false
+	}
+
+	if err := decodeJSONBody(w, r, &reqs, maxVoteBatchSize*maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return user, "", nil, false
+	}
+	if len(reqs) == 0 || len(reqs) > maxVoteBatchSize {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("batch must contain 1 to %d votes", maxVoteBatchSize))
+		return user, "", nil, false
+	}
+	return user, device, reqs, true
+}
+
+// parseVoteBatch を通った投票を配列の順に記録してレスポンスを書く
+func (rm *room) applyVoteBatch(w http.ResponseWriter, r *http.Request, user authUser, device string, reqs []VoteRequest) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if !rm.checkVotingOpen(w) {
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+
+	results := make([]BatchVoteResult, len(reqs))
+	failed := func(i int, code, message string) {
+		results[i].Error = &ErrorDetail{Code: code, Message: message}
+	}
+	failedToSave := func(i int, err error) {
+		if errors.Is(err, errStoreUnavailable) {
+			failed(i, errCodeUnavailable, "Vote store is temporarily unavailable")
+		} else {
+			failed(i, errCodeInternal, "Failed to save vote")
+		}
+	}
+	for i, req := range reqs {
+		results[i].Index = i
+
+		// 認証が有効なら全件をトークンのユーザーの投票として扱う
+		if user.UID != "" {
+			req.UserID = user.UID
+		}
+		if errs := validateVoteRequest(rm.optionSet(), &req); len(errs) > 0 {
+			detail := fieldErrorDetail(errs)
+			results[i].Error = &detail
+			continue
+		}
+		if !userAllowed(req.UserID) {
+			failed(i, errCodeForbidden, "User is not allowed to vote")
+			continue
+		}
+		if anonymousVoting {
+			// 匿名投票モードでは以前の投票を見ずに毎回1票として数える
+			if rm.optionFull(false, "", req.Vote) {
+				failed(i, errCodeOptionFull, "option full")
+				continue
+			}
+			if err := rm.recordAnonymousVote(ctx, req.Vote, voteWeight(user.UID, user.Role)); err != nil {
+				slog.ErrorContext(r.Context(), "failed to save anonymous vote", "event", "vote", "roomId", rm.id, "error", err)
+				failedToSave(i, err)
+				continue
+			}
+			rm.tallyCohort("", requestCohort(user, req.Cohort), "", false, req.Vote)
+			rm.voteRecorded(r, "", "", req.Vote, voteStatusNew)
+			results[i].Status = voteStatusNew
+			continue
+		}
+		if code, reason, ok := checkVoteNonce(req.UserID, req.Nonce); !ok {
+			failed(i, code, reason)
+			continue
+		}
+		// まとめて送ってもレート制限は1件ずつ数える
+		if userRateLimiter != nil {
+			if ok, _ := userRateLimiter.allow(req.UserID, time.Now()); !ok {
+				failed(i, errCodeRateLimited, "Too many requests")
+				continue
+			}
+		}
+
+		if !rm.hasSession(req.UserID, time.Now()) {
+			failed(i, errCodeSessionRequired, "Call POST /session/start before voting")
+			continue
+		}
+
+		previousVote, hasPrevious := rm.store.UserVote(req.UserID)
+		changing := rm.previousVoteCounts(r.Context(), req.UserID, previousVote, hasPrevious)
+		if !allowVoteChange && changing && previousVote != req.Vote {
+			failed(i, errCodeAlreadyVoted, "already voted")
+			continue
+		}
+		if remaining := rm.changeCooldownRemaining(req.UserID, changing, previousVote, req.Vote, time.Now()); remaining > 0 {
+			failed(i, errCodeChangeCooldown, cooldownMessage(remaining))
+			continue
+		}
+		if !rm.canAcceptVoter(hasPrevious) {
+			failed(i, errCodePollFull, "poll full")
+			continue
+		}
+		if rm.optionFull(hasPrevious, previousVote, req.Vote) {
+			failed(i, errCodeOptionFull, "option full")
+			continue
+		}
+		if !rm.deviceAllows(device, req.UserID, time.Now()) {
+			failed(i, errCodeDeviceInUse, "Another user has already voted from this device")
+			continue
+		}
+		if hasPrevious && previousVote == req.Vote {
+			rm.saveComment(req.UserID, req.Comment, time.Now())
+			rm.tallyCohort(req.UserID, requestCohort(user, req.Cohort), previousVote, hasPrevious, req.Vote)
+			results[i].Status = voteStatusUnchanged
+			results[i].ReceiptID = rm.issueReceipt(req.UserID, req.Vote, time.Now())
+			continue
+		}
+		status := voteStatusNew
+		if changing {
+			status = voteStatusChanged
+		}
+
+		if err := rm.recordVote(ctx, req.UserID, req.Vote, voteWeight(req.UserID, user.Role), status); err != nil {
+			slog.ErrorContext(r.Context(), "failed to save vote", "event", "vote", "roomId", rm.id, "userId", logUserID(req.UserID), "error", err)
+			failedToSave(i, err)
+			continue
+		}
+		rm.bindDevice(device, req.UserID, time.Now())
+		rm.saveComment(req.UserID, req.Comment, time.Now())
+		rm.tallyCohort(req.UserID, requestCohort(user, req.Cohort), previousVote, hasPrevious, req.Vote)
+		rm.voteRecorded(r, req.UserID, previousVote, req.Vote, status)
+		results[i].Status = status
+		results[i].ReceiptID = rm.issueReceipt(req.UserID, req.Vote, time.Now())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(BatchVoteResponse{Results: results, Counts: rm.visibleCounts(r, rm.store.Counts())})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// STORE_BREAKER_THRESHOLD / STORE_BREAKER_COOLDOWN が未設定のときの値
+// 5回続けて失敗したら30秒は保存先に書き込まず、すぐに 503 を返す
+const (
+	defaultStoreBreakerThreshold = 5
+	defaultStoreBreakerCooldown  = 30 * time.Second
+)
+
+// 保存先が一時的に使えない (サーキットブレーカーが開いている)
+var errStoreUnavailable = errors.New("vote store unavailable")
+
+// サーキットブレーカーの状態
+const (
+	breakerClosed   = "closed"    // 通常どおり
+	breakerOpen     = "open"      // 失敗が続いたので保存先を呼ばない
+	breakerHalfOpen = "half-open" // 待ち時間が過ぎたので1回だけ試している
+)
+
+// 保存先の失敗が続いたら、しばらく呼ばずにすぐ失敗させる
+// 全部屋で同じ保存先を使うので、ブレーカーも1つを共有する
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	failures int       // 続けて失敗した回数
+	open     bool      // 開いているか
+	openedAt time.Time // 開いた時刻
+	trial    bool      // 開いた後の試しの呼び出しが進行中か
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// 保存先を呼んでよいか。だめならもう一度試せるまでの時間も返す
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true, 0
+	}
+	if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+		return false, wait
+	}
+	if b.trial {
+		// 他のリクエストが試している最中
+		return false, time.Second
+	}
+	b.trial = true
+	return true, 0
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		slog.Warn("vote store recovered; circuit closed", "event", "store_breaker", "state", breakerClosed)
+	}
+	b.failures = 0
+	b.open = false
+	b.trial = false
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		// 試しの呼び出しも失敗したので、もう一度待つ
+		b.openedAt = now
+		b.trial = false
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = now
+		slog.Error("vote store failing; circuit opened", "event", "store_breaker", "state", breakerOpen, "failures", b.failures, "cooldown", b.cooldown.String())
+	}
+}
+
+func (b *circuitBreaker) state(now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case !b.open:
+		return breakerClosed
+	case b.trial || !now.Before(b.openedAt.Add(b.cooldown)):
+		return breakerHalfOpen
+	}
+	return breakerOpen
+}
+
+// もう一度試せるまでの時間 (閉じていれば0)
+func (b *circuitBreaker) retryAfter(now time.Time) time.Duration {
+	if ok, wait := b.allowPeek(now); !ok {
+		return wait
+	}
+	return 0
+}
+
+// allow と同じ判定だが、試しの呼び出しの枠は使わない
+func (b *circuitBreaker) allowPeek(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true, 0
+	}
+	if wait := b.openedAt.Add(b.cooldown).Sub(now); wait > 0 {
+		return false, wait
+	}
+	return !b.trial, time.Second
+}
+
+// 保存先のサーキットブレーカー (nilなら使わない。STORE_BREAKER_THRESHOLD=0 で無効)
+var storeBreaker *circuitBreaker
+
+// 読み取りの失敗を返せる保存先 (Redisなど、読み取りのたびに外部を呼ぶもの)
+type fallibleCountsReader interface {
+	countsErr(ctx context.Context) (map[string]int, error)
+	weightedCountsErr(ctx context.Context) (map[string]int, error)
+}
+
+// VoteStore をサーキットブレーカーで包む
+// 書き込みは開いている間はすぐに errStoreUnavailable を返す
+// 票数の読み取りに失敗したときは最後に読めた票数を返し、staleSince で古いことを知らせる
+type breakerStore struct {
+	inner   VoteStore
+	breaker *circuitBreaker
+
+	// 票数の読み取りは RLock 中に並行して呼ばれるので、別のロックで守る
+	mu               sync.Mutex
+	lastGood         map[string]int
+	lastGoodWeighted map[string]int
+	goodAt           time.Time
+	stale            bool
+}
+
+func newBreakerStore(inner VoteStore, breaker *circuitBreaker) *breakerStore {
+	return &breakerStore{inner: inner, breaker: breaker}
+}
+
+// 保存先を呼び、結果をブレーカーに知らせる (投票が無いことは失敗として数えない)
+func (s *breakerStore) guard(op func() error) error {
+	if ok, _ := s.breaker.allow(time.Now()); !ok {
+		return errStoreUnavailable
+	}
+	err := op()
+	if err != nil && !errors.Is(err, errVoteNotFound) {
+		s.breaker.failure(time.Now())
+		return err
+	}
+	s.breaker.success()
+	return err
+}
+
+func (s *breakerStore) RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error {
+	return s.guard(func() error { return s.inner.RecordVote(ctx, userID, vote, weight, at) })
+}
+
+func (s *breakerStore) RecordAnonymousVote(ctx context.Context, vote string, weight int, at time.Time) error {
+	return s.guard(func() error { return s.inner.RecordAnonymousVote(ctx, vote, weight, at) })
+}
+
+func (s *breakerStore) DeleteVote(ctx context.Context, userID string) error {
+	return s.guard(func() error { return s.inner.DeleteVote(ctx, userID) })
+}
+
+func (s *breakerStore) Reset(ctx context.Context) error {
+	return s.guard(func() error { return s.inner.Reset(ctx) })
+}
+
+func (s *breakerStore) EraseUser(ctx context.Context, userID string) error {
+	return s.guard(func() error { return eraseUserVotes(ctx, s.inner, userID) })
+}
+
+func (s *breakerStore) addOption(key string) {
+	if r, ok := s.inner.(optionResizer); ok {
+		r.addOption(key)
+	}
+}
+
+func (s *breakerStore) removeOption(key string) {
+	if r, ok := s.inner.(optionResizer); ok {
+		r.removeOption(key)
+	}
+}
+
+func (s *breakerStore) Counts() map[string]int {
+	reader, ok := s.inner.(fallibleCountsReader)
+	if !ok {
+		// メモリ上のキャッシュから読む保存先は失敗しない
+		return s.inner.Counts()
+	}
+
+	var counts map[string]int
+	err := s.guard(func() error {
+		var err error
+		counts, err = reader.countsErr(context.Background())
+		return err
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.stale = true
+		if s.lastGood == nil {
+			return s.inner.Counts()
+		}
+		return copyCounts(s.lastGood)
+	}
+	s.lastGood = copyCounts(counts)
+	s.goodAt = time.Now()
+	s.stale = false
+	return counts
+}
+
+// 読めなかったときは Counts と同じく最後に読めた重み付きの票数を返す (古いかどうかは Counts の結果で知らせる)
+func (s *breakerStore) WeightedCounts() map[string]int {
+	reader, ok := s.inner.(fallibleCountsReader)
+	if !ok {
+		return s.inner.WeightedCounts()
+	}
+
+	var counts map[string]int
+	err := s.guard(func() error {
+		var err error
+		counts, err = reader.weightedCountsErr(context.Background())
+		return err
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if s.lastGoodWeighted == nil {
+			return s.inner.WeightedCounts()
+		}
+		return copyCounts(s.lastGoodWeighted)
+	}
+	s.lastGoodWeighted = copyCounts(counts)
+	return counts
+}
+
+func (s *breakerStore) UserVote(userID string) (string, bool) {
+	return s.inner.UserVote(userID)
+}
+
+func (s *breakerStore) AdjustCounts(ctx context.Context, deltas map[string]int, at time.Time) error {
+	return s.guard(func() error { return adjustStoreCounts(ctx, s.inner, deltas, at) })
+}
+
+func (s *breakerStore) countsAdjustedAt() time.Time {
+	return storeCountsAdjustedAt(s.inner)
+}
+
+// ブレーカー自体は自分のロックで守るので、保存先が同時に記録できるならそのまま同時に呼ぶ
+func (s *breakerStore) recordsVotesConcurrently() bool {
+	return recordsVotesConcurrently(s.inner)
+}
+
+func (s *breakerStore) userRecord(userID string) (voteRecord, bool) {
+	return lookupUserRecord(s.inner, userID)
+}
+
+func (s *breakerStore) voteEventsUntil(ctx context.Context, until time.Time) ([]VoteEvent, error) {
+	var events []VoteEvent
+	err := s.guard(func() error {
+		var err error
+		events, err = storeVoteEventsUntil(ctx, s.inner, until)
+		return err
+	})
+	return events, err
+}
+
+func (s *breakerStore) UserVotes() map[string]voteRecord {
+	return s.inner.UserVotes()
+}
+
+func (s *breakerStore) VoterCount() int {
+	return s.inner.VoterCount()
+}
+
+// 直前の Counts が古い票数を返したなら、その票数を読めた時刻
+func (s *breakerStore) staleSince() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.goodAt, s.stale
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	out := make(map[string]int, len(counts))
+	for option, count := range counts {
+		out[option] = count
+	}
+	return out
+}
+
+// 保存先の書き込みの失敗をレスポンスにする
+// ブレーカーが開いているなら 503 と Retry-After、それ以外は 500
+func writeStoreError(w http.ResponseWriter, err error, message string) {
+	if errors.Is(err, errStoreUnavailable) {
+		writeStoreUnavailable(w)
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, errCodeInternal, message)
+}
+
+func writeStoreUnavailable(w http.ResponseWriter) {
+	if storeBreaker != nil {
+		setRetryAfter(w, storeBreaker.retryAfter(time.Now()))
+	}
+	writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Vote store is temporarily unavailable")
+}
+
+// 票数が保存先から読めず古いものなら、その時刻をヘッダーで知らせる
+func setStaleHeader(w http.ResponseWriter, store VoteStore) {
+	s, ok := store.(*breakerStore)
+	if !ok {
+		return
+	}
+	if at, stale := s.staleSince(); stale {
+		w.Header().Set("X-Results-Stale", "true")
+		if !at.IsZero() {
+			w.Header().Set("X-Results-As-Of", at.UTC().Format(time.RFC3339))
+		}
+	}
+}
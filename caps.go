@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 選択肢ごとの票数の上限 (OPTION_CAPS で設定する。設定の無い選択肢は無制限)
+// 「さむい の先着100票に景品」のような投票用。上限は部屋ごとに数える
+var optionCaps map[string]int
+
+// 選択肢ごとの票数と重み付きの票数の上限 (MAX_OPTION_COUNT。既定は int32 の最大値)
+// 票数を int32 で受け取るクライアントがあふれないようにする。OPTION_CAPS と違って全部の選択肢にかかり、
+// 投票は上限に達すると 409 (option_full) で断り、手で直したときや再生したときは上限で止めて警告を残す
+var maxOptionCount = math.MaxInt32
+
+// MAX_OPTION_COUNT を読む
+func loadMaxOptionCount() error {
+	var err error
+	if maxOptionCount, err = envInt("MAX_OPTION_COUNT", math.MaxInt32); err != nil {
+		return err
+	}
+	if maxOptionCount < 1 {
+		return errors.New("MAX_OPTION_COUNT must be positive")
+	}
+	return nil
+}
+
+// OPTION_CAPS を読む ("選択肢=上限" のカンマ区切り。例: さむい=100,あつい=50)
+// 選択肢は表示名でもよい。選択肢を読み込んだ後に呼ぶこと
+func loadOptionCaps() error {
+	optionCaps = make(map[string]int)
+	for _, item := range envList("OPTION_CAPS", nil) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid OPTION_CAPS entry %q: want option=cap", item)
+		}
+		key, ok := canonicalOption(normalizeVote(name))
+		if !ok {
+			return fmt.Errorf("invalid OPTION_CAPS entry %q: unknown vote option", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || limit < 1 {
+			return fmt.Errorf("invalid OPTION_CAPS cap for %q: must be a positive integer", key)
+		}
+		optionCaps[key] = limit
+	}
+	return nil
+}
+
+// 選択肢の票数の上限 (OPTION_CAPS と MAX_OPTION_COUNT の小さい方)
+func optionLimit(vote string) int {
+	if limit, ok := optionCaps[vote]; ok && limit < maxOptionCount {
+		return limit
+	}
+	return maxOptionCount
+}
+
+// vote の票数が上限に達していれば true (呼び出し側でロックを取っておくこと)
+// 同じ選択肢への再投票は票数を増やさないので断らない。上限に達した選択肢から別の選択肢へはいつでも変えられる
+func (rm *room) optionFull(hasPrevious bool, previousVote, vote string) bool {
+	if hasPrevious && previousVote == vote {
+		return false
+	}
+	return rm.store.Counts()[vote] >= optionLimit(vote)
+}
+
+// vote の票数が上限に達していれば 409 を書いて false を返す (呼び出し側でロックを取っておくこと)
+func (rm *room) checkOptionCap(w http.ResponseWriter, hasPrevious bool, previousVote, vote string) bool {
+	if !rm.optionFull(hasPrevious, previousVote, vote) {
+		return true
+	}
+	slog.Info("option full", "event", "option_full", "roomId", rm.id, "option", vote, "cap", optionLimit(vote))
+	writeJSONError(w, http.StatusConflict, errCodeOptionFull, "option full")
+	return false
+}
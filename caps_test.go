@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 票数を int32 の最大値の手前まで入れた状態から、上限ちょうどまでは受け付け、その次は 409 にする
+func TestMaxOptionCountBoundary(t *testing.T) {
+	srv := newTestServer(t)
+	s := defaultRoom.store.(*memoryStore)
+	s.voteCounts["hot"].Store(math.MaxInt32 - 1)
+	s.weightedCounts["hot"].Store(math.MaxInt32 - 1)
+
+	if res := srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK); res.Counts["hot"] != math.MaxInt32 {
+		t.Errorf("vote at the limit: hot %d, want %d", res.Counts["hot"], math.MaxInt32)
+	}
+	for range 3 {
+		res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u2", Vote: "hot"})
+		if res.StatusCode != http.StatusConflict {
+			t.Fatalf("vote past the limit: status %d, want 409: %s", res.StatusCode, data)
+		}
+		if code := errorCode(t, data); code != errCodeOptionFull {
+			t.Errorf("vote past the limit: code %q, want %q", code, errCodeOptionFull)
+		}
+	}
+	if got := s.Counts()["hot"]; got != math.MaxInt32 {
+		t.Errorf("hot %d after rejected votes, want %d", got, math.MaxInt32)
+	}
+	// 同じ選択肢への再投票は増やさないので断らず、ほかの選択肢へもいつでも変えられる
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK)
+	// 空いた1票分は別のユーザーが入れられる
+	srv.vote(t, "/v1/vote", "u2", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u3", "hot", http.StatusConflict)
+}
+
+// MAX_OPTION_COUNT と OPTION_CAPS の小さい方が上限になる
+func TestOptionLimit(t *testing.T) {
+	srv := newTestServer(t, "MAX_OPTION_COUNT=3", "OPTION_CAPS=さむい=2,hot=10")
+	for _, tt := range []struct {
+		option string
+		limit  int
+	}{
+		{"hot", 3},
+		{"cold", 2},
+		{"ok", 3},
+	} {
+		if got := optionLimit(tt.option); got != tt.limit {
+			t.Errorf("optionLimit(%s) = %d, want %d", tt.option, got, tt.limit)
+		}
+	}
+	for i, user := range []string{"a", "b", "c"} {
+		want := http.StatusOK
+		if i >= 2 {
+			want = http.StatusConflict
+		}
+		srv.vote(t, "/v1/vote", user, "cold", want)
+	}
+}
+
+// 手で直したときや票数を足したときは 409 にできないので、上限で止める (int64 があふれても負にならない)
+func TestAddClampedNeverOverflows(t *testing.T) {
+	newTestServer(t, "MAX_OPTION_COUNT=100")
+	var c atomic.Int64
+	c.Store(99)
+	if got := addClamped(&c, 5); got != clampedToMax || c.Load() != 100 {
+		t.Errorf("add past the limit: %v, %d", got, c.Load())
+	}
+	if got := addClamped(&c, math.MaxInt64); got != clampedToMax || c.Load() != 100 {
+		t.Errorf("add MaxInt64: %v, %d", got, c.Load())
+	}
+	if got := addClamped(&c, math.MinInt64); got != clampedToZero || c.Load() != 0 {
+		t.Errorf("add MinInt64: %v, %d", got, c.Load())
+	}
+	if got := addClamped(&c, 100); got != notClamped || c.Load() != 100 {
+		t.Errorf("add to the limit: %v, %d", got, c.Load())
+	}
+
+	s := newMemoryStore([]string{"hot"})
+	s.AdjustCounts(context.Background(), map[string]int{"hot": math.MaxInt}, time.Now())
+	if got := s.Counts()["hot"]; got != 100 {
+		t.Errorf("adjusted count %d, want 100", got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// 1つの部屋に残せるチェックポイントの数 (再起動すると消える)
+const maxCheckpoints = 50
+
+// ある時点で保存した票数 (GET /results/compare の比較の基準)
+type checkpoint struct {
+	At     time.Time
+	Counts map[string]int
+}
+
+// POST /admin/checkpoints のレスポンス形式
+type CheckpointResponse struct {
+	Name       string         `json:"name"`
+	CapturedAt string         `json:"capturedAt"` // RFC3339
+	Counts     map[string]int `json:"counts"`
+}
+
+// POST /admin/checkpoints?name=<name>&roomId= エンドポイントの処理
+// 現在の票数を名前を付けて保存する。同じ名前なら上書きする
+func adminCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if !roomIDPattern.MatchString(name) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid checkpoint name")
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if _, exists := rm.checkpoints[name]; !exists && len(rm.checkpoints) >= maxCheckpoints {
+		writeJSONError(w, http.StatusConflict, errCodeInvalidParameter, "Too many checkpoints")
+		return
+	}
+	cp := checkpoint{At: time.Now(), Counts: rm.store.Counts()}
+	rm.checkpoints[name] = cp
+	slog.InfoContext(r.Context(), "checkpoint captured", "event", "checkpoint", "roomId", rm.id, "name", name, "counts", cp.Counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CheckpointResponse{Name: name, CapturedAt: cp.At.UTC().Format(time.RFC3339), Counts: cp.Counts})
+}
+
+// GET /results/compare の選択肢ごとの比較
+type OptionDelta struct {
+	Option   string `json:"option"`
+	Current  int    `json:"current"`
+	Baseline int    `json:"baseline"`
+	Delta    int    `json:"delta"` // current - baseline
+}
+
+// GET /results/compare のレスポンス形式
+type CompareResponse struct {
+	Checkpoint string        `json:"checkpoint"`
+	CapturedAt string        `json:"capturedAt"` // RFC3339
+	Options    []OptionDelta `json:"options"`    // 選択肢の設定順
+}
+
+// GET /results/compare?checkpoint=<name> エンドポイントの処理
+// 保存したチェックポイントからの票数の増減を返す
+func (rm *room) compareHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	name := r.URL.Query().Get("checkpoint")
+	if name == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "checkpoint is required")
+		return
+	}
+
+	rm.mutex.RLock()
+	cp, ok := rm.checkpoints[name]
+	current := rm.store.Counts()
+	rm.mutex.RUnlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Checkpoint not found")
+		return
+	}
+
+	res := CompareResponse{
+		Checkpoint: name,
+		CapturedAt: cp.At.UTC().Format(time.RFC3339),
+		Options:    make([]OptionDelta, 0, len(rm.optionSet().keys)),
+	}
+	for _, option := range rm.optionSet().keys {
+		res.Options = append(res.Options, OptionDelta{
+			Option:   option,
+			Current:  current[option],
+			Baseline: cp.Counts[option],
+			Delta:    current[option] - cp.Counts[option],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// X-Forwarded-For を信用するプロキシ (TRUSTED_PROXIES で設定する。空なら信用しない)
+var trustedProxies []netip.Prefix
+
+// TRUSTED_PROXIES (カンマ区切りのIPかCIDR。例: 10.0.0.0/8,127.0.0.1) を読む
+func loadTrustedProxies() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range envList("TRUSTED_PROXIES", nil) {
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", item, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", item, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// リクエストの送信元IP (レート制限、監査ログ、アクセスログはすべてここで求める)
+// 直接の接続元が信用するプロキシのときだけ X-Forwarded-For を見る
+// (右から順に信用するプロキシを飛ばし、最初のそれ以外のアドレスを使う)
+// X-Forwarded-For が無ければ X-Real-IP を使う (nginx の real_ip のように1つだけ付けるプロキシ向け)
+// そうでなければどちらも偽装できるので無視する
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if r.Header.Get("X-Forwarded-For") == "" {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+			if addr, err := netip.ParseAddr(realIP); err == nil {
+				return addr.Unmap().String()
+			}
+		}
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// 読めないアドレスより先は信用できない
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
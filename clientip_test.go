@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 信用するプロキシを通ったときだけ X-Forwarded-For と X-Real-IP を見て、それ以外の偽装は無視する
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string // TRUSTED_PROXIES
+		remote  string
+		xff     []string
+		realIP  string
+		want    string
+	}{
+		{name: "no proxy", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "spoofed xff without trusted proxies", remote: "203.0.113.5:1234", xff: []string{"1.2.3.4"}, want: "203.0.113.5"},
+		{name: "spoofed real ip without trusted proxies", remote: "203.0.113.5:1234", realIP: "1.2.3.4", want: "203.0.113.5"},
+		{name: "xff from untrusted peer", proxies: "10.0.0.0/8", remote: "203.0.113.5:1234", xff: []string{"1.2.3.4"}, want: "203.0.113.5"},
+		{name: "trusted proxy", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		// クライアントが先頭に書いた偽のアドレスは、プロキシが足した本当の送信元より左にあるので使わない
+		{name: "client prepends spoofed hop", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234", xff: []string{"1.2.3.4, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "chain of trusted proxies", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234", xff: []string{"198.51.100.7, 10.0.0.3", "10.0.0.2"}, want: "198.51.100.7"},
+		{name: "unparsable hop stops the chain", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234", xff: []string{"198.51.100.7, garbage, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "all hops trusted", proxies: "10.0.0.0/8", remote: "10.0.0.1:1234", xff: []string{"10.0.0.2"}, want: "10.0.0.2"},
+		{name: "real ip from trusted proxy", proxies: "127.0.0.1", remote: "127.0.0.1:1234", realIP: "198.51.100.7", want: "198.51.100.7"},
+		{name: "invalid real ip", proxies: "127.0.0.1", remote: "127.0.0.1:1234", realIP: "not-an-ip", want: "127.0.0.1"},
+		{name: "xff wins over real ip", proxies: "127.0.0.1", remote: "127.0.0.1:1234", xff: []string{"198.51.100.7"}, realIP: "1.2.3.4", want: "198.51.100.7"},
+		{name: "ipv4-mapped trusted peer", proxies: "127.0.0.1", remote: "[::ffff:127.0.0.1]:1234", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "ipv6 proxy", proxies: "fd00::/8", remote: "[fd00::1]:1234", xff: []string{"2001:db8::7"}, want: "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.proxies)
+			var err error
+			if trustedProxies, err = loadTrustedProxies(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { trustedProxies = nil })
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/results", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := remoteIP(r); got != tt.want {
+				t.Errorf("remoteIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTrustedProxiesInvalid(t *testing.T) {
+	for _, v := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1,bad/8"} {
+		t.Setenv("TRUSTED_PROXIES", v)
+		if _, err := loadTrustedProxies(); err == nil {
+			t.Errorf("TRUSTED_PROXIES=%q: no error", v)
+		}
+	}
+}
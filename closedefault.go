@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// 受付が終わったときに、投票画面を開いた (POST /session/start を呼んだ) のに投票しなかったユーザーに割り当てる選択肢
+// (CLOSE_DEFAULT_OPTION で設定する。空なら割り当てない)
+// 「回答が無ければ ちょうどよい として数える」ような調査用。割り当てた票は確定した結果に入る
+var closeDefaultOption string
+
+// CLOSE_DEFAULT_OPTION を読む (キーでも表示名でもよい)。選択肢を読み込んだ後に呼ぶこと
+// 匿名投票モードではユーザーごとの投票が無く、投票したかどうかが分からないので使えない
+// 複数選択モードでも、選ばなかったことと投票しなかったことを区別できないので使えない (VOTE_MODE の後に呼ぶ)
+func loadCloseDefaultOption() error {
+	closeDefaultOption = ""
+	v := os.Getenv("CLOSE_DEFAULT_OPTION")
+	if v == "" {
+		return nil
+	}
+	key, ok := canonicalOption(v)
+	if !ok {
+		return fmt.Errorf("invalid CLOSE_DEFAULT_OPTION %q: unknown vote option", v)
+	}
+	if anonymousVoting {
+		return errors.New("CLOSE_DEFAULT_OPTION cannot be used with ANONYMOUS_VOTING")
+	}
+	if multiSelectVoting {
+		return errors.New("CLOSE_DEFAULT_OPTION cannot be used with VOTE_MODE=multi")
+	}
+	closeDefaultOption = key
+	return nil
+}
+
+// 部屋ごとの、投票画面を開いたユーザー (CLOSE_DEFAULT_OPTION のときだけ記録する)
+// SESSION_TTL で忘れる開始時刻とは別に、受付が終わるまで覚えておく
+type sessionViewers struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]struct{}
+	count int
+}
+
+var closeViewers = &sessionViewers{rooms: make(map[string]map[string]struct{})}
+
+// ユーザーが投票画面を開いたことを記録する。覚えておく数が maxVoteSessions に達していれば false
+func (v *sessionViewers) add(roomID, userID string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	users, ok := v.rooms[roomID]
+	if !ok {
+		users = make(map[string]struct{})
+		v.rooms[roomID] = users
+	}
+	if _, ok := users[userID]; ok {
+		return true
+	}
+	if v.count >= maxVoteSessions {
+		return false
+	}
+	users[userID] = struct{}{}
+	v.count++
+	return true
+}
+
+// 部屋の記録を取り出して忘れる
+func (v *sessionViewers) take(roomID string) map[string]struct{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	users := v.rooms[roomID]
+	delete(v.rooms, roomID)
+	v.count -= len(users)
+	return users
+}
+
+// ユーザーの記録を忘れる (ユーザーの削除)
+func (v *sessionViewers) remove(roomID, userID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.rooms[roomID][userID]; ok {
+		delete(v.rooms[roomID], userID)
+		v.count--
+	}
+}
+
+// 受付が終わった部屋で、投票画面を開いたのに投票していないユーザーに closeDefaultOption を割り当てる
+// 結果を確定する直前に、書き込みロックを取った状態で呼ぶ (freezeIfClosed から)
+// 許可されていないユーザー、MAX_VOTERS や OPTION_CAPS の上限を超える分は割り当てない
+func (rm *room) assignCloseDefault(closedAt time.Time) {
+	viewers := closeViewers.take(rm.id)
+	if closeDefaultOption == "" || len(viewers) == 0 {
+		return
+	}
+	option := closeDefaultOption
+	if !rm.optionSet().has(option) {
+		slog.Warn("close default option is not an option of this room", "event", "auto_assign", "roomId", rm.id, "option", option)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	assigned := 0
+	for userID := range viewers {
+		if _, voted := rm.store.UserVote(userID); voted || !userAllowed(userID) {
+			continue
+		}
+		if !rm.canAcceptVoter(false) || rm.optionFull(false, "", option) {
+			slog.Warn("close default not assigned: limit reached", "event", "auto_assign", "roomId", rm.id, "userId", logUserID(userID), "option", option)
+			continue
+		}
+		if err := rm.recordVote(ctx, userID, option, voteWeight(userID, ""), voteStatusNew); err != nil {
+			slog.Error("failed to save close default vote", "event", "auto_assign", "roomId", rm.id, "userId", logUserID(userID), "error", err)
+			continue
+		}
+		rm.tallyCohort(userID, "", "", false, option)
+		rm.recordTransition(userID, voteStatusNew, "", option, closedAt)
+		recordAudit(AuditEntry{Action: "auto_assign", RoomID: rm.id, UserID: userID, NewVote: option})
+		votesTotal.WithLabelValues(rm.id, option).Inc()
+		assigned++
+		slog.Info("close default assigned", "event", "auto_assign", "roomId", rm.id, "userId", logUserID(userID), "option", option)
+	}
+	if assigned > 0 {
+		rm.notifySubscribers()
+		rm.updateVoteGauges(rm.store.Counts())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// コホート (階数など、ユーザーのまとまり) の名前の長さの上限
+const maxCohortLength = 64
+
+// 1つの部屋で別々に数えるコホートの数の上限 (それを超えた新しいコホートは unknownCohort に入れる)
+const maxCohorts = 100
+
+// コホートが分からないユーザーの票をまとめる名前
+const unknownCohort = "unknown"
+
+// GET /results?groupBy=cohort のコホートごとの集計
+type CohortResult struct {
+	Counts map[string]int `json:"counts"`
+	Total  int            `json:"total"`
+}
+
+// トークンのクレーム "cohort" の値を文字列にする (階数などは数値で入っていることもある)
+func cohortClaim(v any) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	}
+	return ""
+}
+
+// 投票を数えるコホート。トークンのクレームがあればそれを使い、無ければリクエストの cohort を使う
+func requestCohort(user authUser, requested string) string {
+	if user.Cohort != "" {
+		if cohort, ok := normalizeCohort(user.Cohort); ok {
+			return cohort
+		}
+	}
+	return requested
+}
+
+// コホートの名前を揃える。空や unknownCohort はコホートなし ("") にする。使えない名前なら false
+func normalizeCohort(cohort string) (string, bool) {
+	cohort = normalizeVote(cohort)
+	if cohort == unknownCohort {
+		return "", true
+	}
+	if utf8.RuneCountInString(cohort) > maxCohortLength {
+		return "", false
+	}
+	for _, r := range cohort {
+		if !unicode.IsPrint(r) {
+			return "", false
+		}
+	}
+	return cohort, true
+}
+
+// 投票の保存後に、コホートごとの票数を合わせる (呼び出し側で書き込みロックを取っておくこと)
+// cohort が空ならそのユーザーの前のコホートのまま。以前の投票はそのときのコホートから引く
+// コホートごとの票数はメモリ上だけに持つので、再起動する前の票は投票し直すまで unknownCohort に数える
+func (rm *room) tallyCohort(userID, cohort, previousVote string, hasPrevious bool, vote string) {
+	previousCohort, hadCohort := rm.userCohorts[userID]
+	if cohort == "" {
+		cohort = previousCohort
+	}
+	if hasPrevious && hadCohort {
+		rm.addCohortVote(previousCohort, previousVote, -1)
+	}
+	if cohort == "" || !rm.addCohortVote(cohort, vote, 1) {
+		delete(rm.userCohorts, userID)
+		return
+	}
+	if userID != "" {
+		if rm.userCohorts == nil {
+			rm.userCohorts = make(map[string]string)
+		}
+		rm.userCohorts[userID] = cohort
+	}
+}
+
+// 取り消した投票をそのユーザーのコホートから引く (呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) untallyCohort(userID, previousVote string) {
+	if cohort, ok := rm.userCohorts[userID]; ok {
+		rm.addCohortVote(cohort, previousVote, -1)
+		delete(rm.userCohorts, userID)
+	}
+}
+
+// コホートの票数を delta だけ変える。コホートの数が上限に達していて数えられなければ false
+func (rm *room) addCohortVote(cohort, vote string, delta int) bool {
+	counts, ok := rm.cohortCounts[cohort]
+	if !ok {
+		if delta < 0 || len(rm.cohortCounts) >= maxCohorts {
+			return false
+		}
+		if rm.cohortCounts == nil {
+			rm.cohortCounts = make(map[string]map[string]int)
+		}
+		counts = make(map[string]int)
+		rm.cohortCounts[cohort] = counts
+	}
+	counts[vote] = max(counts[vote]+delta, 0)
+	return true
+}
+
+// コホートごとの票数を全体の票数 (counts) に合わせて返す
+// コホートの分からない票は、全体からコホートごとの票を引いた残りとして unknownCohort に入れる
+func buildCohortResults(counts map[string]int, cohortCounts map[string]map[string]int) map[string]CohortResult {
+	res := make(map[string]CohortResult, len(cohortCounts)+1)
+	unknown := CohortResult{Counts: make(map[string]int, len(counts))}
+	for option, count := range counts {
+		unknown.Counts[option] = count
+	}
+	for cohort, byOption := range cohortCounts {
+		c := CohortResult{Counts: make(map[string]int, len(counts))}
+		for option := range counts {
+			n := byOption[option]
+			c.Counts[option] = n
+			c.Total += n
+			unknown.Counts[option] = max(unknown.Counts[option]-n, 0)
+		}
+		res[cohort] = c
+	}
+	for _, n := range unknown.Counts {
+		unknown.Total += n
+	}
+	if unknown.Total > 0 {
+		res[unknownCohort] = unknown
+	}
+	return res
+}
+
+func cloneCohortCounts(cohortCounts map[string]map[string]int) map[string]map[string]int {
+	out := make(map[string]map[string]int, len(cohortCounts))
+	for cohort, counts := range cohortCounts {
+		out[cohort] = cloneCounts(counts)
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 投票に付けられるコメントの最大の文字数
+const maxCommentLength = 200
+
+// GET /results/comments の件数の既定値と上限
+const (
+	defaultCommentsLimit = 50
+	maxCommentsLimit     = 200
+)
+
+// ユーザーの投票に付いたコメント (同じユーザーが投票し直してコメントを送ると置き換わる)
+type voteComment struct {
+	Text string
+	At   time.Time
+}
+
+// コメントを保存できる形にする。制御文字 (改行やタブは空白にする) と不正な UTF-8 を取り除き、前後の空白を除く
+// 長すぎればエラー
+func sanitizeComment(comment string) (string, error) {
+	comment = strings.ToValidUTF8(comment, "")
+	comment = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, comment)
+	comment = strings.TrimSpace(comment)
+	if utf8.RuneCountInString(comment) > maxCommentLength {
+		return "", fmt.Errorf("comment must be at most %d characters", maxCommentLength)
+	}
+	return comment, nil
+}
+
+// 投票と一緒に送られたコメントを覚える。空なら前のコメントを残す (呼び出し側で書き込みロックを取っておくこと)
+// 匿名投票モードではユーザーと結び付けられないので、コメントは保存しない
+func (rm *room) saveComment(userID, comment string, at time.Time) {
+	if comment == "" || userID == "" {
+		return
+	}
+	if rm.comments == nil {
+		rm.comments = make(map[string]voteComment)
+	}
+	rm.comments[userID] = voteComment{Text: comment, At: at}
+}
+
+// GET /results/comments の1要素 (誰のコメントかは返さない)
+type CommentEntry struct {
+	Option  string `json:"option"` // コメントしたユーザーの現在の投票
+	Comment string `json:"comment"`
+	At      string `json:"at"` // コメントを送った時刻 (RFC3339, UTC)
+}
+
+// GET /results/comments のレスポンス形式
+type CommentsResponse struct {
+	Total    int            `json:"total"` // 条件に合うコメントの数
+	Limit    int            `json:"limit"`
+	Offset   int            `json:"offset"`
+	Comments []CommentEntry `json:"comments"` // 新しい順
+}
+
+// GET /results/comments?option=&limit=&offset= エンドポイントの処理
+// 投票に付いたコメントを新しい順に返す。option があればその選択肢に投票しているユーザーのものだけ
+// コメントはメモリ上だけに持つので、再起動すると消える (票数には影響しない)
+func (rm *room) commentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	var option string
+	if v := r.URL.Query().Get("option"); v != "" {
+		key, ok := rm.optionSet().canonical(v)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidOption, "Invalid vote option")
+			return
+		}
+		option = key
+	}
+	limit, ok := parseIntParam(w, r, "limit", defaultCommentsLimit, 1, maxCommentsLimit)
+	if !ok {
+		return
+	}
+	offset, ok := parseIntParam(w, r, "offset", 0, 0, math.MaxInt)
+	if !ok {
+		return
+	}
+
+	type item struct {
+		entry CommentEntry
+		at    time.Time
+	}
+	rm.mutex.RLock()
+	votes := rm.store.UserVotes()
+	items := make([]item, 0, len(rm.comments))
+	for userID, c := range rm.comments {
+		record, ok := votes[userID]
+		if !ok || (option != "" && record.Vote != option) {
+			continue
+		}
+		items = append(items, item{CommentEntry{Option: record.Vote, Comment: c.Text, At: c.At.UTC().Format(time.RFC3339)}, c.At})
+	}
+	rm.mutex.RUnlock()
+
+	// 新しい順 (同じ時刻ならコメントの文字列順にして、ページをまたいでも順序を変えない)
+	slices.SortFunc(items, func(a, b item) int {
+		if c := b.at.Compare(a.at); c != 0 {
+			return c
+		}
+		return strings.Compare(a.entry.Comment, b.entry.Comment)
+	})
+
+	res := CommentsResponse{Total: len(items), Limit: limit, Offset: offset, Comments: []CommentEntry{}}
+	start := min(offset, len(items))
+	for _, it := range items[start:min(start+limit, len(items))] {
+		res.Comments = append(res.Comments, it.entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
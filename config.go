@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 整数の環境変数を読む。未設定なら def
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+// 真偽値の環境変数を読む ("true", "false", "1", "0" など)。未設定なら def
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
+
+// 小数の環境変数を読む。未設定なら def
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
+
+// 時間の環境変数を読む ("10s", "1m" など)。未設定なら def
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
+
+// HTTP_*_TIMEOUT が未設定のときの値
+// 回線が不安定なモバイル端末でも投票の1往復が収まり、止まった接続はいずれ切れる程度にしている
+const (
+	defaultReadHeaderTimeout = 10 * time.Second  // ヘッダーを読み終えるまで
+	defaultReadTimeout       = 30 * time.Second  // ボディまで読み終えるまで
+	defaultWriteTimeout      = 30 * time.Second  // レスポンスを書き終えるまで
+	defaultIdleTimeout       = 120 * time.Second // keep-alive の接続を次のリクエストまで待つ時間
+)
+
+type serverTimeouts struct {
+	readHeader, read, write, idle time.Duration
+}
+
+// HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT, HTTP_IDLE_TIMEOUT を読む (0 で無制限)
+func loadServerTimeouts() (serverTimeouts, error) {
+	var t serverTimeouts
+	var err error
+	if t.readHeader, err = envDuration("HTTP_READ_HEADER_TIMEOUT", defaultReadHeaderTimeout); err != nil {
+		return t, err
+	}
+	if t.read, err = envDuration("HTTP_READ_TIMEOUT", defaultReadTimeout); err != nil {
+		return t, err
+	}
+	if t.write, err = envDuration("HTTP_WRITE_TIMEOUT", defaultWriteTimeout); err != nil {
+		return t, err
+	}
+	if t.idle, err = envDuration("HTTP_IDLE_TIMEOUT", defaultIdleTimeout); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// 設定が無いときの選択肢 (これまでの温度アンケート)
+// キーを導入する前は日本語の表示名をそのまま保存していたので、ja の表示名は以前の値と同じにしておく
+var defaultVoteOptions = []voteOption{
+	{Key: "hot", Labels: map[string]string{"ja": "あつい", "en": "Hot"}},
+	{Key: "ok", Labels: map[string]string{"ja": "ちょうどよい", "en": "Just right"}},
+	{Key: "cold", Labels: map[string]string{"ja": "さむい", "en": "Cold"}},
+}
+
+// 選択肢を読み込む
+// VOTE_OPTIONS_FILE (JSON配列のファイル) を優先し、無ければ VOTE_OPTIONS (カンマ区切りのキー) を使う。
+// どちらも無ければ既定の3つに戻る
+// ファイルの要素は {"key": "hot", "labels": {"ja": "あつい", "en": "Hot"}} か、キーの文字列だけ (表示名もキーになる)
+// 要素には "metadata": {"color": "#e53935"} のように、クライアント向けの任意の JSON のオブジェクトも書ける
+func loadVoteOptions() ([]voteOption, error) {
+	var options []voteOption
+	if path := os.Getenv("VOTE_OPTIONS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for _, item := range items {
+			var option voteOption
+			if err := json.Unmarshal(item, &option.Key); err != nil {
+				if err := json.Unmarshal(item, &option); err != nil {
+					return nil, fmt.Errorf("parse %s: %w", path, err)
+				}
+			}
+			options = append(options, option)
+		}
+	} else if env := os.Getenv("VOTE_OPTIONS"); env != "" {
+		for _, key := range strings.Split(env, ",") {
+			options = append(options, voteOption{Key: key})
+		}
+	} else {
+		options = defaultVoteOptions
+	}
+	options, err := normalizeVoteOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return orderVoteOptions(options)
+}
+
+// OPTION_ORDER (カンマ区切りのキー) があれば、その順に選択肢を並べ替える
+// 結果の配列・CSV・ダッシュボード・同票の勝者・GET /options はすべて選択肢の順に並ぶので、クライアントもこの順で表示できる
+// 設定した選択肢をちょうど1回ずつ並べていなければエラー
+func orderVoteOptions(options []voteOption) ([]voteOption, error) {
+	order := envList("OPTION_ORDER", nil)
+	if order == nil {
+		return options, nil
+	}
+	byKey := make(map[string]voteOption, len(options))
+	for _, option := range options {
+		byKey[option.Key] = option
+	}
+	ordered := make([]voteOption, 0, len(options))
+	for _, key := range order {
+		key = normalizeVote(key)
+		option, ok := byKey[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid OPTION_ORDER: %q is not a configured vote option or is listed twice", key)
+		}
+		delete(byKey, key)
+		ordered = append(ordered, option)
+	}
+	for _, option := range options {
+		if _, missing := byKey[option.Key]; missing {
+			return nil, fmt.Errorf("invalid OPTION_ORDER: vote option %q is not listed", option.Key)
+		}
+	}
+	return ordered, nil
+}
+
+// 選択肢のキーを normalizeVote で揃え、空のキーや重複が無いか確かめる
+func normalizeVoteOptions(options []voteOption) ([]voteOption, error) {
+	seen := make(map[string]bool, len(options))
+	result := make([]voteOption, 0, len(options))
+	for _, option := range options {
+		option.Key = normalizeVote(option.Key)
+		if option.Key == "" {
+			return nil, fmt.Errorf("empty vote option")
+		}
+		if seen[option.Key] {
+			return nil, fmt.Errorf("duplicate vote option %q", option.Key)
+		}
+		metadata, err := normalizeOptionMetadata(option.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vote option %q: %w", option.Key, err)
+		}
+		option.Metadata = metadata
+		seen[option.Key] = true
+		result = append(result, option)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no vote options configured")
+	}
+	return result, nil
+}
+
+// PORT が未設定のときの待ち受けポート
+const defaultPort = "8080"
+
+// 待ち受けアドレスを PORT から作る。数字でなければエラー
+func loadListenAddr() (string, error) {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid PORT %q: must be a number between 1 and 65535", port)
+	}
+	return ":" + port, nil
+}
+
+// CORSで許可するオリジンを CORS_ALLOWED_ORIGINS (カンマ区切り) から読む。未設定ならすべて許可
+func loadCORSOrigins() []string {
+	return envList("CORS_ALLOWED_ORIGINS", []string{"*"})
+}
+
+// ルートが受け付けるメソッド (CORS_ALLOWED_METHODS の既定値)
+var servedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPatch, http.MethodDelete}
+
+// ブラウザから送るリクエストヘッダー (CORS_ALLOWED_HEADERS の既定値)
+var defaultCORSHeaders = []string{"Content-Type", "Authorization", "X-Admin-Key", "X-Request-ID", "X-Device-ID", "Idempotency-Key"}
+
+// CORSで許可するメソッドを CORS_ALLOWED_METHODS (カンマ区切り) から読む。未設定ならルートが受け付けるすべてのメソッド
+// 受け付けるメソッドが抜けているとブラウザのプリフライトで止まるので、警告を出す
+func loadCORSMethods() []string {
+	methods := envList("CORS_ALLOWED_METHODS", servedMethods)
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(method)
+	}
+	for _, method := range servedMethods {
+		if !slices.Contains(methods, method) {
+			slog.Warn("CORS_ALLOWED_METHODS does not include a served method; browsers will fail preflight", "method", method)
+		}
+	}
+	return methods
+}
+
+// CORSで許可するリクエストヘッダーを CORS_ALLOWED_HEADERS (カンマ区切り) から読む
+func loadCORSHeaders() []string {
+	return envList("CORS_ALLOWED_HEADERS", defaultCORSHeaders)
+}
+
+// カンマ区切りの環境変数を読む。未設定なら def
+func envList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return def
+	}
+	return list
+}
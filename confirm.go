@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// 投票を確定するまでの猶予 (VOTE_CONFIRM_TTL で設定する。0なら確認せずにすぐ記録する)
+// 設定すると POST /vote は投票を保留して確認用のトークンを返し、POST /vote/confirm で確定するまで票数に入れない
+// 大事な投票で、誤ってタップした選択肢が数えられないようにする。期限までに確定しなかった投票は捨てる
+var voteConfirmTTL time.Duration
+
+// 保留中の投票の status
+const voteStatusPending = "pending"
+
+// 確認用のトークンの先頭に付ける文字列
+const confirmTokenPrefix = "cnf_"
+
+// 確定を待っている投票 (POST /vote で確かめた内容のまま持っておく)
+type pendingVote struct {
+	req       VoteRequest
+	user      authUser
+	device    string
+	expiresAt time.Time
+}
+
+// POST /vote で投票を保留したときのレスポンス形式 (202)
+type PendingVoteResponse struct {
+	Status            string    `json:"status"`            // 常に "pending"
+	ConfirmationToken string    `json:"confirmationToken"` // POST /vote/confirm に送るトークン
+	ExpiresAt         time.Time `json:"expiresAt"`         // この時刻までに確定しないと捨てる
+}
+
+// POST /vote/confirm のリクエスト形式
+type ConfirmVoteRequest struct {
+	Token string `json:"token"`
+}
+
+// VOTE_CONFIRM_TTL を読む。匿名投票モードとは一緒に使えない (保留した投票を本人に結び付けられないため)
+func loadVoteConfirm() error {
+	var err error
+	if voteConfirmTTL, err = envDuration("VOTE_CONFIRM_TTL", 0); err != nil {
+		return err
+	}
+	if voteConfirmTTL < 0 {
+		return errors.New("VOTE_CONFIRM_TTL must not be negative")
+	}
+	if voteConfirmTTL > 0 && anonymousVoting {
+		return errors.New("VOTE_CONFIRM_TTL cannot be used with ANONYMOUS_VOTING")
+	}
+	return nil
+}
+
+func newConfirmToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return confirmTokenPrefix + hex.EncodeToString(b)
+}
+
+// checkVote を通った投票を保留し、確認用のトークンを書く (呼び出し側でロックを取っておくこと)
+// 同じユーザーの前の保留は捨てる (確定できるのは最後に選んだものだけ)
+func (rm *room) holdVote(w http.ResponseWriter, r *http.Request, user authUser, req VoteRequest, device string) {
+	rm.dropPendingVote(req.UserID)
+	if rm.pendingVotes == nil {
+		rm.pendingVotes = make(map[string]pendingVote)
+	}
+	token := newConfirmToken()
+	expiresAt := time.Now().Add(voteConfirmTTL)
+	rm.pendingVotes[token] = pendingVote{req: req, user: user, device: device, expiresAt: expiresAt}
+	slog.InfoContext(r.Context(), "vote pending confirmation", "event", "vote_pending", "roomId", rm.id, "userId", logUserID(req.UserID), "vote", req.Vote)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(PendingVoteResponse{Status: voteStatusPending, ConfirmationToken: token, ExpiresAt: expiresAt.UTC()})
+}
+
+// ユーザーの保留中の投票を捨てる (呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) dropPendingVote(userID string) {
+	for token, pending := range rm.pendingVotes {
+		if pending.req.UserID == userID {
+			delete(rm.pendingVotes, token)
+		}
+	}
+}
+
+// POST /vote/confirm エンドポイントの処理 (保留した投票を確定する)
+// 保留してから状況が変わっているかもしれないので (受付の終了、上限、別の投票など)、確定するときにもう一度 POST /vote と同じ確認をする
+// トークンは1回だけ使える。期限切れや他のユーザーのトークンは 404
+func (rm *room) confirmVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if !checkJSONContentType(w, r) {
+		return
+	}
+
+	user, err := authenticateUser(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req ConfirmVoteRequest
+	if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	pending, ok := rm.pendingVotes[req.Token]
+	if !ok || !time.Now().Before(pending.expiresAt) || (user.UID != "" && user.UID != pending.req.UserID) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Pending vote not found or expired")
+		return
+	}
+	delete(rm.pendingVotes, req.Token)
+
+	previousVote, hasPrevious, status, ok := rm.checkVote(w, r, pending.req, pending.device)
+	if !ok {
+		return
+	}
+	rm.commitVote(w, r, pending.user, pending.req, pending.device, previousVote, hasPrevious, status)
+}
+
+// 期限を過ぎた保留中の投票を捨てる
+func (rm *room) expirePendingVotes(now time.Time) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	for token, pending := range rm.pendingVotes {
+		if !now.Before(pending.expiresAt) {
+			delete(rm.pendingVotes, token)
+			slog.Debug("pending vote expired", "event", "vote_pending_expired", "roomId", rm.id, "userId", logUserID(pending.req.UserID))
+		}
+	}
+}
+
+// 定期的にすべての部屋の期限切れの保留中の投票を捨てる。サーバーが終了すると止まる
+func startPendingVoteSweep() {
+	interval := min(voteConfirmTTL, time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, rm := range allRooms() {
+					rm.expirePendingVotes(now)
+				}
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
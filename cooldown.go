@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// 投票を変えてから次に変えられるまでの時間 (VOTE_CHANGE_COOLDOWN。0 なら待たせない)
+// ライブのイベントで何度も投票を変えるのを抑えるためのもので、初めての投票や同じ選択肢への再投票には関係ない
+var voteChangeCooldown time.Duration
+
+// VOTE_CHANGE_COOLDOWN を読む
+func loadVoteChangeCooldown() error {
+	var err error
+	if voteChangeCooldown, err = envDuration("VOTE_CHANGE_COOLDOWN", 0); err != nil {
+		return err
+	}
+	if voteChangeCooldown < 0 {
+		return errors.New("VOTE_CHANGE_COOLDOWN must not be negative")
+	}
+	return nil
+}
+
+// 投票を変えられるようになるまでの残り時間。今すぐ変えられるなら 0 (呼び出し側でロックを取っておくこと)
+// 前の投票の時刻は保存先の VotedAt (その選択肢を選んだ時刻) を使う
+func (rm *room) changeCooldownRemaining(userID string, hasPrevious bool, previousVote, vote string, now time.Time) time.Duration {
+	if voteChangeCooldown <= 0 || !hasPrevious || previousVote == vote {
+		return 0
+	}
+	record, ok := lookupUserRecord(rm.store, userID)
+	if !ok || record.VotedAt.IsZero() {
+		return 0
+	}
+	return max(record.VotedAt.Add(voteChangeCooldown).Sub(now), 0)
+}
+
+// まだ投票を変えられなければ 429 と Retry-After を書いて false を返す (呼び出し側でロックを取っておくこと)
+func (rm *room) checkChangeCooldown(w http.ResponseWriter, userID string, hasPrevious bool, previousVote, vote string) bool {
+	remaining := rm.changeCooldownRemaining(userID, hasPrevious, previousVote, vote, time.Now())
+	if remaining <= 0 {
+		return true
+	}
+	setRetryAfter(w, remaining)
+	writeJSONError(w, http.StatusTooManyRequests, errCodeChangeCooldown, cooldownMessage(remaining))
+	return false
+}
+
+func cooldownMessage(remaining time.Duration) string {
+	return fmt.Sprintf("Vote can be changed again in %d seconds", int(math.Ceil(remaining.Seconds())))
+}
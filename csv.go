@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Excel が UTF-8 と判断するためのBOM
+const utf8BOM = "\xef\xbb\xbf"
+
+// GET /results.csv エンドポイントの処理
+// 票数を option,count のCSVで返す。?bom=true でBOMを付ける (Excelで文字化けしないように)
+func (rm *room) resultsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	withBOM := false
+	if v := r.URL.Query().Get("bom"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid bom parameter")
+			return
+		}
+		withBOM = b
+	}
+
+	var buf bytes.Buffer
+	if withBOM {
+		buf.WriteString(utf8BOM)
+	}
+
+	// 途中で票が変わらないよう、読み取りロック中にコピーした票数から書き出す
+	// 終了した投票は確定した票数を書き出す
+	rm.ensureFinal(time.Now())
+	snap := rm.snapshotResults(time.Now(), false)
+	if err := writeCountsCSV(&buf, snap.set, snap.counts); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write results csv", "roomId", rm.id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to export results")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="results.csv"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// 票数をCSVで書く。選択肢の並びは set の順 (set に無い選択肢は後ろに名前順)
+// カンマや引用符を含む選択肢は encoding/csv が引用符で囲む
+func writeCountsCSV(buf *bytes.Buffer, set *optionSet, counts map[string]int) error {
+	return writeCountsDelimited(buf, set, counts, ',')
+}
+
+// 票数を comma 区切りで書く (TSV は '\t')
+func writeCountsDelimited(buf *bytes.Buffer, set *optionSet, counts map[string]int, comma rune) error {
+	cw := csv.NewWriter(buf)
+	cw.Comma = comma
+	cw.Write([]string{"option", "count"})
+
+	var extra []string
+	for option := range counts {
+		if !set.has(option) {
+			extra = append(extra, option)
+		}
+	}
+	slices.Sort(extra)
+
+	for _, option := range append(slices.Clone(set.keys), extra...) {
+		cw.Write([]string{option, strconv.Itoa(counts[option])})
+	}
+	cw.Flush()
+	return cw.Error()
+}
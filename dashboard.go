@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SSE が使えないときにページを読み込み直す間隔 (秒)
+const dashboardRefreshSeconds = 10
+
+// GET /dashboard の1行
+type dashboardRow struct {
+	Key        string
+	Label      string
+	Count      int
+	Percentage float64
+}
+
+// GET /dashboard のテンプレートに渡す値
+type dashboardPage struct {
+	Title          string
+	Lang           string
+	Rows           []dashboardRow
+	Total          int
+	Status         string
+	UpdatedAt      string
+	StreamURL      string
+	RefreshSeconds int
+}
+
+// プロジェクター用の結果のページ
+// 票数と割合はサーバーで埋めておき、SSE (results/stream) で届いた票数で書き換える
+// JavaScript が動かないときは meta refresh、SSE がつながらないときは一定時間ごとに読み込み直す
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<noscript><meta http-equiv="refresh" content="{{.RefreshSeconds}}"></noscript>
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, "Hiragino Sans", "Noto Sans JP", sans-serif; margin: 2rem; font-size: 2rem; }
+table { width: 100%; border-collapse: collapse; }
+td { padding: .5rem; vertical-align: middle; }
+td.label { width: 25%; white-space: nowrap; }
+td.count, td.pct { width: 10%; text-align: right; font-variant-numeric: tabular-nums; }
+.bar { height: 2rem; background: #e07a5f; }
+footer { margin-top: 1rem; font-size: 1rem; color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{range .Rows}}<tr data-key="{{.Key}}">
+<td class="label">{{.Label}}</td>
+<td><div class="bar" style="width: {{.Percentage}}%"></div></td>
+<td class="count">{{.Count}}</td>
+<td class="pct">{{.Percentage}}%</td>
+</tr>
+{{end}}</table>
+<footer>合計 <span id="total">{{.Total}}</span> 票 · {{.Status}} · <span id="updated">{{.UpdatedAt}}</span></footer>
+<script>
+(function () {
+  var refresh = function () { setTimeout(function () { location.reload(); }, {{.RefreshSeconds}} * 1000); };
+  if (!window.EventSource) { refresh(); return; }
+  var source = new EventSource({{.StreamURL}});
+  source.onmessage = function (e) {
+    var counts = JSON.parse(e.data), total = 0, key;
+    for (key in counts) { total += counts[key]; }
+    document.querySelectorAll("tr[data-key]").forEach(function (row) {
+      var n = counts[row.dataset.key] || 0;
+      var pct = total ? Math.round(n * 1000 / total) / 10 : 0;
+      row.querySelector(".count").textContent = n;
+      row.querySelector(".pct").textContent = pct + "%";
+      row.querySelector(".bar").style.width = pct + "%";
+    });
+    document.getElementById("total").textContent = total;
+    document.getElementById("updated").textContent = new Date().toLocaleTimeString();
+  };
+  source.onerror = function () { source.close(); refresh(); };
+})();
+</script>
+</body>
+</html>
+`))
+
+// GET /dashboard エンドポイントの処理 (フロントエンドを用意しなくても、ブラウザで結果を映せるように)
+// 表示名は ?lang= か Accept-Language の言語にする。割合はサーバーでは GET /results と同じ計算で、
+// SSE で書き換えるときはブラウザで四捨五入するので、合計が 100 にならないことがある
+func (rm *room) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	now := time.Now()
+	rm.ensureFinal(now)
+	snap := rm.snapshotResults(now, false)
+	lang := requestLanguage(r)
+	res := buildResults(snap.set, snap.counts, snap.weighted, lang)
+
+	page := dashboardPage{
+		Title:          "投票結果",
+		Lang:           lang,
+		Total:          res.Total,
+		Status:         snap.status,
+		UpdatedAt:      now.Format("15:04:05"),
+		StreamURL:      "/v1/results/stream",
+		RefreshSeconds: dashboardRefreshSeconds,
+	}
+	if rm.id != "" {
+		page.Title += " - " + rm.id
+		page.StreamURL = "/v1/rooms/" + rm.id + "/results/stream"
+	}
+	if page.Lang == "" {
+		page.Lang = "ja"
+	}
+	for _, key := range snap.set.keys {
+		o := res.Options[key]
+		page.Rows = append(page.Rows, dashboardRow{Key: key, Label: o.Label, Count: o.Count, Percentage: o.Percentage})
+	}
+
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, page); err != nil {
+		slog.ErrorContext(r.Context(), "failed to render dashboard", "roomId", rm.id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to render dashboard")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// /rooms/{roomId}/dashboard エンドポイントの処理
+func roomDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.dashboardHandler(w, r)
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// DB_PATH が未設定のときに使うSQLiteファイルのパス
+const defaultDBPath = "votes.db"
+
+// SQLiteファイルを開き、テーブルがまだ無ければ作成する
+func openDB(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLiteは同時書き込みに弱いので接続は1本に絞る
+	conn.SetMaxOpenConns(1)
+
+	if err := migrateRoomSchema(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+
+	// room_id が空文字の行は既定の投票 (/vote) のもの
+	// voted_at はUnixミリ秒 (時刻を記録する前の行は0)。weight は票の重み (重みを記録する前の行は1)
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS vote_counts (
+			room_id TEXT NOT NULL DEFAULT '',
+			option  TEXT NOT NULL,
+			count   INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (room_id, option)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_votes (
+			room_id  TEXT NOT NULL DEFAULT '',
+			user_id  TEXT NOT NULL,
+			vote     TEXT NOT NULL,
+			voted_at INTEGER NOT NULL DEFAULT 0,
+			weight   INTEGER NOT NULL DEFAULT 1,
+			PRIMARY KEY (room_id, user_id)
+		)`,
+		// 投票の変更の追記専用の記録。起動時にはここから投票を組み立て直す
+		`CREATE TABLE IF NOT EXISTS vote_events (
+			id      INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id TEXT NOT NULL DEFAULT '',
+			user_id TEXT NOT NULL,
+			vote    TEXT NOT NULL,
+			at      INTEGER NOT NULL DEFAULT 0,
+			weight  INTEGER NOT NULL DEFAULT 1,
+			adjust  INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS vote_events_room_id ON vote_events (room_id, id)`,
+		// POST /polls で作った投票の定義 (definition は pollInfo の JSON)
+		`CREATE TABLE IF NOT EXISTS polls (
+			id         TEXT PRIMARY KEY,
+			definition TEXT NOT NULL
+		)`,
+	}
+	for _, stmt := range schema {
+		if _, err := conn.Exec(stmt); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+
+	if err := repairDoubleCounts(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("repair vote counts: %w", err)
+	}
+
+	// 投票時刻や重み、手で直した票数を記録する前のテーブルには列を足す
+	columns := []struct{ table, column, def string }{
+		{"user_votes", "voted_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"user_votes", "weight", "INTEGER NOT NULL DEFAULT 1"},
+		{"vote_events", "weight", "INTEGER NOT NULL DEFAULT 1"},
+		{"vote_events", "adjust", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		has, _, err := tableHasColumn(conn, c.table, c.column)
+		if err == nil && !has {
+			_, err = conn.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` ` + c.def)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("migrate schema: %w", err)
+		}
+	}
+
+	if err := backfillVoteEvents(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("backfill vote events: %w", err)
+	}
+
+	return conn, nil
+}
+
+// 部屋に対応する前のテーブル (room_id 列なし) があれば、既定の投票のデータとして移し替える
+func migrateRoomSchema(conn *sql.DB) error {
+	hasRoomID, exists, err := tableHasColumn(conn, "vote_counts", "room_id")
+	if err != nil || !exists || hasRoomID {
+		return err
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`ALTER TABLE vote_counts RENAME TO vote_counts_old`,
+		`ALTER TABLE user_votes RENAME TO user_votes_old`,
+		`CREATE TABLE vote_counts (
+			room_id TEXT NOT NULL DEFAULT '',
+			option  TEXT NOT NULL,
+			count   INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (room_id, option)
+		)`,
+		`CREATE TABLE user_votes (
+			room_id TEXT NOT NULL DEFAULT '',
+			user_id TEXT NOT NULL,
+			vote    TEXT NOT NULL,
+			PRIMARY KEY (room_id, user_id)
+		)`,
+		`INSERT INTO vote_counts (room_id, option, count) SELECT '', option, count FROM vote_counts_old`,
+		`INSERT INTO user_votes (room_id, user_id, vote) SELECT '', user_id, vote FROM user_votes_old`,
+		`DROP TABLE vote_counts_old`,
+		`DROP TABLE user_votes_old`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 以前は同じ選択肢に再投票すると票数が二重に増えていたので、
+// 一度だけ user_votes から票数を数え直す (PRAGMA user_version で実施済みかを記録する)
+func repairDoubleCounts(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= 1 {
+		return nil
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`UPDATE vote_counts SET count = (
+			SELECT COUNT(*) FROM user_votes
+			WHERE user_votes.room_id = vote_counts.room_id AND user_votes.vote = vote_counts.option
+		)`,
+		`PRAGMA user_version = 1`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 表示名で保存されていた投票を選択肢のキーに書き換える (aliases は表示名からキーへの対応)
+// 書き換えた後は対象の行が無くなるので、毎回の起動で呼んでも2回目以降は何も変わらない
+func migrateOptionKeys(conn *sql.DB, aliases map[string]string) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for label, key := range aliases {
+		stmts := []string{
+			`UPDATE vote_events SET vote = ? WHERE vote = ?`,
+			`UPDATE user_votes SET vote = ? WHERE vote = ?`,
+			// 同じ部屋にキーの行が既にあれば足し合わせる
+			`INSERT INTO vote_counts (room_id, option, count)
+			 SELECT room_id, ?, count FROM vote_counts WHERE option = ?
+			 ON CONFLICT(room_id, option) DO UPDATE SET count = count + excluded.count`,
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt, key, label); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM vote_counts WHERE option = ?`, label); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// テーブルに列があるかを調べる。exists はテーブル自体があるかどうか
+func tableHasColumn(conn *sql.DB, table, column string) (has bool, exists bool, err error) {
+	rows, err := conn.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		exists = true
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, false, err
+		}
+		if name == column {
+			has = true
+		}
+	}
+	return has, exists, rows.Err()
+}
+
+// 保存済みの部屋IDを返す (既定の投票の空文字は含めない)
+func loadRoomIDs(conn *sql.DB) ([]string, error) {
+	rows, err := conn.Query(
+		`SELECT room_id FROM vote_counts WHERE room_id != ''
+		 UNION SELECT room_id FROM user_votes WHERE room_id != ''`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SQLiteに書き込む VoteStore
+// データベースが正で、読み取りはメモリ上のキャッシュから返す
+// (SQLITE_BATCH_INTERVAL を設定したときは、まだ書いていない投票の分だけキャッシュが先に進む)
+type sqliteStore struct {
+	conn   *sql.DB
+	roomID string
+	cache  *memoryStore
+	batch  *voteBatcher // 投票をまとめて書くとき (SQLITE_BATCH_INTERVAL) だけ
+}
+
+// 部屋の保存済みデータをキャッシュに読み込んで sqliteStore を作る
+func newSQLiteStore(conn *sql.DB, roomID string) (*sqliteStore, error) {
+	s := &sqliteStore{conn: conn, roomID: roomID, cache: newMemoryStore(roomOptions(roomID).keys)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if sqliteBatchInterval > 0 {
+		s.batch = newVoteBatcher(conn, roomID)
+	}
+	return s, nil
+}
+
+// まとめて書くときは溜めた投票を先に書く (ほかの書き込みがイベントの順序を追い越さないように)
+func (s *sqliteStore) flushBatch(ctx context.Context) error {
+	if s.batch == nil {
+		return nil
+	}
+	return s.batch.flush(ctx)
+}
+
+// 接続は1つなので書き込みはデータベース側で順番になり、溜める投票は voteBatcher.mu で守るので、
+// 違うユーザーの投票は同時に記録してよい (同じユーザーの前の投票はキャッシュから読む)
+func (s *sqliteStore) recordsVotesConcurrently() bool {
+	return true
+}
+
+// vote_events を再生してキャッシュを作る
+// vote_counts と user_votes は同じトランザクションで更新している現在の状態で、部屋の一覧などに使う
+func (s *sqliteStore) load() error {
+	events, err := loadVoteEvents(s.conn, s.roomID)
+	if err != nil {
+		return err
+	}
+	s.cache = Replay(events, roomOptions(s.roomID).keys)
+	return nil
+}
+
+// 先にデータベースへ書き込み、失敗したらキャッシュは変更しない
+// まとめて書くときはキャッシュだけを変えて投票を溜める (データベースへの書き込みの失敗はここでは返らない)
+func (s *sqliteStore) RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error {
+	previous, ok := s.cache.userRecord(userID)
+	if ok && previous.Vote == vote {
+		// 同じ選択肢への再投票は何も書かない
+		return nil
+	}
+	if s.batch != nil {
+		if err := s.cache.RecordVote(ctx, userID, vote, weight, at); err != nil {
+			return err
+		}
+		s.batch.add(voteWrite{userID: userID, previousVote: previous.Vote, vote: vote, weight: weight, at: at})
+		return nil
+	}
+	if err := saveVote(ctx, s.conn, s.roomID, userID, previous.Vote, vote, weight, at); err != nil {
+		return err
+	}
+	return s.cache.RecordVote(ctx, userID, vote, weight, at)
+}
+
+// ユーザーIDの無いイベントとして書き込む (再生すると票数だけが増える)
+func (s *sqliteStore) RecordAnonymousVote(ctx context.Context, vote string, weight int, at time.Time) error {
+	if err := s.flushBatch(ctx); err != nil {
+		return err
+	}
+	if err := saveAnonymousVote(ctx, s.conn, s.roomID, vote, weight, at); err != nil {
+		return err
+	}
+	return s.cache.RecordAnonymousVote(ctx, vote, weight, at)
+}
+
+// 票数を直したことをユーザーIDの無いイベントとして書き込む (再生すると同じだけ票数が変わる)
+func (s *sqliteStore) AdjustCounts(ctx context.Context, deltas map[string]int, at time.Time) error {
+	if err := s.flushBatch(ctx); err != nil {
+		return err
+	}
+	if err := saveCountAdjustment(ctx, s.conn, s.roomID, deltas, at); err != nil {
+		return err
+	}
+	return s.cache.AdjustCounts(ctx, deltas, at)
+}
+
+func (s *sqliteStore) countsAdjustedAt() time.Time {
+	return s.cache.countsAdjustedAt()
+}
+
+func (s *sqliteStore) DeleteVote(ctx context.Context, userID string) error {
+	previousVote, ok := s.cache.UserVote(userID)
+	if !ok {
+		return errVoteNotFound
+	}
+	if err := s.flushBatch(ctx); err != nil {
+		return err
+	}
+	if err := deleteVote(ctx, s.conn, s.roomID, userID, previousVote, time.Now()); err != nil {
+		return err
+	}
+	return s.cache.DeleteVote(ctx, userID)
+}
+
+// 現在の投票を取り消し、vote_events からもそのユーザーの行を消す
+// 再生したときにそのユーザーが投票しなかったのと同じ結果になる
+func (s *sqliteStore) EraseUser(ctx context.Context, userID string) error {
+	if err := s.flushBatch(ctx); err != nil {
+		return err
+	}
+	previousVote, _ := s.cache.UserVote(userID)
+	erased, err := eraseUser(ctx, s.conn, s.roomID, userID, previousVote)
+	if err != nil {
+		return err
+	}
+	if !erased {
+		return errVoteNotFound
+	}
+	if previousVote != "" {
+		return s.cache.DeleteVote(ctx, userID)
+	}
+	return nil
+}
+
+func (s *sqliteStore) addOption(key string) {
+	s.cache.addOption(key)
+}
+
+func (s *sqliteStore) removeOption(key string) {
+	s.cache.removeOption(key)
+}
+
+func (s *sqliteStore) Counts() map[string]int {
+	return s.cache.Counts()
+}
+
+func (s *sqliteStore) WeightedCounts() map[string]int {
+	return s.cache.WeightedCounts()
+}
+
+func (s *sqliteStore) UserVote(userID string) (string, bool) {
+	return s.cache.UserVote(userID)
+}
+
+func (s *sqliteStore) userRecord(userID string) (voteRecord, bool) {
+	return s.cache.userRecord(userID)
+}
+
+func (s *sqliteStore) UserVotes() map[string]voteRecord {
+	return s.cache.UserVotes()
+}
+
+func (s *sqliteStore) VoterCount() int {
+	return s.cache.VoterCount()
+}
+
+func (s *sqliteStore) Reset(ctx context.Context) error {
+	if err := s.flushBatch(ctx); err != nil {
+		return err
+	}
+	if err := resetVotes(ctx, s.conn, s.roomID, time.Now()); err != nil {
+		return err
+	}
+	return s.cache.Reset(ctx)
+}
+
+// 1件の投票をトランザクションで書き込む
+// previousVote はそのユーザーの以前の投票 (無ければ空文字)
+func saveVote(ctx context.Context, conn *sql.DB, roomID, userID, previousVote, vote string, weight int, at time.Time) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if previousVote == vote {
+		return nil
+	}
+	if err := writeVote(ctx, tx, roomID, voteWrite{userID: userID, previousVote: previousVote, vote: vote, weight: weight, at: at}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 1件の投票をトランザクションの中で書く (saveVote と、まとめて書くときの flush で使う)
+func writeVote(ctx context.Context, tx *sql.Tx, roomID string, v voteWrite) error {
+	if v.previousVote != "" {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE vote_counts SET count = MAX(count - 1, 0) WHERE room_id = ? AND option = ?`,
+			roomID, v.previousVote,
+		); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO vote_counts (room_id, option, count) VALUES (?, ?, 1)
+		 ON CONFLICT(room_id, option) DO UPDATE SET count = count + 1`,
+		roomID, v.vote,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO user_votes (room_id, user_id, vote, voted_at, weight) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(room_id, user_id) DO UPDATE SET vote = excluded.vote, voted_at = excluded.voted_at, weight = excluded.weight`,
+		roomID, v.userID, v.vote, unixMilli(v.at), v.weight,
+	); err != nil {
+		return err
+	}
+	return appendVoteEvent(ctx, tx, roomID, VoteEvent{UserID: v.userID, Vote: v.vote, Weight: v.weight, Timestamp: v.at})
+}
+
+// 匿名の1票をトランザクションで書き込む (user_votes には何も残さない)
+func saveAnonymousVote(ctx context.Context, conn *sql.DB, roomID, vote string, weight int, at time.Time) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO vote_counts (room_id, option, count) VALUES (?, ?, 1)
+		 ON CONFLICT(room_id, option) DO UPDATE SET count = count + 1`,
+		roomID, vote,
+	); err != nil {
+		return err
+	}
+	if err := appendVoteEvent(ctx, tx, roomID, VoteEvent{Vote: vote, Weight: weight, Timestamp: at}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 選択肢ごとに票数を deltas だけ増減する (0未満にはしない)
+func saveCountAdjustment(ctx context.Context, conn *sql.DB, roomID string, deltas map[string]int, at time.Time) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for option, delta := range deltas {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO vote_counts (room_id, option, count) VALUES (?, ?, 0) ON CONFLICT(room_id, option) DO NOTHING`,
+			roomID, option,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE vote_counts SET count = MAX(count + ?, 0) WHERE room_id = ? AND option = ?`,
+			delta, roomID, option,
+		); err != nil {
+			return err
+		}
+		if err := appendVoteEvent(ctx, tx, roomID, VoteEvent{Vote: option, Adjust: delta, Timestamp: at}); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ユーザーの投票を取り消し、その選択肢の票を1つ減らす
+func deleteVote(ctx context.Context, conn *sql.DB, roomID, userID, vote string, at time.Time) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE vote_counts SET count = MAX(count - 1, 0) WHERE room_id = ? AND option = ?`,
+		roomID, vote,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_votes WHERE room_id = ? AND user_id = ?`, roomID, userID); err != nil {
+		return err
+	}
+	if err := appendVoteEvent(ctx, tx, roomID, VoteEvent{UserID: userID, Timestamp: at}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ユーザーの投票とイベントをすべて消す。previousVote はそのユーザーの現在の投票 (無ければ空文字)
+// 消す行が無ければ false
+func eraseUser(ctx context.Context, conn *sql.DB, roomID, userID, previousVote string) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if previousVote != "" {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE vote_counts SET count = MAX(count - 1, 0) WHERE room_id = ? AND option = ?`,
+			roomID, previousVote,
+		); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_votes WHERE room_id = ? AND user_id = ?`, roomID, userID); err != nil {
+		return false, err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM vote_events WHERE room_id = ? AND user_id = ?`, roomID, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// 部屋の票数を0にし、ユーザーごとの投票を消す
+// イベントには投票していた全員分の取り消しを記録する
+func resetVotes(ctx context.Context, conn *sql.DB, roomID string, at time.Time) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO vote_events (room_id, user_id, vote, at) SELECT room_id, user_id, '', ? FROM user_votes WHERE room_id = ?`,
+		unixMilli(at), roomID,
+	); err != nil {
+		return err
+	}
+	// ユーザーIDの無い取り消しはリセットの印 (再生するとユーザーの投票に含まれない匿名の票も0にする)
+	if err := appendVoteEvent(ctx, tx, roomID, VoteEvent{Timestamp: at}); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE vote_counts SET count = 0 WHERE room_id = ?`, roomID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_votes WHERE room_id = ?`, roomID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 時刻をUnixミリ秒にする (ゼロ値は0)
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// 保存済みの投票の定義 (POST /polls) を読む
+func loadPollDefinitions(conn *sql.DB) ([]pollInfo, error) {
+	rows, err := conn.Query(`SELECT id, definition FROM polls`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []pollInfo
+	for rows.Next() {
+		var id, definition string
+		if err := rows.Scan(&id, &definition); err != nil {
+			return nil, err
+		}
+		var info pollInfo
+		if err := json.Unmarshal([]byte(definition), &info); err != nil {
+			return nil, fmt.Errorf("parse poll %q: %w", id, err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// 投票の定義を書く (同じIDの定義は置き換える)
+func savePollDefinition(ctx context.Context, conn *sql.DB, info pollInfo) error {
+	definition, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx,
+		`INSERT INTO polls (id, definition) VALUES (?, ?)
+		 ON CONFLICT(id) DO UPDATE SET definition = excluded.definition`,
+		info.ID, string(definition),
+	)
+	return err
+}
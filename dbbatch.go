@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SQLITE_BATCH_SIZE が未設定のときの、まとめて書く投票の数
+const defaultSQLiteBatchSize = 100
+
+// 投票を SQLite にまとめて書く間隔 (SQLITE_BATCH_INTERVAL で設定する。0 なら1票ごとに書く)
+// 設定すると投票はすぐメモリ上の票数に入り、データベースには interval ごとか sqliteBatchSize 票ごとの早い方で、1つのトランザクションで書く
+// 投票が集中したときにデータベースへの書き込みを減らす代わりに、プロセスが落ちると最後の1回分 (最大で interval の間か sqliteBatchSize 票) の投票が失われる
+// 通常の終了では必ず書いてから閉じる。匿名の票、取り消し、リセットなどは、溜めた投票を書いてから1件ずつ書く
+var sqliteBatchInterval time.Duration
+
+// 溜めた投票がこの数に達したら interval を待たずに書く (SQLITE_BATCH_SIZE)
+var sqliteBatchSize = defaultSQLiteBatchSize
+
+// SQLITE_BATCH_INTERVAL と SQLITE_BATCH_SIZE を読む
+func loadSQLiteBatching() error {
+	var err error
+	if sqliteBatchInterval, err = envDuration("SQLITE_BATCH_INTERVAL", 0); err != nil {
+		return err
+	}
+	if sqliteBatchInterval < 0 {
+		return errors.New("SQLITE_BATCH_INTERVAL must not be negative")
+	}
+	if sqliteBatchSize, err = envInt("SQLITE_BATCH_SIZE", defaultSQLiteBatchSize); err != nil {
+		return err
+	}
+	if sqliteBatchSize < 1 {
+		return errors.New("SQLITE_BATCH_SIZE must be positive")
+	}
+	return nil
+}
+
+// まだデータベースに書いていない1件の投票
+type voteWrite struct {
+	userID       string
+	previousVote string // そのユーザーの以前の投票 (無ければ空文字)
+	vote         string
+	weight       int
+	at           time.Time
+}
+
+// 部屋の投票を溜めておき、まとめて1つのトランザクションで書く
+// 投票は room.mutex の中で溜まるが、定期的な書き込みはロックの外から来るので、溜めた投票は mu で守る
+type voteBatcher struct {
+	roomID string
+	write  func(ctx context.Context, batch []voteWrite) error // 溜めた投票を書く (テストでは書いた回数を数えるものに替える)
+
+	mu      sync.Mutex
+	pending []voteWrite
+
+	flushMu sync.Mutex    // 書き込みどうしを順番にする (溜めた順にデータベースに入るように)
+	kick    chan struct{} // sqliteBatchSize に達したことを書き込みの goroutine に知らせる
+}
+
+var (
+	voteBatchersMutex sync.Mutex
+	voteBatchers      []*voteBatcher
+)
+
+// 部屋の voteBatcher を作り、定期的に書き込む goroutine を始める
+func newVoteBatcher(conn *sql.DB, roomID string) *voteBatcher {
+	b := &voteBatcher{roomID: roomID, kick: make(chan struct{}, 1)}
+	b.write = func(ctx context.Context, batch []voteWrite) error {
+		return writeVoteBatch(ctx, conn, roomID, batch)
+	}
+	voteBatchersMutex.Lock()
+	voteBatchers = append(voteBatchers, b)
+	voteBatchersMutex.Unlock()
+	go b.run(sqliteBatchInterval, shuttingDown)
+	return b
+}
+
+// 投票を溜める。sqliteBatchSize に達したら書き込みを促す (書き込みは待たない)
+func (b *voteBatcher) add(v voteWrite) {
+	b.mu.Lock()
+	b.pending = append(b.pending, v)
+	full := len(b.pending) >= sqliteBatchSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 溜めた投票をすべて書く
+// 失敗したら溜めた投票を戻し、次の書き込みでやり直す (メモリ上の票数にはもう入っているので捨てない)
+func (b *voteBatcher) flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := b.write(ctx, batch); err != nil {
+		b.mu.Lock()
+		b.pending = append(batch, b.pending...)
+		b.mu.Unlock()
+		return err
+	}
+	slog.Debug("vote batch flushed", "event", "vote_batch", "roomId", b.roomID, "votes", len(batch))
+	return nil
+}
+
+// 投票を1つのトランザクションで書く
+func writeVoteBatch(ctx context.Context, conn *sql.DB, roomID string, batch []voteWrite) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, v := range batch {
+		if err := writeVote(ctx, tx, roomID, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// interval ごとか、sqliteBatchSize に達したときに書く。stop が閉じると止まる (最後の書き込みは flushVoteBatches で行う)
+func (b *voteBatcher) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.kick:
+		case <-stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := b.flush(ctx); err != nil {
+			slog.Error("failed to flush vote batch", "event", "vote_batch", "roomId", b.roomID, "error", err)
+		}
+		cancel()
+	}
+}
+
+// すべての部屋の溜めた投票を書く (データベースを閉じる前に呼ぶ)
+func flushVoteBatches() error {
+	voteBatchersMutex.Lock()
+	all := append([]*voteBatcher(nil), voteBatchers...)
+	voteBatchersMutex.Unlock()
+
+	var errs []error
+	for _, b := range all {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := b.flush(ctx); err != nil {
+			slog.Error("failed to flush vote batch", "event", "vote_batch", "roomId", b.roomID, "error", err)
+			errs = append(errs, err)
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 書いた回数と投票を数える、voteBatcher の書き込み先の代わり
+type fakeBatchWriter struct {
+	mu      sync.Mutex
+	flushes int
+	votes   []voteWrite
+	fail    int      // この回数だけ失敗する
+	flushed chan int // 書いた投票の数 (読まれなければ捨てる)
+}
+
+func newFakeBatchWriter() *fakeBatchWriter {
+	return &fakeBatchWriter{flushed: make(chan int, 1)}
+}
+
+func (f *fakeBatchWriter) write(ctx context.Context, batch []voteWrite) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail > 0 {
+		f.fail--
+		return errors.New("write failed")
+	}
+	f.flushes++
+	f.votes = append(f.votes, batch...)
+	select {
+	case f.flushed <- len(batch):
+	default:
+	}
+	return nil
+}
+
+func (f *fakeBatchWriter) stats() (flushes int, votes []voteWrite) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flushes, append([]voteWrite(nil), f.votes...)
+}
+
+// 書き込みの goroutine を動かした voteBatcher (テストが終わると止める)
+func startTestBatcher(t *testing.T, interval time.Duration, size int) (*voteBatcher, *fakeBatchWriter) {
+	t.Helper()
+	oldSize := sqliteBatchSize
+	sqliteBatchSize = size
+	f := newFakeBatchWriter()
+	b := &voteBatcher{roomID: "r1", write: f.write, kick: make(chan struct{}, 1)}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(interval, stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+		sqliteBatchSize = oldSize
+	})
+	return b, f
+}
+
+func waitFlush(t *testing.T, f *fakeBatchWriter) int {
+	t.Helper()
+	select {
+	case n := <-f.flushed:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no flush")
+		return 0
+	}
+}
+
+// SQLITE_BATCH_SIZE 票溜まったら interval を待たずに1回で書く
+func TestVoteBatcherFlushesOnSize(t *testing.T) {
+	b, f := startTestBatcher(t, time.Hour, 3)
+	for i := range 3 {
+		b.add(voteWrite{userID: fmt.Sprintf("u%d", i), vote: "hot"})
+	}
+	if n := waitFlush(t, f); n != 3 {
+		t.Errorf("flushed %d votes, want 3", n)
+	}
+	b.add(voteWrite{userID: "u3", vote: "hot"})
+	select {
+	case n := <-f.flushed:
+		t.Errorf("flushed %d votes before the batch was full", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// SQLITE_BATCH_SIZE に届かなくても interval ごとに書く
+func TestVoteBatcherFlushesOnInterval(t *testing.T) {
+	b, f := startTestBatcher(t, 20*time.Millisecond, 100)
+	b.add(voteWrite{userID: "u1", vote: "hot"})
+	b.add(voteWrite{userID: "u2", vote: "cold"})
+	if n := waitFlush(t, f); n != 2 {
+		t.Errorf("flushed %d votes, want 2", n)
+	}
+}
+
+// 書き込みに失敗した投票は捨てずに、後から溜まった投票より先に書き直す
+func TestVoteBatcherRetriesInOrder(t *testing.T) {
+	f := newFakeBatchWriter()
+	f.fail = 1
+	b := &voteBatcher{roomID: "r1", write: f.write, kick: make(chan struct{}, 1)}
+	ctx := context.Background()
+
+	b.add(voteWrite{userID: "u1", vote: "hot"})
+	if err := b.flush(ctx); err == nil {
+		t.Fatal("flush: no error")
+	}
+	b.add(voteWrite{userID: "u2", vote: "cold"})
+	if err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	flushes, votes := f.stats()
+	if flushes != 1 || len(votes) != 2 || votes[0].userID != "u1" || votes[1].userID != "u2" {
+		t.Errorf("flushes %d, votes %v", flushes, votes)
+	}
+	// 溜まっていなければ書かない
+	if err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if flushes, _ := f.stats(); flushes != 1 {
+		t.Errorf("empty flush wrote: flushes %d", flushes)
+	}
+}
+
+// 同時に溜めても、書いている途中に溜めても、投票を取りこぼさず1回ずつ書く
+func TestVoteBatcherConcurrentAdds(t *testing.T) {
+	b, f := startTestBatcher(t, 5*time.Millisecond, 7)
+	const writers, perWriter = 20, 50
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				b.add(voteWrite{userID: fmt.Sprintf("u%d-%d", w, i), vote: "hot"})
+			}
+		}()
+	}
+	wg.Wait()
+	// 終了時と同じく、残りを書いてから数える
+	if err := b.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, votes := f.stats()
+	seen := make(map[string]bool, len(votes))
+	for _, v := range votes {
+		if seen[v.userID] {
+			t.Errorf("%s written twice", v.userID)
+		}
+		seen[v.userID] = true
+	}
+	if len(seen) != writers*perWriter {
+		t.Errorf("wrote %d votes, want %d", len(seen), writers*perWriter)
+	}
+}
+
+// まとめて書く設定でも、投票はすぐ票数に入り、終了時の書き込みでデータベースに残る
+func TestSQLiteBatchedVotesSurviveShutdown(t *testing.T) {
+	oldInterval := sqliteBatchInterval
+	sqliteBatchInterval = time.Hour
+	t.Cleanup(func() { sqliteBatchInterval = oldInterval })
+
+	path := filepath.Join(t.TempDir(), "votes.db")
+	conn, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newSQLiteStore(conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		voteBatchersMutex.Lock()
+		voteBatchers = nil
+		voteBatchersMutex.Unlock()
+	})
+	ctx := context.Background()
+	for i, vote := range []string{"hot", "hot", "cold"} {
+		if err := store.RecordVote(ctx, fmt.Sprintf("u%d", i), vote, 1, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := store.Counts(); !sameCounts(got, map[string]int{"hot": 2, "cold": 1}) {
+		t.Errorf("counts before flush %v", got)
+	}
+
+	if err := flushVoteBatches(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	conn, err = openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reopened, err := newSQLiteStore(conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Counts(); !sameCounts(got, map[string]int{"hot": 2, "cold": 1}) {
+		t.Errorf("counts after reopen %v", got)
+	}
+}
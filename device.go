@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 1台の端末から投票できるユーザーを1人にするか (DEVICE_GUARD=true)
+// 1台のスマホで複数のアカウントを使って票を増やすのを防ぐ。ユーザーごとの1票に加えて端末ごとにも1票に制限する
+//
+// プライバシー: 端末IDはクライアントが X-Device-ID ヘッダーで送る値で、端末を追跡できる識別子になりうる。
+// そのため元の値は保存せずハッシュだけをメモリ上に持ち、DEVICE_GUARD_TTL を過ぎたら消す
+// (ファイルや保存先には書かないので再起動でも消える)。ログにも出さない。
+// 利用規約などで、重複投票を防ぐために端末の識別子を使うことを利用者に知らせること
+var deviceGuard bool
+
+// DEVICE_GUARD_TTL が未設定のときの、端末とユーザーの対応を覚えておく時間
+const defaultDeviceGuardTTL = 24 * time.Hour
+
+// 端末とユーザーの対応を覚えておく時間 (最後の投票から数える)
+var deviceGuardTTL = defaultDeviceGuardTTL
+
+// DEVICE_GUARD のときにクライアントが端末IDを送るヘッダー
+const deviceIDHeader = "X-Device-ID"
+
+// 端末IDの長さの上限
+const maxDeviceIDLength = 256
+
+// 端末で最後に投票したユーザー
+type deviceVote struct {
+	userID string
+	seenAt time.Time
+}
+
+// DEVICE_GUARD と DEVICE_GUARD_TTL を読む。匿名投票モードとは一緒に使えない
+func loadDeviceGuard() error {
+	var err error
+	if deviceGuard, err = envBool("DEVICE_GUARD", false); err != nil || !deviceGuard {
+		return err
+	}
+	if anonymousVoting {
+		return errors.New("DEVICE_GUARD cannot be used with ANONYMOUS_VOTING")
+	}
+	if deviceGuardTTL, err = envDuration("DEVICE_GUARD_TTL", defaultDeviceGuardTTL); err != nil {
+		return err
+	}
+	if deviceGuardTTL <= 0 {
+		return errors.New("DEVICE_GUARD_TTL must be positive")
+	}
+	return nil
+}
+
+// リクエストの端末IDのハッシュを返す。DEVICE_GUARD が無効なら空文字
+// 有効なのにヘッダーが無い (または長すぎる) ときは 400 を書いて false を返す
+// (ヘッダーを付けなければ制限を逃れられてしまうので、無いリクエストは受け付けない)
+func requestDevice(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !deviceGuard {
+		return "", true
+	}
+	id := strings.TrimSpace(r.Header.Get(deviceIDHeader))
+	if id == "" || len(id) > maxDeviceIDLength {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, deviceIDHeader+" header is required")
+		return "", false
+	}
+	return hashUserID(id), true
+}
+
+// この端末から userID が投票してよいか (呼び出し側でロックを取っておくこと)
+// 端末で最後に投票したのが別のユーザーなら、DEVICE_GUARD_TTL が過ぎるまで断る
+func (rm *room) deviceAllows(device, userID string, now time.Time) bool {
+	if device == "" {
+		return true
+	}
+	entry, ok := rm.deviceVotes[device]
+	return !ok || entry.userID == userID || now.Sub(entry.seenAt) >= deviceGuardTTL
+}
+
+// 別のユーザーがこの端末から投票済みなら 409 を書いて false を返す (呼び出し側でロックを取っておくこと)
+func (rm *room) checkDevice(w http.ResponseWriter, device, userID string) bool {
+	if rm.deviceAllows(device, userID, time.Now()) {
+		return true
+	}
+	writeJSONError(w, http.StatusConflict, errCodeDeviceInUse, "Another user has already voted from this device")
+	return false
+}
+
+// 投票を保存した後に、端末で投票したユーザーを記録する (呼び出し側でロックを取っておくこと)
+func (rm *room) bindDevice(device, userID string, now time.Time) {
+	if device != "" {
+		rm.deviceVotes[device] = deviceVote{userID: userID, seenAt: now}
+	}
+}
+
+// DEVICE_GUARD_TTL を過ぎた端末の記録を消す (マップが際限なく大きくならないように)
+func (rm *room) evictStaleDevices(now time.Time) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	for device, entry := range rm.deviceVotes {
+		if now.Sub(entry.seenAt) >= deviceGuardTTL {
+			delete(rm.deviceVotes, device)
+		}
+	}
+}
+
+// 定期的にすべての部屋の古い端末の記録を消す。サーバーが終了すると止まる
+func startDeviceEviction() {
+	interval := min(deviceGuardTTL, time.Hour)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				roomsMutex.Lock()
+				all := make([]*room, 0, len(rooms)+1)
+				all = append(all, defaultRoom)
+				for _, rm := range rooms {
+					all = append(all, rm)
+				}
+				roomsMutex.Unlock()
+
+				for _, rm := range all {
+					rm.evictStaleDevices(now)
+				}
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
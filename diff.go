@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// GET /results/diff のレスポンス形式
+type ResultsDiffResponse struct {
+	Version uint64         `json:"version"` // 次の ?version= に渡す値
+	Full    bool           `json:"full"`    // true なら changed がすべての選択肢 (手元の集計を置き換える)
+	Changed map[string]int `json:"changed"` // ?version= の後に票数が変わった選択肢と今の票数
+	Removed []string       `json:"removed"` // ?version= の後に取り除かれた選択肢
+}
+
+// 選択肢ごとに票数が最後に変わったバージョンを記録する (bumpVersion から呼ぶ。呼び出し側でロックを取っておくこと)
+// 取り除かれた選択肢は、最後の票数を消して、取り除いたバージョンだけを残す
+func (rm *room) trackOptionChanges() {
+	counts := rm.store.Counts()
+	if rm.optionVersions == nil {
+		rm.optionVersions = make(map[string]uint64)
+	}
+	for key, n := range counts {
+		if last, ok := rm.diffCounts[key]; !ok || last != n {
+			rm.optionVersions[key] = rm.version
+		}
+	}
+	for key := range rm.diffCounts {
+		if _, ok := counts[key]; !ok {
+			rm.optionVersions[key] = rm.version
+		}
+	}
+	rm.diffCounts = counts
+}
+
+// バージョン since の後の変更を集める (呼び出し側でロックを取っておくこと)
+// since が 0 か今のバージョンより新しい (再起動で数え直した) ときは、すべての選択肢を返す
+func (rm *room) resultsDiff(since uint64) ResultsDiffResponse {
+	counts := rm.store.Counts()
+	res := ResultsDiffResponse{Version: rm.version, Changed: make(map[string]int), Removed: []string{}}
+	if since == 0 || since > rm.version {
+		res.Full = true
+		res.Changed = counts
+		return res
+	}
+	for key, v := range rm.optionVersions {
+		if v <= since {
+			continue
+		}
+		if n, ok := counts[key]; ok {
+			res.Changed[key] = n
+		} else {
+			res.Removed = append(res.Removed, key)
+		}
+	}
+	return res
+}
+
+// GET /results/diff?version=N エンドポイントの処理 (差分のロングポーリング)
+// 集計のバージョンが N より新しくなるまで待ってから、N の後に票数が変わった選択肢だけを新しいバージョンと一緒に返す
+// クライアントは changed を手元の集計に上書きし、removed を消す。?version が無いか 0 ならすぐにすべての選択肢を返す
+// 待つ時間は ?timeout= (秒、既定と上限は longPollTimeout) で、その間に変わらなければ 304 を返す
+// バージョンは再起動すると 0 から数え直すので、返ってきた version が渡したものより小さければ full で置き換えること
+func (rm *room) resultsDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	since, ok := parseIntParam(w, r, "version", 0, 0, math.MaxInt)
+	if !ok {
+		return
+	}
+	maxSeconds := int(longPollTimeout / time.Second)
+	seconds, ok := parseIntParam(w, r, "timeout", maxSeconds, 1, maxSeconds)
+	if !ok {
+		return
+	}
+	timeout := time.Duration(seconds) * time.Second
+
+	// ロングポーリングと同じく、このリクエストだけ書き込みの期限を延ばす
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		rm.mutex.RLock()
+		version, changed := rm.version, rm.changed
+		if since == 0 || version != uint64(since) {
+			res := rm.resultsDiff(uint64(since))
+			rm.mutex.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		rm.mutex.RUnlock()
+
+		select {
+		case <-changed:
+			// 新しいバージョンを読み直す
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-shuttingDown:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// /rooms/{roomId}/results/diff エンドポイントの処理
+func roomResultsDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsDiffHandler(w, r)
+	}
+}
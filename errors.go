@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// エラーレスポンスの code (クライアントはこちらで分岐する)
+const (
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeInvalidBody      = "invalid_body"
+	errCodeMediaType        = "unsupported_media_type"
+	errCodeNotAcceptable    = "not_acceptable"
+	errCodeInvalidOption    = "invalid_option"
+	errCodeInvalidParameter = "invalid_parameter"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeRateLimited      = "rate_limited"
+	errCodeVotingClosed     = "voting_closed"
+	errCodeVoteConflict     = "vote_conflict"
+	errCodePollFull         = "poll_full"
+	errCodeAlreadyVoted     = "already_voted"
+	errCodeNonceReused      = "nonce_reused"
+	errCodeIdempotencyBusy  = "idempotency_in_progress"
+	errCodeIdempotencyReuse = "idempotency_key_reused"
+	errCodeOptionExists     = "option_exists"
+	errCodeOptionInUse      = "option_in_use"
+	errCodeOptionFull       = "option_full"
+	errCodeDeviceInUse      = "device_in_use"
+	errCodePollExists       = "poll_exists"
+	errCodePollArchived     = "poll_archived"
+	errCodeResultsHidden    = "results_hidden"
+	errCodeChangeCooldown   = "vote_change_cooldown"
+	errCodeSessionRequired  = "session_required"
+	errCodeUnavailable      = "unavailable"
+	errCodeNotImplemented   = "not_implemented"
+	errCodeInternal         = "internal_error"
+)
+
+// エラーレスポンスの形式 { "error": { "code": "...", "message": "..." } }
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"` // リクエストの確認で見つかった、フィールドごとの問題
+}
+
+// JSONのエラーレスポンスを書く
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// GET か HEAD か (HEAD は GET と同じ処理をして、ヘッダーだけを返す)
+// HEAD で書いたボディは net/http が捨てる。ボディが小さければ Content-Length も付く
+func isGetOrHead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// 許可されていないメソッドへの 405
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Invalid request method")
+}
+
+// どのルートにも一致しないリクエストへの 404 (標準のプレーンテキストの代わり)
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Not found")
+}
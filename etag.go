@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /results に ETag を付けるか (RESULTS_ETAG=false で無効)
+var resultsETag = true
+
+// GET /results を CDN などでキャッシュしてよい時間 (RESULTS_MAX_AGE。既定の0ならキャッシュさせない)
+// 設定すると Cache-Control: public, max-age=N を付け、その間は投票しても古い票数が返りうる
+// ライブのイベントで票数をすぐに見せたいときは 1s〜5s 程度にとどめる (SSE や WebSocket はキャッシュしないので、即時性が要る画面はそちらを使う)
+// エラーのレスポンスと、保存先が読めずに古い票数を返すとき (X-Results-Stale) はキャッシュさせない
+// Vary: Accept-Encoding は圧縮のミドルウェアがすべてのレスポンスに付ける
+var resultsMaxAge time.Duration
+
+// RESULTS_MAX_AGE を読む
+func loadResultsMaxAge() error {
+	var err error
+	if resultsMaxAge, err = envDuration("RESULTS_MAX_AGE", 0); err != nil {
+		return err
+	}
+	if resultsMaxAge < 0 {
+		return errors.New("RESULTS_MAX_AGE must not be negative")
+	}
+	if resultsMaxAge%time.Second != 0 {
+		return errors.New("RESULTS_MAX_AGE must be a whole number of seconds")
+	}
+	return nil
+}
+
+// レスポンスの本文から弱い ETag を作る
+// 本文 (票数、受付状態、表示名の言語など) が同じなら同じ値になり、投票で中身が変わったときだけ変わる
+// 圧縮の有無では変えない (弱い ETag は同じ内容であることだけを表す)
+func weakETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// If-None-Match がこの ETag を含むか (弱い比較なので W/ の有無は区別しない)
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// JSON の本文を ETag 付きで書く。If-None-Match が一致すれば本文を送らずに 304 を返す
+// 毎秒取りに来るダッシュボードが同じ内容を何度もダウンロードしなくて済むようにする
+// ETag は tagSource から作る (サーバーの時刻のように毎回変わる部分を除いた本文を渡す)
+// RESULTS_MAX_AGE を設定していれば、その間は確かめずに使ってよいことにする (古い票数のときを除く)
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, body, tagSource []byte) {
+	cacheControl := "no-cache"
+	if resultsMaxAge > 0 && w.Header().Get("X-Results-Stale") == "" {
+		cacheControl = "public, max-age=" + strconv.Itoa(int(resultsMaxAge/time.Second))
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if resultsETag {
+		writeETaggedJSON(w, r, body, tagSource, cacheControl)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// RESULTS_ETAG にかかわらず ETag を付けて書く (GET /options のように、ほとんど変わらない本文用)
+// キャッシュしてもよいが、使う前に毎回確かめてもらう
+func writeCacheableJSON(w http.ResponseWriter, r *http.Request, body, tagSource []byte) {
+	writeETaggedJSON(w, r, body, tagSource, "no-cache")
+}
+
+// ETag と cacheControl を付けて書く。If-None-Match が一致すれば 304 (304 にも同じ Cache-Control を付ける)
+func writeETaggedJSON(w http.ResponseWriter, r *http.Request, body, tagSource []byte, cacheControl string) {
+	w.Header().Set("Content-Type", "application/json")
+	etag := weakETag(tagSource)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+)
+
+// 投票の変更を1件ずつ記録したイベント (vote_events テーブルの1行)
+// Vote が空文字のイベントは取り消し。リセットは投票していた全員分の取り消しとして記録する
+// UserID が空文字のイベントは匿名の1票で、Vote も空文字ならリセット (匿名の票も0に戻す)
+// UserID が空文字で Adjust が0でないイベントは、管理者が Vote の票数を Adjust だけ手で直したもの
+type VoteEvent struct {
+	UserID    string
+	Vote      string
+	Weight    int // 票の重み (重みを記録する前のイベントは0で、1票として扱う)
+	Adjust    int // 手で直した票数の増減 (POST /admin/adjust のときだけ)
+	Timestamp time.Time
+}
+
+// イベントを古い順に適用して票数とユーザーごとの投票を組み立て直す
+// 同じユーザーのイベントは後のものが前のものを置き換える
+// 表示名で記録された投票は選択肢のキーとして数える
+// 現在の選択肢に無いものは票数に含めない (そのユーザーの投票は残す)
+func Replay(events []VoteEvent, options []string) *memoryStore {
+	ctx := context.Background() // メモリ上だけなので待つことはない
+	s := newMemoryStore(options)
+	// 表示名で保存された古い投票だけをキーに読み替える (部屋の選択肢のキーはそのまま使う)
+	canonical := func(vote string) string {
+		if slices.Contains(options, vote) {
+			return vote
+		}
+		return canonicalStoredVote(vote)
+	}
+	for _, e := range events {
+		if e.UserID == "" {
+			if e.Adjust != 0 {
+				s.AdjustCounts(ctx, map[string]int{canonical(e.Vote): e.Adjust}, e.Timestamp)
+				continue
+			}
+			if e.Vote == "" {
+				s.Reset(ctx)
+			} else {
+				s.RecordAnonymousVote(ctx, canonical(e.Vote), normalizeWeight(e.Weight), e.Timestamp)
+			}
+			continue
+		}
+		if e.Vote == "" {
+			// 投票していないユーザーの取り消し (errVoteNotFound) は無視してよい
+			s.DeleteVote(ctx, e.UserID)
+			continue
+		}
+		s.RecordVote(ctx, e.UserID, canonical(e.Vote), normalizeWeight(e.Weight), e.Timestamp)
+	}
+
+	return s
+}
+
+// 部屋のイベントを書き込んだ順に読む
+func loadVoteEvents(conn *sql.DB, roomID string) ([]VoteEvent, error) {
+	rows, err := conn.Query(
+		`SELECT user_id, vote, weight, adjust, at FROM vote_events WHERE room_id = ? ORDER BY id`,
+		roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteEvents(rows)
+}
+
+// 部屋の until 以前のイベントを書き込んだ順に読む (溜めている投票は先に書く)
+func (s *sqliteStore) voteEventsUntil(ctx context.Context, until time.Time) ([]VoteEvent, error) {
+	if err := s.flushBatch(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.conn.QueryContext(ctx,
+		`SELECT user_id, vote, weight, adjust, at FROM vote_events WHERE room_id = ? AND at <= ? ORDER BY id`,
+		s.roomID, unixMilli(until),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanVoteEvents(rows)
+}
+
+func scanVoteEvents(rows *sql.Rows) ([]VoteEvent, error) {
+	defer rows.Close()
+
+	var events []VoteEvent
+	for rows.Next() {
+		var e VoteEvent
+		var at int64
+		if err := rows.Scan(&e.UserID, &e.Vote, &e.Weight, &e.Adjust, &at); err != nil {
+			return nil, err
+		}
+		if at > 0 {
+			e.Timestamp = time.UnixMilli(at)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// 投票を書き込むトランザクションの中でイベントを1件追記する
+func appendVoteEvent(ctx context.Context, tx *sql.Tx, roomID string, e VoteEvent) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO vote_events (room_id, user_id, vote, weight, adjust, at) VALUES (?, ?, ?, ?, ?, ?)`,
+		roomID, e.UserID, e.Vote, normalizeWeight(e.Weight), e.Adjust, unixMilli(e.Timestamp),
+	)
+	return err
+}
+
+// イベントを記録する前の投票を、現在の投票1件ずつのイベントとして一度だけ書き込む
+// (PRAGMA user_version を 2 にして実施済みを記録する)
+func backfillVoteEvents(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= 2 {
+		return nil
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`INSERT INTO vote_events (room_id, user_id, vote, at)
+		 SELECT room_id, user_id, vote, voted_at FROM user_votes ORDER BY voted_at`,
+		`PRAGMA user_version = 2`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 保存先の票数とユーザーごとの投票 (選択肢と重み) が同じか
+func sameStoreState(t *testing.T, got, want VoteStore) {
+	t.Helper()
+	if !maps.Equal(got.Counts(), want.Counts()) {
+		t.Errorf("counts %v, want %v", got.Counts(), want.Counts())
+	}
+	if !maps.Equal(got.WeightedCounts(), want.WeightedCounts()) {
+		t.Errorf("weighted counts %v, want %v", got.WeightedCounts(), want.WeightedCounts())
+	}
+	votes := func(s VoteStore) map[string]voteRecord {
+		out := make(map[string]voteRecord)
+		for userID, v := range s.UserVotes() {
+			out[userID] = voteRecord{Vote: v.Vote, Weight: v.Weight}
+		}
+		return out
+	}
+	if !maps.Equal(votes(got), votes(want)) {
+		t.Errorf("user votes %v, want %v", votes(got), votes(want))
+	}
+}
+
+// 保存先への操作とそれを記録したイベント
+type eventStep struct {
+	apply func(ctx context.Context, s VoteStore, at time.Time) error
+	event VoteEvent
+}
+
+func voteStep(userID, vote string, weight int) eventStep {
+	return eventStep{
+		apply: func(ctx context.Context, s VoteStore, at time.Time) error {
+			return s.RecordVote(ctx, userID, vote, weight, at)
+		},
+		event: VoteEvent{UserID: userID, Vote: vote, Weight: weight},
+	}
+}
+
+func retractStep(userID string) eventStep {
+	return eventStep{
+		apply: func(ctx context.Context, s VoteStore, _ time.Time) error { return s.DeleteVote(ctx, userID) },
+		event: VoteEvent{UserID: userID},
+	}
+}
+
+var eventSteps = []eventStep{
+	voteStep("a", "hot", 1),
+	voteStep("b", "cold", 2),
+	voteStep("a", "ok", 1), // 変更
+	voteStep("c", "hot", 1),
+	retractStep("c"),
+	voteStep("b", "cold", 2), // 同じ選択肢への再投票
+	voteStep("c", "cold", 1),
+}
+
+// イベントを再生した状態は、同じ操作をそのまま適用した状態と同じになる
+func TestReplayMatchesDirectApplication(t *testing.T) {
+	ctx := context.Background()
+	options := currentOptions.Load().keys
+	direct := newMemoryStore(options)
+	var events []VoteEvent
+	at := time.Now()
+	for i, step := range eventSteps {
+		stepAt := at.Add(time.Duration(i) * time.Second)
+		if err := step.apply(ctx, direct, stepAt); err != nil {
+			t.Fatal(err)
+		}
+		e := step.event
+		e.Timestamp = stepAt
+		events = append(events, e)
+	}
+	sameStoreState(t, Replay(events, options), direct)
+
+	// 表示名のイベントはキーとして、リセットは匿名の票も含めて0に戻す
+	events = append(events,
+		VoteEvent{UserID: "d", Vote: "あつい"},
+		VoteEvent{Vote: "ok"},
+		VoteEvent{Vote: "ok", Adjust: 3},
+	)
+	replayed := Replay(events, options)
+	if want := map[string]int{"hot": 1, "ok": 5, "cold": 2}; !maps.Equal(replayed.Counts(), want) {
+		t.Errorf("counts %v, want %v", replayed.Counts(), want)
+	}
+	if vote, _ := replayed.UserVote("d"); vote != "hot" {
+		t.Errorf("label vote replayed as %q, want hot", vote)
+	}
+	replayed = Replay(append(events, VoteEvent{}), options)
+	if replayed.VoterCount() != 0 || !sameCounts(replayed.Counts(), nil) {
+		t.Errorf("after reset: counts %v, voters %d", replayed.Counts(), replayed.VoterCount())
+	}
+}
+
+// SQLite に書いたイベントを読み直すと、書いた保存先と同じ状態になる (起動時の組み立て直し)
+func TestSQLiteEventsRebuildState(t *testing.T) {
+	loadTestConfig(t)
+	ctx := context.Background()
+	conn, err := openDB(filepath.Join(t.TempDir(), "votes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	store, err := newSQLiteStore(conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range eventSteps {
+		if err := step.apply(ctx, store, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := newSQLiteStore(conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameStoreState(t, reopened, store)
+
+	events, err := loadVoteEvents(conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同じ選択肢への再投票は書かない
+	if len(events) != len(eventSteps)-1 {
+		t.Errorf("%d events, want %d", len(events), len(eventSteps)-1)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /results/export で返せる形式
+// 新しい形式はここに足す (Accept が */* や未指定なら先頭の JSON)
+type exportFormat struct {
+	mediaType   string // Accept と比べる値
+	contentType string
+	extension   string // Content-Disposition のファイル名の拡張子
+	write       func(buf *bytes.Buffer, snap resultsSnapshot, lang string) error
+}
+
+var exportFormats = []exportFormat{
+	{mediaType: "application/json", contentType: "application/json", extension: "json", write: writeExportJSON},
+	{mediaType: "text/csv", contentType: "text/csv; charset=utf-8", extension: "csv", write: func(buf *bytes.Buffer, snap resultsSnapshot, _ string) error {
+		return writeCountsCSV(buf, snap.set, snap.counts)
+	}},
+	{mediaType: "text/tab-separated-values", contentType: "text/tab-separated-values; charset=utf-8", extension: "tsv", write: func(buf *bytes.Buffer, snap resultsSnapshot, _ string) error {
+		return writeCountsDelimited(buf, snap.set, snap.counts, '\t')
+	}},
+}
+
+// GET /results と同じ形の JSON (serverTime は付けない)
+func writeExportJSON(buf *bytes.Buffer, snap resultsSnapshot, lang string) error {
+	res := buildResults(snap.set, snap.counts, snap.weighted, lang)
+	res.Status = snap.status
+	if snap.final {
+		res.Final = true
+		res.ClosedAt = snap.closedAt.UTC().Format(time.RFC3339)
+		res.FinalHash = snap.finalHash
+	}
+	return json.NewEncoder(buf).Encode(res)
+}
+
+// Accept ヘッダーから返す形式を決める。返せる形式が無ければ false
+// 形式ごとに、いちばん具体的に一致する範囲 (text/csv > text/* > */*) の q を使い、q の大きいものを選ぶ (同じなら exportFormats の順)
+func negotiateExport(accept string) (exportFormat, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return exportFormats[0], true
+	}
+
+	type weight struct {
+		q           float64
+		specificity int // 0: 一致しない, 1: */*, 2: text/*, 3: text/csv
+	}
+	weights := make([]weight, len(exportFormats))
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for i, f := range exportFormats {
+			specificity := 0
+			switch {
+			case mediaType == f.mediaType:
+				specificity = 3
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(f.mediaType, strings.TrimSuffix(mediaType, "*")):
+				specificity = 2
+			case mediaType == "*/*":
+				specificity = 1
+			}
+			if specificity > weights[i].specificity {
+				weights[i] = weight{q: q, specificity: specificity}
+			}
+		}
+	}
+
+	best := -1
+	for i, w := range weights {
+		if w.specificity > 0 && w.q > 0 && (best < 0 || w.q > weights[best].q) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return exportFormat{}, false
+	}
+	return exportFormats[best], true
+}
+
+// GET /results/export エンドポイントの処理
+// Accept ヘッダーで JSON (既定)、CSV、TSV のどれかを選んで、ファイルとして保存できるように返す
+// どの形式も読み取りロック中にコピーした同じ票数から書き出す。返せる形式が無ければ 406
+func (rm *room) resultsExportHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	format, ok := negotiateExport(r.Header.Get("Accept"))
+	if !ok {
+		writeJSONError(w, http.StatusNotAcceptable, errCodeNotAcceptable, "Supported formats: application/json, text/csv, text/tab-separated-values")
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	rm.ensureFinal(time.Now())
+	snap := rm.snapshotResults(time.Now(), false)
+
+	var buf bytes.Buffer
+	if err := format.write(&buf, snap, requestLanguage(r)); err != nil {
+		slog.ErrorContext(r.Context(), "failed to export results", "roomId", rm.id, "format", format.extension, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to export results")
+		return
+	}
+
+	// JSON の表示名は Accept-Language で変わる
+	w.Header().Add("Vary", "Accept, Accept-Language")
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="results.`+format.extension+`"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// 終了した投票の確定した結果
+// 受付期間が終わったときの票数をコピーして持ち、その後の GET /results などはこのコピーから返す
+// (ライブの票数が何かの理由で変わっても、確定した結果は変わらない)
+type finalResults struct {
+	ClosedAt time.Time
+	Counts   map[string]int
+	Weighted map[string]int
+	Hash     string                    // 確定した票数の改ざん検出用ハッシュ (finalResultsHash を参照)
+	Cohorts  map[string]map[string]int // 確定したときのコホートごとの票数 (ハッシュには含めない)
+}
+
+// 確定した結果のハッシュに使う鍵 (FINAL_RESULTS_KEY。未設定なら鍵なしの SHA-256 にする)
+var finalResultsKey []byte
+
+func loadFinalResultsKey() {
+	if v := os.Getenv("FINAL_RESULTS_KEY"); v != "" {
+		finalResultsKey = []byte(v)
+	}
+}
+
+// 確定した票数の JSON のハッシュ。鍵があれば HMAC-SHA256 にして、鍵を持つ人だけが作れる値にする
+// JSON のマップはキーの順に並ぶので、同じ票数なら常に同じ値になる
+func finalResultsHash(roomID string, closedAt time.Time, counts, weighted map[string]int) string {
+	data, _ := json.Marshal(struct {
+		RoomID   string         `json:"roomId"`
+		ClosedAt string         `json:"closedAt"`
+		Counts   map[string]int `json:"counts"`
+		Weighted map[string]int `json:"weighted"`
+	}{roomID, closedAt.UTC().Format(time.RFC3339), counts, weighted})
+
+	if finalResultsKey != nil {
+		mac := hmac.New(sha256.New, finalResultsKey)
+		mac.Write(data)
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// 受付期間が終わっていて、まだ確定していなければ結果を確定する (呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) freezeIfClosed(now time.Time) {
+	if rm.final != nil || rm.schedule.status(now) != pollStatusClosed {
+		return
+	}
+	closedAt := *rm.schedule.ClosesAt
+	rm.assignCloseDefault(closedAt)
+	counts := rm.store.Counts()
+	weighted := rm.store.WeightedCounts()
+	rm.final = &finalResults{
+		ClosedAt: closedAt,
+		Counts:   counts,
+		Weighted: weighted,
+		Hash:     finalResultsHash(rm.id, closedAt, counts, weighted),
+		Cohorts:  cloneCohortCounts(rm.cohortCounts),
+	}
+	slog.Warn("poll results finalized", "event", "finalize", "roomId", rm.id, "closedAt", closedAt, "counts", counts, "hash", rm.final.Hash)
+}
+
+// 結果を読む前に呼ぶ。終了していれば確定させる (確定が必要なときだけ書き込みロックを取る)
+func (rm *room) ensureFinal(now time.Time) {
+	rm.mutex.RLock()
+	needed := rm.final == nil && rm.schedule.status(now) == pollStatusClosed
+	rm.mutex.RUnlock()
+	if needed {
+		rm.mutex.Lock()
+		rm.freezeIfClosed(now)
+		rm.mutex.Unlock()
+	}
+}
+
+// 結果として返す票数と重み付きの票数 (確定していれば確定した票数のコピー。呼び出し側でロックを取っておくこと)
+func (rm *room) resultCounts() (map[string]int, map[string]int) {
+	if rm.final != nil {
+		return cloneCounts(rm.final.Counts), cloneCounts(rm.final.Weighted)
+	}
+	return rm.store.Counts(), rm.store.WeightedCounts()
+}
+
+// 結果として返すコホートごとの票数 (呼び出し側でロックを取っておくこと)
+func (rm *room) resultCohorts() map[string]map[string]int {
+	if rm.final != nil {
+		return rm.final.Cohorts
+	}
+	return rm.cohortCounts
+}
+
+func cloneCounts(counts map[string]int) map[string]int {
+	out := make(map[string]int, len(counts))
+	for option, n := range counts {
+		out[option] = n
+	}
+	return out
+}
+
+// 確定していれば 409 を書いて false を返す (呼び出し側でロックを取っておくこと)
+// 確定した投票のリセットや受付期間の変更は POST /admin/reopen でやり直してからにする
+func (rm *room) checkNotFinal(w http.ResponseWriter) bool {
+	if rm.final == nil {
+		return true
+	}
+	writeJSONError(w, http.StatusConflict, errCodeVotingClosed, "Poll is closed and its results are final; reopen it first")
+	return false
+}
+
+// POST /admin/reopen のリクエスト形式 (closesAt が無ければ期限なしで再開する)
+type ReopenRequest struct {
+	ClosesAt *time.Time `json:"closesAt"`
+}
+
+// POST /admin/reopen?roomId= エンドポイントの処理
+// 確定した結果を捨てて投票の受付を再開する。票数は終了したときのまま続きから数える
+func adminReopenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	var req ReopenRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+	}
+	now := time.Now()
+	if req.ClosesAt != nil && !req.ClosesAt.After(now) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "closesAt must be in the future")
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if !checkNotArchived(w, rm) {
+		return
+	}
+	rm.freezeIfClosed(now)
+	if rm.final == nil {
+		writeJSONError(w, http.StatusConflict, errCodeInvalidParameter, "Poll is not closed")
+		return
+	}
+	previous := rm.final
+	rm.final = nil
+	rm.schedule.ClosesAt = req.ClosesAt
+	if rm.schedule.OpensAt != nil && rm.schedule.OpensAt.After(now) {
+		rm.schedule.OpensAt = nil
+	}
+	rm.notifySubscribers()
+
+	recordAudit(AuditEntry{Action: "reopen", RoomID: rm.id, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+	slog.WarnContext(r.Context(), "poll reopened", "event", "reopen", "roomId", rm.id, "previousHash", previous.Hash, "closesAt", req.ClosesAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ScheduleResponse{pollSchedule: rm.schedule, Status: rm.schedule.status(now)})
+}
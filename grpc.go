@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC のエラーの ErrorInfo に入れる domain (reason には HTTP と同じエラーの code を入れる)
+const grpcErrorDomain = "mille-feuille"
+
+// GRPC_PORT を読む。未設定なら gRPC サーバーは起動しない ("" を返す)
+// HTTP と同じポートにはできない。TLS は使わないので、外に出すときは TLS を終端するプロキシを前に置くこと
+func loadGRPCAddr(httpAddr string) (string, error) {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		return "", nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid GRPC_PORT %q: must be a number between 1 and 65535", port)
+	}
+	if ":"+port == httpAddr {
+		return "", errors.New("GRPC_PORT must differ from PORT")
+	}
+	return ":" + port, nil
+}
+
+// gRPC サーバーを起動する。待ち受けを始められなければエラーを返す
+// 止めるときは stopGRPCServer を呼ぶ
+func startGRPCServer(addr string) (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(grpcWireCodec{}),
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	)
+	server.RegisterService(&voteServiceDesc, grpcVoteService{})
+
+	slog.Info("grpc server starting", "addr", addr)
+	go func() {
+		if err := server.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			fatal("grpc server failed", "error", err)
+		}
+	}()
+	return server, nil
+}
+
+// 処理中の呼び出しが終わるのを待って gRPC サーバーを止める (ctx の期限が来たら待たずに切る)
+// WatchResults は shuttingDown が閉じられると終わるので、HTTP サーバーの Shutdown と同時に呼ぶこと
+func stopGRPCServer(ctx context.Context, server *grpc.Server) {
+	if server == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("grpc server did not stop in time; closing connections")
+		server.Stop()
+		<-done
+	}
+}
+
+// proto/vote.proto の millefeuille.v1.VoteService
+var voteServiceDesc = grpc.ServiceDesc{
+	ServiceName: "millefeuille.v1.VoteService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Vote",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := new(grpcVoteRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					return srv.(grpcVoteService).Vote(ctx, req.(*grpcVoteRequest))
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/millefeuille.v1.VoteService/Vote"}, handler)
+			},
+		},
+		{
+			MethodName: "ConfirmVote",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := new(grpcConfirmVoteRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					return srv.(grpcVoteService).ConfirmVote(ctx, req.(*grpcConfirmVoteRequest))
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/millefeuille.v1.VoteService/ConfirmVote"}, handler)
+			},
+		},
+		{
+			MethodName: "GetResults",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+				req := new(grpcResultsRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req any) (any, error) {
+					return srv.(grpcVoteService).GetResults(ctx, req.(*grpcResultsRequest))
+				}
+				return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/millefeuille.v1.VoteService/GetResults"}, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchResults",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				req := new(grpcResultsRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(grpcVoteService).WatchResults(req, stream)
+			},
+		},
+	},
+	Metadata: "proto/vote.proto",
+}
+
+// 呼び出しごとの時間を HTTP と同じヒストグラム (handler="grpc_<メソッド名>") に記録し、panic をエラーにする
+func grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res any, err error) {
+	defer recoverGRPCPanic(ctx, info.FullMethod, &err)
+	start := time.Now()
+	res, err = handler(ctx, req)
+	requestDuration.WithLabelValues(grpcHandlerName(info.FullMethod)).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+// ストリームは開いている時間が長いので、panic をエラーにするだけにする
+func grpcStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverGRPCPanic(ss.Context(), info.FullMethod, &err)
+	return handler(srv, ss)
+}
+
+func recoverGRPCPanic(ctx context.Context, method string, err *error) {
+	if p := recover(); p != nil {
+		slog.ErrorContext(ctx, "panic in grpc handler", "event", "panic", "method", method, "panic", p, "stack", string(debug.Stack()))
+		*err = grpcError(http.StatusInternalServerError, errCodeInternal, "Internal server error")
+	}
+}
+
+// "/millefeuille.v1.VoteService/GetResults" → "grpc_get_results"
+func grpcHandlerName(fullMethod string) string {
+	name := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	var b strings.Builder
+	b.WriteString("grpc")
+	for _, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			b.WriteByte('_')
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// HTTP のステータスとエラーの code から gRPC のエラーを作る (エラーの code は ErrorInfo の reason に入れる)
+func grpcError(httpStatus int, code, message string) error {
+	c := codes.Internal
+	switch httpStatus {
+	case http.StatusBadRequest:
+		c = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		c = codes.Unauthenticated
+	case http.StatusForbidden:
+		c = codes.PermissionDenied
+	case http.StatusNotFound:
+		c = codes.NotFound
+	case http.StatusConflict:
+		c = codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		c = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		c = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		c = codes.DeadlineExceeded
+	}
+	st := status.New(c, message)
+	if withInfo, err := st.WithDetails(&errdetails.ErrorInfo{Reason: code, Domain: grpcErrorDomain}); err == nil {
+		st = withInfo
+	}
+	return st.Err()
+}
+
+// gRPC の呼び出しを HTTP のハンドラーに渡すリクエストにする
+// メタデータはヘッダーに (authorization, x-admin-key, x-device-id など)、接続元は RemoteAddr に入れるので、
+// 認証・管理用キー・レート制限・TRUSTED_PROXIES は HTTP と同じに働く
+func grpcHTTPRequest(ctx context.Context, method, path string, body []byte) *http.Request {
+	id := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get("x-request-id"); len(ids) > 0 && requestIDPattern.MatchString(ids[0]) {
+		id = ids[0]
+	}
+	if id == "" {
+		id = uuid.NewString()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+	r, _ := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		for _, v := range values {
+			r.Header.Add(key, v)
+		}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r
+}
+
+// 部屋IDから部屋を探す (空なら既定の投票)。create が true なら無い場合に作成する
+func grpcRoom(roomID string, create bool) (*room, error) {
+	if roomID == "" {
+		return defaultRoom, nil
+	}
+	if !roomIDPattern.MatchString(roomID) {
+		return nil, grpcError(http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+	}
+	rm, err := getRoom(roomID, create)
+	if errors.Is(err, errRoomNotFound) {
+		return nil, grpcError(http.StatusNotFound, errCodeNotFound, "Room not found")
+	}
+	if err != nil {
+		slog.Error("failed to open room", "roomId", roomID, "error", err)
+		return nil, grpcError(http.StatusInternalServerError, errCodeInternal, "Failed to open room")
+	}
+	return rm, nil
+}
+
+// 結果を隠している間は PermissionDenied を返す
+func (rm *room) grpcCheckResultsRevealed(r *http.Request) error {
+	rm.mutex.RLock()
+	hidden := rm.resultsHidden(r)
+	rm.mutex.RUnlock()
+	if hidden {
+		return grpcError(http.StatusForbidden, errCodeResultsHidden, fmt.Sprintf("Results are hidden until %d votes are in", minReveal))
+	}
+	return nil
+}
+
+// millefeuille.v1.VoteService の実装 (HTTP のハンドラーと同じ部屋・保存先・ロックを使う)
+type grpcVoteService struct{}
+
+// 投票は POST /v1/vote のハンドラーをそのまま通し、確認や記録の処理を HTTP と分けないようにする
+func (grpcVoteService) Vote(ctx context.Context, req *grpcVoteRequest) (*grpcVoteResponse, error) {
+	handler, path := defaultRoom.voteRouteHandler, "/v1/vote"
+	if req.RoomID != "" {
+		if !roomIDPattern.MatchString(req.RoomID) {
+			return nil, grpcError(http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		}
+		// 部屋は POST /rooms/{roomId}/vote と同じく、投票を確かめてから作る
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			r.SetPathValue("roomId", req.RoomID)
+			roomVoteHandler(w, r)
+		}
+		path = "/v1/rooms/" + req.RoomID + "/vote"
+	}
+	body, _ := json.Marshal(VoteRequest{UserID: req.UserID, Vote: req.Vote, Nonce: req.Nonce, Comment: req.Comment, Cohort: req.Cohort})
+	return grpcCallVoteHandler(ctx, limitPerIP(handler), path, body)
+}
+
+// 保留した投票を POST /v1/vote/confirm のハンドラーで確定する (VOTE_CONFIRM_TTL のとき)
+func (grpcVoteService) ConfirmVote(ctx context.Context, req *grpcConfirmVoteRequest) (*grpcVoteResponse, error) {
+	rm, err := grpcRoom(req.RoomID, false)
+	if err != nil {
+		return nil, err
+	}
+	path := "/v1/vote/confirm"
+	if rm.id != "" {
+		path = "/v1/rooms/" + rm.id + "/vote/confirm"
+	}
+	body, _ := json.Marshal(ConfirmVoteRequest{Token: req.Token})
+	return grpcCallVoteHandler(ctx, limitPerIP(rm.confirmVoteHandler), path, body)
+}
+
+// 投票のハンドラーを呼び、レスポンスを VoteResponse にする (保留したときは status が "pending" で確認用のトークンが入る)
+func grpcCallVoteHandler(ctx context.Context, handler http.HandlerFunc, path string, body []byte) (*grpcVoteResponse, error) {
+	r := grpcHTTPRequest(ctx, http.MethodPost, path, body)
+	res := newBufferedResponse()
+	handler(res, r)
+
+	switch res.statusCode() {
+	case http.StatusOK, http.StatusCreated:
+		var vote VoteResponse
+		if err := json.Unmarshal(res.body.Bytes(), &vote); err != nil {
+			return nil, grpcError(http.StatusInternalServerError, errCodeInternal, "Failed to read vote response")
+		}
+		return &grpcVoteResponse{Status: vote.Status, Counts: vote.Counts, ReceiptID: vote.ReceiptID, CountsHidden: vote.Counts == nil}, nil
+	case http.StatusAccepted:
+		var pending PendingVoteResponse
+		if err := json.Unmarshal(res.body.Bytes(), &pending); err != nil {
+			return nil, grpcError(http.StatusInternalServerError, errCodeInternal, "Failed to read vote response")
+		}
+		return &grpcVoteResponse{Status: pending.Status, ConfirmationToken: pending.ConfirmationToken}, nil
+	}
+	var failure ErrorResponse
+	json.Unmarshal(res.body.Bytes(), &failure)
+	if retryAfter := res.Header().Get("Retry-After"); retryAfter != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter))
+	}
+	return nil, grpcError(res.statusCode(), failure.Error.Code, failure.Error.Message)
+}
+
+// GET /v1/results と同じ票数を返す (終了した投票は確定した票数)
+func (grpcVoteService) GetResults(ctx context.Context, req *grpcResultsRequest) (*grpcResults, error) {
+	rm, err := grpcRoom(req.RoomID, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := rm.grpcCheckResultsRevealed(grpcHTTPRequest(ctx, http.MethodGet, "/v1/results", nil)); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rm.ensureFinal(now)
+	snap := rm.snapshotResults(now, false)
+	return newGRPCResults(rm.id, snap.counts), nil
+}
+
+// SSE / WebSocket と同じ購読者の仕組みで、票が変わるたびに集計を送る
+// 遅いクライアントには途中の集計を飛ばして最新のものだけを送る。サーバーが終了すると終わる
+func (grpcVoteService) WatchResults(req *grpcResultsRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	rm, err := grpcRoom(req.RoomID, false)
+	if err != nil {
+		return err
+	}
+	if err := rm.grpcCheckResultsRevealed(grpcHTTPRequest(ctx, http.MethodGet, "/v1/results/stream", nil)); err != nil {
+		return err
+	}
+
+	if !acquireStream() {
+		stream.SetTrailer(metadata.Pairs("retry-after", strconv.Itoa(int(streamRetryAfter/time.Second))))
+		return grpcError(http.StatusServiceUnavailable, errCodeUnavailable, "Too many open streams")
+	}
+	defer releaseStream()
+
+	ch, initial := rm.subscribe()
+	defer rm.unsubscribe(ch)
+
+	send := func(data []byte) error {
+		var counts map[string]int
+		if err := json.Unmarshal(data, &counts); err != nil {
+			return grpcError(http.StatusInternalServerError, errCodeInternal, "Failed to read counts")
+		}
+		return stream.SendMsg(newGRPCResults(rm.id, counts))
+	}
+	if err := send(initial); err != nil {
+		return err
+	}
+	for {
+		select {
+		case data := <-ch:
+			if err := send(data); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		case <-shuttingDown:
+			return nil
+		}
+	}
+}
+
+func newGRPCResults(roomID string, counts map[string]int) *grpcResults {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return &grpcResults{RoomID: roomID, Counts: counts, Total: total}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// proto/vote.proto のメッセージを protowire で直接読み書きする (protoc を使わずにビルドできるように)
+// フィールド番号は proto/vote.proto と合わせること。知らないフィールドは読み飛ばす
+
+// サーバーが受け取るメッセージ
+type wireUnmarshaler interface {
+	unmarshalWire(data []byte) error
+}
+
+// サーバーが返すメッセージ
+type wireMarshaler interface {
+	marshalWire() []byte
+}
+
+// gRPC サーバーで使うコーデック (名前は標準のものと同じ "proto" にして、普通のクライアントとやり取りできるようにする)
+type grpcWireCodec struct{}
+
+func (grpcWireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot marshal %T", v)
+	}
+	return m.marshalWire(), nil
+}
+
+func (grpcWireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireUnmarshaler)
+	if !ok {
+		return fmt.Errorf("grpc: cannot unmarshal %T", v)
+	}
+	return m.unmarshalWire(data)
+}
+
+func (grpcWireCodec) Name() string { return "proto" }
+
+// 文字列のフィールドだけのメッセージを読む (fields にフィールド番号ごとの書き込み先を渡す)
+func unmarshalStringFields(data []byte, fields map[protowire.Number]*string) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if dst, ok := fields[num]; ok && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			*dst = v
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendIntField(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// map<string, int64> のフィールドを書く (同じ集計が同じバイト列になるよう、キーの順に並べる)
+func appendCountsField(b []byte, num protowire.Number, counts map[string]int) []byte {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		var entry []byte
+		entry = appendStringField(entry, 1, key)
+		entry = appendIntField(entry, 2, int64(counts[key]))
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// millefeuille.v1.VoteRequest
+type grpcVoteRequest struct {
+	RoomID  string
+	UserID  string
+	Vote    string
+	Nonce   string
+	Comment string
+	Cohort  string
+}
+
+func (m *grpcVoteRequest) unmarshalWire(data []byte) error {
+	return unmarshalStringFields(data, map[protowire.Number]*string{
+		1: &m.RoomID, 2: &m.UserID, 3: &m.Vote, 4: &m.Nonce, 5: &m.Comment, 6: &m.Cohort,
+	})
+}
+
+// millefeuille.v1.VoteResponse
+type grpcVoteResponse struct {
+	Status            string
+	Counts            map[string]int
+	ReceiptID         string
+	CountsHidden      bool
+	ConfirmationToken string
+}
+
+func (m *grpcVoteResponse) marshalWire() []byte {
+	var b []byte
+	b = appendStringField(b, 1, m.Status)
+	b = appendCountsField(b, 2, m.Counts)
+	b = appendStringField(b, 3, m.ReceiptID)
+	if m.CountsHidden {
+		b = appendIntField(b, 4, 1)
+	}
+	b = appendStringField(b, 5, m.ConfirmationToken)
+	return b
+}
+
+// millefeuille.v1.ConfirmVoteRequest
+type grpcConfirmVoteRequest struct {
+	RoomID string
+	Token  string
+}
+
+func (m *grpcConfirmVoteRequest) unmarshalWire(data []byte) error {
+	return unmarshalStringFields(data, map[protowire.Number]*string{1: &m.RoomID, 2: &m.Token})
+}
+
+// millefeuille.v1.ResultsRequest
+type grpcResultsRequest struct {
+	RoomID string
+}
+
+func (m *grpcResultsRequest) unmarshalWire(data []byte) error {
+	return unmarshalStringFields(data, map[protowire.Number]*string{1: &m.RoomID})
+}
+
+// millefeuille.v1.Results
+type grpcResults struct {
+	RoomID string
+	Counts map[string]int
+	Total  int
+}
+
+func (m *grpcResults) marshalWire() []byte {
+	var b []byte
+	b = appendStringField(b, 1, m.RoomID)
+	b = appendCountsField(b, 2, m.Counts)
+	b = appendIntField(b, 3, int64(m.Total))
+	return b
+}
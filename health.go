@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// 1つの確認にかけてよい時間
+const readinessCheckTimeout = time.Second
+
+// /readyz で確認する保存先など (main で登録する)
+// 投票のロックは取らないので、投票が混んでいてもすぐに応答できる
+var readinessChecks = map[string]func(context.Context) error{}
+
+// GET /healthz エンドポイントの処理 (サーバーが動いていれば200)
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// GET /readyz エンドポイントの処理
+// 登録された確認がすべて通れば200、1つでも失敗すれば503
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	status := http.StatusOK
+	checks := make(map[string]string, len(readinessChecks))
+	for name, check := range readinessChecks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+		err := check(ctx)
+		cancel()
+		if err != nil {
+			slog.WarnContext(r.Context(), "readiness check failed", "event", "readiness", "check", name, "error", err)
+			checks[name] = err.Error()
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		checks[name] = "ok"
+	}
+
+	res := map[string]any{"status": "ok", "checks": checks}
+	if status != http.StatusOK {
+		res["status"] = "unavailable"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
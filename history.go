@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HISTORY_INTERVAL / HISTORY_SIZE が未設定のときの値 (1分ごとに24時間分)
+// 部屋ごとに最大 historySize 個の票数のコピーを持つので、
+// メモリは 部屋数 × historySize × 選択肢数 で頭打ちになる (古いものから上書きする)
+const (
+	defaultHistoryInterval = time.Minute
+	defaultHistorySize     = 24 * 60
+)
+
+// GET /results/history の既定値と、1回で返す点の上限
+const (
+	defaultHistoryBucket = 5 * time.Minute
+	defaultHistoryWindow = time.Hour
+	maxHistoryPoints     = 1000
+)
+
+var (
+	// 票数を記録する間隔
+	historyInterval = defaultHistoryInterval
+	// 部屋ごとに残す記録の数
+	historySize = defaultHistorySize
+)
+
+// ある時点の票数
+type historySnapshot struct {
+	at     time.Time
+	counts map[string]int
+}
+
+// 票数の記録を固定長のリングバッファで持つ
+// 投票のロックとは別のロックで守る (記録中に投票を待たせない)
+type resultsHistory struct {
+	mu        sync.Mutex
+	snapshots []historySnapshot
+	next      int // 次に書き込む位置 (一周したら古いものを上書きする)
+}
+
+func (h *resultsHistory) record(at time.Time, counts map[string]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := historySnapshot{at: at, counts: counts}
+	if len(h.snapshots) < historySize {
+		h.snapshots = append(h.snapshots, s)
+		return
+	}
+	h.snapshots[h.next] = s
+	h.next = (h.next + 1) % len(h.snapshots)
+}
+
+// 古い順の記録のコピー
+func (h *resultsHistory) ordered() []historySnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make([]historySnapshot, 0, len(h.snapshots))
+	out = append(out, h.snapshots[h.next:]...)
+	return append(out, h.snapshots[:h.next]...)
+}
+
+// 現在の票数を部屋の記録に追加する
+func (rm *room) recordHistory(now time.Time) {
+	rm.mutex.RLock()
+	counts := rm.store.Counts()
+	rm.mutex.RUnlock()
+	rm.history.record(now, counts)
+}
+
+// historyInterval ごとにすべての部屋の票数を記録する。サーバーが終了すると止まる
+func startHistorySampler() {
+	go func() {
+		ticker := time.NewTicker(historyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				roomsMutex.Lock()
+				all := make([]*room, 0, len(rooms)+1)
+				all = append(all, defaultRoom)
+				for _, rm := range rooms {
+					all = append(all, rm)
+				}
+				roomsMutex.Unlock()
+
+				for _, rm := range all {
+					rm.recordHistory(now)
+				}
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// GET /results/history の1点
+type HistoryPoint struct {
+	Timestamp string         `json:"timestamp"` // RFC3339
+	Counts    map[string]int `json:"counts"`
+}
+
+// GET /results/history?bucket=5m&window=1h エンドポイントの処理
+// window 前から bucket ごとに、その時点での票数を古い順に返す (最後の点は現在の票数)
+// 記録は historyInterval ごとなので、各点はその時刻以前の最新の記録になる
+// サーバーの起動前や記録の保持期間より前の時刻は含めない
+func (rm *room) resultsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	bucket, ok := parseDurationParam(w, r, "bucket", defaultHistoryBucket)
+	if !ok {
+		return
+	}
+	window, ok := parseDurationParam(w, r, "window", defaultHistoryWindow)
+	if !ok {
+		return
+	}
+	if bucket < historyInterval {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "bucket must be at least "+historyInterval.String())
+		return
+	}
+	if window/bucket > maxHistoryPoints {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Too many buckets")
+		return
+	}
+
+	snapshots := rm.history.ordered()
+	rm.mutex.RLock()
+	current := rm.store.Counts()
+	rm.mutex.RUnlock()
+
+	now := time.Now()
+	points := []HistoryPoint{}
+	i := 0
+	var latest *historySnapshot
+	for t := now.Add(-window); t.Before(now); t = t.Add(bucket) {
+		for i < len(snapshots) && !snapshots[i].at.After(t) {
+			latest = &snapshots[i]
+			i++
+		}
+		if latest == nil {
+			continue
+		}
+		points = append(points, HistoryPoint{Timestamp: t.UTC().Format(time.RFC3339), Counts: latest.counts})
+	}
+	points = append(points, HistoryPoint{Timestamp: now.UTC().Format(time.RFC3339), Counts: current})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(points)
+}
+
+// GET /results/at のレスポンス形式
+type ResultsAtResponse struct {
+	At            string                  `json:"at"` // 票数を組み立てた時刻 (RFC3339, UTC)
+	Options       map[string]OptionResult `json:"options"`
+	Total         int                     `json:"total"`
+	WeightedTotal int                     `json:"weightedTotal"`
+	Events        int                     `json:"events"` // 適用したイベントの数
+}
+
+// GET /results/at?t=<RFC3339> エンドポイントの処理
+// vote_events を t まで書き込んだ順に適用し直して、その時点の票数を返す (票数は現在の選択肢で数える)
+// イベントを残すのは SQLite の保存先だけで、それ以外は 501。t が未来なら 400
+// 呼ぶたびに部屋のイベントを最初から読んで数え直すので、時間もメモリもイベントの数に比例する
+// イベントが何十万件もある部屋で頻繁に呼ぶ用途には向かない (間隔の決まった推移は GET /results/history を使う)
+func (rm *room) resultsAtHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	v := r.URL.Query().Get("t")
+	if v == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "t is required")
+		return
+	}
+	at, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid t timestamp")
+		return
+	}
+	if at.After(time.Now()) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "t must not be in the future")
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	events, err := storeVoteEventsUntil(ctx, rm.store, at)
+	if errors.Is(err, errEventsNotRecorded) {
+		writeJSONError(w, http.StatusNotImplemented, errCodeNotImplemented, "Vote events are only recorded by the SQLite store")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to load vote events", "roomId", rm.id, "error", err)
+		writeStoreError(w, err, "Failed to load vote events")
+		return
+	}
+
+	rm.mutex.RLock()
+	set := rm.optionSet()
+	rm.mutex.RUnlock()
+
+	replayed := Replay(events, set.keys)
+	res := buildResults(set, replayed.Counts(), replayed.WeightedCounts(), requestLanguage(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ResultsAtResponse{
+		At:            at.UTC().Format(time.RFC3339),
+		Options:       res.Options,
+		Total:         res.Total,
+		WeightedTotal: res.WeightedTotal,
+		Events:        len(events),
+	})
+}
+
+// クエリパラメータを正の時間として読む。不正ならエラーレスポンスを書いて false を返す
+func parseDurationParam(w http.ResponseWriter, r *http.Request, name string, def time.Duration) (time.Duration, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid "+name+" duration")
+		return 0, false
+	}
+	return d, true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 投票の再試行を安全にするヘッダー
+// 同じキーのリクエストが idempotencyTTL 以内にもう一度届いたら、投票をやり直さずに最初のレスポンスをそのまま返す
+// (nonce は再送を断るが、こちらは最初の結果を返す。電波の悪いところでクライアントが再試行する用)
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// 返したレスポンスが覚えておいたものであることを知らせるヘッダー
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// IDEMPOTENCY_TTL が未設定のときの、レスポンスを覚えておく時間
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// Idempotency-Key の長さの上限
+const maxIdempotencyKeyLength = 255
+
+// 同時に覚えておくレスポンスの数の上限 (超えた分は覚えずにそのまま処理する)
+const maxIdempotencyEntries = 100000
+
+// レスポンスを覚えておく時間 (IDEMPOTENCY_TTL で設定する。0 なら Idempotency-Key を無視する)
+var idempotencyTTL = defaultIdempotencyTTL
+
+// 1つのキーで覚えているレスポンス
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte // ボディのハッシュ (同じキーで別のリクエストが来たら断る)
+	done        chan struct{}     // 最初のリクエストの処理が終わると閉じる
+	status      int
+	header      http.Header
+	body        []byte
+	expiresAt   time.Time
+}
+
+// キーごとのレスポンスを ttl の間だけ覚えておく
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+var idempotentResponses = &idempotencyCache{entries: make(map[string]*idempotentResponse)}
+
+// IDEMPOTENCY_TTL を読む
+func loadIdempotencyTTL() error {
+	var err error
+	if idempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", defaultIdempotencyTTL); err != nil {
+		return err
+	}
+	if idempotencyTTL < 0 {
+		return errors.New("IDEMPOTENCY_TTL must not be negative")
+	}
+	return nil
+}
+
+// キーのレスポンスを取り出す。無ければ処理中として登録して (nil, true) を返す
+// 覚えておく数が上限に達していて登録できなければ (nil, false)
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte, now time.Time) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && (entry.expiresAt.IsZero() || now.Before(entry.expiresAt)) {
+		return entry, true
+	}
+	if len(c.entries) >= maxIdempotencyEntries {
+		return nil, false
+	}
+	c.entries[key] = &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	return nil, true
+}
+
+// 処理の終わったリクエストのレスポンスを覚える。覚えないもの (keep=false) はキーを忘れて、次の再試行でやり直させる
+func (c *idempotencyCache) finish(key string, res *bufferedResponse, keep bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[key]
+	if keep {
+		entry.status = res.statusCode()
+		entry.header = res.Header().Clone()
+		entry.body = res.body.Bytes()
+		entry.expiresAt = now.Add(idempotencyTTL)
+	} else {
+		delete(c.entries, key)
+	}
+	close(entry.done)
+}
+
+// 期限を過ぎたレスポンスを忘れる (処理中のものは残す)
+func (c *idempotencyCache) evictExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// 定期的に evictExpired を呼ぶ。サーバーが終了すると止まる
+func (c *idempotencyCache) startEviction() {
+	go func() {
+		ticker := time.NewTicker(min(idempotencyTTL, time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.evictExpired(now)
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// 投票のエンドポイントで Idempotency-Key を扱うミドルウェア
+// キーはメソッド・パス・Authorization ごとに区別する (別のユーザーが同じキーを使っても他人のレスポンスは返さない)
+// 同じキーでボディが違えば 422、最初のリクエストがまだ処理中なら 409
+// 5xx と 429 は覚えずに、再試行でやり直させる
+func idempotent(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || idempotencyTTL <= 0 {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Idempotency-Key is too long")
+			return
+		}
+
+		// ボディは handler の上限まで読んでおき、handler にはそのまま渡す
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "Failed to read body")
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if int64(len(body)) > maxBytes {
+			// 大きすぎるボディは handler が断るので覚えない
+			next(w, r)
+			return
+		}
+
+		auth := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+		scope := r.Method + "\x00" + r.URL.Path + "\x00" + string(auth[:]) + "\x00" + key
+		fingerprint := sha256.Sum256(body)
+
+		entry, ok := idempotentResponses.begin(scope, fingerprint, time.Now())
+		if !ok {
+			slog.WarnContext(r.Context(), "idempotency cache full; processing without it", "event", "idempotency")
+			next(w, r)
+			return
+		}
+		if entry != nil {
+			replayIdempotent(w, r, entry, fingerprint)
+			return
+		}
+
+		// handler が panic しても処理中のまま残らないように、必ず finish する
+		res := newBufferedResponse()
+		keep := false
+		defer func() { idempotentResponses.finish(scope, res, keep, time.Now()) }()
+		next(res, r)
+		status := res.statusCode()
+		keep = status < http.StatusInternalServerError && status != http.StatusTooManyRequests
+
+		for name, values := range res.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+		w.Write(res.body.Bytes())
+	}
+}
+
+// 覚えておいたレスポンスを書く
+func replayIdempotent(w http.ResponseWriter, r *http.Request, entry *idempotentResponse, fingerprint [sha256.Size]byte) {
+	if entry.fingerprint != fingerprint {
+		writeJSONError(w, http.StatusUnprocessableEntity, errCodeIdempotencyReuse, "Idempotency-Key was already used for a different request")
+		return
+	}
+	select {
+	case <-entry.done:
+	default:
+		writeJSONError(w, http.StatusConflict, errCodeIdempotencyBusy, "A request with this Idempotency-Key is still in progress")
+		return
+	}
+	slog.InfoContext(r.Context(), "idempotent request replayed", "event", "idempotency", "status", entry.status)
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
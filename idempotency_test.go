@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestIdempotentVote(t *testing.T) {
+	srv := newTestServer(t)
+	key := header{idempotencyKeyHeader: "k1"}
+
+	first, firstBody := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u1", Vote: "hot"}, key)
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first: status %d: %s", first.StatusCode, firstBody)
+	}
+	// 変更した後に同じキーで送り直すと、最初のレスポンスをそのまま返して記録し直さない
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK)
+	again, againBody := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u1", Vote: "hot"}, key)
+	if again.StatusCode != first.StatusCode || !bytes.Equal(againBody, firstBody) {
+		t.Errorf("replay: %d %s, want %d %s", again.StatusCode, againBody, first.StatusCode, firstBody)
+	}
+	if got := again.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("replay Content-Type %q", got)
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"cold": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+
+	// 同じキーで別のボディは 422
+	res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u1", Vote: "ok"}, key)
+	if res.StatusCode != http.StatusUnprocessableEntity || errorCode(t, data) != errCodeIdempotencyReuse {
+		t.Errorf("reused key: %d %s, want 422 %s", res.StatusCode, data, errCodeIdempotencyReuse)
+	}
+
+	// 断ったレスポンス (429 以外の 4xx) も覚えて、同じキーには同じものを返す
+	badKey := header{idempotencyKeyHeader: "k2"}
+	for range 2 {
+		res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u2", Vote: "warm"}, badKey)
+		if res.StatusCode != http.StatusBadRequest || errorCode(t, data) != errCodeInvalidOption {
+			t.Errorf("invalid vote: %d %s, want 400 %s", res.StatusCode, data, errCodeInvalidOption)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// true ならログに出すユーザーIDをハッシュにする (LOG_REDACT_USER_IDS=true)
+var redactUserIDs bool
+
+// JSON形式のロガーを既定のロガーにする
+// LOG_LEVEL (debug, info, warn, error) で出力するレベルを変えられる。本番で投票ごとの info を止めたいときは warn にする
+func setupLogging() error {
+	level := slog.LevelInfo
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q: %w", v, err)
+		}
+	}
+	redactUserIDs = strings.EqualFold(os.Getenv("LOG_REDACT_USER_IDS"), "true")
+
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(requestIDLogHandler{sampledLogHandler{handler}}))
+	return nil
+}
+
+// *Context のログにリクエストIDを付ける slog.Handler
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("requestId", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
+
+// ログに出すユーザーID (設定によってはSHA-256の先頭だけにする)
+// JSON のログでも改行を含む値は読み手やツールを惑わせるので、制御文字は "?" に置き換える
+func logUserID(userID string) string {
+	if !redactUserIDs {
+		return sanitizeLogValue(userID)
+	}
+	return hashUserID(userID)
+}
+
+// ログに出す値の改行などの制御文字を "?" に置き換える (クライアントから届いた値を1行に収めるため)
+func sanitizeLogValue(v string) string {
+	if strings.IndexFunc(v, unicode.IsControl) < 0 {
+		return v
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, v)
+}
+
+// ユーザーIDを元に戻せない短いハッシュにする
+func hashUserID(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// エラーを記録して異常終了する
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+)
+
+// 投票のログを残す割合 (VOTE_LOG_SAMPLE で設定する。1 ならすべて、0.1 なら10件に1件)
+// 人の多い投票では1票ごとの info とアクセスログが多すぎるので間引く
+// warn 以上のログ、エラーになったリクエストのアクセスログ、管理操作のログは間引かない
+var voteLogSample = 1.0
+
+// false なら同じ選択肢への再投票のログを出さない (VOTE_LOG_UNCHANGED=false。票数の変わった投票だけ残す)
+var voteLogUnchanged = true
+
+// VOTE_LOG_SAMPLE と VOTE_LOG_UNCHANGED を読む
+func loadVoteLogSampling() error {
+	var err error
+	if voteLogSample, err = envFloat("VOTE_LOG_SAMPLE", 1); err != nil {
+		return err
+	}
+	if voteLogSample < 0 || voteLogSample > 1 {
+		return fmt.Errorf("VOTE_LOG_SAMPLE must be between 0 and 1")
+	}
+	if voteLogUnchanged, err = envBool("VOTE_LOG_UNCHANGED", true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// リクエストのログを残すかどうかを持つ context のキー
+type logSampledKey struct{}
+
+// リクエストのログを残すかどうかを先に決めて ctx に入れる
+// 同じリクエストの投票のログとアクセスログは、両方残すか両方出さないかにする (片方だけだと追えないため)
+func withLogSample(ctx context.Context) context.Context {
+	return context.WithValue(ctx, logSampledKey{}, rand.Float64() < voteLogSample)
+}
+
+// 投票のログを残すか (ctx で決めていなければ、その場で voteLogSample の割合で決める)
+func logSampled(ctx context.Context) bool {
+	if voteLogSample >= 1 {
+		return true
+	}
+	if sampled, ok := ctx.Value(logSampledKey{}).(bool); ok {
+		return sampled
+	}
+	return rand.Float64() < voteLogSample
+}
+
+// 投票を受け付けるエンドポイントか (ルートのパターンとメソッドで見分ける。読み出しは間引かない)
+func isVoteRoute(r *http.Request) bool {
+	if isGetOrHead(r) {
+		return false
+	}
+	for _, suffix := range []string{"/vote", "/vote/batch", "/vote/confirm", "/vote/{userId}"} {
+		if strings.HasSuffix(r.Pattern, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// event が vote の info 以下のログを間引く slog.Handler
+type sampledLogHandler struct {
+	slog.Handler
+}
+
+func (h sampledLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn && !keepVoteLog(ctx, record) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h sampledLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return sampledLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h sampledLogHandler) WithGroup(name string) slog.Handler {
+	return sampledLogHandler{h.Handler.WithGroup(name)}
+}
+
+// 投票のログでなければ常に true
+func keepVoteLog(ctx context.Context, record slog.Record) bool {
+	var event, status string
+	record.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case "event":
+			event = a.Value.String()
+		case "status":
+			status = a.Value.String()
+		}
+		return true
+	})
+	if event != "vote" {
+		return true
+	}
+	if status == voteStatusUnchanged && !voteLogUnchanged {
+		return false
+	}
+	return logSampled(ctx)
+}
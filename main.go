@@ -1,116 +1,1441 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
-	"sync"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/rs/cors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
 )
 
-// Flutterから受け取る投票リクエストの形式
-type VoteRequest struct {
-	UserID string `json:"userId"` // ユーザーID (Firebaseから取得したものを想定)
-	Vote   string `json:"vote"`   // "あつい", "ちょうどよい", "さむい" のいずれか
+// SHUTDOWN_TIMEOUT が未設定のときに、処理中のリクエストの完了を待つ時間
+const defaultShutdownTimeout = 10 * time.Second
+
+// 投票リクエストのボディの上限 (1票分には十分な大きさ)
+const maxVoteBodyBytes = 1 << 10
+
+// 知らないフィールドのあるボディを 400 にするか (既定は無視して受け付ける。STRICT_JSON=true で 400 にする)
+var strictJSON = false
+
+// ボディをJSONとして読み込む。大きすぎるボディはエラーにする
+// 知らないフィールドは strictJSON ならエラー、そうでなければ無視する
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any, maxBytes int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	decoder := json.NewDecoder(r.Body)
+	if strictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
 }
 
-// サーバー内でデータを保持する変数
-var (
-	// 全体の投票数を保存するマップ
-	voteCounts = map[string]int{
-		"あつい":    0,
-		"ちょうどよい": 0,
-		"さむい":    0,
+// Content-Type が application/json でなければ 415 を書いて false を返す
+// charset は省略してよい。付けるなら utf-8 だけを受け付ける (JSON は UTF-8 で送ること)
+func checkJSONContentType(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mediaType == "application/json" {
+		if charset, ok := params["charset"]; !ok || strings.EqualFold(charset, "utf-8") {
+			return true
+		}
 	}
+	writeJSONError(w, http.StatusUnsupportedMediaType, errCodeMediaType, "Content-Type must be application/json")
+	return false
+}
+
+// STORE_TIMEOUT が未設定のときの、保存先への1回の書き込みにかけてよい時間
+const defaultStoreTimeout = 5 * time.Second
 
-	// どのユーザーが何に投票したかを保存するマップ
-	userVotes = make(map[string]string)
+// 保存先への1回の書き込みにかけてよい時間
+var storeTimeout = defaultStoreTimeout
+
+// リクエストの context に storeTimeout の期限を付ける (クライアントが切断しても取り消される)
+func storeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), storeTimeout)
+}
 
-	// 複数のリクエストが同時にデータを書き換えるのを防ぐためのロック
-	mutex = &sync.Mutex{}
+// サーバーの終了が始まると閉じられるチャネル
+var shuttingDown = make(chan struct{})
+
+// 投票によってユーザーの状態がどう変わったか
+const (
+	voteStatusNew       = "new"       // 初めての投票
+	voteStatusChanged   = "changed"   // 別の選択肢に変えた
+	voteStatusUnchanged = "unchanged" // 同じ選択肢への再投票 (票数は変わらない)
 )
 
+// POST /vote のレスポンス形式
+type VoteResponse struct {
+	Status string         `json:"status"` // voteStatusNew などのいずれか
+	Counts map[string]int `json:"counts"` // この投票を反映した集計 (MIN_REVEAL で結果を隠している間は null)
+	// 投票の受付番号 (GET /receipts/{id} で記録された投票を確かめられる。匿名投票モードでは無い)
+	ReceiptID string `json:"receiptId,omitempty"`
+	// 複数選択モードで、この投票の後にユーザーが選んでいる選択肢
+	Selections []string `json:"selections,omitempty"`
+}
+
+// Flutterから受け取る投票リクエストの形式
+type VoteRequest struct {
+	UserID  string `json:"userId"`            // ユーザーID (認証が有効なときはトークンのUIDで上書きされる)
+	Vote    string `json:"vote"`              // 選択肢のキー (既定は "hot", "ok", "cold"。以前の "あつい" などの表示名や VOTE_ALIASES の値も受け付ける)
+	Nonce   string `json:"nonce,omitempty"`   // 再送を防ぐための使い捨ての値 (VOTE_NONCE_TTL を設定したときは必須)
+	Comment string `json:"comment,omitempty"` // 投票に付ける自由記述のコメント (maxCommentLength 文字まで)
+	Cohort  string `json:"cohort,omitempty"`  // ユーザーのコホート (階数など。トークンにクレーム "cohort" があればそちらを使う)
+}
+
 // POST /vote エンドポイントの処理
-func voteHandler(w http.ResponseWriter, r *http.Request) {
+func (rm *room) voteHandler(w http.ResponseWriter, r *http.Request) {
+	user, req, device, ok := parseVote(w, r, rm.optionSet())
+	if !ok {
+		return
+	}
+	rm.castVote(w, r, user, req, device)
+}
+
+// POST /vote のリクエストを読んで確かめる (認証、ボディ、選択肢、許可したユーザー、ノンス、端末)
+// 部屋の状態は見ないので、部屋を作る前にも呼べる。だめならエラーを書いて ok=false を返す
+func parseVote(w http.ResponseWriter, r *http.Request, set *optionSet) (user authUser, req VoteRequest, device string, ok bool) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
+		return user, req, "", false
+	}
+	if !checkJSONContentType(w, r) {
+		return user, req, "", false
+	}
+
+	user, err := authenticateUser(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return user, req, "", false
+	}
+
+	if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return user, req, "", false
+	}
+
+	// ボディのUserIDは信用せず、検証済みトークンのUIDを使う (票の重みもトークンのロールで決める)
+	if user.UID != "" {
+		req.UserID = user.UID
+	}
+	if errs := validateVoteRequest(set, &req); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return user, req, "", false
+	}
+	if !checkUserAllowed(w, req.UserID) {
+		return user, req, "", false
+	}
+	// 匿名投票モードではノンスも端末も使えない (設定を読むときに断る) ので、どちらも素通りする
+	if !requireVoteNonce(w, r, req.UserID, req.Nonce) {
+		return user, req, "", false
+	}
+	device, ok = requestDevice(w, r)
+	return user, req, device, ok
+}
+
+// parseVote を通った投票を部屋に記録してレスポンスを書く
+func (rm *room) castVote(w http.ResponseWriter, r *http.Request, user authUser, req VoteRequest, device string) {
+	if anonymousVoting {
+		rm.anonymousVoteHandler(w, r, user, req.Vote, requestCohort(user, req.Cohort))
+		return
+	}
+	if multiSelectVoting {
+		rm.multiSelectVoteHandler(w, r, user, req, device)
+		return
+	}
+
+	userLock := rm.userLock(req.UserID)
+	userLock.Lock()
+	defer userLock.Unlock()
+	if rm.castVoteShared(w, r, user, req) {
+		return
+	}
+
+	// 投票ロジック (データを保護するためにロック)
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock() // 関数終了時に自動でロックを解除
+
+	previousVote, hasPrevious, status, ok := rm.checkVote(w, r, req, device)
+	if !ok {
+		return
+	}
+	// VOTE_CONFIRM_TTL のときは保留して、POST /vote/confirm で確定する
+	if voteConfirmTTL > 0 {
+		rm.holdVote(w, r, user, req, device)
+		return
+	}
+	rm.commitVote(w, r, user, req, device, previousVote, hasPrevious, status)
+}
+
+// 投票の確認を読み取りロックで行い、保存先への書き込みは部屋のロックの外で違うユーザーの投票と同時に進める
+// 保存先が同時に記録できず、あるいは確認が他のユーザーの投票に左右される (人数・選択肢の票数の上限、端末、確定待ち) ときや
+// 受付期間外のときは何もせずに false を返すので、呼び出し側で書き込みロックを取って投票する
+// 同じユーザーの投票は呼び出し側の userLock で順番にし、保存した後の記録と通知だけを書き込みロックで行う
+func (rm *room) castVoteShared(w http.ResponseWriter, r *http.Request, user authUser, req VoteRequest) bool {
+	if maxVoters > 0 || len(optionCaps) > 0 || deviceGuard || voteConfirmTTL > 0 || !recordsVotesConcurrently(rm.store) {
+		return false
+	}
+
+	// リセットや選択肢の変更 (Lock) は、書き込み中の投票が終わるまで待つ
+	rm.mutex.store.RLock()
+	rm.mutex.RLock()
+	if rm.schedule.status(time.Now()) != pollStatusOpen {
+		rm.mutex.RUnlock()
+		rm.mutex.store.RUnlock()
+		return false
+	}
+	previousVote, hasPrevious, status, ok := rm.checkVoteRules(w, r, req, "")
+	rm.mutex.RUnlock()
+	if !ok {
+		rm.mutex.store.RUnlock()
+		return true
+	}
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	err := rm.storeVote(ctx, r, user, req, status)
+	rm.mutex.store.RUnlock()
+	if err != nil {
+		writeStoreError(w, err, "Failed to save vote")
+		return true
+	}
+
+	rm.mutex.lockRoom()
+	defer rm.mutex.unlockRoom()
+	// 保存した後にリセットや取り消しで投票が消えていれば、コメントやコホートは残さない
+	if vote, ok := rm.store.UserVote(req.UserID); !ok || vote != req.Vote {
+		writeVoteResponse(w, status, rm.visibleCounts(r, rm.store.Counts()), "")
+		return true
+	}
+	rm.voteStored(w, r, user, req, "", previousVote, hasPrevious, status)
+	return true
+}
+
+// 投票を記録できるか確かめ、以前の投票と記録したときの status を返す
+// 記録できなければエラーを書いて ok=false を返す (呼び出し側でロックを取っておくこと)
+func (rm *room) checkVote(w http.ResponseWriter, r *http.Request, req VoteRequest, device string) (previousVote string, hasPrevious bool, status string, ok bool) {
+	if !rm.checkVotingOpen(w) {
+		return "", false, "", false
+	}
+	return rm.checkVoteRules(w, r, req, device)
+}
+
+// 受付期間のほかの checkVote の確認 (部屋のデータは読むだけなので、読み取りロックでよい)
+func (rm *room) checkVoteRules(w http.ResponseWriter, r *http.Request, req VoteRequest, device string) (previousVote string, hasPrevious bool, status string, ok bool) {
+	if !rm.checkSession(w, r, req.UserID) {
+		return "", false, "", false
+	}
+
+	previousVote, hasPrevious = rm.store.UserVote(req.UserID)
+	changing := rm.previousVoteCounts(r.Context(), req.UserID, previousVote, hasPrevious)
+	if !checkVoteChange(w, changing, previousVote, req.Vote) {
+		return "", false, "", false
+	}
+	if !rm.checkChangeCooldown(w, req.UserID, changing, previousVote, req.Vote) {
+		return "", false, "", false
+	}
+	if !rm.checkVoterCapacity(w, hasPrevious) {
+		return "", false, "", false
+	}
+	if !rm.checkOptionCap(w, hasPrevious, previousVote, req.Vote) {
+		return "", false, "", false
+	}
+	if !rm.checkDevice(w, device, req.UserID) {
+		return "", false, "", false
+	}
+	status = voteStatusNew
+	if changing {
+		status = voteStatusChanged
+		if previousVote == req.Vote {
+			status = voteStatusUnchanged
+		}
+	}
+	return previousVote, hasPrevious, status, true
+}
+
+// checkVote を通った投票を記録してレスポンスを書く (呼び出し側でロックを取っておくこと)
+func (rm *room) commitVote(w http.ResponseWriter, r *http.Request, user authUser, req VoteRequest, device, previousVote string, hasPrevious bool, status string) {
+	// 保存に失敗したら集計は変わらない
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := rm.storeVote(ctx, r, user, req, status); err != nil {
+		writeStoreError(w, err, "Failed to save vote")
+		return
+	}
+	rm.voteStored(w, r, user, req, device, previousVote, hasPrevious, status)
+}
+
+// 投票を保存先に記録する。失敗したらログに残す (呼び出し側でロックを取っておくこと)
+func (rm *room) storeVote(ctx context.Context, r *http.Request, user authUser, req VoteRequest, status string) error {
+	err := rm.recordVote(ctx, req.UserID, req.Vote, voteWeight(req.UserID, user.Role), status)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to save vote", "event", "vote", "roomId", rm.id, "userId", logUserID(req.UserID), "error", err)
+	}
+	return err
+}
+
+// 保存した投票の端末・コメント・コホートなどを記録してレスポンスを書く (呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) voteStored(w http.ResponseWriter, r *http.Request, user authUser, req VoteRequest, device, previousVote string, hasPrevious bool, status string) {
+	rm.bindDevice(device, req.UserID, time.Now())
+	rm.saveComment(req.UserID, req.Comment, time.Now())
+	rm.tallyCohort(req.UserID, requestCohort(user, req.Cohort), previousVote, hasPrevious, req.Vote)
+	rm.observeDeliberation(req.UserID, time.Now())
+	receiptID := rm.issueReceipt(req.UserID, req.Vote, time.Now())
+	if status == voteStatusUnchanged {
+		counts := rm.store.Counts()
+		slog.InfoContext(r.Context(), "vote unchanged", "event", "vote", "status", voteStatusUnchanged, "roomId", rm.id, "userId", logUserID(req.UserID), "vote", req.Vote)
+		writeVoteResponse(w, status, rm.visibleCounts(r, counts), receiptID)
+		return
+	}
+
+	counts := rm.voteRecorded(r, req.UserID, previousVote, req.Vote, status)
+	writeUserVoteResponse(w, r, req.UserID, status, rm.visibleCounts(r, counts), receiptID)
+}
+
+// 投票が保存された後の通知・監査ログ・メトリクス (呼び出し側でロックを取っておくこと)
+// 反映後の集計を返す
+func (rm *room) voteRecorded(r *http.Request, userID, previousVote, vote, status string) map[string]int {
+	rm.velocity.add(vote)
+	rm.throughput.add(time.Now())
+	rm.recordTransition(userID, status, previousVote, vote, time.Now())
+
+	// SSE / WebSocket の購読者への配信
+	_, span := startSpan(r.Context(), "notifySubscribers", voteSpanAttributes(rm, vote, status)...)
+	rm.notifySubscribers()
+	span.End()
+
+	recordAudit(AuditEntry{
+		Action:    "vote",
+		RoomID:    rm.id,
+		UserID:    userID,
+		OldVote:   previousVote,
+		NewVote:   vote,
+		RemoteIP:  remoteIP(r),
+		RequestID: requestIDFromContext(r.Context()),
+	})
+
+	counts := rm.store.Counts()
+	votesTotal.WithLabelValues(rm.id, vote).Inc()
+	rm.updateVoteGauges(counts)
+	rm.checkThresholds(r.Context(), vote, counts[vote])
+	slog.InfoContext(r.Context(), "vote received",
+		"event", "vote",
+		"roomId", rm.id,
+		"userId", logUserID(userID),
+		"vote", vote,
+		"previousVote", previousVote,
+		"status", status,
+		"counts", counts,
+	)
+	return counts
+}
+
+// 再度 GET /results を呼ばなくて済むよう、この投票を反映した集計を返す
+func writeVoteResponse(w http.ResponseWriter, status string, counts map[string]int, receiptID string) {
+	writeVoteResponseCode(w, http.StatusOK, status, counts, receiptID)
+}
+
+func writeVoteResponseCode(w http.ResponseWriter, code int, status string, counts map[string]int, receiptID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(VoteResponse{Status: status, Counts: counts, ReceiptID: receiptID})
+}
+
+// ユーザーの投票のレスポンスを書く
+// VOTE_CREATED_STATUS=true なら、初めての投票は 201 にして、その投票を読む URL (GET /vote/{userId}) を Location に付ける
+func writeUserVoteResponse(w http.ResponseWriter, r *http.Request, userID, status string, counts map[string]int, receiptID string) {
+	if !voteCreatedStatus || status != voteStatusNew {
+		writeVoteResponse(w, status, counts, receiptID)
+		return
+	}
+	// /v1 や /rooms/{roomId} はリクエストのパスのまま使う (POST /vote/confirm なら /vote/{userId})
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/confirm")+"/"+url.PathEscape(userID))
+	writeVoteResponseCode(w, http.StatusCreated, status, counts, receiptID)
+}
+
+// POST /vote/validate のレスポンス形式
+type ValidateVoteResponse struct {
+	Valid  bool         `json:"valid"`
+	Code   string       `json:"code,omitempty"`   // 無効なときのエラーの code (最初の問題のもの)
+	Reason string       `json:"reason,omitempty"` // 無効なときの理由
+	Fields []FieldError `json:"fields,omitempty"` // 無効なフィールドのすべて
+}
+
+// POST /vote/validate エンドポイントの処理
+// POST /vote と同じ確認だけを行い、投票は記録しない (送信ボタンの有効・無効の判定用)
+// 投票データには触らないのでロックは取らない。部屋ごとに選択肢は変わらないので /rooms/{roomId}/vote/validate も同じ処理
+func validateVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	var req VoteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
 		return
 	}
+	if uid != "" {
+		req.UserID = uid
+	}
+
+	res := ValidateVoteResponse{Valid: true}
+	status := http.StatusOK
+	if errs := validateVoteRequest(roomOptions(r.PathValue("roomId")), &req); len(errs) > 0 {
+		detail := fieldErrorDetail(errs)
+		res = ValidateVoteResponse{Code: detail.Code, Reason: detail.Message, Fields: errs}
+		status = http.StatusBadRequest
+	}
 
-	if _, ok := voteCounts[req.Vote]; !ok {
-		http.Error(w, "Invalid vote option", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// DELETE /vote エンドポイントの処理 (自分の投票を取り消す)
+// userId はボディかクエリパラメータで受け取る
+func (rm *room) deleteVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w)
 		return
 	}
 
-	// 投票ロジック (データを保護するためにロック)
-	mutex.Lock()
-	defer mutex.Unlock() // 関数終了時に自動でロックを解除
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
 
-	// ユーザーが以前に投票していたかチェック
-	if previousVote, ok := userVotes[req.UserID]; ok {
-		// 以前の投票があった場合、その票を1つ減らす
-		if previousVote != req.Vote {
-			voteCounts[previousVote]--
+	userID := r.URL.Query().Get("userId")
+	if userID == "" && r.ContentLength != 0 {
+		var req VoteRequest
+		if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
 		}
+		userID = req.UserID
+	}
+	if uid != "" {
+		userID = uid
+	}
+	if !checkUserID(w, userID) {
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if !rm.checkVotingOpen(w) {
+		return
+	}
+
+	previousVote, ok := rm.store.UserVote(userID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Vote not found")
+		return
+	}
+	// 変更できない投票では取り消しもできない (取り消してから投票し直せてしまうので)
+	if !allowVoteChange {
+		writeJSONError(w, http.StatusConflict, errCodeAlreadyVoted, "already voted")
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := rm.deleteVote(ctx, userID, previousVote); err != nil {
+		slog.ErrorContext(r.Context(), "failed to delete vote", "event", "retract", "roomId", rm.id, "userId", logUserID(userID), "error", err)
+		writeStoreError(w, err, "Failed to delete vote")
+		return
+	}
+	delete(rm.comments, userID)
+	rm.untallyCohort(userID, previousVote)
+	rm.dropReceipt(userID)
+	rm.recordTransition(userID, transitionRetracted, previousVote, "", time.Now())
+	rm.notifySubscribers()
+
+	recordAudit(AuditEntry{
+		Action:    "retract",
+		RoomID:    rm.id,
+		UserID:    userID,
+		OldVote:   previousVote,
+		RemoteIP:  remoteIP(r),
+		RequestID: requestIDFromContext(r.Context()),
+	})
+
+	counts := rm.store.Counts()
+	rm.updateVoteGauges(counts)
+	slog.InfoContext(r.Context(), "vote retracted",
+		"event", "retract",
+		"roomId", rm.id,
+		"userId", logUserID(userID),
+		"previousVote", previousVote,
+		"counts", counts,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(counts)
+}
+
+// PATCH /vote のリクエスト形式
+type PatchVoteRequest struct {
+	UserID string `json:"userId"`
+	// クライアントが知っている現在の投票 (まだ投票していないなら空文字)
+	CurrentVote *string `json:"currentVote"`
+	Vote        string  `json:"vote"`
+	Nonce       string  `json:"nonce,omitempty"`
+}
+
+// PATCH /vote で currentVote が食い違ったときの 409 レスポンス
+type VoteConflictResponse struct {
+	Error       ErrorDetail `json:"error"`
+	CurrentVote *string     `json:"currentVote"` // サーバーに記録されている投票 (未投票なら null)
+}
+
+// PATCH /vote エンドポイントの処理 (楽観的な排他による投票の変更)
+// サーバーの投票が currentVote のままのときだけ vote に変える
+// 複数の端末で開いていて、古い画面からの操作で新しい投票を上書きしないようにする
+func (rm *room) patchVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeMethodNotAllowed(w)
+		return
 	}
 
-	// 新しい投票を記録
-	voteCounts[req.Vote]++
-	userVotes[req.UserID] = req.Vote
+	user, err := authenticateUser(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
 
-	log.Printf("Vote received: UserID=%s, Vote=%s", req.UserID, req.Vote)
-	log.Printf("Current counts: %+v", voteCounts)
+	var req PatchVoteRequest
+	if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	if user.UID != "" {
+		req.UserID = user.UID
+	}
+	if !checkUserID(w, req.UserID) {
+		return
+	}
+	if req.CurrentVote == nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "currentVote is required")
+		return
+	}
+	if !checkUserAllowed(w, req.UserID) {
+		return
+	}
+	vote, ok := resolveVoteLogged(rm.optionSet(), req.Vote)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOption, "Invalid vote option")
+		return
+	}
+	req.Vote = vote
+	if key, ok := rm.optionSet().canonical(*req.CurrentVote); ok {
+		req.CurrentVote = &key
+	}
+	if !requireVoteNonce(w, r, req.UserID, req.Nonce) {
+		return
+	}
+	device, ok := requestDevice(w, r)
+	if !ok {
+		return
+	}
+
+	// 比較から書き込みまでを同じロックの中で行う
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if !rm.checkVotingOpen(w) {
+		return
+	}
+	if !rm.checkSession(w, r, req.UserID) {
+		return
+	}
+
+	previousVote, hasPrevious := rm.store.UserVote(req.UserID)
+	if previousVote != *req.CurrentVote {
+		slog.InfoContext(r.Context(), "vote conflict", "event", "vote_conflict", "roomId", rm.id, "userId", logUserID(req.UserID), "currentVote", previousVote, "claimedVote", *req.CurrentVote)
+		res := VoteConflictResponse{Error: ErrorDetail{Code: errCodeVoteConflict, Message: "Vote has changed"}}
+		if hasPrevious {
+			res.CurrentVote = &previousVote
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	if previousVote == req.Vote {
+		writeVoteResponse(w, voteStatusUnchanged, rm.visibleCounts(r, rm.store.Counts()), rm.issueReceipt(req.UserID, req.Vote, time.Now()))
+		return
+	}
+	changing := rm.previousVoteCounts(r.Context(), req.UserID, previousVote, hasPrevious)
+	if !checkVoteChange(w, changing, previousVote, req.Vote) {
+		return
+	}
+	if !rm.checkChangeCooldown(w, req.UserID, changing, previousVote, req.Vote) {
+		return
+	}
+	if !rm.checkVoterCapacity(w, hasPrevious) {
+		return
+	}
+	if !rm.checkOptionCap(w, hasPrevious, previousVote, req.Vote) {
+		return
+	}
+	if !rm.checkDevice(w, device, req.UserID) {
+		return
+	}
+	status := voteStatusNew
+	if changing {
+		status = voteStatusChanged
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := rm.recordVote(ctx, req.UserID, req.Vote, voteWeight(req.UserID, user.Role), status); err != nil {
+		slog.ErrorContext(r.Context(), "failed to save vote", "event", "vote", "roomId", rm.id, "userId", logUserID(req.UserID), "error", err)
+		writeStoreError(w, err, "Failed to save vote")
+		return
+	}
+	rm.bindDevice(device, req.UserID, time.Now())
+	rm.tallyCohort(req.UserID, requestCohort(user, ""), previousVote, hasPrevious, req.Vote)
+	receiptID := rm.issueReceipt(req.UserID, req.Vote, time.Now())
+
+	counts := rm.voteRecorded(r, req.UserID, previousVote, req.Vote, status)
+	writeUserVoteResponse(w, r, req.UserID, status, rm.visibleCounts(r, counts), receiptID)
+}
+
+// /vote はメソッドごとに処理を振り分ける
+func (rm *room) voteRouteHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		limitVotesPerUser(rm.voteHandler)(w, r)
+	case http.MethodPatch, http.MethodDelete:
+		if anonymousVoting {
+			writeAnonymousVoteChange(w)
+		} else if multiSelectVoting {
+			writeMultiSelectUnsupported(w)
+		} else if r.Method == http.MethodPatch {
+			limitVotesPerUser(rm.patchVoteHandler)(w, r)
+		} else {
+			rm.deleteVoteHandler(w, r)
+		}
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// GET /vote/{userId} のレスポンス形式
+type UserVoteResponse struct {
+	UserID string   `json:"userId"`
+	Vote   string   `json:"vote"`            // 複数選択モードでは空文字 (votes を使う)
+	Votes  []string `json:"votes,omitempty"` // 複数選択モードで選んでいる選択肢
+}
+
+// GET /vote/{userId} エンドポイントの処理 (画面を開いたときに自分の投票を復元する)
+// 認証が有効なときは自分の投票しか読めない
+func (rm *room) userVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID := r.PathValue("userId")
+	if !checkUserIDParameter(w, userID) {
+		return
+	}
+	if uid != "" && uid != userID {
+		writeJSONError(w, http.StatusForbidden, errCodeForbidden, "Forbidden")
+		return
+	}
+
+	rm.mutex.RLock()
+	vote, ok := rm.store.UserVote(userID)
+	var selections []string
+	if multiSelectVoting {
+		selections = rm.userSelections(userID)
+		ok = len(selections) > 0
+	}
+	rm.mutex.RUnlock()
+
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Vote not found")
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "Vote recorded successfully")
+	json.NewEncoder(w).Encode(UserVoteResponse{UserID: userID, Vote: vote, Votes: selections})
 }
 
 // GET /results エンドポイントの処理
-func resultsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+// 既定では選択肢ごとの票数と割合、総数をオブジェクトで返す
+// ?format=list なら [{option, count, weighted, percentage}] の配列を返す。並びは ?sort=options (既定、選択肢の設定順) か ?sort=count (票数の多い順)
+// どちらも人数 (count) と重み付きの票数 (weighted) を並べて返す (重みを設定していなければ同じ値)
+// 選択肢はキーで返し、表示名 (label) は ?lang= か Accept-Language の言語にする
+// 本文から作った ETag を付け、If-None-Match が一致すれば 304 を返す
+// 既定の形式には集計が最後に変わった時刻 (lastUpdated) とサーバーの時刻 (serverTime) も付ける
+// 終了した投票は確定した票数を返し、final, closedAt と票数のハッシュ (finalHash) を付ける
+// ?format=counts なら従来どおり票数のマップだけを返す
+// ?groupBy=cohort なら既定の形式にコホートごとの票数 (cohorts) も付ける
+// ?metadata=true なら既定の形式の選択肢ごとに設定の metadata (色など) も付ける
+// 複数選択モードでは total は選んだ数の合計で、既定の形式に選んだ人数 (voters) も付ける
+// MIN_REVEAL を設定していると、票数がそれに届くまでは 403 (results_hidden) を返す (管理用キーがあれば返す)
+func (rm *room) resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	order := query.Get("sort")
+	if order == "" {
+		order = resultsSortOptions
+	}
+	if order != resultsSortOptions && order != resultsSortCount {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid sort")
+		return
+	}
+	groupBy := query.Get("groupBy")
+	if groupBy != "" && (groupBy != "cohort" || format != "") {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid groupBy")
+		return
+	}
+	withMetadata := query.Get("metadata") == "true"
+	if withMetadata && format != "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "metadata is only available in the default format")
+		return
+	}
+
+	// 終了していれば先に結果を確定させ、確定した票数から返す
+	rm.ensureFinal(time.Now())
+
+	// 集計のコピーだけをロック中に取り、組み立てとエンコードはロックを外してから行う
+	now := time.Now()
+	snap := rm.snapshotResults(now, groupBy == "cohort")
+
+	// 保存先が読めないときは最後に読めた票数を返し、ヘッダーで古いことを知らせる
+	if !snap.final {
+		setStaleHeader(w, rm.store)
+	}
+
+	// 表示名は Accept-Language で変わる
+	w.Header().Add("Vary", "Accept-Language")
+
+	var buf bytes.Buffer
+	switch format {
+	case "counts":
+		json.NewEncoder(&buf).Encode(snap.counts)
+	case "list":
+		lang := requestLanguage(r)
+		list := rm.cachedAggregate(snap, "list:"+order+":"+lang, func() any {
+			return buildResultsList(snap.set, snap.counts, snap.weighted, lang, order)
+		})
+		json.NewEncoder(&buf).Encode(list)
+	default:
+		// 終了後も最終結果は見られる
+		lang := requestLanguage(r)
+		res := rm.cachedAggregate(snap, "results:"+lang, func() any {
+			return buildResults(snap.set, snap.counts, snap.weighted, lang)
+		}).(ResultsResponse)
+		res.Status = snap.status
+		if !snap.lastUpdated.IsZero() {
+			res.LastUpdated = snap.lastUpdated.UTC().Format(time.RFC3339)
+		}
+		if snap.final {
+			res.Final = true
+			res.ClosedAt = snap.closedAt.UTC().Format(time.RFC3339)
+			res.FinalHash = snap.finalHash
+		}
+		if groupBy == "cohort" {
+			res.Cohorts = rm.cachedAggregate(snap, "cohorts", func() any {
+				return buildCohortResults(snap.counts, snap.cohorts)
+			}).(map[string]CohortResult)
+		}
+		if withMetadata {
+			// 覚えておいた結果は書き換えない
+			res.Options = maps.Clone(res.Options)
+			for option, result := range res.Options {
+				result.Metadata = snap.set.metadata[option]
+				res.Options[option] = result
+			}
+		}
+		if !snap.adjustedAt.IsZero() {
+			res.AdjustedAt = snap.adjustedAt.UTC().Format(time.RFC3339)
+		}
+		if multiSelectVoting {
+			rm.mutex.RLock()
+			res.Voters = rm.multiSelectVoters()
+			rm.mutex.RUnlock()
+		}
+		// serverTime は毎回変わるので ETag には含めない (304 のときクライアントは前回の本文を使う)
+		var tag bytes.Buffer
+		json.NewEncoder(&tag).Encode(res)
+		res.ServerTime = now.UTC().Format(time.RFC3339)
+		json.NewEncoder(&buf).Encode(res)
+		writeJSONWithETag(w, r, buf.Bytes(), tag.Bytes())
+		return
+	}
+	writeJSONWithETag(w, r, buf.Bytes(), buf.Bytes())
+}
+
+// GET /results/winner エンドポイントの処理
+// まだ1票も無いときは 204 No Content を返す
+func (rm *room) winnerHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	rm.ensureFinal(time.Now())
+	snap := rm.snapshotResults(time.Now(), false)
+	winner, ok := computeWinner(snap.set, snap.counts)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(winner)
+}
 
-	json.NewEncoder(w).Encode(voteCounts)
+// GET /results/stats エンドポイントの処理
+// 総数、最多票の選択肢、割合をまとめて返す (ダッシュボードの要約用)
+func (rm *room) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	rm.ensureFinal(time.Now())
+	snap := rm.snapshotResults(time.Now(), false)
+	stats := rm.cachedAggregate(snap, "stats", func() any { return computeStats(snap.set, snap.counts) }).(StatsResponse)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
 }
 
 // main関数（修正済み）
 func main() {
-	// 新しいルーター(mux)を作成
-	mux := http.NewServeMux()
+	// --restore: 起動時に GET /admin/backup のダンプからその部屋の投票を戻す
+	restorePath := flag.String("restore", "", "restore votes from a GET /admin/backup dump at startup")
+	// --migrate-from / --migrate-to: SNAPSHOT_PATH のスナップショットを SQLite や Redis に書き込んで終了する
+	migrateFrom := flag.String("migrate-from", "", "write the votes in a SNAPSHOT_PATH file into the configured store, then exit")
+	migrateTo := flag.String("migrate-to", "", "store to migrate into with --migrate-from (sqlite or redis)")
+	flag.Parse()
 
-	// http.HandleFuncではなく、mux.HandleFuncに処理を登録
-	mux.HandleFunc("/vote", voteHandler)
-	mux.HandleFunc("/results", resultsHandler)
+	if err := setupLogging(); err != nil {
+		fatal("could not configure logging", "error", err)
+	}
+	slog.Info("build info", "commit", buildCommit, "buildTime", buildTime, "goVersion", runtime.Version())
 
-	// CORSの設定を作成
-	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST"},
-	})
+	// 分散トレース (OTEL_EXPORTER_OTLP_ENDPOINT が未設定なら何もしない)
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("could not configure tracing", "error", err)
+	}
+	if tracingEnabled {
+		slog.Info("tracing enabled", "exporter", "otlp")
+	}
+
+	// 選択肢を読み込んでから投票データを用意する
+	options, err := loadVoteOptions()
+	if err != nil {
+		fatal("could not load vote options", "error", err)
+	}
+	setVoteOptions(options)
+	slog.Info("vote options loaded", "options", voteOptions())
+
+	// 投票済みのユーザーが投票を変えられるか (ALLOW_VOTE_CHANGE=false で1回限りの投票にする)
+	if allowVoteChange, err = envBool("ALLOW_VOTE_CHANGE", true); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 初めての投票に 201 と Location を返す (VOTE_CREATED_STATUS=true。既定は従来のクライアントのためにすべて 200)
+	if voteCreatedStatus, err = envBool("VOTE_CREATED_STATUS", false); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 部屋ごとの投票できる人数 (MAX_VOTERS=0 で無制限)
+	if maxVoters, err = envInt("MAX_VOTERS", 0); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 投票の再送を防ぐ nonce を覚えておく時間 (VOTE_NONCE_TTL。0 なら nonce を求めない)
+	nonceTTL, err := envDuration("VOTE_NONCE_TTL", 0)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if nonceTTL > 0 {
+		voteNonces = newNonceCache(nonceTTL)
+		voteNonces.startEviction()
+	}
+	if err := loadIdempotencyTTL(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if idempotencyTTL > 0 {
+		idempotentResponses.startEviction()
+	}
+
+	// 誰が投票したかを保存しない匿名投票 (ANONYMOUS_VOTING=true。投票の変更や重複の排除とは一緒に使えない)
+	if err := loadAnonymousVoting(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if anonymousVoting {
+		slog.Warn("anonymous voting enabled; votes are counted without tracking users, so repeated votes are not deduplicated")
+	}
+
+	// POST /session/start から投票までの時間を測るために開始時刻を覚えておく時間 (SESSION_TTL)
+	if err := loadSessionTTL(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadRequireSession(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadSessionClearsVote(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	voteSessions.startEviction()
+
+	// リクエストごとのアクセスログ (ACCESS_LOG=false で止める。ストリーミングは ACCESS_LOG_STREAM_SAMPLE の割合だけ)
+	if err := loadAccessLog(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadVoteLogSampling(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 投票を変えてから次に変えられるまで待たせる (VOTE_CHANGE_COOLDOWN=30s など)
+	if err := loadVoteChangeCooldown(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 招待したユーザーだけに投票させる (ALLOWED_USERS / ALLOWED_USERS_FILE。ファイルは SIGHUP で読み込み直す)
+	allowedUsersFile = os.Getenv("ALLOWED_USERS_FILE")
+	if err := loadAllowedUsers(); err != nil {
+		fatal("could not load allowed users", "path", allowedUsersFile, "error", err)
+	}
+	if count := allowedUserCount(); count > 0 {
+		slog.Info("voting is limited to allowed users", "users", count, "file", allowedUsersFile)
+	}
+	startAllowedUsersReloader()
+
+	// 結果の配信の接続を MAX_STREAMS までに抑え、終了時は STREAM_CLOSE_GRACE だけ閉じるのを待つ
+	if err := loadMaxStreams(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadMaxUserIDLength(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 票数が MIN_REVEAL に届くまで結果を隠す (管理用キーがあれば見られる)
+	if err := loadMinReveal(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if minReveal > 0 {
+		slog.Info("results are hidden until enough votes are in", "minReveal", minReveal)
+	}
+
+	// 取り除かれた選択肢に投票していたユーザーがもう一度投票したときの扱い (ORPHANED_VOTE_POLICY=revote/change)
+	if err := loadOrphanedVotePolicy(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 1台の端末からは1人だけが投票できるようにする (DEVICE_GUARD=true。X-Device-ID ヘッダーが必須になる)
+	if err := loadDeviceGuard(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if deviceGuard {
+		startDeviceEviction()
+		slog.Info("device guard enabled", "header", deviceIDHeader, "ttl", deviceGuardTTL.String())
+	}
+	if err := loadVoteConfirm(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if voteConfirmTTL > 0 {
+		startPendingVoteSweep()
+		slog.Info("votes require confirmation", "ttl", voteConfirmTTL.String())
+	}
+	// 1人がいくつでも選べる複数選択モード (VOTE_MODE=multi。既定は1人1つ)
+	if err := loadVoteMode(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if multiSelectVoting {
+		slog.Info("multi-select voting enabled; POST /vote toggles one option per request")
+	}
+
+	// 投票の保存先を開く (REDIS_URL があれば Redis、SNAPSHOT_PATH があればメモリと定期的なファイルへの書き出し、どちらも無ければ SQLite)
+	var roomIDs []string
+	var closeStore func() error
+	startPersistence := func() {}
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		client, err := openRedis(redisURL)
+		if err != nil {
+			fatal("could not connect to redis", "error", err)
+		}
+		prefix := redisKeyPrefix()
+		definitions, err := loadRedisPolls(client, prefix)
+		if err != nil {
+			fatal("could not load polls", "error", err)
+		}
+		registerPolls(definitions)
+		storePoll = func(ctx context.Context, info pollInfo) error {
+			return saveRedisPoll(ctx, client, prefix, info)
+		}
+		fetchPoll = func(id string) (pollInfo, bool) {
+			return fetchRedisPoll(client, prefix, id)
+		}
+		openStore = func(roomID string) (VoteStore, error) {
+			return newRedisStore(client, prefix, roomID), nil
+		}
+		roomExists = func(roomID string) bool {
+			return redisRoomExists(client, prefix, roomID)
+		}
+		readinessChecks["redis"] = func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		}
+		closeStore = client.Close
+
+		if roomIDs, err = loadRedisRoomIDs(client, prefix); err != nil {
+			fatal("could not load rooms", "error", err)
+		}
+		if err := migrateRedisOptionKeys(client, prefix, roomIDs, optionAliases()); err != nil {
+			fatal("could not migrate vote options", "error", err)
+		}
+		if err := backfillRedisWeights(client, prefix, roomIDs); err != nil {
+			fatal("could not migrate weighted counts", "error", err)
+		}
+		storeBackend = "redis"
+		slog.Info("using redis store", "addr", client.Options().Addr, "prefix", prefix)
+	} else if snapshotPath := os.Getenv("SNAPSHOT_PATH"); snapshotPath != "" {
+		interval, err := envDuration("SNAPSHOT_INTERVAL", defaultSnapshotInterval)
+		if err != nil {
+			fatal("invalid configuration", "error", err)
+		}
+		if interval <= 0 {
+			fatal("invalid configuration", "error", "SNAPSHOT_INTERVAL must be positive")
+		}
+		loaded, err := loadSnapshot(snapshotPath)
+		if err != nil {
+			fatal("could not load snapshot", "path", snapshotPath, "error", err)
+		}
+		openStore = func(roomID string) (VoteStore, error) {
+			if s, ok := loaded[roomID]; ok {
+				return s, nil
+			}
+			return newMemoryStore(roomOptions(roomID).keys), nil
+		}
+		for id := range loaded {
+			if id != "" {
+				roomIDs = append(roomIDs, id)
+			}
+		}
+		// 終了時に最後の状態を書き出す
+		closeStore = func() error { return writeSnapshot(snapshotPath) }
+		startPersistence = func() { startSnapshotter(snapshotPath, interval) }
+		storeBackend = "snapshot"
+		slog.Info("using in-memory store with snapshots", "path", snapshotPath, "interval", interval.String())
+	} else {
+		// データベースを開き、保存済みの投票をメモリに読み込む
+		dbPath := os.Getenv("DB_PATH")
+		if dbPath == "" {
+			dbPath = defaultDBPath
+		}
+		conn, err := openDB(dbPath)
+		if err != nil {
+			fatal("could not open database", "path", dbPath, "error", err)
+		}
+		if err := loadSQLiteBatching(); err != nil {
+			fatal("invalid configuration", "error", err)
+		}
+		if err := migrateOptionKeys(conn, optionAliases()); err != nil {
+			fatal("could not migrate vote options", "error", err)
+		}
+		definitions, err := loadPollDefinitions(conn)
+		if err != nil {
+			fatal("could not load polls", "error", err)
+		}
+		registerPolls(definitions)
+		storePoll = func(ctx context.Context, info pollInfo) error {
+			return savePollDefinition(ctx, conn, info)
+		}
+		openStore = func(roomID string) (VoteStore, error) {
+			return newSQLiteStore(conn, roomID)
+		}
+		readinessChecks["database"] = conn.PingContext
+		// まとめて書く投票を溜めていれば、閉じる前に書く
+		closeStore = func() error {
+			return errors.Join(flushVoteBatches(), conn.Close())
+		}
+
+		if roomIDs, err = loadRoomIDs(conn); err != nil {
+			fatal("could not load rooms", "error", err)
+		}
+		storeBackend = "sqlite"
+		slog.Info("using sqlite store", "path", dbPath)
+		if sqliteBatchInterval > 0 {
+			slog.Warn("sqlite writes are batched; a crash can lose the votes of the last batch", "interval", sqliteBatchInterval.String(), "size", sqliteBatchSize)
+		}
+	}
+
+	// 保存先の失敗が続いたら書き込みを止めて 503 を返す (STORE_BREAKER_THRESHOLD=0 で無効)
+	breakerThreshold, err := envInt("STORE_BREAKER_THRESHOLD", defaultStoreBreakerThreshold)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	breakerCooldown, err := envDuration("STORE_BREAKER_COOLDOWN", defaultStoreBreakerCooldown)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if breakerThreshold > 0 {
+		storeBreaker = newCircuitBreaker(breakerThreshold, breakerCooldown)
+		openBackend := openStore
+		openStore = func(roomID string) (VoteStore, error) {
+			store, err := openBackend(roomID)
+			if err != nil {
+				return nil, err
+			}
+			return newBreakerStore(store, storeBreaker), nil
+		}
+		readinessChecks["storeBreaker"] = func(ctx context.Context) error {
+			if state := storeBreaker.state(time.Now()); state != breakerClosed {
+				return fmt.Errorf("circuit %s", state)
+			}
+			return nil
+		}
+	}
+
+	store, err := openStore("")
+	if err != nil {
+		fatal("could not load votes", "error", err)
+	}
+	defaultRoom = newRoom("", store)
+	if defaultRoom.schedule, err = loadPollSchedule(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	for _, id := range roomIDs {
+		if _, err := getRoom(id, true); err != nil {
+			fatal("could not load room", "roomId", id, "error", err)
+		}
+	}
+	slog.Info("votes loaded", "counts", defaultRoom.store.Counts(), "rooms", len(rooms))
+
+	if *migrateFrom != "" {
+		report, err := migrateSnapshot(*migrateFrom, *migrateTo)
+		if err != nil {
+			fatal("could not migrate snapshot", "path", *migrateFrom, "error", err)
+		}
+		slog.Info("snapshot migrated", "event", "migrate", "path", *migrateFrom, "store", storeBackend,
+			"rooms", report.Rooms, "votes", report.Votes, "skipped", report.Skipped, "polls", report.Polls)
+		if err := closeStore(); err != nil {
+			fatal("could not close store", "error", err)
+		}
+		return
+	}
+	startPersistence()
+
+	// 読み込んだ票数でゲージを初期化する
+	registerMetrics(prometheus.DefaultRegisterer)
+	defaultRoom.updateVoteGauges(defaultRoom.store.Counts())
+	for _, rm := range rooms {
+		rm.updateVoteGauges(rm.store.Counts())
+	}
+
+	// Firebase Auth でIDトークンを検証する (DISABLE_AUTH=true なら無効)
+	if os.Getenv("DISABLE_AUTH") == "true" {
+		slog.Warn("authentication is disabled (DISABLE_AUTH=true)")
+	} else {
+		v, err := newFirebaseVerifier(context.Background())
+		if err != nil {
+			fatal("could not initialize Firebase Auth", "error", err)
+		}
+		verifier = v
+	}
 
-	// muxをCORSミドルウェアでラップして、最終的なhandlerを作成
-	handler := c.Handler(mux)
+	// 投票の変更を監査ログに残す (AUDIT_LOG_PATH が未設定なら無効)
+	if path := os.Getenv("AUDIT_LOG_PATH"); path != "" {
+		maxBytes, err := envInt("AUDIT_LOG_MAX_BYTES", defaultAuditLogMaxBytes)
+		if err != nil {
+			fatal("invalid configuration", "error", err)
+		}
+		auditLog, err = openAuditLog(path, int64(maxBytes))
+		if err != nil {
+			fatal("could not open audit log", "path", path, "error", err)
+		}
+	}
 
-	fmt.Println("Server starting on :8080")
+	// GET /results の ETag (RESULTS_ETAG=false で付けない)
+	if resultsETag, err = envBool("RESULTS_ETAG", true); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadResultsMaxAge(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// ユーザーやロールごとの票の重み (USER_WEIGHTS, ROLE_WEIGHTS。未設定なら全員1票)
+	if err := loadVoteWeights(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadMaxOptionCount(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadOptionCaps(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadVoteAliases(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadQuorum(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if err := loadCloseDefaultOption(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 票数が設定の値に達したときの通知 (WEBHOOK_URL が未設定なら無効)
+	if webhookThresholds, err = loadWebhookThresholds(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if url := os.Getenv("WEBHOOK_URL"); url != "" {
+		webhook = newWebhookNotifier(url)
+		slog.Info("webhook notifications enabled", "thresholds", webhookThresholds)
+	} else if len(webhookThresholds) > 0 {
+		slog.Warn("WEBHOOK_THRESHOLDS is set but WEBHOOK_URL is not; threshold notifications are disabled")
+	}
+
+	// 票の急増の検知 (SURGE_MULTIPLIER が未設定なら無効)
+	if err := loadSurgeDetector(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if surgeWebhook && webhook == nil {
+		slog.Warn("SURGE_WEBHOOK is set but WEBHOOK_URL is not; surge notifications are disabled")
+	}
 
-	// サーバーの起動時に、nilではなく作成したhandlerを渡す
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
+	// 開発用のエンドポイント (DEV_MODE=true。本番では設定しない)
+	if devMode, err = envBool("DEV_MODE", false); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if devMode {
+		slog.Warn("DEV_MODE is enabled; development endpoints such as POST /admin/seed are available")
+	}
+
+	adminKey = os.Getenv("ADMIN_KEY")
+	if adminKey == "" {
+		slog.Warn("ADMIN_KEY is not set; admin endpoints are disabled")
+	}
+
+	// ユーザーごとの投票のレート制限 (VOTE_RATE_LIMIT=0 で無効)
+	rateLimit, err := envInt("VOTE_RATE_LIMIT", defaultVoteRateLimit)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	rateWindow, err := envDuration("VOTE_RATE_WINDOW", defaultVoteRateWindow)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if rateLimit > 0 && rateWindow > 0 {
+		userRateLimiter = newRateLimiter(rateLimit, rateWindow)
+		userRateLimiter.startEviction()
+	}
+
+	// 送信元IPごとのレート制限 (IP_RATE_LIMIT=0 で無効)
+	if trustedProxies, err = loadTrustedProxies(); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	ipLimit, err := envInt("IP_RATE_LIMIT", defaultIPRateLimit)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	ipWindow, err := envDuration("IP_RATE_WINDOW", defaultIPRateWindow)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if ipLimit > 0 && ipWindow > 0 {
+		ipRateLimiter = newRateLimiter(ipLimit, ipWindow)
+		ipRateLimiter.startEviction()
+	}
+
+	// 確定した結果のハッシュの鍵 (FINAL_RESULTS_KEY。未設定なら鍵なしのハッシュ)
+	loadFinalResultsKey()
+
+	// 推移グラフ用に票数を定期的に記録する
+	if historyInterval, err = envDuration("HISTORY_INTERVAL", defaultHistoryInterval); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if historySize, err = envInt("HISTORY_SIZE", defaultHistorySize); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if historyInterval > 0 && historySize > 0 {
+		startHistorySampler()
+	}
+
+	// GET /results/velocity と GET /results/throughput のバケットを1秒ごとに進める
+	startVelocityTicker()
+
+	// WebSocketのクライアントに集計を配るハブ
+	hub = newWSHub()
+	go hub.run()
+
+	// ルートとミドルウェアをまとめたハンドラーを作成
+	handler := newRouter()
+
+	addr, err := loadListenAddr()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	// GRPC_PORT を設定すると、同じ投票を gRPC でも受け付ける (proto/vote.proto)
+	grpcAddr, err := loadGRPCAddr(addr)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// TLS_CERT_FILE / TLS_KEY_FILE か TLS_AUTOCERT_DOMAINS があればHTTPSで待ち受ける
+	tlsConfig, err := loadTLSSettings()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	timeouts, err := loadServerTimeouts()
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if storeTimeout, err = envDuration("STORE_TIMEOUT", defaultStoreTimeout); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	// 新しいフィールドを送るクライアントでも古いサーバーで受け付けられるよう、既定では知らないフィールドを無視する
+	// クライアントのフィールド名の誤りを見つけたいときは STRICT_JSON=true にする
+	if strictJSON, err = envBool("STRICT_JSON", false); err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// 保存先への書き込みの期限 (STORE_TIMEOUT) が決まってから戻す
+	if *restorePath != "" {
+		if err := restoreFromFile(*restorePath); err != nil {
+			fatal("could not restore backup", "path", *restorePath, "error", err)
+		}
+	}
+
+	// SSE は resultsStreamHandler で書き込みの期限を外している (WebSocketは切り替え時に外れる)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.readHeader,
+		ReadTimeout:       timeouts.read,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+	}
+	// SSEなどの開きっぱなしの接続に終了を知らせる (ふつうは Shutdown の前に closeStreams で始めている)
+	server.RegisterOnShutdown(beginShutdown)
+
+	shutdownTimeout, err := envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+
+	// SIGINT (Ctrl-C) と SIGTERM (Kubernetes) を待つ
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := serve(server, tlsConfig); err != nil {
+			fatal("could not start server", "error", err)
+		}
+	}()
+
+	// NATS_URL を設定すると、NATS に流れてくる投票も受け付ける
+	if err := startNATSVoteConsumer(); err != nil {
+		fatal("could not start nats consumer", "error", err)
+	}
+
+	var grpcServer *grpc.Server
+	if grpcAddr != "" {
+		if grpcServer, err = startGRPCServer(grpcAddr); err != nil {
+			fatal("could not start grpc server", "addr", grpcAddr, "error", err)
+		}
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down", "timeout", shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// 配信の接続に閉じることを知らせ、閉じ終わるまで待ってから HTTP サーバーを止める
+	closeStreams(shutdownCtx)
+	// gRPC も同じ期限で止める (WatchResults は HTTP の Shutdown が閉じる shuttingDown で終わる)
+	grpcStopped := make(chan struct{})
+	go func() {
+		stopGRPCServer(shutdownCtx, grpcServer)
+		close(grpcStopped)
+	}()
+	err = server.Shutdown(shutdownCtx)
+	<-grpcStopped
+	if err != nil {
+		closeStore()
+		fatal("shutdown did not complete", "error", err)
+	}
+
+	// NATS から届いて処理中の投票を終えてから保存先を閉じる
+	stopNATSVoteConsumer(shutdownCtx)
+
+	// 永続化したデータはここで確実に書き出して閉じる
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	if webhook != nil {
+		webhook.Close()
+	}
+	if err := closeStore(); err != nil {
+		slog.Error("failed to close vote store", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
 	}
+	slog.Info("shutdown complete")
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// テストで使う管理用キー
+const testAdminKey = "test-admin-key"
+
+func TestMain(m *testing.M) {
+	// ハンドラーのログはテストの出力に混ぜない (LOG_LEVEL=debug などで見る)
+	level := slog.LevelError + 1
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		level.UnmarshalText([]byte(v))
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	setVoteOptions(defaultVoteOptions)
+	defaultRoom = newRoom("", newMemoryStore(currentOptions.Load().keys))
+
+	// 集計を配るハブは main と同じく1つだけ動かす (止まるのはサーバーの終了時だけ)
+	hub = newWSHub()
+	go hub.run()
+
+	os.Exit(m.Run())
+}
+
+// main と同じ順に環境変数から設定を読み込む (t.Setenv で変えた値を反映する)
+func loadTestConfig(t testing.TB) {
+	t.Helper()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("invalid configuration: %v", err)
+		}
+	}
+
+	options, err := loadVoteOptions()
+	must(err)
+	setVoteOptions(options)
+	allowVoteChange, err = envBool("ALLOW_VOTE_CHANGE", true)
+	must(err)
+	voteCreatedStatus, err = envBool("VOTE_CREATED_STATUS", false)
+	must(err)
+	maxVoters, err = envInt("MAX_VOTERS", 0)
+	must(err)
+	nonceTTL, err := envDuration("VOTE_NONCE_TTL", 0)
+	must(err)
+	voteNonces = nil
+	if nonceTTL > 0 {
+		voteNonces = newNonceCache(nonceTTL)
+	}
+	must(loadIdempotencyTTL())
+	idempotentResponses = &idempotencyCache{entries: make(map[string]*idempotentResponse)}
+	must(loadAnonymousVoting())
+	must(loadSessionTTL())
+	must(loadRequireSession())
+	must(loadSessionClearsVote())
+	must(loadAccessLog())
+	must(loadVoteLogSampling())
+	must(loadVoteChangeCooldown())
+	allowedUsersFile = os.Getenv("ALLOWED_USERS_FILE")
+	must(loadAllowedUsers())
+	must(loadMaxStreams())
+	must(loadMaxUserIDLength())
+	must(loadMinReveal())
+	must(loadOrphanedVotePolicy())
+	must(loadDeviceGuard())
+	must(loadVoteConfirm())
+	must(loadVoteMode())
+	resultsETag, err = envBool("RESULTS_ETAG", true)
+	must(err)
+	must(loadResultsMaxAge())
+	must(loadVoteWeights())
+	must(loadMaxOptionCount())
+	must(loadOptionCaps())
+	must(loadVoteAliases())
+	must(loadQuorum())
+	must(loadCloseDefaultOption())
+	webhookThresholds, err = loadWebhookThresholds()
+	must(err)
+	must(loadSurgeDetector())
+	devMode, err = envBool("DEV_MODE", false)
+	must(err)
+	trustedProxies, err = loadTrustedProxies()
+	must(err)
+	storeTimeout, err = envDuration("STORE_TIMEOUT", defaultStoreTimeout)
+	must(err)
+	strictJSON, err = envBool("STRICT_JSON", false)
+	must(err)
+}
+
+// テスト用のサーバー (newRouter をそのまま httptest.Server で動かす)
+type testServer struct {
+	*httptest.Server
+}
+
+// 設定を env ("KEY=value" の並び) で読み込み直し、メモリ上の空の投票でサーバーを立てる
+// 部屋・投票の定義・レート制限などの状態は毎回作り直すので、テストどうしで投票は残らない
+func newTestServer(t testing.TB, env ...string) *testServer {
+	t.Helper()
+	for _, kv := range env {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			t.Fatalf("invalid env %q", kv)
+		}
+		t.Setenv(key, value)
+	}
+	loadTestConfig(t)
+
+	adminKey = testAdminKey
+	verifier = nil
+	userRateLimiter = nil
+	ipRateLimiter = nil
+	closeViewers = &sessionViewers{rooms: make(map[string]map[string]struct{})}
+	openStore = func(roomID string) (VoteStore, error) {
+		return newMemoryStore(roomOptions(roomID).keys), nil
+	}
+	roomExists = func(string) bool { return false }
+
+	roomsMutex.Lock()
+	rooms = make(map[string]*room)
+	roomsMutex.Unlock()
+	pollsMutex.Lock()
+	polls = make(map[string]*pollDefinition)
+	pollsMutex.Unlock()
+
+	defaultRoom = newRoom("", newMemoryStore(currentOptions.Load().keys))
+	var err error
+	if defaultRoom.schedule, err = loadPollSchedule(); err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+
+	// WebSocket に切り替えた接続は Close が待たないので、ハンドラーが戻るまで待ってから次のテストで設定を変える
+	var handlers sync.WaitGroup
+	router := newRouter()
+	srv := &testServer{httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		router.ServeHTTP(w, r)
+	}))}
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+	})
+	return srv
+}
+
+// テストのリクエストに付けるヘッダー (値が空ならそのヘッダーを消す)
+type header map[string]string
+
+// 管理用キーのヘッダー
+var adminHeader = header{"X-Admin-Key": testAdminKey}
+
+// method と path でリクエストを送り、レスポンスとボディを返す
+// body が string ならそのまま、それ以外は JSON にして送る (nil なら空)
+func (s *testServer) do(t testing.TB, method, path string, body any, headers ...header) (*http.Response, []byte) {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, h := range headers {
+		for k, v := range h {
+			if v == "" {
+				req.Header.Del(k)
+			} else {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+	res, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, data
+}
+
+// POST path に userID の vote を送る。ステータスが want でなければ失敗にする
+func (s *testServer) vote(t testing.TB, path, userID, vote string, want int) VoteResponse {
+	t.Helper()
+	res, data := s.do(t, http.MethodPost, path, VoteRequest{UserID: userID, Vote: vote})
+	if res.StatusCode != want {
+		t.Errorf("POST %s %s=%s: status %d, want %d: %s", path, userID, vote, res.StatusCode, want, data)
+		return VoteResponse{}
+	}
+	var body VoteResponse
+	if res.StatusCode < 300 {
+		decodeJSON(t, data, &body)
+	}
+	return body
+}
+
+// GET path の結果を読む
+func (s *testServer) results(t testing.TB, path string, headers ...header) ResultsResponse {
+	t.Helper()
+	res, data := s.do(t, http.MethodGet, path, nil, headers...)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET %s: status %d: %s", path, res.StatusCode, data)
+		return ResultsResponse{}
+	}
+	var body ResultsResponse
+	decodeJSON(t, data, &body)
+	return body
+}
+
+// 結果の選択肢ごとの票数
+func resultCounts(res ResultsResponse) map[string]int {
+	counts := make(map[string]int, len(res.Options))
+	for key, o := range res.Options {
+		counts[key] = o.Count
+	}
+	return counts
+}
+
+func decodeJSON(t testing.TB, data []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Errorf("decode %s: %v", data, err)
+	}
+}
+
+// エラーレスポンスの code
+func errorCode(t testing.TB, data []byte) string {
+	t.Helper()
+	var body struct {
+		Error ErrorDetail `json:"error"`
+	}
+	decodeJSON(t, data, &body)
+	return body.Error.Code
+}
+
+// 2つの票数が同じか (0 の選択肢は無くても同じとみなす)
+func sameCounts(a, b map[string]int) bool {
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	for k, v := range b {
+		if a[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 投票のリクエストのボディ
+func voteBody(userID, vote string) io.Reader {
+	data, _ := json.Marshal(VoteRequest{UserID: userID, Vote: vote})
+	return bytes.NewReader(data)
+}
+
+// 同じ選択肢への再投票 (表示名でもキーでも) は票数を変えず unchanged を返す
+func TestRevoteSameOption(t *testing.T) {
+	srv := newTestServer(t)
+
+	for i, vote := range []string{"あつい", "hot", "あつい"} {
+		want := voteStatusUnchanged
+		if i == 0 {
+			want = voteStatusNew
+		}
+		res := srv.vote(t, "/v1/vote", "u1", vote, http.StatusOK)
+		if res.Status != want {
+			t.Errorf("vote %d (%s): status %q, want %q", i, vote, res.Status, want)
+		}
+		if !sameCounts(res.Counts, map[string]int{"hot": 1}) {
+			t.Errorf("vote %d (%s): counts %v, want hot=1", i, vote, res.Counts)
+		}
+	}
+
+	_, data := srv.do(t, http.MethodGet, "/v1/vote/u1", nil)
+	var user UserVoteResponse
+	decodeJSON(t, data, &user)
+	if user.Vote != "hot" {
+		t.Errorf("GET /vote/u1: %q, want hot", user.Vote)
+	}
+}
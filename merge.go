@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// POST /admin/merge で、両方に投票のあるユーザーをどちらの投票にするか (?conflict=)
+const (
+	mergeConflictLatest   = "latest"   // 後に投票した方 (既定)
+	mergeConflictExisting = "existing" // この部屋の投票のまま
+	mergeConflictIncoming = "incoming" // 取り込む側の投票
+)
+
+// POST /admin/merge のレスポンス形式
+type MergeResponse struct {
+	Counts       map[string]int `json:"counts"`                 // 取り込んだ後の票数
+	Conflict     string         `json:"conflict"`               // 使った conflict の方針
+	Added        int            `json:"added"`                  // この部屋に投票の無かったユーザー (匿名投票モードでは匿名の票として足したユーザーの投票)
+	Replaced     int            `json:"replaced"`               // 両方に投票があり、取り込む側の投票にしたユーザー
+	Kept         int            `json:"kept"`                   // 両方に投票があり、この部屋の投票のままにしたユーザー
+	Unchanged    int            `json:"unchanged"`              // 両方で同じ選択肢に投票していたユーザー
+	Unattributed map[string]int `json:"unattributed,omitempty"` // 誰の票か分からないので、そのまま足した票
+}
+
+// 取り込む側の票数のうち、ユーザーごとの投票で説明できない分 (選択肢ごと)
+// counts が無ければユーザーごとの投票だけを取り込む。票数がユーザーの投票より少ない選択肢はエラー
+func unattributedCounts(b backupFile) (map[string]int, error) {
+	if b.Counts == nil {
+		return nil, nil
+	}
+	attributed := make(map[string]int)
+	for _, v := range b.UserVotes {
+		attributed[v.Vote]++
+	}
+	extra := make(map[string]int)
+	for option, n := range attributed {
+		if b.Counts[option] < n {
+			return nil, &invalidBackupError{fmt.Sprintf("counts for %q are lower than its user votes", option)}
+		}
+	}
+	for option, count := range b.Counts {
+		if n := count - attributed[option]; n > 0 {
+			extra[option] = n
+		}
+	}
+	return extra, nil
+}
+
+// POST /admin/merge?roomId=&conflict= エンドポイントの処理 (管理用)
+// 別の端末でオフラインで行った同じ投票の結果 (GET /admin/backup の形式) を、この部屋の投票に足し合わせる
+// ユーザーごとの投票はユーザーIDで突き合わせるので、両方で投票したユーザーを二重に数えない
+// 両方に投票のあるユーザーは conflict の方針で一方の投票にする (latest は votedAt を比べ、同じ時刻か votedAt が無ければこの部屋のまま)
+// 票数のうちユーザーごとの投票で説明できない分 (票数だけを渡したときなど) は誰の票か分からないので、
+// POST /admin/adjust と同じく票数に足す (重み付きの票数には1票ずつ足す。GET /results に adjustedAt が付く)
+// 匿名投票モードではユーザーごとの投票を残さないので、突き合わせずにすべて匿名の票として足す
+// 現在の選択肢に無い票や、投票では使えないユーザーIDを含むものは、何も取り込まずに 400。書き込みが途中で失敗すると一部だけ取り込んだ状態になる
+// 終了して結果が確定した投票には取り込めない (POST /admin/reopen で再開してから)。複数選択モードでは 403
+func adminMergeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if multiSelectVoting {
+		writeMultiSelectUnsupported(w)
+		return
+	}
+
+	conflict := r.URL.Query().Get("conflict")
+	switch conflict {
+	case "":
+		conflict = mergeConflictLatest
+	case mergeConflictLatest, mergeConflictExisting, mergeConflictIncoming:
+	default:
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("conflict must be %s, %s or %s", mergeConflictLatest, mergeConflictExisting, mergeConflictIncoming))
+		return
+	}
+
+	var b backupFile
+	if err := decodeJSONBody(w, r, &b, maxRestoreBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rm.freezeIfClosed(time.Now())
+	if !rm.checkNotFinal(w) {
+		return
+	}
+
+	// どちらも invalidBackupError だけを返す
+	if err := rm.validateBackup(b); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	extra, err := unattributedCounts(b)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	res := MergeResponse{Conflict: conflict}
+	if len(extra) > 0 {
+		res.Unattributed = extra
+	}
+	now := time.Now()
+	current := rm.store.UserVotes()
+	for userID, v := range b.UserVotes {
+		prev, exists := current[userID]
+		switch {
+		case !exists:
+			res.Added++
+		case prev.Vote == v.Vote:
+			res.Unchanged++
+			continue
+		// votedAt の無い投票はいつのものか分からないので、この部屋の投票より新しいとはみなさない
+		case conflict == mergeConflictExisting,
+			conflict == mergeConflictLatest && !v.VotedAt.After(prev.VotedAt):
+			res.Kept++
+			continue
+		default:
+			res.Replaced++
+		}
+
+		at := v.VotedAt
+		if at.IsZero() {
+			at = now
+		}
+		ctx, cancel := storeContext(r)
+		var err error
+		if anonymousVoting {
+			err = rm.store.RecordAnonymousVote(ctx, v.Vote, normalizeWeight(v.Weight), at)
+		} else {
+			err = rm.store.RecordVote(ctx, userID, v.Vote, normalizeWeight(v.Weight), at)
+		}
+		cancel()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to merge votes", "event", "merge", "roomId", rm.id, "error", err)
+			writeStoreError(w, err, "Failed to merge votes")
+			return
+		}
+		if anonymousVoting {
+			continue
+		}
+		if exists {
+			// 前の投票に付いていたものは取り込んだ投票には当てはまらない
+			rm.untallyCohort(userID, prev.Vote)
+			delete(rm.comments, userID)
+			rm.dropReceipt(userID)
+			rm.recordTransition(userID, transitionChanged, prev.Vote, v.Vote, now)
+		} else {
+			rm.recordTransition(userID, transitionNew, "", v.Vote, now)
+		}
+	}
+	if len(extra) > 0 {
+		ctx, cancel := storeContext(r)
+		err := adjustStoreCounts(ctx, rm.store, extra, now)
+		cancel()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to merge vote counts", "event", "merge", "roomId", rm.id, "error", err)
+			writeStoreError(w, err, "Failed to merge votes")
+			return
+		}
+	}
+	rm.notifySubscribers()
+
+	recordAudit(AuditEntry{
+		Action:    "merge",
+		RoomID:    rm.id,
+		Deltas:    res.Unattributed,
+		RemoteIP:  remoteIP(r),
+		RequestID: requestIDFromContext(r.Context()),
+	})
+
+	res.Counts = rm.store.Counts()
+	rm.updateVoteGauges(res.Counts)
+	slog.WarnContext(r.Context(), "votes merged", "event", "merge", "roomId", rm.id, "conflict", conflict,
+		"added", res.Added, "replaced", res.Replaced, "kept", res.Kept, "unchanged", res.Unchanged, "unattributed", res.Unattributed, "counts", res.Counts)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
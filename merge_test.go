@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminMerge(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name     string
+		conflict string
+		body     string
+		counts   map[string]int
+		merged   MergeResponse
+	}{
+		{
+			name:   "votedAt missing does not beat the existing vote",
+			body:   `{"userVotes":{"u1":{"vote":"cold"},"u3":{"vote":"ok"}}}`,
+			counts: map[string]int{"hot": 1, "cold": 1, "ok": 1},
+			merged: MergeResponse{Added: 1, Kept: 1},
+		},
+		{
+			name:   "later vote replaces",
+			body:   fmt.Sprintf(`{"userVotes":{"u1":{"vote":"cold","votedAt":%q},"u2":{"vote":"hot","votedAt":%q}}}`, future, past),
+			counts: map[string]int{"cold": 2},
+			merged: MergeResponse{Replaced: 1, Kept: 1},
+		},
+		{
+			name:     "incoming",
+			conflict: mergeConflictIncoming,
+			body:     `{"userVotes":{"u1":{"vote":"ok"},"u2":{"vote":"cold"}}}`,
+			counts:   map[string]int{"ok": 1, "cold": 1},
+			merged:   MergeResponse{Replaced: 1, Unchanged: 1},
+		},
+		{
+			name:     "existing",
+			conflict: mergeConflictExisting,
+			body:     fmt.Sprintf(`{"userVotes":{"u1":{"vote":"ok","votedAt":%q}}}`, future),
+			counts:   map[string]int{"hot": 1, "cold": 1},
+			merged:   MergeResponse{Kept: 1},
+		},
+		{
+			name:   "unattributed counts",
+			body:   `{"counts":{"ok":3},"userVotes":{"u3":{"vote":"ok"}}}`,
+			counts: map[string]int{"hot": 1, "cold": 1, "ok": 3},
+			merged: MergeResponse{Added: 1, Unattributed: map[string]int{"ok": 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+			srv.vote(t, "/v1/vote", "u2", "cold", http.StatusOK)
+
+			path := "/v1/admin/merge"
+			if tt.conflict != "" {
+				path += "?conflict=" + tt.conflict
+			}
+			res, data := srv.do(t, http.MethodPost, path, tt.body, adminHeader)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("merge: status %d: %s", res.StatusCode, data)
+			}
+			var merged MergeResponse
+			decodeJSON(t, data, &merged)
+			if merged.Added != tt.merged.Added || merged.Replaced != tt.merged.Replaced || merged.Kept != tt.merged.Kept ||
+				merged.Unchanged != tt.merged.Unchanged || !sameCounts(merged.Unattributed, tt.merged.Unattributed) {
+				t.Errorf("merge result %+v, want %+v", merged, tt.merged)
+			}
+			if !sameCounts(merged.Counts, tt.counts) {
+				t.Errorf("merge counts %v, want %v", merged.Counts, tt.counts)
+			}
+			if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, tt.counts) {
+				t.Errorf("GET /results %v, want %v", got, tt.counts)
+			}
+		})
+	}
+}
+
+func TestAdminMergeRejects(t *testing.T) {
+	srv := newTestServer(t)
+	for _, tt := range []struct {
+		name, path, body string
+		status           int
+	}{
+		{"unknown conflict", "/v1/admin/merge?conflict=newest", `{}`, http.StatusBadRequest},
+		{"unknown option", "/v1/admin/merge", `{"userVotes":{"u1":{"vote":"warm"}}}`, http.StatusBadRequest},
+		{"counts below user votes", "/v1/admin/merge", `{"counts":{"hot":0},"userVotes":{"u1":{"vote":"hot"}}}`, http.StatusBadRequest},
+	} {
+		if res, data := srv.do(t, http.MethodPost, tt.path, tt.body, adminHeader); res.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, res.StatusCode, tt.status, data)
+		}
+	}
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, nil) {
+		t.Errorf("rejected merges changed counts: %v", got)
+	}
+}
+
+// 使えないユーザーIDが1つでもあれば、他のユーザーの投票も取り込まない
+func TestMergeRejectsInvalidUserIDs(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+
+	for _, conflict := range []string{mergeConflictLatest, mergeConflictIncoming} {
+		body := `{"userVotes":{"u1":{"vote":"cold"},"u2":{"vote":"ok"},"bad\u001fhot":{"vote":"ok"}}}`
+		res, data := srv.do(t, http.MethodPost, "/v1/admin/merge?conflict="+conflict, body, adminHeader)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", conflict, res.StatusCode, data)
+		} else if !strings.Contains(string(data), "control characters") {
+			t.Errorf("%s: %s, want the user id error", conflict, data)
+		}
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// 受け付けた投票の数 (取り消しや変更で減ることはない)
+	votesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "votes_total",
+		Help: "Number of votes accepted, by room and option.",
+	}, []string{"room", "option"})
+
+	// 現在の票数 (voteCounts と同じ値)
+	voteCurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vote_current",
+		Help: "Current vote count, by room and option.",
+	}, []string{"room", "option"})
+
+	// 現在の票数の合計 (部屋ごと)
+	voteTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vote_total",
+		Help: "Current total number of votes, by room.",
+	}, []string{"room"})
+
+	// 最も多い選択肢の票数が合計に占める割合 (0〜1。票が無ければ0)
+	// 1つの選択肢に票が偏ったとき (例えば 0.8 を超えたとき) のアラート用
+	voteDominanceRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vote_dominance_ratio",
+		Help: "Share of the leading option in the current total votes (0-1), by room.",
+	}, []string{"room"})
+
+	// 票数の不整合を見つけて直した回数 (negative_count: 0未満になる減算を0で止めた, unknown_option: 票数の無い選択肢への増減)
+	voteCountAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vote_count_anomalies_total",
+		Help: "Number of inconsistent vote count updates that were corrected or ignored, by reason.",
+	}, []string{"reason"})
+
+	// ハンドラーごとのリクエストの処理時間
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by handler.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
+
+// main でコレクターを登録する
+func registerMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(votesTotal, voteCurrent, voteTotal, voteDominanceRatio, voteCountAnomalies, requestDuration, deliberationSeconds, votesPerMinute, votesPerMinutePeak, openStreams, natsVotesTotal)
+}
+
+// 票数のゲージを現在の集計に合わせる
+// ずれないよう、集計を変えたのと同じロックの中で呼ぶこと
+func (rm *room) updateVoteGauges(counts map[string]int) {
+	for option, count := range counts {
+		voteCurrent.WithLabelValues(rm.id, option).Set(float64(count))
+	}
+	total, ratio := voteDominance(counts)
+	voteTotal.WithLabelValues(rm.id).Set(float64(total))
+	voteDominanceRatio.WithLabelValues(rm.id).Set(ratio)
+}
+
+// 票数の合計と、最も多い選択肢の票数が合計に占める割合 (票が無ければ 0, 0)
+func voteDominance(counts map[string]int) (total int, ratio float64) {
+	top := 0
+	for _, count := range counts {
+		total += count
+		top = max(top, count)
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return total, float64(top) / float64(total)
+}
+
+// ハンドラーの処理時間をヒストグラムに記録するミドルウェア
+// トレースが有効なら、リクエストのスパンにもハンドラーの名前とルートを付ける
+func instrument(name string, next http.HandlerFunc) http.HandlerFunc {
+	observer := requestDuration.WithLabelValues(name)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(attribute.String("handler", name), attribute.String("http.route", r.Pattern))
+		}
+		start := time.Now()
+		next(w, r)
+		observer.Observe(time.Since(start).Seconds())
+	}
+}
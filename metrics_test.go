@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVoteDominance(t *testing.T) {
+	tests := []struct {
+		counts map[string]int
+		total  int
+		ratio  float64
+	}{
+		{nil, 0, 0},
+		{map[string]int{"hot": 0, "ok": 0, "cold": 0}, 0, 0},
+		{map[string]int{"hot": 5}, 5, 1},
+		{map[string]int{"hot": 1, "ok": 1, "cold": 1}, 3, 1.0 / 3},
+		{map[string]int{"hot": 8, "ok": 1, "cold": 1}, 10, 0.8},
+		{map[string]int{"hot": 9, "ok": 1, "cold": 0}, 10, 0.9},
+		{map[string]int{"hot": 2, "ok": 2, "cold": 1}, 5, 0.4}, // 同票でも最も多い票数の割合
+		{map[string]int{"hot": 1, "ok": 999}, 1000, 0.999},
+	}
+	for _, tt := range tests {
+		total, ratio := voteDominance(tt.counts)
+		if total != tt.total || math.Abs(ratio-tt.ratio) > 1e-9 {
+			t.Errorf("voteDominance(%v) = %d, %v, want %d, %v", tt.counts, total, ratio, tt.total, tt.ratio)
+		}
+	}
+}
+
+// 投票のたびに vote_total と vote_dominance_ratio が今の集計に合う
+func TestDominanceGauges(t *testing.T) {
+	srv := newTestServer(t)
+	room := "gauges"
+	path := "/v1/rooms/" + room + "/vote"
+
+	steps := []struct {
+		user, vote string
+		total      int
+		ratio      float64
+	}{
+		{"u1", "hot", 1, 1},
+		{"u2", "cold", 2, 0.5},
+		{"u3", "hot", 3, 2.0 / 3},
+		{"u4", "hot", 4, 0.75},
+		{"u2", "hot", 4, 1},
+	}
+	for _, step := range steps {
+		srv.vote(t, path, step.user, step.vote, http.StatusOK)
+		if got := testutil.ToFloat64(voteTotal.WithLabelValues(room)); got != float64(step.total) {
+			t.Errorf("after %s votes %s: vote_total %v, want %d", step.user, step.vote, got, step.total)
+		}
+		if got := testutil.ToFloat64(voteDominanceRatio.WithLabelValues(room)); math.Abs(got-step.ratio) > 1e-9 {
+			t.Errorf("after %s votes %s: vote_dominance_ratio %v, want %v", step.user, step.vote, got, step.ratio)
+		}
+	}
+
+	if res, data := srv.do(t, http.MethodDelete, "/v1/rooms/"+room+"/vote?userId=u1", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /vote: status %d: %s", res.StatusCode, data)
+	}
+	if got := testutil.ToFloat64(voteTotal.WithLabelValues(room)); got != 3 {
+		t.Errorf("after retract: vote_total %v, want 3", got)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ハンドラーのpanicを拾って500を返すミドルウェア
+// 1つのリクエストのせいで接続が黙って切れないようにする (エラー通知を足すならここ)
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// 意図的な中断はそのまま net/http に任せる
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			slog.ErrorContext(r.Context(), "panic in handler",
+				"event", "panic",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", err,
+				"stack", string(debug.Stack()),
+			)
+
+			writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// これより小さいレスポンスは圧縮しない (gzipのヘッダーの分かえって大きくなる)
+const gzipMinSize = 1 << 10
+
+var gzipWriterPool = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// Accept-Encoding: gzip のクライアントにはレスポンスをgzipで返すミドルウェア
+// WebSocketの切り替えとSSE (text/event-stream) は圧縮せずにそのまま流す
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			// gzip;q=0 は明示的な拒否
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// 書き込みが gzipMinSize に達するまで溜めておき、達したら圧縮を始める ResponseWriter
+// 達しないまま終わったときや途中で Flush されたときは、溜めた分をそのまま書く
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+
+	gz          *gzip.Writer
+	passthrough bool // 圧縮しないと決めた
+	wroteHeader bool // 下の ResponseWriter にヘッダーを書いた
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader || g.gz != nil {
+		return
+	}
+	g.status = status
+
+	h := g.Header()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		g.startPassthrough()
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.passthrough {
+		return g.ResponseWriter.Write(p)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// ストリーミングするハンドラー向け。まだ圧縮を始めていなければ、以降は圧縮しない
+func (g *gzipResponseWriter) Flush() {
+	switch {
+	case g.gz != nil:
+		g.gz.Flush()
+	case !g.passthrough:
+		g.startPassthrough()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) writeHeader() {
+	if !g.wroteHeader {
+		g.wroteHeader = true
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+}
+
+func (g *gzipResponseWriter) startPassthrough() {
+	g.passthrough = true
+	g.writeHeader()
+	if len(g.buf) > 0 {
+		g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+func (g *gzipResponseWriter) startGzip() error {
+	h := g.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.writeHeader()
+
+	g.gz = gzipWriterPool.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// ハンドラーが終わったら、圧縮中なら閉じ、溜めたままならそのまま書く
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+		gzipWriterPool.Put(g.gz)
+		g.gz = nil
+		return
+	}
+	if !g.passthrough {
+		g.startPassthrough()
+	}
+}
+
+// リクエストIDを入れる context のキー
+type requestIDKey struct{}
+
+// クライアントから受け取るリクエストIDとして使える文字列 (ログやヘッダーを壊さないように制限する)
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// X-Request-ID を受け取るか新しく作り、context とレスポンスのヘッダーに入れるミドルウェア
+// ハンドラーが slog.*Context で出すログにはすべてこのIDが付く
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// context のリクエストID (無ければ空文字)
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// アクセスログを出すか (ACCESS_LOG=false で止める)
+var accessLog = true
+
+// 接続を張ったままにするエンドポイント (SSE, WebSocket, ロングポーリング) のアクセスログを残す割合
+// (ACCESS_LOG_STREAM_SAMPLE。0 で出さない、1 ですべて出す)
+var accessLogStreamSample = defaultAccessLogStreamSample
+
+const defaultAccessLogStreamSample = 0.1
+
+// ACCESS_LOG と ACCESS_LOG_STREAM_SAMPLE を読む
+func loadAccessLog() error {
+	var err error
+	if accessLog, err = envBool("ACCESS_LOG", true); err != nil {
+		return err
+	}
+	if accessLogStreamSample, err = envFloat("ACCESS_LOG_STREAM_SAMPLE", defaultAccessLogStreamSample); err != nil {
+		return err
+	}
+	if accessLogStreamSample < 0 || accessLogStreamSample > 1 {
+		return fmt.Errorf("ACCESS_LOG_STREAM_SAMPLE must be between 0 and 1")
+	}
+	return nil
+}
+
+// 件数の多い接続を張ったままのエンドポイントか (ルートのパターンで見分ける)
+func isStreamingRoute(pattern string) bool {
+	for _, suffix := range []string{"/results/stream", "/results/poll", "/results/diff", "/ws"} {
+		if strings.HasSuffix(pattern, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// リクエストごとにメソッド、パス、ステータス、レスポンスの大きさ、処理時間をログに出すミドルウェア
+// リクエストIDを付けたいので withRequestID の内側に置く
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withLogSample(r.Context()))
+		if !accessLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// r.Pattern はルーティングの後に分かる
+		if isStreamingRoute(r.Pattern) && rand.Float64() >= accessLogStreamSample {
+			return
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// エラーになった投票は間引かずに残す
+		if isVoteRoute(r) && status < http.StatusBadRequest && !logSampled(r.Context()) {
+			return
+		}
+		slog.InfoContext(r.Context(), "request",
+			"event", "access",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", r.Pattern,
+			"status", status,
+			"bytes", rec.bytes,
+			"durationMs", time.Since(start).Milliseconds(),
+			"remoteIp", remoteIP(r),
+		)
+	})
+}
+
+// 書いたステータスとバイト数を覚えておく ResponseWriter
+// SSE の Flush と WebSocket の Hijack はそのまま下の ResponseWriter に渡す
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	if s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// クライアントに書き出さずにレスポンスを溜めておく ResponseWriter
+// ハンドラーを中から呼んで、そのレスポンスを後で使うとき (NATS の投票の返信など) に渡す
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// 書かれたステータス (何も書かれていなければ 200)
+func (b *bufferedResponse) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
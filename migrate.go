@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// --migrate-from で書き込んだ件数
+type migrationReport struct {
+	Rooms   int // 投票を書き込んだ部屋の数
+	Votes   int // 書き込んだユーザーの投票
+	Skipped int // 現在の設定では受け付けない投票 (選択肢に無い、ユーザーIDが不正など)
+	Polls   int // 書き込んだ投票の定義 (POST /polls)
+}
+
+// SNAPSHOT_PATH のスナップショットを、いま設定されている保存先 (target は sqlite か redis) に書き込む
+// メモリ上の保存先から永続化する保存先に移るとき用。起動時の --migrate-from から呼び、書き終えたらサーバーは起動せずに終了する
+// 書き込む前にすべての投票を現在の選択肢で確かめる。選択肢に無い投票は飛ばして件数だけ数える
+// 書き込み先に投票のある部屋があれば、何も書かずにエラーにする (二重に数えないため。先に POST /admin/reset で空にする)
+func migrateSnapshot(path, target string) (migrationReport, error) {
+	var report migrationReport
+	if target != "sqlite" && target != "redis" {
+		return report, fmt.Errorf("invalid --migrate-to %q: want sqlite or redis", target)
+	}
+	if target != storeBackend {
+		return report, fmt.Errorf("--migrate-to=%s but the configured store is %s (set DB_PATH or REDIS_URL, and unset SNAPSHOT_PATH)", target, storeBackend)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return report, fmt.Errorf("parse snapshot: %w", err)
+	}
+
+	// 部屋の選択肢が決まるよう、先に投票の定義を書き込む (書き込み先にすでにあるものはそのまま)
+	for _, info := range file.Polls {
+		if _, ok := lookupPoll(info.ID); ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		err := storePoll(ctx, info)
+		cancel()
+		if err != nil {
+			return report, fmt.Errorf("save poll %q: %w", info.ID, err)
+		}
+		registerPolls([]pollInfo{info})
+		report.Polls++
+	}
+
+	roomIDs := make([]string, 0, len(file.Rooms))
+	for id := range file.Rooms {
+		if id != "" && !roomIDPattern.MatchString(id) {
+			return report, fmt.Errorf("invalid room id %q", id)
+		}
+		roomIDs = append(roomIDs, id)
+	}
+	slices.Sort(roomIDs)
+
+	targets := make(map[string]*room, len(roomIDs))
+	for _, id := range roomIDs {
+		rm := defaultRoom
+		if id != "" {
+			if rm, err = getRoom(id, true); err != nil {
+				return report, fmt.Errorf("open room %q: %w", id, err)
+			}
+		}
+		if total, _ := voteDominance(rm.store.Counts()); total > 0 {
+			return report, fmt.Errorf("room %q already has votes in the %s store", id, target)
+		}
+		targets[id] = rm
+	}
+
+	newContext := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), storeTimeout)
+	}
+	for _, id := range roomIDs {
+		migrated, skipped, err := targets[id].migrateRoomSnapshot(newContext, file.Rooms[id])
+		if err != nil {
+			return report, fmt.Errorf("migrate room %q: %w", id, err)
+		}
+		slog.Info("room migrated", "event", "migrate", "roomId", id, "votes", migrated, "skipped", skipped)
+		report.Rooms++
+		report.Votes += migrated
+		report.Skipped += skipped
+	}
+	return report, nil
+}
+
+// 部屋のスナップショットの投票を保存先に書き込み、書き込んだ数と飛ばした数を返す
+func (rm *room) migrateRoomSnapshot(newContext func() (context.Context, context.CancelFunc), snap roomSnapshot) (migrated, skipped int, err error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	set := rm.optionSet()
+	for userID, v := range snap.UserVotes {
+		key, ok := set.canonical(v.Vote)
+		if _, valid := validateUserID(userID); !ok || !valid {
+			slog.Warn("snapshot vote skipped", "event", "migrate", "roomId", rm.id, "userId", logUserID(userID), "vote", sanitizeLogValue(v.Vote))
+			skipped++
+			continue
+		}
+		ctx, cancel := newContext()
+		err := rm.store.RecordVote(ctx, userID, key, normalizeWeight(v.Weight), v.VotedAt)
+		cancel()
+		if err != nil {
+			return migrated, skipped, err
+		}
+		migrated++
+	}
+	if anonymousVoting {
+		// 選択肢に無い匿名の票は戻さない
+		valid := roomSnapshot{Counts: make(map[string]int), WeightedCounts: make(map[string]int)}
+		for option, count := range snap.Counts {
+			key, ok := set.canonical(option)
+			if !ok {
+				skipped += count
+				continue
+			}
+			valid.Counts[key] += count
+			if w, ok := snap.WeightedCounts[option]; ok {
+				valid.WeightedCounts[key] += w
+			}
+		}
+		if err := rm.restoreAnonymousVotes(newContext, valid); err != nil {
+			return migrated, skipped, err
+		}
+	}
+	return migrated, skipped, nil
+}
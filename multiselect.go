@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 投票のモード (VOTE_MODE)
+const (
+	voteModeSingle = "single" // 1人1つの選択肢 (既定)
+	voteModeMulti  = "multi"  // 1人がいくつでも選べる (当てはまるものをすべて選ぶアンケート用)
+)
+
+// 複数選択モードの投票の status
+const (
+	voteStatusAdded   = "added"   // 選択肢を選んだ
+	voteStatusRemoved = "removed" // 選んでいた選択肢を外した
+)
+
+// 複数選択モード (VOTE_MODE=multi) か
+// POST /vote は選択肢を選ぶか外すかの切り替えになり (選んでいる選択肢に投票すると外す)、票数は選択肢ごとに選んでいる人数になる
+// そのため票数の合計 (total) は選んだ数の合計で、投票した人数は GET /results の voters で返す
+// ALLOW_VOTE_CHANGE=false のときは、最初に選んだ後は選び足すことも外すこともできない
+// 選択の1つ1つを保存先に「ユーザーID + 区切り + 選択肢」の投票として保存するので、どの保存先でもそのまま使える
+// コメントとコホートも選択ごとに覚える (コメントはその選択肢を選んだときに送ったもの。外すと消える)
+// 投票の変更 (PATCH)、取り消し (DELETE /vote)、まとめての投票、VOTE_CONFIRM_TTL、MAX_VOTERS、CLOSE_DEFAULT_OPTION、匿名投票とは一緒に使えない
+var multiSelectVoting bool
+
+// 選択のユーザーIDと選択肢の区切り
+// ユーザーIDには制御文字を使えないので、本物のユーザーIDと重ならない
+const selectionSeparator = "\x1f"
+
+// VOTE_MODE を読む。複数選択モードと一緒に使えない設定があればエラー (他の設定を読んだ後に呼ぶ)
+func loadVoteMode() error {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("VOTE_MODE")))
+	switch mode {
+	case "", voteModeSingle:
+		multiSelectVoting = false
+		return nil
+	case voteModeMulti:
+	default:
+		return fmt.Errorf("invalid VOTE_MODE %q: want %s or %s", mode, voteModeSingle, voteModeMulti)
+	}
+	switch {
+	case anonymousVoting:
+		return errors.New("VOTE_MODE=multi cannot be used with ANONYMOUS_VOTING")
+	case voteConfirmTTL > 0:
+		return errors.New("VOTE_MODE=multi cannot be used with VOTE_CONFIRM_TTL")
+	case maxVoters > 0:
+		return errors.New("VOTE_MODE=multi cannot be used with MAX_VOTERS")
+	}
+	multiSelectVoting = true
+	return nil
+}
+
+// ユーザーが option を選んだことを保存するときのユーザーID
+func selectionUserID(userID, option string) string {
+	return userID + selectionSeparator + option
+}
+
+// ユーザーが選んでいる選択肢 (選択肢の順。呼び出し側でロックを取っておくこと)
+func (rm *room) userSelections(userID string) []string {
+	selections := []string{}
+	for _, option := range rm.optionSet().keys {
+		if _, ok := rm.store.UserVote(selectionUserID(userID, option)); ok {
+			selections = append(selections, option)
+		}
+	}
+	return selections
+}
+
+// 選択を数えるコホート。cohort が空なら、そのユーザーの他の選択のコホートを使う (呼び出し側でロックを取っておくこと)
+func (rm *room) selectionCohort(userID, cohort string) string {
+	if cohort != "" {
+		return cohort
+	}
+	for _, option := range rm.userSelections(userID) {
+		if c, ok := rm.userCohorts[selectionUserID(userID, option)]; ok {
+			return c
+		}
+	}
+	return ""
+}
+
+// 1つでも選択肢を選んでいるユーザーの数 (呼び出し側でロックを取っておくこと)
+func (rm *room) multiSelectVoters() int {
+	users := make(map[string]struct{})
+	for id := range rm.store.UserVotes() {
+		if userID, _, ok := strings.Cut(id, selectionSeparator); ok {
+			users[userID] = struct{}{}
+		}
+	}
+	return len(users)
+}
+
+// 複数選択モードの POST /vote の処理 (voteHandler から呼ぶ)
+// req.Vote を選んでいなければ選び、選んでいれば外す。レスポンスの selections はその後に選んでいる選択肢
+func (rm *room) multiSelectVoteHandler(w http.ResponseWriter, r *http.Request, user authUser, req VoteRequest, device string) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if !rm.checkVotingOpen(w) {
+		return
+	}
+	if !rm.checkSession(w, r, req.UserID) {
+		return
+	}
+	if !rm.checkDevice(w, device, req.UserID) {
+		return
+	}
+
+	// 変更できない投票 (ALLOW_VOTE_CHANGE=false) では、選んだ後は選び足すことも外すこともできない
+	if !allowVoteChange && len(rm.userSelections(req.UserID)) > 0 {
+		writeJSONError(w, http.StatusConflict, errCodeAlreadyVoted, "already voted")
+		return
+	}
+
+	id := selectionUserID(req.UserID, req.Vote)
+	_, selected := rm.store.UserVote(id)
+	if !selected && !rm.checkOptionCap(w, false, "", req.Vote) {
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	status := voteStatusAdded
+	var counts map[string]int
+	if selected {
+		status = voteStatusRemoved
+		if err := rm.deleteVote(ctx, id, req.Vote); err != nil {
+			slog.ErrorContext(r.Context(), "failed to remove selection", "event", "vote", "roomId", rm.id, "userId", logUserID(req.UserID), "error", err)
+			writeStoreError(w, err, "Failed to save vote")
+			return
+		}
+		delete(rm.comments, id)
+		rm.untallyCohort(id, req.Vote)
+		rm.notifySubscribers()
+		recordAudit(AuditEntry{
+			Action:    "retract",
+			RoomID:    rm.id,
+			UserID:    req.UserID,
+			OldVote:   req.Vote,
+			RemoteIP:  remoteIP(r),
+			RequestID: requestIDFromContext(r.Context()),
+		})
+		counts = rm.store.Counts()
+		rm.updateVoteGauges(counts)
+		slog.InfoContext(r.Context(), "selection removed", "event", "vote", "status", status, "roomId", rm.id, "userId", logUserID(req.UserID), "vote", req.Vote, "counts", counts)
+	} else {
+		if err := rm.recordVote(ctx, id, req.Vote, voteWeight(req.UserID, user.Role), status); err != nil {
+			slog.ErrorContext(r.Context(), "failed to save selection", "event", "vote", "roomId", rm.id, "userId", logUserID(req.UserID), "error", err)
+			writeStoreError(w, err, "Failed to save vote")
+			return
+		}
+		rm.bindDevice(device, req.UserID, time.Now())
+		rm.saveComment(id, req.Comment, time.Now())
+		rm.tallyCohort(id, rm.selectionCohort(req.UserID, requestCohort(user, req.Cohort)), "", false, req.Vote)
+		counts = rm.voteRecorded(r, req.UserID, "", req.Vote, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(VoteResponse{Status: status, Counts: rm.visibleCounts(r, counts), Selections: rm.userSelections(req.UserID)})
+}
+
+// 複数選択モードでは選択を1つずつ切り替えるので、変更・取り消し・まとめての投票は 403 にする
+// ユーザーに投票が1つだけあるものとして扱う GET /results/me やバックアップ・取り込みも 403
+func writeMultiSelectUnsupported(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusForbidden, errCodeForbidden, "Not supported in multi-select mode")
+}
+
+// ユーザーの選択をすべて消す (DELETE /users/{userId} 用。呼び出し側で書き込みロックを取っておくこと)
+// 消したものがあれば true
+func (rm *room) eraseSelections(r *http.Request, userID string) (bool, error) {
+	erased := false
+	for _, option := range rm.userSelections(userID) {
+		id := selectionUserID(userID, option)
+		ctx, cancel := storeContext(r)
+		err := eraseUserVotes(ctx, rm.store, id)
+		cancel()
+		if errors.Is(err, errVoteNotFound) {
+			continue
+		}
+		if err != nil {
+			return erased, err
+		}
+		delete(rm.comments, id)
+		rm.untallyCohort(id, option)
+		erased = true
+	}
+	return erased, nil
+}
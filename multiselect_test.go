@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCloseDefaultRejectedInMultiMode(t *testing.T) {
+	t.Setenv("VOTE_MODE", voteModeMulti)
+	t.Setenv("CLOSE_DEFAULT_OPTION", "ok")
+	t.Cleanup(func() { multiSelectVoting = false })
+
+	if err := loadVoteMode(); err != nil {
+		t.Fatal(err)
+	}
+	err := loadCloseDefaultOption()
+	if err == nil || !strings.Contains(err.Error(), "VOTE_MODE=multi") {
+		t.Fatalf("loadCloseDefaultOption() = %v, want an error about VOTE_MODE=multi", err)
+	}
+	if closeDefaultOption != "" {
+		t.Errorf("closeDefaultOption = %q, want empty", closeDefaultOption)
+	}
+}
+
+// 選択の保存に使う「ユーザーID + 区切り + 選択肢」は API の外に出さない
+func TestMultiSelectHidesSelectionIDs(t *testing.T) {
+	srv := newTestServer(t, "VOTE_MODE=multi")
+	t.Cleanup(func() { multiSelectVoting = false })
+
+	srv.vote(t, "/v1/vote", "a", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "a", "cold", http.StatusOK)
+	srv.vote(t, "/v1/vote", "b", "hot", http.StatusOK)
+
+	res, data := srv.do(t, http.MethodGet, "/v1/results/hot/voters", nil, adminHeader)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("voters: status %d: %s", res.StatusCode, data)
+	}
+	var voters VotersResponse
+	decodeJSON(t, data, &voters)
+	if want := []string{"a", "b"}; !slices.Equal(voters.Voters, want) {
+		t.Errorf("voters %q, want %q", voters.Voters, want)
+	}
+
+	// ユーザーに投票が1つだけあるものとして扱うエンドポイントは 403
+	for _, tt := range []struct {
+		method, path string
+		body         any
+	}{
+		{http.MethodGet, "/v1/results/me?userId=a", nil},
+		{http.MethodGet, "/v1/admin/backup", nil},
+		{http.MethodPost, "/v1/admin/restore", backupFile{}},
+		{http.MethodPost, "/v1/admin/merge", backupFile{}},
+	} {
+		res, data := srv.do(t, tt.method, tt.path, tt.body, adminHeader)
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s: status %d, want 403: %s", tt.method, tt.path, res.StatusCode, data)
+			continue
+		}
+		if strings.Contains(string(data), selectionSeparator) {
+			t.Errorf("%s %s leaked a selection ID: %s", tt.method, tt.path, data)
+		}
+	}
+}
+
+func TestMultiSelectRespectsAllowVoteChange(t *testing.T) {
+	srv := newTestServer(t, "VOTE_MODE=multi", "ALLOW_VOTE_CHANGE=false")
+	t.Cleanup(func() { multiSelectVoting = false })
+
+	if res := srv.vote(t, "/v1/vote", "a", "hot", http.StatusOK); res.Status != voteStatusAdded {
+		t.Errorf("first selection: status %q, want %q", res.Status, voteStatusAdded)
+	}
+	// 選び足すのも外すのも、投票の変更と同じく 409
+	for _, option := range []string{"cold", "hot"} {
+		res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "a", Vote: option})
+		if res.StatusCode != http.StatusConflict {
+			t.Errorf("toggle %s: status %d, want 409: %s", option, res.StatusCode, data)
+		} else if code := errorCode(t, data); code != errCodeAlreadyVoted {
+			t.Errorf("toggle %s: code %q, want %q", option, code, errCodeAlreadyVoted)
+		}
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+}
+
+// コメントとコホートは選択ごとに数え、外した選択のものは消える
+func TestMultiSelectCommentsAndCohorts(t *testing.T) {
+	srv := newTestServer(t, "VOTE_MODE=multi")
+	t.Cleanup(func() { multiSelectVoting = false })
+
+	for _, req := range []VoteRequest{
+		{UserID: "a", Vote: "hot", Comment: "暑い", Cohort: "3F"},
+		{UserID: "a", Vote: "cold"}, // コホートは a の他の選択のもの
+		{UserID: "b", Vote: "cold", Comment: "寒い", Cohort: "5F"},
+		{UserID: "b", Vote: "cold"}, // 外す
+	} {
+		if res, data := srv.do(t, http.MethodPost, "/v1/vote", req); res.StatusCode != http.StatusOK {
+			t.Fatalf("POST /vote %+v: status %d: %s", req, res.StatusCode, data)
+		}
+	}
+
+	var comments CommentsResponse
+	_, data := srv.do(t, http.MethodGet, "/v1/results/comments", nil)
+	decodeJSON(t, data, &comments)
+	if len(comments.Comments) != 1 || comments.Comments[0].Option != "hot" || comments.Comments[0].Comment != "暑い" {
+		t.Errorf("comments %s", data)
+	}
+
+	res := srv.results(t, "/v1/results?groupBy=cohort")
+	if got, want := res.Cohorts["3F"].Counts, map[string]int{"hot": 1, "cold": 1}; !sameCounts(got, want) {
+		t.Errorf("cohort 3F %v, want %v", got, want)
+	}
+	if got := res.Cohorts["5F"].Total; got != 0 {
+		t.Errorf("cohort 5F total %d after the selection was removed", got)
+	}
+
+	if res, data := srv.do(t, http.MethodDelete, "/v1/users/a", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /users/a: status %d: %s", res.StatusCode, data)
+	}
+	_, data = srv.do(t, http.MethodGet, "/v1/results/comments", nil)
+	decodeJSON(t, data, &comments)
+	if comments.Total != 0 {
+		t.Errorf("comments after erase %s", data)
+	}
+	if got := srv.results(t, "/v1/results?groupBy=cohort").Cohorts["3F"].Total; got != 0 {
+		t.Errorf("cohort 3F total %d after erase", got)
+	}
+}
+
+// 同じ選択肢への投票は選ぶと外すの切り替えになり、total は選んだ数、voters は人数で数える
+func TestMultiSelectToggle(t *testing.T) {
+	srv := newTestServer(t, "VOTE_MODE=multi")
+	t.Cleanup(func() { multiSelectVoting = false })
+
+	steps := []struct {
+		option     string
+		status     string
+		selections []string
+		counts     map[string]int
+	}{
+		{"hot", voteStatusAdded, []string{"hot"}, map[string]int{"hot": 1}},
+		{"cold", voteStatusAdded, []string{"hot", "cold"}, map[string]int{"hot": 1, "cold": 1}},
+		{"hot", voteStatusRemoved, []string{"cold"}, map[string]int{"cold": 1}},
+		{"hot", voteStatusAdded, []string{"hot", "cold"}, map[string]int{"hot": 1, "cold": 1}},
+	}
+	for _, step := range steps {
+		res := srv.vote(t, "/v1/vote", "a", step.option, http.StatusOK)
+		if res.Status != step.status || !slices.Equal(res.Selections, step.selections) {
+			t.Errorf("select %s: status %q, selections %v, want %q %v", step.option, res.Status, res.Selections, step.status, step.selections)
+		}
+		if got := srv.results(t, "/v1/results"); !sameCounts(resultCounts(got), step.counts) || got.Voters != 1 {
+			t.Errorf("select %s: counts %v voters %d, want %v voters 1", step.option, resultCounts(got), got.Voters, step.counts)
+		}
+	}
+
+	srv.vote(t, "/v1/vote", "b", "hot", http.StatusOK)
+	res := srv.results(t, "/v1/results")
+	if got, want := resultCounts(res), map[string]int{"hot": 2, "cold": 1}; !sameCounts(got, want) || res.Total != 3 || res.Voters != 2 {
+		t.Errorf("counts %v total %d voters %d, want %v total 3 voters 2", got, res.Total, res.Voters, want)
+	}
+	var vote UserVoteResponse
+	_, data := srv.do(t, http.MethodGet, "/v1/vote/a", nil)
+	decodeJSON(t, data, &vote)
+	if want := []string{"hot", "cold"}; !slices.Equal(vote.Votes, want) {
+		t.Errorf("GET /vote/a: %s, want votes %v", data, want)
+	}
+
+	// ユーザーを消すと、すべての選択が消える
+	if res, data := srv.do(t, http.MethodDelete, "/v1/users/a", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /users/a: status %d: %s", res.StatusCode, data)
+	}
+	if res, data := srv.do(t, http.MethodGet, "/v1/vote/a", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /vote/a after erase: status %d: %s", res.StatusCode, data)
+	}
+	res = srv.results(t, "/v1/results")
+	if got, want := resultCounts(res), map[string]int{"hot": 1}; !sameCounts(got, want) || res.Total != 1 || res.Voters != 1 {
+		t.Errorf("after erase: counts %v total %d voters %d, want %v total 1 voters 1", got, res.Total, res.Voters, want)
+	}
+}
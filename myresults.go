@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// GET /results/me のレスポンス形式
+type MyResultsResponse struct {
+	UserID  string                  `json:"userId"`
+	Vote    string                  `json:"vote"`    // ユーザーの現在の投票
+	Leading bool                    `json:"leading"` // ユーザーの投票が最多票の選択肢か (同票で並んでいても true)
+	Rank    int                     `json:"rank"`    // ユーザーの投票の票数の順位 (1 が最多。同票は同じ順位。選択肢から外された投票なら 0)
+	Options map[string]OptionResult `json:"options"` // GET /results と同じ選択肢ごとの票数
+	Total   int                     `json:"total"`
+	Status  string                  `json:"status"`
+}
+
+// 選択肢 vote の票数の順位 (自分より票数の多い選択肢の数 + 1)。vote が選択肢に無ければ 0
+func optionRank(set *optionSet, counts map[string]int, vote string) int {
+	if !set.has(vote) {
+		return 0
+	}
+	rank := 1
+	for _, option := range set.keys {
+		if counts[option] > counts[vote] {
+			rank++
+		}
+	}
+	return rank
+}
+
+// GET /results/me?userId= エンドポイントの処理 (「あなたは多数派です」のような表示用)
+// 票数とユーザーの投票を同じ読み取りロックの中で読むので、返す票数にはその投票が必ず入っている
+// 投票していなければ 404。結果を隠しているあいだ (MIN_REVEAL) は GET /results と同じく 403
+// 複数選択モードではユーザーの投票が1つに決まらないので 403 (選んでいるものは GET /vote/{userId} で返す)
+func (rm *room) myResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if multiSelectVoting {
+		writeMultiSelectUnsupported(w)
+		return
+	}
+
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID := r.URL.Query().Get("userId")
+	if !checkUserIDParameter(w, userID) {
+		return
+	}
+	if uid != "" && uid != userID {
+		writeJSONError(w, http.StatusForbidden, errCodeForbidden, "Forbidden")
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	now := time.Now()
+	rm.ensureFinal(now)
+
+	rm.mutex.RLock()
+	vote, ok := rm.store.UserVote(userID)
+	set := rm.optionSet()
+	counts, weighted := rm.resultCounts()
+	status := rm.schedule.status(now)
+	rm.mutex.RUnlock()
+
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Vote not found")
+		return
+	}
+
+	results := buildResults(set, counts, weighted, requestLanguage(r))
+	rank := optionRank(set, counts, vote)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MyResultsResponse{
+		UserID:  userID,
+		Vote:    vote,
+		Leading: rank == 1,
+		Rank:    rank,
+		Options: results.Options,
+		Total:   results.Total,
+		Status:  status,
+	})
+}
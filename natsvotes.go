@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NATS_SUBJECT と NATS_QUEUE が未設定のときの値
+const (
+	defaultNATSSubject = "votes"
+	defaultNATSQueue   = "mille-feuille"
+)
+
+// 保存先に書き込めなかった投票をやり直す回数と、最初の待ち時間 (やり直すたびに倍にする)
+const (
+	natsVoteRetries    = 3
+	natsVoteRetryDelay = 200 * time.Millisecond
+)
+
+// JetStream で1通を届ける回数の上限と、nak してから届け直してもらうまでの時間
+// ack 待ちは1通なので、届け直しのあいだは後ろの投票も止まる。上限に達した投票は捨てる
+const (
+	natsMaxDeliver = 10
+	natsNakDelay   = time.Second
+)
+
+// NATS_DEDUPE_TTL が未設定のときの、処理したメッセージIDを覚えておく時間
+const defaultNATSDedupeTTL = 10 * time.Minute
+
+// メッセージIDを載せるヘッダー (JetStream の重複排除と同じもの)
+const natsMsgIDHeader = "Nats-Msg-Id"
+
+// 重複や順番の古いメッセージを記録せずに飛ばしたときの、返信の status
+const (
+	natsStatusDuplicate = "duplicate" // 同じメッセージIDをもう処理した
+	natsStatusStale     = "stale"     // 同じユーザーのもっと新しい sequence をもう処理した
+)
+
+// 同じメッセージIDか同じユーザーの投票を記録している途中に届いたときの natsVotesTotal のラベル (409 で返し、nak する)
+const natsResultBusy = "busy"
+
+// NATS から届いた投票を処理した結果 (accepted: 記録した, pending: 確定を待っている, rejected: 確認で断った, failed: やり直しても保存できなかった,
+// duplicate: 処理済みのメッセージIDだった, stale: 同じユーザーの新しい投票を処理した後に届いた, busy: 同じメッセージかユーザーを記録している途中だった)
+var natsVotesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "nats_votes_total",
+	Help: "Number of votes received from NATS, by result.",
+}, []string{"result"})
+
+// NATS の購読 (NATS_URL が未設定なら nil)
+var natsConn *nats.Conn
+
+// NATS から受け取る投票のメッセージ (POST /vote のボディに部屋IDとトークンを足したもの)
+type NATSVoteMessage struct {
+	RoomID    string `json:"roomId,omitempty"`    // 部屋ID (空なら既定の投票。無ければ作る)
+	Token     string `json:"token,omitempty"`     // 認証が有効なときの ID トークン (Authorization: Bearer と同じ)
+	MessageID string `json:"messageId,omitempty"` // 送り直しを見分けるID (Nats-Msg-Id ヘッダーがあればそちらを使う)
+	Sequence  int64  `json:"sequence,omitempty"`  // ユーザーごとに増える番号 (送った時刻のミリ秒など)。これ以下の番号の投票は後から届いても記録しない
+	VoteRequest
+}
+
+// 少なくとも1回は届く (同じメッセージが何度も届きうる、順番が入れ替わりうる) 配信で、投票の変更を正しく数えるための記録
+// メッセージIDもユーザーごとの sequence も、最後に処理してから NATS_DEDUPE_TTL の間だけ覚える (再起動すると忘れる)
+// 確認と記録のあいだはメッセージIDとユーザーを予約し、投票の記録 (やり直しの待ち時間を含む) 中はロックを持たない
+type natsDelivery struct {
+	mu        sync.Mutex // seen の確認と sequences, inFlight を守る
+	seen      *nonceCache
+	sequences map[string]natsSequence // 部屋ID + ユーザーID ごとの、処理した最新の sequence
+	inFlight  map[string]struct{}     // 記録している途中のメッセージIDと、部屋ID + ユーザーID
+}
+
+// ユーザーの処理した最新の sequence と、それを処理した時刻
+type natsSequence struct {
+	sequence int64
+	at       time.Time
+}
+
+func newNATSDelivery(ttl time.Duration) *natsDelivery {
+	return &natsDelivery{seen: newNonceCache(ttl), sequences: make(map[string]natsSequence), inFlight: make(map[string]struct{})}
+}
+
+// 予約に使うキー (メッセージIDとユーザーが重ならないよう分ける)
+func natsMessageKey(msgID string) string    { return "message\x00" + msgID }
+func natsUserKey(sequenceKey string) string { return "user\x00" + sequenceKey }
+
+// メッセージを記録してよいか確かめ、よければ release までメッセージIDとユーザー (sequenceKey。空なら順番を見ない) を予約する
+// 記録しないときは natsStatusDuplicate, natsStatusStale, natsResultBusy のどれかと、ユーザーの処理した最新の sequence を返す
+func (d *natsDelivery) reserve(msgID, sequenceKey string, sequence int64, now time.Time) (string, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if msgID != "" && d.seen.has("", msgID, now) {
+		return natsStatusDuplicate, 0
+	}
+	if sequenceKey != "" {
+		if latest := d.latestSequence(sequenceKey, now); sequence <= latest {
+			return natsStatusStale, latest
+		}
+	}
+	if _, busy := d.inFlight[natsMessageKey(msgID)]; msgID != "" && busy {
+		return natsResultBusy, 0
+	}
+	if _, busy := d.inFlight[natsUserKey(sequenceKey)]; sequenceKey != "" && busy {
+		return natsResultBusy, 0
+	}
+	if msgID != "" {
+		d.inFlight[natsMessageKey(msgID)] = struct{}{}
+	}
+	if sequenceKey != "" {
+		d.inFlight[natsUserKey(sequenceKey)] = struct{}{}
+	}
+	return "", 0
+}
+
+// reserve の予約を解く。記録できていれば (recorded) メッセージIDと sequence を処理済みにする
+func (d *natsDelivery) release(msgID, sequenceKey string, sequence int64, recorded bool, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if msgID != "" {
+		delete(d.inFlight, natsMessageKey(msgID))
+		if recorded {
+			d.seen.use("", msgID, now)
+		}
+	}
+	if sequenceKey != "" {
+		delete(d.inFlight, natsUserKey(sequenceKey))
+		if recorded {
+			d.sequences[sequenceKey] = natsSequence{sequence: sequence, at: now}
+		}
+	}
+}
+
+var natsDeliveries = newNATSDelivery(defaultNATSDedupeTTL)
+
+// ユーザーの処理した最新の sequence (ttl を過ぎていれば 0)。呼び出し側で d.mu を取っておくこと
+func (d *natsDelivery) latestSequence(key string, now time.Time) int64 {
+	s, ok := d.sequences[key]
+	if !ok || now.Sub(s.at) >= d.seen.ttl {
+		return 0
+	}
+	return s.sequence
+}
+
+// ttl を過ぎたメッセージIDと sequence を忘れる
+func (d *natsDelivery) evictExpired(now time.Time) {
+	d.seen.evictExpired(now)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, s := range d.sequences {
+		if now.Sub(s.at) >= d.seen.ttl {
+			delete(d.sequences, key)
+		}
+	}
+}
+
+// 定期的に evictExpired を呼ぶ。サーバーが終了すると止まる
+func (d *natsDelivery) startEviction() {
+	go func() {
+		ticker := time.NewTicker(d.seen.ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				d.evictExpired(now)
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// NATS_URL があれば NATS_SUBJECT を購読し、届いた投票を HTTP と同じ部屋・保存先に記録する
+// 複数のインスタンスで同じ投票を二重に数えないよう、NATS_QUEUE のキューグループで購読する (1通はどれか1つに届く)
+// 接続が切れても裏でつなぎ直し続ける。NATS を使わなければ何もしない
+//
+// NATS_DURABLE を設定すると JetStream の永続コンシューマーで購読する (少なくとも1回は届く配信)
+// 投票を記録し (2xx)、SQLITE_BATCH_INTERVAL で溜めていればデータベースに書いてから ack する
+// 届け直せば記録できるかもしれない投票 (5xx、レート制限の 429、記録している途中の 409) は natsNakDelay 待ってから届け直してもらう
+// 届け直しても変わらない投票 (選択肢や本文の誤り、認証、締め切りなどの 4xx) は term して捨てる (後ろの投票を止めない)
+// 1通を届けるのは natsMaxDeliver 回までで、それでも記録できなければ捨てる
+// 届け直しで二重に数えないよう、メッセージID (Nats-Msg-Id か messageId) を NATS_DEDUPE_TTL の間覚えて、同じIDは飛ばす
+//
+// 投票の変更を正しく数えるには、同じユーザーの投票が送った順に届く必要がある
+// JetStream では ack 待ちを1通に制限するので、ストリームの順に1通ずつ処理する (nak した投票を届け直すまで次は来ない)
+// 同じユーザーの投票は同じ subject (ユーザーIDで分けるならその subject) に送ること。別々のストリームやインスタンスをまたぐと順番は保証されない
+// 送る側で sequence を付ければ、順番が入れ替わって届いても、そのユーザーの処理済みの番号以下の投票は記録しない
+// (認証が有効なときのユーザーはトークンのUIDで、本文の userId ではない)
+func startNATSVoteConsumer() error {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		return nil
+	}
+	subject := os.Getenv("NATS_SUBJECT")
+	if subject == "" {
+		subject = defaultNATSSubject
+	}
+	queue := os.Getenv("NATS_QUEUE")
+	if queue == "" {
+		queue = defaultNATSQueue
+	}
+	durable := os.Getenv("NATS_DURABLE")
+	dedupeTTL, err := envDuration("NATS_DEDUPE_TTL", defaultNATSDedupeTTL)
+	if err != nil {
+		return err
+	}
+	if dedupeTTL <= 0 {
+		return errors.New("NATS_DEDUPE_TTL must be positive")
+	}
+	natsDeliveries = newNATSDelivery(dedupeTTL)
+	natsDeliveries.startEviction()
+
+	nc, err := nats.Connect(url,
+		nats.Name("mille-feuille-app"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("nats disconnected", "event", "nats", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("nats reconnected", "event", "nats", "url", nc.ConnectedUrlRedacted())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				slog.Error("nats subscription error", "event", "nats", "subject", sub.Subject, "error", err)
+			} else {
+				slog.Error("nats error", "event", "nats", "error", err)
+			}
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	if durable != "" {
+		js, err := nc.JetStream()
+		if err != nil {
+			nc.Close()
+			return err
+		}
+		if _, err := js.QueueSubscribe(subject, queue, handleJetStreamVote,
+			nats.Durable(durable), nats.ManualAck(), nats.AckExplicit(), nats.MaxAckPending(1), nats.MaxDeliver(natsMaxDeliver), nats.DeliverAll(),
+		); err != nil {
+			nc.Close()
+			return err
+		}
+		natsConn = nc
+		slog.Info("consuming votes from nats jetstream", "event", "nats", "subject", subject, "queue", queue, "durable", durable, "dedupeTtl", dedupeTTL.String())
+		return nil
+	}
+
+	// 届いた順に1通ずつ処理する (同じユーザーの投票の順番を入れ替えない)
+	if _, err := nc.QueueSubscribe(subject, queue, handleNATSVote); err != nil {
+		nc.Close()
+		return err
+	}
+	natsConn = nc
+	slog.Info("consuming votes from nats", "event", "nats", "subject", subject, "queue", queue)
+	return nil
+}
+
+// 購読をやめ、処理中の投票を終えてから接続を閉じる (保存先を閉じる前に呼ぶ)
+func stopNATSVoteConsumer(ctx context.Context) {
+	if natsConn == nil {
+		return
+	}
+	closed := make(chan struct{})
+	natsConn.SetClosedHandler(func(*nats.Conn) { close(closed) })
+	if err := natsConn.Drain(); err != nil {
+		natsConn.Close()
+		return
+	}
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		slog.Warn("nats consumer did not drain in time", "event", "nats")
+		natsConn.Close()
+	}
+}
+
+// NATS から届いた1通の投票を記録する。返信先があれば POST /vote と同じ形式のレスポンスを返す
+func handleNATSVote(m *nats.Msg) {
+	_, body, result := applyNATSVote(m.Data, m.Header.Get(natsMsgIDHeader), m.Header.Get("X-Request-ID"))
+	natsVotesTotal.WithLabelValues(result).Inc()
+	if m.Reply != "" {
+		if err := m.Respond(body); err != nil {
+			slog.Warn("failed to reply to nats vote", "event", "nats", "error", err)
+		}
+	}
+}
+
+// JetStream のメッセージへの返事 (*nats.Msg。テストでは差し替える)
+type jetStreamAcker interface {
+	Ack(opts ...nats.AckOpt) error
+	NakWithDelay(delay time.Duration, opts ...nats.AckOpt) error
+	Term(opts ...nats.AckOpt) error
+	Metadata() (*nats.MsgMetadata, error)
+}
+
+// JetStream から届いた1通の投票を記録する
+func handleJetStreamVote(m *nats.Msg) {
+	status, body, result := applyNATSVote(m.Data, m.Header.Get(natsMsgIDHeader), m.Header.Get("X-Request-ID"))
+	natsVotesTotal.WithLabelValues(result).Inc()
+	settleJetStreamVote(m, status, body)
+}
+
+// 記録した投票は保存先に書いてから ack する
+// 届け直せば記録できるかもしれないときだけ nak する (記録済みなら届け直しはメッセージIDで飛ばす)。それ以外と、届ける回数の上限に達したものは term する
+func settleJetStreamVote(m jetStreamAcker, status int, body []byte) {
+	if status >= 200 && status < 300 && sqliteBatchInterval > 0 {
+		if err := flushVoteBatches(); err != nil {
+			slog.Warn("failed to write nats vote", "event", "nats", "error", err)
+			status = http.StatusInternalServerError
+		}
+	}
+	if status >= 200 && status < 300 {
+		if err := m.Ack(); err != nil {
+			slog.Warn("failed to ack nats vote", "event", "nats", "error", err)
+		}
+		return
+	}
+
+	var delivered uint64
+	if meta, err := m.Metadata(); err == nil {
+		delivered = meta.NumDelivered
+	}
+	if natsVoteRetryable(status, body) && delivered < natsMaxDeliver {
+		if err := m.NakWithDelay(natsNakDelay); err != nil {
+			slog.Warn("failed to nak nats vote", "event", "nats", "error", err)
+		}
+		return
+	}
+	slog.Warn("nats vote dropped", "event", "nats", "status", status, "delivered", delivered, "response", string(body))
+	if err := m.Term(); err != nil {
+		slog.Warn("failed to term nats vote", "event", "nats", "error", err)
+	}
+}
+
+// 届け直せば記録できるかもしれないか (保存先の失敗、レート制限、同じメッセージかユーザーを記録している途中)
+func natsVoteRetryable(status int, body []byte) bool {
+	switch {
+	case status >= http.StatusInternalServerError, status == http.StatusTooManyRequests:
+		return true
+	case status == http.StatusConflict:
+		var res ErrorResponse
+		return json.Unmarshal(body, &res) == nil && res.Error.Code == errCodeIdempotencyBusy
+	default:
+		return false
+	}
+}
+
+// 処理した結果の natsVotesTotal のラベル
+func natsVoteResult(status int) string {
+	switch {
+	case status == http.StatusOK, status == http.StatusCreated:
+		return "accepted"
+	case status == http.StatusAccepted:
+		return "pending"
+	case status >= http.StatusInternalServerError:
+		return "failed"
+	default:
+		return "rejected"
+	}
+}
+
+// メッセージを POST /vote と同じハンドラーに通して記録し、ステータスとレスポンスの本文、natsVotesTotal のラベルを返す
+// 確認 (選択肢、許可したユーザー、ノンス、レート制限など) も部屋のロックも HTTP と同じものを使う
+// 保存先に書き込めなかったとき (5xx) だけ、待ち時間を延ばしながら natsVoteRetries 回までやり直す
+// 処理済みのメッセージIDと、そのユーザーの処理済みの sequence 以下の投票は、記録せずに 200 で返す
+// 記録できなかった投票 (2xx 以外) は処理済みにしない (届け直されたときに、もう一度記録する)
+// 同じメッセージIDか同じユーザー (sequence のあるとき) の投票を記録している途中なら、記録せずに 409 で返す (nak して届け直してもらう)
+func applyNATSVote(data []byte, msgID, requestID string) (int, []byte, string) {
+	if !requestIDPattern.MatchString(requestID) {
+		requestID = uuid.NewString()
+	}
+	ctx := context.WithValue(context.Background(), requestIDKey{}, requestID)
+
+	var msg NATSVoteMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&msg); err != nil {
+		slog.InfoContext(ctx, "invalid vote message from nats", "event", "nats", "error", err)
+		status, body := natsErrorReply(http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return status, body, natsVoteResult(status)
+	}
+	if msgID == "" {
+		msgID = msg.MessageID
+	}
+	if len(msgID) > maxNonceLength {
+		status, body := natsErrorReply(http.StatusBadRequest, errCodeInvalidBody, "messageId is too long")
+		return status, body, natsVoteResult(status)
+	}
+
+	// 順番は投票を記録するユーザー (認証が有効ならトークンのUID) ごとに見る
+	userID, err := natsVoteUserID(ctx, msg)
+	if err != nil {
+		slog.InfoContext(ctx, "authentication failed", "event", "nats", "error", err)
+		status, body := natsErrorReply(http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return status, body, natsVoteResult(status)
+	}
+
+	var sequenceKey string
+	if msg.Sequence > 0 && userID != "" {
+		sequenceKey = msg.RoomID + "\x00" + userID
+	}
+	d := natsDeliveries
+	switch skip, latest := d.reserve(msgID, sequenceKey, msg.Sequence, time.Now()); skip {
+	case natsStatusDuplicate:
+		slog.InfoContext(ctx, "duplicate vote from nats ignored", "event", "nats", "messageId", sanitizeLogValue(msgID))
+		body, _ := json.Marshal(VoteResponse{Status: natsStatusDuplicate})
+		return http.StatusOK, body, natsStatusDuplicate
+	case natsStatusStale:
+		slog.InfoContext(ctx, "stale vote from nats ignored", "event", "nats", "roomId", msg.RoomID, "userId", logUserID(userID), "sequence", msg.Sequence, "latest", latest)
+		body, _ := json.Marshal(VoteResponse{Status: natsStatusStale})
+		return http.StatusOK, body, natsStatusStale
+	case natsResultBusy:
+		// 先に届いた方の記録が終わってから届け直してもらう
+		slog.InfoContext(ctx, "vote from nats is already being recorded", "event", "nats", "messageId", sanitizeLogValue(msgID), "roomId", msg.RoomID, "userId", logUserID(userID))
+		status, body := natsErrorReply(http.StatusConflict, errCodeIdempotencyBusy, "A vote for this message or user is already being recorded")
+		return status, body, natsResultBusy
+	}
+
+	status, body := recordNATSVote(ctx, msg)
+	d.release(msgID, sequenceKey, msg.Sequence, status >= 200 && status < 300, time.Now())
+	return status, body, natsVoteResult(status)
+}
+
+// メッセージの投票を記録するユーザーID。認証が有効なら POST /vote と同じくトークンを確かめて UID を返す
+func natsVoteUserID(ctx context.Context, msg NATSVoteMessage) (string, error) {
+	if verifier == nil {
+		return msg.UserID, nil
+	}
+	token := strings.TrimSpace(msg.Token)
+	if token == "" {
+		return "", errMissingToken
+	}
+	user, err := verifier.VerifyToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return user.UID, nil
+}
+
+// 確かめたメッセージの投票を記録する
+func recordNATSVote(ctx context.Context, msg NATSVoteMessage) (int, []byte) {
+	handler, path := defaultRoom.voteRouteHandler, "/v1/vote"
+	if msg.RoomID != "" {
+		if !roomIDPattern.MatchString(msg.RoomID) {
+			return natsErrorReply(http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		}
+		// 部屋は POST /rooms/{roomId}/vote と同じく、投票を確かめてから作る
+		handler, path = roomVoteHandler, "/v1/rooms/"+msg.RoomID+"/vote"
+	}
+	body, _ := json.Marshal(msg.VoteRequest)
+
+	delay := natsVoteRetryDelay
+	for attempt := 0; ; attempt++ {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if msg.Token != "" {
+			r.Header.Set("Authorization", "Bearer "+msg.Token)
+		}
+		r.SetPathValue("roomId", msg.RoomID)
+		res := newBufferedResponse()
+		handler(res, r)
+
+		status := res.statusCode()
+		if status < http.StatusInternalServerError || attempt == natsVoteRetries {
+			if status != http.StatusOK && status != http.StatusCreated && status != http.StatusAccepted {
+				slog.WarnContext(ctx, "vote from nats not recorded", "event", "nats", "roomId", msg.RoomID, "status", status, "attempts", attempt+1, "response", res.body.String())
+			}
+			return status, res.body.Bytes()
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-shuttingDown:
+			return status, res.body.Bytes()
+		}
+	}
+}
+
+func natsErrorReply(status int, code, message string) (int, []byte) {
+	body, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{Code: code, Message: message}})
+	return status, body
+}
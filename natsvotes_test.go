@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// "token-<uid>" を uid のトークンとして受け付ける TokenVerifier
+type testVerifier struct{}
+
+func (testVerifier) VerifyToken(_ context.Context, token string) (authUser, error) {
+	uid, ok := strings.CutPrefix(token, "token-")
+	if !ok {
+		return authUser{}, errors.New("invalid token")
+	}
+	return authUser{UID: uid}, nil
+}
+
+// NATS の1通を applyNATSVote に通す
+func applyTestNATSVote(t *testing.T, msgID string, msg NATSVoteMessage) (int, string) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, result := applyNATSVote(data, msgID, "")
+	return status, result
+}
+
+func TestNATSVoteRedelivery(t *testing.T) {
+	srv := newTestServer(t, "VOTE_CHANGE_COOLDOWN=200ms")
+	natsDeliveries = newNATSDelivery(time.Minute)
+
+	vote := func(user, option string, sequence int64) NATSVoteMessage {
+		return NATSVoteMessage{Sequence: sequence, VoteRequest: VoteRequest{UserID: user, Vote: option}}
+	}
+	steps := []struct {
+		name   string
+		msgID  string
+		msg    NATSVoteMessage
+		status int
+		result string
+		counts map[string]int
+	}{
+		{"first", "m1", vote("a", "hot", 2), http.StatusOK, "accepted", map[string]int{"hot": 1}},
+		{"redelivered", "m1", vote("a", "hot", 2), http.StatusOK, natsStatusDuplicate, map[string]int{"hot": 1}},
+		{"older sequence", "m0", vote("a", "cold", 1), http.StatusOK, natsStatusStale, map[string]int{"hot": 1}},
+		{"same sequence", "m0b", vote("a", "cold", 2), http.StatusOK, natsStatusStale, map[string]int{"hot": 1}},
+		// 変更の待ち時間中は 429 で、処理済みにしない
+		{"rate limited", "m2", vote("a", "cold", 3), http.StatusTooManyRequests, "rejected", map[string]int{"hot": 1}},
+		{"other user", "m3", vote("b", "cold", 1), http.StatusOK, "accepted", map[string]int{"hot": 1, "cold": 1}},
+	}
+	for _, step := range steps {
+		status, result := applyTestNATSVote(t, step.msgID, step.msg)
+		if status != step.status || result != step.result {
+			t.Errorf("%s: got %d %s, want %d %s", step.name, status, result, step.status, step.result)
+		}
+		if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, step.counts) {
+			t.Errorf("%s: counts %v, want %v", step.name, got, step.counts)
+		}
+	}
+
+	// 断った投票は届け直されたときに記録する
+	time.Sleep(voteChangeCooldown)
+	if status, result := applyTestNATSVote(t, "m2", vote("a", "cold", 3)); status != http.StatusOK || result != "accepted" {
+		t.Errorf("redelivered after cooldown: got %d %s, want 200 accepted", status, result)
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"cold": 2}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+}
+
+// 順番はトークンのユーザーで見る (本文の userId を変えても古い投票は通らない)
+func TestNATSVoteOrderingUsesVerifiedUser(t *testing.T) {
+	srv := newTestServer(t)
+	verifier = testVerifier{}
+	t.Cleanup(func() { verifier = nil })
+	natsDeliveries = newNATSDelivery(time.Minute)
+
+	msg := func(userID, option string, sequence int64) NATSVoteMessage {
+		return NATSVoteMessage{Token: "token-a", Sequence: sequence, VoteRequest: VoteRequest{UserID: userID, Vote: option}}
+	}
+	if status, result := applyTestNATSVote(t, "m1", msg("a", "hot", 5)); status != http.StatusOK || result != "accepted" {
+		t.Fatalf("first: got %d %s", status, result)
+	}
+	if status, result := applyTestNATSVote(t, "m2", msg("someone-else", "cold", 3)); status != http.StatusOK || result != natsStatusStale {
+		t.Errorf("older vote with another body userId: got %d %s, want 200 %s", status, result, natsStatusStale)
+	}
+	if status, result := applyTestNATSVote(t, "m3", NATSVoteMessage{Token: "bad", VoteRequest: VoteRequest{UserID: "a", Vote: "ok"}}); status != http.StatusUnauthorized {
+		t.Errorf("invalid token: got %d %s, want 401", status, result)
+	}
+
+	verifier = nil
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+}
+
+func TestNATSDeliveryEviction(t *testing.T) {
+	const ttl = time.Minute
+	d := newNATSDelivery(ttl)
+	now := time.Now()
+	d.seen.use("", "m1", now)
+	d.sequences["\x00a"] = natsSequence{sequence: 3, at: now}
+	d.sequences["\x00b"] = natsSequence{sequence: 1, at: now.Add(-ttl)}
+
+	d.evictExpired(now)
+	if _, ok := d.sequences["\x00b"]; ok {
+		t.Error("expired sequence was kept")
+	}
+	if got := d.latestSequence("\x00a", now.Add(ttl/2)); got != 3 {
+		t.Errorf("latestSequence = %d, want 3", got)
+	}
+	if got := d.latestSequence("\x00a", now.Add(ttl)); got != 0 {
+		t.Errorf("latestSequence after ttl = %d, want 0", got)
+	}
+
+	d.evictExpired(now.Add(ttl))
+	if len(d.sequences) != 0 || d.seen.has("", "m1", now) {
+		t.Errorf("entries left after ttl: sequences %v", d.sequences)
+	}
+}
+
+// 記録している途中のメッセージとユーザーは、ほかのメッセージを止めずに 409 で断る
+func TestNATSVoteInFlight(t *testing.T) {
+	srv := newTestServer(t)
+	natsDeliveries = newNATSDelivery(time.Minute)
+
+	// m1 (ユーザー a) を記録している途中にする
+	if skip, _ := natsDeliveries.reserve("m1", "\x00a", 1, time.Now()); skip != "" {
+		t.Fatalf("reserve: %q", skip)
+	}
+	tests := []struct {
+		name   string
+		msgID  string
+		msg    NATSVoteMessage
+		status int
+		result string
+	}{
+		{"same message", "m1", NATSVoteMessage{Sequence: 1, VoteRequest: VoteRequest{UserID: "a", Vote: "hot"}}, http.StatusConflict, natsResultBusy},
+		{"same user", "m2", NATSVoteMessage{Sequence: 2, VoteRequest: VoteRequest{UserID: "a", Vote: "cold"}}, http.StatusConflict, natsResultBusy},
+		{"other user", "m3", NATSVoteMessage{Sequence: 1, VoteRequest: VoteRequest{UserID: "b", Vote: "cold"}}, http.StatusOK, "accepted"},
+	}
+	for _, tt := range tests {
+		if status, result := applyTestNATSVote(t, tt.msgID, tt.msg); status != tt.status || result != tt.result {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, status, result, tt.status, tt.result)
+		}
+	}
+
+	// 記録できずに予約を解けば、届け直した m1 を記録する
+	natsDeliveries.release("m1", "\x00a", 1, false, time.Now())
+	if status, result := applyTestNATSVote(t, "m1", tests[0].msg); status != http.StatusOK || result != "accepted" {
+		t.Errorf("after release: got %d %s, want 200 accepted", status, result)
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 1, "cold": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+	if len(natsDeliveries.inFlight) != 0 {
+		t.Errorf("reservations left: %v", natsDeliveries.inFlight)
+	}
+}
+
+// settleJetStreamVote の返事を覚える、JetStream のメッセージの代わり
+type fakeJetStreamMsg struct {
+	msgID     string
+	data      []byte
+	delivered uint64
+	settled   string // ack, nak, term
+}
+
+func (m *fakeJetStreamMsg) Ack(...nats.AckOpt) error { m.settled = "ack"; return nil }
+func (m *fakeJetStreamMsg) NakWithDelay(time.Duration, ...nats.AckOpt) error {
+	m.settled = "nak"
+	return nil
+}
+func (m *fakeJetStreamMsg) Term(...nats.AckOpt) error { m.settled = "term"; return nil }
+func (m *fakeJetStreamMsg) Metadata() (*nats.MsgMetadata, error) {
+	return &nats.MsgMetadata{NumDelivered: m.delivered}, nil
+}
+
+// ack 待ちを1通にしたコンシューマーと同じく、nak したメッセージを届け直してから次を届ける
+func consumeJetStream(t *testing.T, msgs []*fakeJetStreamMsg) {
+	t.Helper()
+	for deliveries := 0; len(msgs) > 0; deliveries++ {
+		if deliveries > 100 {
+			t.Fatalf("%s is redelivered forever", msgs[0].msgID)
+		}
+		m := msgs[0]
+		m.delivered++
+		status, body, _ := applyNATSVote(m.data, m.msgID, "")
+		settleJetStreamVote(m, status, body)
+		if m.settled != "nak" {
+			msgs = msgs[1:]
+		}
+	}
+}
+
+// 届け直しても記録できない投票は term して、後ろの投票を止めない
+func TestJetStreamPoisonMessage(t *testing.T) {
+	srv := newTestServer(t)
+	natsDeliveries = newNATSDelivery(time.Minute)
+
+	msg := func(msgID string, body any) *fakeJetStreamMsg {
+		data, ok := body.(string)
+		if !ok {
+			b, err := json.Marshal(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = string(b)
+		}
+		return &fakeJetStreamMsg{msgID: msgID, data: []byte(data)}
+	}
+	invalidOption := msg("m1", NATSVoteMessage{VoteRequest: VoteRequest{UserID: "a", Vote: "warm"}})
+	invalidBody := msg("m2", `{"userId":`)
+	valid := msg("m3", NATSVoteMessage{VoteRequest: VoteRequest{UserID: "a", Vote: "hot"}})
+	consumeJetStream(t, []*fakeJetStreamMsg{invalidOption, invalidBody, valid})
+
+	for _, m := range []*fakeJetStreamMsg{invalidOption, invalidBody} {
+		if m.settled != "term" || m.delivered != 1 {
+			t.Errorf("%s: %s after %d deliveries, want term after 1", m.msgID, m.settled, m.delivered)
+		}
+	}
+	if valid.settled != "ack" {
+		t.Errorf("valid vote: %s, want ack", valid.settled)
+	}
+	if got, want := resultCounts(srv.results(t, "/v1/results")), map[string]int{"hot": 1}; !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+}
+
+// 届け直せば記録できるかもしれない投票だけ、natsMaxDeliver 回まで nak する
+func TestSettleJetStreamVote(t *testing.T) {
+	newTestServer(t)
+	errorBody := func(code string) []byte {
+		_, body := natsErrorReply(http.StatusConflict, code, "")
+		return body
+	}
+	tests := []struct {
+		status    int
+		body      []byte
+		delivered uint64
+		want      string
+	}{
+		{http.StatusOK, nil, 1, "ack"},
+		{http.StatusAccepted, nil, 1, "ack"},
+		{http.StatusInternalServerError, nil, 1, "nak"},
+		{http.StatusServiceUnavailable, nil, natsMaxDeliver - 1, "nak"},
+		{http.StatusServiceUnavailable, nil, natsMaxDeliver, "term"},
+		{http.StatusTooManyRequests, nil, 1, "nak"},
+		{http.StatusConflict, errorBody(errCodeIdempotencyBusy), 1, "nak"},
+		{http.StatusConflict, errorBody(errCodeAlreadyVoted), 1, "term"},
+		{http.StatusConflict, errorBody(errCodeOptionFull), 1, "term"},
+		{http.StatusBadRequest, nil, 1, "term"},
+		{http.StatusUnauthorized, nil, 1, "term"},
+		{http.StatusForbidden, nil, 1, "term"},
+		{http.StatusNotFound, nil, 1, "term"},
+	}
+	for _, tt := range tests {
+		m := &fakeJetStreamMsg{delivered: tt.delivered}
+		settleJetStreamVote(m, tt.status, tt.body)
+		if m.settled != tt.want {
+			t.Errorf("status %d %s (delivered %d): %s, want %s", tt.status, tt.body, tt.delivered, m.settled, tt.want)
+		}
+	}
+}
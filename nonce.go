@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// nonce に使える長さの上限 (UUID などを想定)
+const maxNonceLength = 128
+
+// 一度使われた nonce を ttl の間だけ覚えておく
+// 捕まえたリクエストをそのまま送り直す再送を防ぐためのもので、回数を数えるレート制限とは別
+type nonceCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[string]time.Time // キーごとに使われた時刻
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// nonce を使用済みにする。ttl 以内にもう使われていれば false
+// nonce はユーザーごとに区別するので、別のユーザーとたまたま同じ値になっても断らない
+func (c *nonceCache) use(userID, nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := userID + "\x00" + nonce
+	if at, ok := c.seen[key]; ok && now.Sub(at) < c.ttl {
+		return false
+	}
+	c.seen[key] = now
+	return true
+}
+
+// nonce が ttl 以内に使われたか (使用済みにはしない)
+func (c *nonceCache) has(userID, nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	at, ok := c.seen[userID+"\x00"+nonce]
+	return ok && now.Sub(at) < c.ttl
+}
+
+// ttl を過ぎた nonce を忘れる (マップが際限なく大きくならないように)
+func (c *nonceCache) evictExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, at := range c.seen {
+		if now.Sub(at) >= c.ttl {
+			delete(c.seen, key)
+		}
+	}
+}
+
+// 定期的に evictExpired を呼ぶ。サーバーが終了すると止まる
+func (c *nonceCache) startEviction() {
+	go func() {
+		ticker := time.NewTicker(c.ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				c.evictExpired(now)
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// 投票の nonce の記録 (nilなら nonce を求めない。VOTE_NONCE_TTL で有効にする)
+var voteNonces *nonceCache
+
+// nonce の確認。問題があればエラーの code と理由を返す
+// 確認した nonce は、その後で投票が失敗しても使用済みになる (送り直すときは新しい nonce を使う)
+func checkVoteNonce(userID, nonce string) (code, reason string, ok bool) {
+	if voteNonces == nil {
+		return "", "", true
+	}
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return errCodeInvalidBody, "nonce is required", false
+	}
+	if !voteNonces.use(userID, nonce, time.Now()) {
+		return errCodeNonceReused, "nonce already used", false
+	}
+	return "", "", true
+}
+
+// checkVoteNonce で断るときはレスポンスを書いて false を返す
+func requireVoteNonce(w http.ResponseWriter, r *http.Request, userID, nonce string) bool {
+	code, reason, ok := checkVoteNonce(userID, nonce)
+	if ok {
+		return true
+	}
+	status := http.StatusBadRequest
+	if code == errCodeNonceReused {
+		status = http.StatusConflict
+		slog.WarnContext(r.Context(), "vote nonce reused", "event", "nonce_reused", "userId", logUserID(userID))
+	}
+	writeJSONError(w, status, code, reason)
+	return false
+}
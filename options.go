@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+)
+
+// 設定ファイルの1つの選択肢
+// Key は保存や投票に使う変わらない値、Labels は言語 (ja, en など) ごとの表示名
+// Metadata はクライアント向けの色やアイコンなど ({"color": "#e53935"} など)。サーバーは中身を見ずにそのまま返す
+type voteOption struct {
+	Key      string            `json:"key"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Metadata json.RawMessage   `json:"metadata,omitempty"`
+}
+
+// 選択肢のメタデータが JSON のオブジェクトか確かめ、空白を詰めた形にする (無ければ nil)
+func normalizeOptionMetadata(metadata json.RawMessage) (json.RawMessage, error) {
+	if trimmed := bytes.TrimSpace(metadata); len(trimmed) == 0 || string(trimmed) == "null" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &fields); err != nil {
+		return nil, errors.New("metadata must be a JSON object")
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, metadata); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 言語の指定が無いとき、または指定された言語の表示名が無いときに使う言語
+const defaultLabelLanguage = "ja"
+
+// 使用中の選択肢の一式
+// 管理用エンドポイントで実行中に変わるので、変えるときは新しい一式を作って丸ごと差し替える
+// (読む側はロックを取らずに、その時点の一式を使える)
+type optionSet struct {
+	options []voteOption
+	keys    []string
+
+	// 選択肢ごとの言語別の表示名
+	labels map[string]map[string]string
+
+	// 選択肢ごとのメタデータ (無い選択肢は含めない)
+	metadata map[string]json.RawMessage
+
+	// 表示名から選択肢のキーへの対応
+	// キーを導入する前のクライアントやデータは表示名 (あつい など) で投票を持っているので、キーに読み替える
+	aliases map[string]string
+}
+
+var currentOptions atomic.Pointer[optionSet]
+
+func init() {
+	setVoteOptions(nil)
+}
+
+// 選択肢の一式を差し替える。起動時に loadVoteOptions の結果で呼ぶ
+func setVoteOptions(options []voteOption) {
+	currentOptions.Store(newOptionSet(options))
+}
+
+// 選択肢の一覧から一式を作る (POST /polls で作る投票ごとの選択肢にも使う)
+func newOptionSet(options []voteOption) *optionSet {
+	set := &optionSet{
+		options:  slices.Clone(options),
+		keys:     make([]string, 0, len(options)),
+		labels:   make(map[string]map[string]string, len(options)),
+		metadata: make(map[string]json.RawMessage),
+		aliases:  make(map[string]string),
+	}
+	for _, option := range options {
+		set.keys = append(set.keys, option.Key)
+		set.labels[option.Key] = option.Labels
+		if option.Metadata != nil {
+			set.metadata[option.Key] = option.Metadata
+		}
+	}
+	for _, option := range options {
+		for _, label := range option.Labels {
+			// キーと同じ表示名や、別の選択肢のキーと重なる表示名は読み替えない
+			label = normalizeVote(label)
+			if label != option.Key && set.labels[label] == nil {
+				set.aliases[label] = option.Key
+			}
+		}
+	}
+	return set
+}
+
+// 投票の値や選択肢の名前を比べられる形にする
+// 前後の空白を除き、全角の英数字は半角に、半角のカタカナは全角にしてから、
+// Unicode の NFC に揃える (結合文字の「か」+「゛」や半角の「ｶﾞ」を「が」「ガ」にする)
+func normalizeVote(s string) string {
+	return norm.NFC.String(width.Fold.String(strings.TrimSpace(s)))
+}
+
+// 選択肢のキー (設定順)。返したスライスは書き換えないこと
+func voteOptions() []string {
+	return currentOptions.Load().keys
+}
+
+// 表示名から選択肢のキーへの対応。返したマップは書き換えないこと
+func optionAliases() map[string]string {
+	return currentOptions.Load().aliases
+}
+
+// 設定された選択肢かどうか
+func isVoteOption(vote string) bool {
+	return currentOptions.Load().has(vote)
+}
+
+// 投票の値を選択肢のキーにする。キーでも表示名でもなければ false
+func canonicalOption(vote string) (string, bool) {
+	return currentOptions.Load().canonical(vote)
+}
+
+// 保存されていた投票の値を選択肢のキーにする (表示名で保存された古いデータ用)
+// キーでも表示名でもないもの (選択肢から外されたもの) はそのまま返す
+func canonicalStoredVote(vote string) string {
+	if key, ok := optionAliases()[vote]; ok {
+		return key
+	}
+	return vote
+}
+
+// 選択肢の lang の表示名。その言語の表示名が無ければ既定の言語、それも無ければキー
+func optionLabel(key, lang string) string {
+	return currentOptions.Load().label(key, lang)
+}
+
+func (s *optionSet) has(vote string) bool {
+	return slices.Contains(s.keys, vote)
+}
+
+func (s *optionSet) canonical(vote string) (string, bool) {
+	vote = normalizeVote(vote)
+	if s.has(vote) {
+		return vote, true
+	}
+	key, ok := s.aliases[vote]
+	return key, ok
+}
+
+func (s *optionSet) label(key, lang string) string {
+	labels := s.labels[key]
+	if label, ok := labels[lang]; ok {
+		return label
+	}
+	if label, ok := labels[defaultLabelLanguage]; ok {
+		return label
+	}
+	return key
+}
+
+// 表示名の言語を ?lang= か Accept-Language ヘッダーから決める
+// Accept-Language は書かれた順に見て (q の値は見ない)、表示名のある最初の言語を使う
+func requestLanguage(r *http.Request) string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		return strings.ToLower(lang)
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		// en-US なら en として探す
+		lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if hasLabelLanguage(lang) {
+			return lang
+		}
+	}
+	return defaultLabelLanguage
+}
+
+func hasLabelLanguage(lang string) bool {
+	if currentOptions.Load().hasLanguage(lang) {
+		return true
+	}
+	pollsMutex.RLock()
+	defer pollsMutex.RUnlock()
+	for _, p := range polls {
+		if p.options.hasLanguage(lang) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *optionSet) hasLanguage(lang string) bool {
+	for _, labels := range s.labels {
+		if _, ok := labels[lang]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 選択肢を変える管理用の操作どうしを順番に行うためのロック
+var optionsMutex sync.Mutex
+
+// 設定の選択肢を使うすべての部屋の書き込みロックを取る (選択肢の変更をすべての部屋に同時に反映するため)
+// POST /polls で独自の選択肢を持たせた投票は含めない。終わるまで新しい部屋も作られない。返した関数でロックを外す
+func lockAllRooms() ([]*room, func()) {
+	roomsMutex.Lock()
+	all := []*room{defaultRoom}
+	for _, rm := range rooms {
+		if !hasOwnOptions(rm.id) {
+			all = append(all, rm)
+		}
+	}
+	for _, rm := range all {
+		rm.mutex.Lock()
+	}
+	return all, func() {
+		for _, rm := range all {
+			rm.mutex.Unlock()
+		}
+		roomsMutex.Unlock()
+	}
+}
+
+// /admin/options のレスポンス形式
+type OptionsResponse struct {
+	Options []voteOption `json:"options"`
+}
+
+func writeOptions(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OptionsResponse{Options: currentOptions.Load().options})
+}
+
+// GET /options のレスポンス形式 (クライアントが選択肢のボタンを作るための情報)
+type OptionsSchemaResponse struct {
+	Order   []string       `json:"order"`   // 選択肢のキーを表示する順 (OPTION_ORDER か設定順)
+	Status  string         `json:"status"`  // 投票の受付状態 (scheduled, open, closed)
+	Options []OptionSchema `json:"options"` // order と同じ順
+}
+
+type OptionSchema struct {
+	Key    string            `json:"key"`
+	Label  string            `json:"label"`            // ?lang= か Accept-Language の言語の表示名
+	Labels map[string]string `json:"labels,omitempty"` // 言語ごとの表示名
+	Cap    int               `json:"cap,omitempty"`    // OPTION_CAPS の票数の上限 (無ければ省く)
+	Full   bool              `json:"full"`             // 上限に達していて、新しくこの選択肢に投票できないか
+
+	Metadata json.RawMessage `json:"metadata,omitempty"` // 設定の metadata (色やアイコンなど。無ければ省く)
+}
+
+// GET /options と /rooms/{roomId}/options エンドポイントの処理 (選択肢を表示する順に返す)
+// クライアントは選択肢を決め打ちせずにこれでボタンを作る。管理者が選択肢を足したり外したりすると ETag が変わる
+// まだ作られていない部屋でも、その部屋で使う選択肢を返す
+func optionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	roomID := r.PathValue("roomId")
+	if roomID != "" && !roomIDPattern.MatchString(roomID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		return
+	}
+	snap := resultsSnapshot{set: roomOptions(roomID), status: pollStatusOpen}
+	if roomID == "" {
+		snap = defaultRoom.snapshotResults(time.Now(), false)
+	} else if rm, err := getRoom(roomID, false); err == nil {
+		snap = rm.snapshotResults(time.Now(), false)
+	}
+
+	lang := requestLanguage(r)
+	res := OptionsSchemaResponse{Order: snap.set.keys, Status: snap.status, Options: make([]OptionSchema, 0, len(snap.set.options))}
+	for _, option := range snap.set.options {
+		schema := OptionSchema{Key: option.Key, Label: snap.set.label(option.Key, lang), Labels: option.Labels, Metadata: option.Metadata}
+		if limit, ok := optionCaps[option.Key]; ok {
+			schema.Cap = limit
+			schema.Full = snap.counts[option.Key] >= limit
+		}
+		res.Options = append(res.Options, schema)
+	}
+
+	// 表示名は Accept-Language で変わる
+	w.Header().Add("Vary", "Accept-Language")
+	body, _ := json.Marshal(res)
+	writeCacheableJSON(w, r, body, body)
+}
+
+// POST /admin/options エンドポイントの処理 (投票の途中で選択肢を足す)
+// ボディは {"key": "...", "labels": {"ja": "..."}}。新しい選択肢の票数は0から始まる
+// 再起動すると設定の選択肢に戻るので、続けて使うなら VOTE_OPTIONS_FILE なども変えること
+func adminAddOptionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	var option voteOption
+	if err := decodeJSONBody(w, r, &option, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	option.Key = normalizeVote(option.Key)
+	if option.Key == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "key is required")
+		return
+	}
+	metadata, err := normalizeOptionMetadata(option.Metadata)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	option.Metadata = metadata
+
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+
+	// キーや表示名が既存の選択肢のキーや表示名と重なると、投票をどちらとして扱うか決まらない
+	names := append([]string{option.Key}, slices.Collect(maps.Values(option.Labels))...)
+	for _, name := range names {
+		if _, ok := canonicalOption(name); ok && name != "" {
+			writeJSONError(w, http.StatusConflict, errCodeOptionExists, "Vote option already exists")
+			return
+		}
+	}
+
+	all, unlock := lockAllRooms()
+	defer unlock()
+
+	set := currentOptions.Load()
+	setVoteOptions(append(slices.Clone(set.options), option))
+	for _, rm := range all {
+		if s, ok := rm.store.(optionResizer); ok {
+			s.addOption(option.Key)
+		}
+		rm.notifySubscribers()
+		rm.updateVoteGauges(rm.store.Counts())
+	}
+
+	recordAudit(AuditEntry{Action: "add_option", NewVote: option.Key, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+	slog.WarnContext(r.Context(), "vote option added", "event", "option_added", "option", option.Key)
+	writeOptions(w, http.StatusCreated)
+}
+
+// DELETE /admin/options/{option}?force=&reassignTo= エンドポイントの処理 (選択肢を取り除く)
+// その選択肢に投票しているユーザーがいるときは force=true が必要 (無ければ 409)
+// reassignTo があればその選択肢に投票を移し、無ければ投票を取り消す
+func adminRemoveOptionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	query := r.URL.Query()
+	force := query.Get("force") == "true"
+
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+
+	key, ok := canonicalOption(r.PathValue("option"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Vote option not found")
+		return
+	}
+	var reassignTo string
+	if v := query.Get("reassignTo"); v != "" {
+		if reassignTo, ok = canonicalOption(v); !ok || reassignTo == key {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid reassignTo")
+			return
+		}
+	}
+	set := currentOptions.Load()
+	if len(set.options) == 1 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Cannot remove the last vote option")
+		return
+	}
+
+	all, unlock := lockAllRooms()
+	defer unlock()
+
+	// 選択肢ごとに、その選択肢に投票しているユーザー
+	voters := make(map[*room][]string, len(all))
+	total := 0
+	for _, rm := range all {
+		for userID, record := range rm.store.UserVotes() {
+			if record.Vote == key {
+				voters[rm] = append(voters[rm], userID)
+				total++
+			}
+		}
+	}
+	if total > 0 && !force {
+		writeJSONError(w, http.StatusConflict, errCodeOptionInUse, "Vote option is the current choice of some users")
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	options := slices.DeleteFunc(slices.Clone(set.options), func(o voteOption) bool { return o.Key == key })
+	setVoteOptions(options)
+	for _, rm := range all {
+		if err := rm.moveVotes(ctx, voters[rm], reassignTo); err != nil {
+			slog.ErrorContext(r.Context(), "failed to move votes of removed option", "event", "option_removed", "roomId", rm.id, "option", key, "error", err)
+			writeStoreError(w, err, "Failed to move votes")
+			return
+		}
+		if s, ok := rm.store.(optionResizer); ok {
+			s.removeOption(key)
+		}
+		voteCurrent.DeleteLabelValues(rm.id, key)
+		rm.notifySubscribers()
+		rm.updateVoteGauges(rm.store.Counts())
+	}
+
+	recordAudit(AuditEntry{Action: "remove_option", OldVote: key, NewVote: reassignTo, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+	slog.WarnContext(r.Context(), "vote option removed", "event", "option_removed", "option", key, "reassignTo", reassignTo, "votes", total)
+	writeOptions(w, http.StatusOK)
+}
+
+// ユーザーの投票を reassignTo に移す。reassignTo が空なら取り消す (呼び出し側でロックを取っておくこと)
+// 移した票はそのユーザーが投票したときの重みのまま数える
+func (rm *room) moveVotes(ctx context.Context, userIDs []string, reassignTo string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	votes := rm.store.UserVotes()
+	now := time.Now()
+	for _, userID := range userIDs {
+		var err error
+		if reassignTo != "" {
+			err = rm.store.RecordVote(ctx, userID, reassignTo, normalizeWeight(votes[userID].Weight), now)
+		} else {
+			err = rm.store.DeleteVote(ctx, userID)
+		}
+		if err != nil && !errors.Is(err, errVoteNotFound) {
+			return err
+		}
+		if reassignTo != "" {
+			rm.tallyCohort(userID, "", votes[userID].Vote, true, reassignTo)
+			rm.recordTransition(userID, transitionReassigned, votes[userID].Vote, reassignTo, now)
+		} else {
+			rm.untallyCohort(userID, votes[userID].Vote)
+			rm.recordTransition(userID, transitionRemoved, votes[userID].Vote, "", now)
+		}
+	}
+	return nil
+}
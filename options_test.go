@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeVote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"  あつい  ", "あつい"},
+		{"　あつい　", "あつい"}, // 全角の空白
+		{"\tさむい\n", "さむい"},
+		{"ｈｏｔ", "hot"},       // 全角の英字
+		{"ﾎｯﾄ", "ホット"},       // 半角のカタカナ
+		{"ｶﾞﾏﾝ", "ガマン"},      // 半角の濁点は前の文字とまとめる
+		{"か\u3099まん", "がまん"}, // 結合文字の濁点
+		{"ハ\u309aンチ", "パンチ"}, // 結合文字の半濁点
+		{"ちょうどよい", "ちょうどよい"}, // もともと正規化されている
+		{"   ", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeVote(tt.in); got != tt.want {
+			t.Errorf("normalizeVote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 空白・全角と半角・結合文字の違いがあっても、同じ選択肢への投票として数える
+func TestVoteNormalization(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "options.json")
+	options := `[
+		{"key": "hot", "labels": {"ja": "あつい"}},
+		{"key": "ok", "labels": {"ja": "ちょうどいい"}},
+		{"key": "gaman", "labels": {"ja": "がまん"}},
+		{"key": "ホット"}
+	]`
+	if err := os.WriteFile(path, []byte(options), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, "VOTE_OPTIONS_FILE="+path)
+
+	for _, tt := range []struct {
+		vote, want string
+	}{
+		{"  あつい  ", "hot"},
+		{"　あつい", "hot"},
+		{"ｈｏｔ", "hot"},
+		{" ｏｋ ", "ok"},
+		{"か\u3099まん", "gaman"},
+		{"ﾎｯﾄ", "ホット"},
+		{"ホット", "ホット"},
+	} {
+		res := srv.vote(t, "/v1/vote", "u1", tt.vote, http.StatusOK)
+		if res.Counts[tt.want] != 1 {
+			t.Errorf("vote %q: counts %v, want %s=1", tt.vote, res.Counts, tt.want)
+		}
+	}
+
+	for _, vote := range []string{"", "   ", "あつ い"} {
+		if res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u1", Vote: vote}); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("vote %q: status %d, want 400: %s", vote, res.StatusCode, data)
+		}
+	}
+}
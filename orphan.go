@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// 取り除かれた選択肢に投票していたユーザーがもう一度投票したときの扱い (ORPHANED_VOTE_POLICY で設定する)
+const (
+	// 新しい投票として受け付ける (ALLOW_VOTE_CHANGE=false や VOTE_CHANGE_COOLDOWN でも断らない)
+	orphanedVoteRevote = "revote"
+	// ほかの選択肢への変更と同じに扱う
+	orphanedVoteChange = "change"
+)
+
+var orphanedVotePolicy = orphanedVoteRevote
+
+func loadOrphanedVotePolicy() error {
+	switch v := os.Getenv("ORPHANED_VOTE_POLICY"); v {
+	case "":
+		orphanedVotePolicy = orphanedVoteRevote
+	case orphanedVoteRevote, orphanedVoteChange:
+		orphanedVotePolicy = v
+	default:
+		return fmt.Errorf("invalid ORPHANED_VOTE_POLICY %q: must be %q or %q", v, orphanedVoteRevote, orphanedVoteChange)
+	}
+	return nil
+}
+
+// 以前の投票を「変更」として扱うかを返す (投票の変更の禁止や待ち時間、レスポンスの status に使う)
+// 以前の投票の選択肢がもう無い (管理者が取り除いた) なら、ログに出して orphanedVotePolicy に従う
+// 取り除かれた選択肢の票は集計に無いので、保存先はそれを引かずに新しい投票を記録する (呼び出し側でロックを取っておくこと)
+func (rm *room) previousVoteCounts(ctx context.Context, userID, previousVote string, hasPrevious bool) bool {
+	if !hasPrevious || rm.optionSet().has(previousVote) {
+		return hasPrevious
+	}
+	slog.InfoContext(ctx, "previous vote is for a removed option", "event", "orphaned_vote", "roomId", rm.id, "userId", logUserID(userID), "previousVote", previousVote, "policy", orphanedVotePolicy)
+	return orphanedVotePolicy == orphanedVoteChange
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// 投票の途中で管理者が選択肢を取り除いても、そこに投票していたユーザーはほかの選択肢に投票し直せる
+func TestRevoteAfterOptionRemoved(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u2", "ok", http.StatusOK)
+
+	if res, data := srv.do(t, http.MethodDelete, "/v1/admin/options/hot?force=true", nil, adminHeader); res.StatusCode != http.StatusOK {
+		t.Fatalf("remove option: status %d: %s", res.StatusCode, data)
+	}
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusBadRequest)
+	if res := srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK); !sameCounts(res.Counts, map[string]int{"ok": 1, "cold": 1}) {
+		t.Errorf("revote: counts %v, want ok=1 cold=1", res.Counts)
+	}
+}
+
+// 保存されていた投票が今は無い選択肢を指していても (選択肢を変えて再起動したときなど)、
+// それを引かずに新しい投票を記録し、ORPHANED_VOTE_POLICY に従って新しい投票か変更として扱う
+func TestOrphanedPreviousVote(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		status int
+		vote   string // 投票のレスポンスの status
+	}{
+		{orphanedVoteRevote, http.StatusOK, voteStatusNew},
+		{orphanedVoteChange, http.StatusConflict, ""},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			srv := newTestServer(t, "ORPHANED_VOTE_POLICY="+tt.policy, "ALLOW_VOTE_CHANGE=false")
+			srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+			srv.vote(t, "/v1/vote", "u2", "ok", http.StatusOK)
+
+			// hot を選択肢から外す (ユーザーの投票は hot のまま残る)
+			set := currentOptions.Load()
+			setVoteOptions(slices.DeleteFunc(slices.Clone(set.options), func(o voteOption) bool { return o.Key == "hot" }))
+			t.Cleanup(func() { setVoteOptions(set.options) })
+			defaultRoom.store.(optionResizer).removeOption("hot")
+
+			res := srv.vote(t, "/v1/vote", "u1", "cold", tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			if res.Status != tt.vote {
+				t.Errorf("status %q, want %q", res.Status, tt.vote)
+			}
+			if want := map[string]int{"ok": 1, "cold": 1}; !sameCounts(res.Counts, want) {
+				t.Errorf("counts %v, want %v", res.Counts, want)
+			}
+			for option, count := range defaultRoom.store.Counts() {
+				if count < 0 {
+					t.Errorf("%s count %d", option, count)
+				}
+			}
+			if vote, _ := defaultRoom.store.UserVote("u1"); vote != "cold" {
+				t.Errorf("u1 vote %q, want cold", vote)
+			}
+		})
+	}
+}
+
+// 既定の方針は revote。前のテストで変えた方針が残らない
+func TestOrphanedVotePolicyDefault(t *testing.T) {
+	for _, env := range []string{"ORPHANED_VOTE_POLICY=change", "ORPHANED_VOTE_POLICY="} {
+		newTestServer(t, env)
+	}
+	if orphanedVotePolicy != orphanedVoteRevote {
+		t.Errorf("policy %q, want %q", orphanedVotePolicy, orphanedVoteRevote)
+	}
+	t.Setenv("ORPHANED_VOTE_POLICY", "drop")
+	if err := loadOrphanedVotePolicy(); err == nil {
+		t.Error("ORPHANED_VOTE_POLICY=drop: no error")
+	}
+}
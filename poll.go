@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// GET /results/poll で変更を待つ最長の時間
+const longPollTimeout = 30 * time.Second
+
+// GET /results/poll のレスポンス形式
+type PollResultsResponse struct {
+	Version uint64         `json:"version"` // 次の ?version= に渡す値
+	Counts  map[string]int `json:"counts"`
+}
+
+// 投票が反映されたことを時刻とともに記録し、GET /results/poll と GET /results/diff で待っているリクエストを起こす
+// (呼び出し側でロックを取っておくこと)
+func (rm *room) bumpVersion() {
+	rm.version++
+	rm.trackOptionChanges()
+	rm.lastUpdated = time.Now()
+	close(rm.changed)
+	rm.changed = make(chan struct{})
+}
+
+// GET /results/poll?version=N エンドポイントの処理 (ロングポーリング)
+// 集計のバージョンが N より新しくなるまで待ってから、新しい集計とバージョンを返す
+// SSE や WebSocket を使えないクライアント向け。?version が無ければすぐに現在の集計を返す
+// longPollTimeout の間に変わらなければ 304 を返すので、クライアントは同じ N でもう一度呼ぶ
+func (rm *room) pollResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	since, ok := parseIntParam(w, r, "version", -1, 0, math.MaxInt)
+	if !ok {
+		return
+	}
+
+	// 待つ時間はサーバー全体の書き込みの期限より長くなることがあるので、このリクエストだけ延ばす
+	deadline := time.Now().Add(longPollTimeout)
+	http.NewResponseController(w).SetWriteDeadline(deadline.Add(10 * time.Second))
+	timer := time.NewTimer(longPollTimeout)
+	defer timer.Stop()
+
+	for {
+		rm.mutex.RLock()
+		version, changed := rm.version, rm.changed
+		if since < 0 || version > uint64(since) {
+			res := PollResultsResponse{Version: version, Counts: rm.store.Counts()}
+			rm.mutex.RUnlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		rm.mutex.RUnlock()
+
+		select {
+		case <-changed:
+			// 新しいバージョンを読み直す
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-shuttingDown:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
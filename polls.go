@@ -0,0 +1,436 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /polls のボディの上限と、1つの投票に設定できる選択肢の数
+const (
+	maxPollBodyBytes = 16 << 10
+	maxPollOptions   = 50
+)
+
+// 投票の状態のうち、保管されて投票を受け付けなくなったもの (pollStatusOpen などに加えて使う)
+const pollStatusArchived = "archived"
+
+// POST /polls で作った投票の定義 (保存先にもこの形の JSON で保存する)
+// 投票は同じIDの部屋として扱い、票数やロックは部屋のものを使う。ここでは部屋ごとの選択肢と受付期間を持つ
+type pollInfo struct {
+	ID         string       `json:"id"`
+	Title      string       `json:"title,omitempty"`
+	Options    []voteOption `json:"options"`
+	Schedule   pollSchedule `json:"schedule"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	ArchivedAt *time.Time   `json:"archivedAt,omitempty"` // 保管した時刻 (保管していなければ省略)
+}
+
+type pollDefinition struct {
+	info    pollInfo
+	options *optionSet
+}
+
+var (
+	// 投票IDごとの定義
+	polls = make(map[string]*pollDefinition)
+
+	// polls マップと定義の読み書きを守るロック (roomsMutex と両方取るときは roomsMutex を先に取る)
+	pollsMutex sync.RWMutex
+)
+
+// 投票の定義を保存先に書く (main で永続化先に合わせて差し替える。スナップショットでは書き出しのときに一緒に保存する)
+var storePoll = func(ctx context.Context, info pollInfo) error {
+	return nil
+}
+
+// まだ読み込んでいない投票の定義を保存先から読む (複数のインスタンスで保存先を共有するときに差し替える)
+var fetchPoll = func(id string) (pollInfo, bool) {
+	return pollInfo{}, false
+}
+
+// 保存先から読んだ投票の定義を登録する (部屋を読み込む前に呼ぶ)
+func registerPolls(infos []pollInfo) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	for _, info := range infos {
+		polls[info.ID] = &pollDefinition{info: info, options: newOptionSet(info.Options)}
+	}
+}
+
+// 投票の定義を返す。無ければ保存先も探す
+func lookupPoll(id string) (*pollDefinition, bool) {
+	if id == "" {
+		return nil, false
+	}
+	pollsMutex.RLock()
+	p, ok := polls[id]
+	pollsMutex.RUnlock()
+	if ok {
+		return p, true
+	}
+
+	info, ok := fetchPoll(id)
+	if !ok {
+		return nil, false
+	}
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	if p, ok := polls[id]; ok {
+		return p, true
+	}
+	p = &pollDefinition{info: info, options: newOptionSet(info.Options)}
+	polls[id] = p
+	return p, true
+}
+
+// 部屋の選択肢の一式 (POST /polls で作った投票はその選択肢、それ以外は設定の選択肢)
+func roomOptions(roomID string) *optionSet {
+	if p, ok := lookupPoll(roomID); ok {
+		return p.options
+	}
+	return currentOptions.Load()
+}
+
+// 設定の選択肢ではなく、投票ごとの選択肢を使う部屋か
+func hasOwnOptions(roomID string) bool {
+	_, ok := lookupPoll(roomID)
+	return ok
+}
+
+func (rm *room) optionSet() *optionSet {
+	return roomOptions(rm.id)
+}
+
+// 保管された投票か
+func isArchivedPoll(roomID string) bool {
+	p, ok := lookupPoll(roomID)
+	if !ok {
+		return false
+	}
+	pollsMutex.RLock()
+	defer pollsMutex.RUnlock()
+	return p.info.ArchivedAt != nil
+}
+
+// POST /polls のリクエスト形式
+// options を省略したときは、その時点の設定の選択肢をコピーして使う (後で設定の選択肢を変えても、この投票は変わらない)
+type CreatePollRequest struct {
+	ID       string       `json:"id"`
+	Title    string       `json:"title"`
+	Options  []voteOption `json:"options"`
+	OpensAt  *time.Time   `json:"opensAt"`
+	ClosesAt *time.Time   `json:"closesAt"`
+}
+
+// GET /polls の1要素と GET /polls/{pollId} のレスポンス形式
+type PollSummary struct {
+	ID         string         `json:"id"`
+	Title      string         `json:"title,omitempty"`
+	Status     string         `json:"status"` // open, closed, scheduled, archived
+	Options    []voteOption   `json:"options"`
+	OpensAt    *time.Time     `json:"opensAt,omitempty"`
+	ClosesAt   *time.Time     `json:"closesAt,omitempty"`
+	CreatedAt  string         `json:"createdAt"`
+	ArchivedAt string         `json:"archivedAt,omitempty"`
+	Total      int            `json:"total"`
+	Counts     map[string]int `json:"counts"`
+}
+
+// GET /polls のレスポンス形式
+type PollListResponse struct {
+	Polls []PollSummary `json:"polls"`
+}
+
+// /polls エンドポイントの処理 (GET で一覧、POST で作成)
+func pollsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		listPollsHandler(w, r)
+	case http.MethodPost:
+		requireAdmin(createPollHandler)(w, r)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// POST /polls エンドポイントの処理 (管理用)
+// { "id": "...", "title": "...", "options": [{"key": "...", "labels": {...}}], "opensAt": "...", "closesAt": "..." }
+// 投票ごとに票数とロックは別々で、/polls/{pollId}/vote と /polls/{pollId}/results で使う
+func createPollHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreatePollRequest
+	if err := decodeJSONBody(w, r, &req, maxPollBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	if !roomIDPattern.MatchString(req.ID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "Invalid poll id")
+		return
+	}
+	options := req.Options
+	if len(options) == 0 {
+		options = currentOptions.Load().options
+	}
+	if len(options) > maxPollOptions {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("a poll can have at most %d options", maxPollOptions))
+		return
+	}
+	options, err := normalizeVoteOptions(options)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	schedule := pollSchedule{OpensAt: req.OpensAt, ClosesAt: req.ClosesAt}
+	if err := schedule.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	info := pollInfo{
+		ID:        req.ID,
+		Title:     strings.TrimSpace(req.Title),
+		Options:   options,
+		Schedule:  schedule,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// 同じIDの部屋が投票で作られないよう、登録するまで部屋の作成を止める
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+	if _, ok := rooms[info.ID]; ok || roomExists(info.ID) || hasOwnOptions(info.ID) {
+		writeJSONError(w, http.StatusConflict, errCodePollExists, "Poll or room already exists")
+		return
+	}
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := storePoll(ctx, info); err != nil {
+		slog.ErrorContext(r.Context(), "failed to save poll", "event", "poll_created", "pollId", info.ID, "error", err)
+		writeStoreError(w, err, "Failed to save poll")
+		return
+	}
+	registerPolls([]pollInfo{info})
+
+	recordAudit(AuditEntry{Action: "create_poll", RoomID: info.ID, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+	slog.WarnContext(r.Context(), "poll created", "event", "poll_created", "pollId", info.ID, "options", len(options))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pollSummary(info, schedule.status(time.Now()), newOptionSet(options), nil))
+}
+
+// GET /polls?archived=true エンドポイントの処理
+// 保管していない投票を作成順に票数の要約付きで返す。archived=true なら保管した投票も含める
+func listPollsHandler(w http.ResponseWriter, r *http.Request) {
+	includeArchived := r.URL.Query().Get("archived") == "true"
+
+	pollsMutex.RLock()
+	ids := make([]string, 0, len(polls))
+	for id, p := range polls {
+		if includeArchived || p.info.ArchivedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+	pollsMutex.RUnlock()
+
+	res := PollListResponse{Polls: make([]PollSummary, 0, len(ids))}
+	for _, id := range ids {
+		summary, err := loadPollSummary(id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to open room", "roomId", id, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to open poll")
+			return
+		}
+		res.Polls = append(res.Polls, summary)
+	}
+	slices.SortFunc(res.Polls, func(a, b PollSummary) int {
+		return cmp.Or(strings.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// 投票の部屋を開いて要約を作る。終了していれば確定した票数を使う
+func loadPollSummary(id string) (PollSummary, error) {
+	p, ok := lookupPoll(id)
+	if !ok {
+		return PollSummary{}, errRoomNotFound
+	}
+	rm, err := getRoom(id, true)
+	if err != nil {
+		return PollSummary{}, err
+	}
+
+	now := time.Now()
+	rm.ensureFinal(now)
+	rm.mutex.RLock()
+	counts, _ := rm.resultCounts()
+	schedule := rm.schedule
+	rm.mutex.RUnlock()
+
+	pollsMutex.RLock()
+	info := p.info
+	pollsMutex.RUnlock()
+	info.Schedule = schedule
+	status := schedule.status(now)
+	if info.ArchivedAt != nil {
+		status = pollStatusArchived
+	}
+	return pollSummary(info, status, p.options, counts), nil
+}
+
+func pollSummary(info pollInfo, status string, set *optionSet, counts map[string]int) PollSummary {
+	s := PollSummary{
+		ID:        info.ID,
+		Title:     info.Title,
+		Status:    status,
+		Options:   info.Options,
+		OpensAt:   info.Schedule.OpensAt,
+		ClosesAt:  info.Schedule.ClosesAt,
+		CreatedAt: info.CreatedAt.UTC().Format(time.RFC3339),
+		Counts:    make(map[string]int, len(set.keys)),
+	}
+	if info.ArchivedAt != nil {
+		s.ArchivedAt = info.ArchivedAt.UTC().Format(time.RFC3339)
+	}
+	for _, option := range set.keys {
+		s.Counts[option] = counts[option]
+		s.Total += counts[option]
+	}
+	return s
+}
+
+// パスの {pollId} から投票の部屋を探す。見つからなければエラーレスポンスを書いて nil を返す
+// /rooms/{roomId} と違い、POST /polls で作っていない投票には投票できない
+func pollFromRequest(w http.ResponseWriter, r *http.Request) *room {
+	id := r.PathValue("pollId")
+	if !roomIDPattern.MatchString(id) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid poll id")
+		return nil
+	}
+	if _, ok := lookupPoll(id); !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Poll not found")
+		return nil
+	}
+	rm, err := getRoom(id, true)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to open room", "roomId", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to open poll")
+		return nil
+	}
+	return rm
+}
+
+// /polls/{pollId} エンドポイントの処理 (GET で要約、DELETE で保管)
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		rm := pollFromRequest(w, r)
+		if rm == nil {
+			return
+		}
+		summary, err := loadPollSummary(rm.id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to open room", "roomId", rm.id, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to open poll")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(summary)
+	case http.MethodDelete:
+		requireAdmin(archivePollHandler)(w, r)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// DELETE /polls/{pollId} エンドポイントの処理 (管理用)
+// 投票を締め切って結果を確定し、一覧から外す。票数は消さずに残すので、結果はその後も読める
+// 保管した投票は新しい投票を 403 で断り、POST /admin/reopen でも再開できない
+func archivePollHandler(w http.ResponseWriter, r *http.Request) {
+	rm := pollFromRequest(w, r)
+	if rm == nil {
+		return
+	}
+	p, _ := lookupPoll(rm.id)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	pollsMutex.RLock()
+	info := p.info
+	pollsMutex.RUnlock()
+	if info.ArchivedAt != nil {
+		writeJSONError(w, http.StatusConflict, errCodePollArchived, "Poll is already archived")
+		return
+	}
+
+	// まだ終了していなければ今を終了時刻にする (再起動した後も同じ時刻で確定し直せるよう、受付期間として保存する)
+	now := time.Now().UTC().Truncate(time.Second)
+	if rm.schedule.status(now) != pollStatusClosed {
+		rm.schedule.ClosesAt = &now
+		if rm.schedule.OpensAt != nil && !rm.schedule.OpensAt.Before(now) {
+			rm.schedule.OpensAt = nil
+		}
+	}
+	info.Schedule = rm.schedule
+	info.ArchivedAt = &now
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	if err := storePoll(ctx, info); err != nil {
+		slog.ErrorContext(r.Context(), "failed to save poll", "event", "poll_archived", "pollId", info.ID, "error", err)
+		writeStoreError(w, err, "Failed to archive poll")
+		return
+	}
+	pollsMutex.Lock()
+	p.info = info
+	pollsMutex.Unlock()
+
+	rm.freezeIfClosed(now)
+	rm.notifySubscribers()
+
+	recordAudit(AuditEntry{Action: "archive_poll", RoomID: info.ID, RemoteIP: remoteIP(r), RequestID: requestIDFromContext(r.Context())})
+	slog.WarnContext(r.Context(), "poll archived", "event", "poll_archived", "pollId", info.ID, "counts", rm.final.Counts)
+
+	counts, _ := rm.resultCounts()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(pollSummary(info, pollStatusArchived, p.options, counts))
+}
+
+// /polls/{pollId}/vote エンドポイントの処理
+func pollVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if rm := pollFromRequest(w, r); rm != nil {
+		rm.voteRouteHandler(w, r)
+	}
+}
+
+// /polls/{pollId}/results エンドポイントの処理
+func pollResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := pollFromRequest(w, r); rm != nil {
+		rm.resultsHandler(w, r)
+	}
+}
+
+// 保管された投票なら 409 を書いて false を返す (POST /admin/reopen 用)
+func checkNotArchived(w http.ResponseWriter, rm *room) bool {
+	if !isArchivedPoll(rm.id) {
+		return true
+	}
+	writeJSONError(w, http.StatusConflict, errCodePollArchived, "Poll is archived")
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VOTE_RATE_LIMIT / VOTE_RATE_WINDOW が未設定のときの上限 (1分に10票まで)
+const (
+	defaultVoteRateLimit  = 10
+	defaultVoteRateWindow = time.Minute
+)
+
+// キーごとの固定ウィンドウ方式のレート制限
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	entries map[string]*rateWindow
+}
+
+// 1つのキーの現在のウィンドウ
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		entries: make(map[string]*rateWindow),
+	}
+}
+
+// 1回分を数え、上限内なら true を返す。超えていれば次のウィンドウまでの時間も返す
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok || now.Sub(entry.start) >= l.window {
+		l.entries[key] = &rateWindow{start: now, count: 1}
+		return true, 0
+	}
+	if entry.count >= l.limit {
+		return false, entry.start.Add(l.window).Sub(now)
+	}
+	entry.count++
+	return true, 0
+}
+
+// ウィンドウが終わったキーを取り除く (マップが際限なく大きくならないように)
+func (l *rateLimiter) evictIdle(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, entry := range l.entries {
+		if now.Sub(entry.start) >= l.window {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// 定期的に evictIdle を呼ぶ。サーバーが終了すると止まる
+func (l *rateLimiter) startEviction() {
+	go func() {
+		ticker := time.NewTicker(l.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				l.evictIdle(now)
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// IP_RATE_LIMIT / IP_RATE_WINDOW が未設定のときの上限 (1分に60リクエストまで)
+// 1つのIPから多くのユーザーIDを使い回す投票を抑えるためのもので、ユーザーごとの上限より緩くする
+const (
+	defaultIPRateLimit  = 60
+	defaultIPRateWindow = time.Minute
+)
+
+// 上限を超えたときの 429 レスポンス
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	writeJSONError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests")
+}
+
+// Retry-After ヘッダーを秒単位 (最低1秒) で付ける
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// ユーザーごとの投票のレート制限 (nilなら制限しない)
+var userRateLimiter *rateLimiter
+
+// 投票のハンドラーをユーザーごとのレート制限で包むミドルウェア
+func limitVotesPerUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if userRateLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		userID := peekUserID(r)
+		if userID == "" {
+			// ユーザーが分からないリクエストはハンドラー側でエラーにする
+			next(w, r)
+			return
+		}
+
+		if ok, retryAfter := userRateLimiter.allow(userID, time.Now()); !ok {
+			slog.InfoContext(r.Context(), "vote rate limited", "event", "rate_limit", "userId", logUserID(userID))
+			writeRateLimited(w, retryAfter)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ハンドラーより先にリクエストのユーザーIDを調べる
+// 認証が有効ならトークンのUID、無効ならボディの userId を使う (ボディは読み戻せるように差し替える)
+func peekUserID(r *http.Request) string {
+	if verifier != nil {
+		uid, err := authenticate(r)
+		if err != nil {
+			return ""
+		}
+		return uid
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var req VoteRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
+	}
+	return req.UserID
+}
+
+// 送信元IPごとのレート制限 (nilなら制限しない)
+var ipRateLimiter *rateLimiter
+
+// ハンドラーを送信元IPごとのレート制限で包むミドルウェア
+// 投票と、SSE/WebSocketの接続の両方に使う
+func limitPerIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ipRateLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		ip := remoteIP(r)
+		if ok, retryAfter := ipRateLimiter.allow(ip, time.Now()); !ok {
+			slog.InfoContext(r.Context(), "request rate limited by ip", "event", "rate_limit_ip", "remoteIp", ip, "path", r.URL.Path)
+			writeRateLimited(w, retryAfter)
+			return
+		}
+		next(w, r)
+	}
+}
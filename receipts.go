@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// 受付番号の接頭辞 (ログなどで他のIDと見分けやすいように)
+const receiptPrefix = "rcpt_"
+
+// 受付番号の形式 (接頭辞と128ビットの乱数の16進)
+var receiptIDPattern = regexp.MustCompile(`^rcpt_[0-9a-f]{32}$`)
+
+// 投票を記録したときにユーザーへ返す受付番号 (ユーザーごとに最新の1つだけ持つ)
+type voteReceipt struct {
+	ID   string
+	Vote string
+	At   time.Time
+}
+
+// 受付番号からどの部屋のどのユーザーのものかを引く索引 (部屋の受付番号と一緒に書き換える)
+// 部屋のロックを取った後に receiptsMutex を取る。逆の順では取らないこと
+var (
+	receiptIndex  = make(map[string]receiptOwner)
+	receiptsMutex sync.Mutex
+)
+
+type receiptOwner struct {
+	roomID string
+	userID string
+}
+
+// 推測できない受付番号を作る
+func newReceiptID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return receiptPrefix + hex.EncodeToString(b)
+}
+
+// 投票を記録したユーザーの受付番号を返す (呼び出し側で書き込みロックを取っておくこと)
+// 今の受付番号が同じ選択肢のものならそれを返し、変わっていれば新しく作って前のものは使えなくする
+// 受付番号はメモリ上だけに持つので、再起動すると前の番号では引けなくなる (次の投票で新しく作る)
+func (rm *room) issueReceipt(userID, vote string, at time.Time) string {
+	if userID == "" {
+		return ""
+	}
+	if current, ok := rm.receipts[userID]; ok && current.Vote == vote {
+		return current.ID
+	}
+	receipt := voteReceipt{ID: newReceiptID(), Vote: vote, At: at}
+
+	receiptsMutex.Lock()
+	if previous, ok := rm.receipts[userID]; ok {
+		delete(receiptIndex, previous.ID)
+	}
+	receiptIndex[receipt.ID] = receiptOwner{roomID: rm.id, userID: userID}
+	receiptsMutex.Unlock()
+
+	if rm.receipts == nil {
+		rm.receipts = make(map[string]voteReceipt)
+	}
+	rm.receipts[userID] = receipt
+	return receipt.ID
+}
+
+// ユーザーの受付番号を使えなくする (投票の取り消しや削除。呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) dropReceipt(userID string) {
+	previous, ok := rm.receipts[userID]
+	if !ok {
+		return
+	}
+	receiptsMutex.Lock()
+	delete(receiptIndex, previous.ID)
+	receiptsMutex.Unlock()
+	delete(rm.receipts, userID)
+}
+
+// 部屋のすべての受付番号を使えなくする (リセットとリストア。呼び出し側で書き込みロックを取っておくこと)
+func (rm *room) dropAllReceipts() {
+	receiptsMutex.Lock()
+	for _, receipt := range rm.receipts {
+		delete(receiptIndex, receipt.ID)
+	}
+	receiptsMutex.Unlock()
+	rm.receipts = nil
+}
+
+// GET /receipts/{id} のレスポンス形式
+type ReceiptResponse struct {
+	ReceiptID   string  `json:"receiptId"`
+	RoomID      string  `json:"roomId,omitempty"` // 既定の投票なら省略
+	UserID      string  `json:"userId"`
+	Vote        string  `json:"vote"`        // 受付番号を返したときに記録した選択肢
+	RecordedAt  string  `json:"recordedAt"`  // 記録した時刻 (RFC3339, UTC)
+	CurrentVote *string `json:"currentVote"` // 今の投票 (選択肢を取り除いて票が移ったときなどは vote と違う。無ければ null)
+}
+
+// GET /receipts/{id} エンドポイントの処理
+// 受付番号から、そのときに記録した投票と今の投票を返す (「投票したのに反映されていない」という問い合わせの確認用)
+// 引けるのは受付番号のユーザー本人か管理用キーがあるときだけ。他人の番号は無いものとして 404 にする
+// 投票し直すと前の受付番号は 404 になる (ユーザーごとに最新の1つだけ持つ)
+func receiptHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	id := r.PathValue("id")
+	if !receiptIDPattern.MatchString(id) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Receipt not found")
+		return
+	}
+	receiptsMutex.Lock()
+	owner, ok := receiptIndex[id]
+	receiptsMutex.Unlock()
+	if !ok || (uid != "" && uid != owner.userID && !isAdmin(r)) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Receipt not found")
+		return
+	}
+
+	rm := defaultRoom
+	if owner.roomID != "" {
+		rm, err = getRoom(owner.roomID, false)
+		if errors.Is(err, errRoomNotFound) {
+			writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Receipt not found")
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to open room", "roomId", owner.roomID, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to open room")
+			return
+		}
+	}
+
+	rm.mutex.RLock()
+	receipt, ok := rm.receipts[owner.userID]
+	var current *string
+	if vote, voted := rm.store.UserVote(owner.userID); voted {
+		current = &vote
+	}
+	rm.mutex.RUnlock()
+	// 索引を引いてから部屋のロックを取るまでに投票し直されていれば、もう使えない番号
+	if !ok || receipt.ID != id {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Receipt not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ReceiptResponse{
+		ReceiptID:   id,
+		RoomID:      owner.roomID,
+		UserID:      owner.userID,
+		Vote:        receipt.Vote,
+		RecordedAt:  receipt.At.UTC().Format(time.RFC3339),
+		CurrentVote: current,
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ?since が無いときの集計期間
+const defaultRecentWindow = 15 * time.Minute
+
+// GET /results/recent のレスポンス形式
+type RecentResultsResponse struct {
+	Since  string         `json:"since"`  // 集計の開始時刻 (RFC3339)
+	Counts map[string]int `json:"counts"` // その時刻以降に選ばれた票の数
+	Total  int            `json:"total"`
+}
+
+// GET /results/recent?since=<duration> エンドポイントの処理
+// 指定した期間 (例: 15m) 内に選ばれた票だけを選択肢ごとに数える
+func (rm *room) recentResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	window := defaultRecentWindow
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid since duration")
+			return
+		}
+		window = d
+	}
+	since := time.Now().Add(-window)
+
+	rm.mutex.RLock()
+	votes := rm.store.UserVotes()
+	rm.mutex.RUnlock()
+
+	res := RecentResultsResponse{
+		Since:  since.UTC().Format(time.RFC3339),
+		Counts: make(map[string]int, len(rm.optionSet().keys)),
+	}
+	for _, option := range rm.optionSet().keys {
+		res.Counts[option] = 0
+	}
+	for _, record := range votes {
+		if record.VotedAt.Before(since) {
+			continue
+		}
+		res.Counts[record.Vote]++
+		res.Total++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// REDIS_KEY_PREFIX が未設定のときのキーの接頭辞
+const defaultRedisKeyPrefix = "mille-feuille"
+
+// Redisに書き込む VoteStore (複数のインスタンスで同じ集計を共有する)
+// 票数と重み付きの票数は部屋ごとのハッシュ、各ユーザーの投票はユーザーごとのハッシュに持つ
+// 他のインスタンスも書き込むので、キャッシュは持たずに毎回Redisから読む
+type redisStore struct {
+	client *redis.Client
+	prefix string
+	roomID string
+}
+
+// REDIS_URL (例: redis://:password@localhost:6379/0) に接続する
+func openRedis(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// REDIS_KEY_PREFIX (同じRedisを別の用途と共有するとき用)
+func redisKeyPrefix() string {
+	if v := os.Getenv("REDIS_KEY_PREFIX"); v != "" {
+		return v
+	}
+	return defaultRedisKeyPrefix
+}
+
+func newRedisStore(client *redis.Client, prefix, roomID string) *redisStore {
+	return &redisStore{client: client, prefix: prefix, roomID: roomID}
+}
+
+// 部屋IDの一覧を入れるセット
+func redisRoomsKey(prefix string) string {
+	return prefix + ":rooms"
+}
+
+// 選択肢ごとの票数のハッシュ
+func (s *redisStore) countsKey() string {
+	return s.prefix + ":room:" + s.roomID + ":counts"
+}
+
+// 最後に票数を手で直した時刻 (Unixミリ秒) の文字列
+func (s *redisStore) adjustedKey() string {
+	return s.prefix + ":room:" + s.roomID + ":adjusted"
+}
+
+// 選択肢ごとの重み付きの票数のハッシュ
+func (s *redisStore) weightedKey() string {
+	return s.prefix + ":room:" + s.roomID + ":weighted"
+}
+
+// 投票したユーザーIDのセット
+func (s *redisStore) usersKey() string {
+	return s.prefix + ":room:" + s.roomID + ":users"
+}
+
+// ユーザーごとに vote と weight、votedAt (Unixミリ秒) を持つハッシュの接頭辞
+func (s *redisStore) userKeyPrefix() string {
+	return s.prefix + ":room:" + s.roomID + ":user:"
+}
+
+// 以前の投票の票を減らして新しい票を増やす。同じ選択肢なら何もしない
+// 重みは以前の投票のときのものを引き、新しい重みを足す (重みを記録する前の投票は1)
+// 票数のキーが外部で消されていても、減らした票数は0未満にしない
+// KEYS: 票数, ユーザー一覧, ユーザーの投票, 部屋一覧, 重み付きの票数  ARGV: 選択肢, 時刻, ユーザーID, 部屋ID, 重み
+var redisRecordVoteScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[3], 'vote')
+if previous == ARGV[1] then
+	return 0
+end
+local function decr(key, field, n)
+	if redis.call('HINCRBY', key, field, -n) < 0 then
+		redis.call('HSET', key, field, 0)
+	end
+end
+if previous then
+	local weight = tonumber(redis.call('HGET', KEYS[3], 'weight') or '1')
+	decr(KEYS[1], previous, 1)
+	decr(KEYS[5], previous, weight)
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('HINCRBY', KEYS[5], ARGV[1], ARGV[5])
+redis.call('HSET', KEYS[3], 'vote', ARGV[1], 'weight', ARGV[5], 'votedAt', ARGV[2])
+redis.call('SADD', KEYS[2], ARGV[3])
+if ARGV[4] ~= '' then
+	redis.call('SADD', KEYS[4], ARGV[4])
+end
+return 1
+`)
+
+// 誰の投票かを残さずに票数だけを増やす (匿名投票モード)
+// KEYS: 票数, 重み付きの票数, 部屋一覧  ARGV: 選択肢, 重み, 部屋ID
+var redisAnonymousVoteScript = redis.NewScript(`
+redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('HINCRBY', KEYS[2], ARGV[1], ARGV[2])
+if ARGV[3] ~= '' then
+	redis.call('SADD', KEYS[3], ARGV[3])
+end
+return 1
+`)
+
+// ユーザーの投票を消してその票を減らす (0未満にはしない)。投票していなければ 0 を返す
+// KEYS: 票数, ユーザー一覧, ユーザーの投票, 重み付きの票数  ARGV: ユーザーID
+var redisDeleteVoteScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[3], 'vote')
+if not previous then
+	return 0
+end
+local weight = tonumber(redis.call('HGET', KEYS[3], 'weight') or '1')
+local function decr(key, field, n)
+	if redis.call('HINCRBY', key, field, -n) < 0 then
+		redis.call('HSET', key, field, 0)
+	end
+end
+decr(KEYS[1], previous, 1)
+decr(KEYS[4], previous, weight)
+redis.call('DEL', KEYS[3])
+redis.call('SREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+// 部屋の票数とユーザーの投票をすべて消す
+// KEYS: 票数, ユーザー一覧, 重み付きの票数, 直した時刻  ARGV: ユーザーの投票のキーの接頭辞
+var redisResetScript = redis.NewScript(`
+for _, userID in ipairs(redis.call('SMEMBERS', KEYS[2])) do
+	redis.call('DEL', ARGV[1] .. userID)
+end
+redis.call('DEL', unpack(KEYS))
+return 1
+`)
+
+// 選択肢ごとに票数と重み付きの票数を増減し (0未満にはしない)、直した時刻を記録する
+// KEYS: 票数, 重み付きの票数, 直した時刻  ARGV: 時刻, 続けて 選択肢, 増減 の組
+var redisAdjustCountsScript = redis.NewScript(`
+for i = 2, #ARGV, 2 do
+	for _, hash in ipairs({KEYS[1], KEYS[2]}) do
+		if redis.call('HINCRBY', hash, ARGV[i], ARGV[i + 1]) < 0 then
+			redis.call('HSET', hash, ARGV[i], 0)
+		end
+	end
+end
+redis.call('SET', KEYS[3], ARGV[1])
+return 1
+`)
+
+// 増減はスクリプトの中でまとめて行うので、他のインスタンスと同時に投票しても票数がずれない
+func (s *redisStore) RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error {
+	keys := []string{s.countsKey(), s.usersKey(), s.userKeyPrefix() + userID, redisRoomsKey(s.prefix), s.weightedKey()}
+	return redisRecordVoteScript.Run(ctx, s.client, keys,
+		vote, unixMilli(at), userID, s.roomID, weight).Err()
+}
+
+func (s *redisStore) RecordAnonymousVote(ctx context.Context, vote string, weight int, at time.Time) error {
+	keys := []string{s.countsKey(), s.weightedKey(), redisRoomsKey(s.prefix)}
+	return redisAnonymousVoteScript.Run(ctx, s.client, keys, vote, weight, s.roomID).Err()
+}
+
+func (s *redisStore) DeleteVote(ctx context.Context, userID string) error {
+	keys := []string{s.countsKey(), s.usersKey(), s.userKeyPrefix() + userID, s.weightedKey()}
+	deleted, err := redisDeleteVoteScript.Run(ctx, s.client, keys, userID).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errVoteNotFound
+	}
+	return nil
+}
+
+// 読めなかったときはログに残し、すべて0の票数を返す
+// (breakerStore で包んでいれば、代わりに最後に読めた票数が返る)
+func (s *redisStore) Counts() map[string]int {
+	counts, err := s.countsErr(context.Background())
+	if err != nil {
+		slog.Error("failed to read vote counts from redis", "roomId", s.roomID, "error", err)
+	}
+	return counts
+}
+
+// 読めなかったときはログに残し、すべて0の票数を返す
+func (s *redisStore) WeightedCounts() map[string]int {
+	counts, err := s.weightedCountsErr(context.Background())
+	if err != nil {
+		slog.Error("failed to read weighted vote counts from redis", "roomId", s.roomID, "error", err)
+	}
+	return counts
+}
+
+// 票数を読む。失敗したときはすべて0の票数とエラーを返す
+func (s *redisStore) countsErr(ctx context.Context) (map[string]int, error) {
+	return s.readCounts(ctx, s.countsKey())
+}
+
+// 重み付きの票数を読む。失敗したときはすべて0の票数とエラーを返す
+func (s *redisStore) weightedCountsErr(ctx context.Context) (map[string]int, error) {
+	return s.readCounts(ctx, s.weightedKey())
+}
+
+// 選択肢ごとの数のハッシュを読む
+func (s *redisStore) readCounts(ctx context.Context, key string) (map[string]int, error) {
+	options := roomOptions(s.roomID).keys
+	counts := make(map[string]int, len(options))
+	for _, option := range options {
+		counts[option] = 0
+	}
+
+	values, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return counts, err
+	}
+	for option, v := range values {
+		// 現在の選択肢に無いものは無視する
+		if _, ok := counts[option]; !ok {
+			continue
+		}
+		count, err := strconv.Atoi(v)
+		if err != nil {
+			slog.Error("invalid vote count in redis", "roomId", s.roomID, "option", option, "value", v)
+			continue
+		}
+		counts[option] = count
+	}
+	return counts, nil
+}
+
+func (s *redisStore) UserVote(userID string) (string, bool) {
+	vote, err := s.client.HGet(context.Background(), s.userKeyPrefix()+userID, "vote").Result()
+	if err == redis.Nil {
+		return "", false
+	}
+	if err != nil {
+		slog.Error("failed to read user vote from redis", "roomId", s.roomID, "userId", logUserID(userID), "error", err)
+		return "", false
+	}
+	return vote, true
+}
+
+func (s *redisStore) userRecord(userID string) (voteRecord, bool) {
+	values, err := s.client.HGetAll(context.Background(), s.userKeyPrefix()+userID).Result()
+	if err != nil {
+		slog.Error("failed to read user vote from redis", "roomId", s.roomID, "userId", logUserID(userID), "error", err)
+		return voteRecord{}, false
+	}
+	if values["vote"] == "" {
+		return voteRecord{}, false
+	}
+	record := voteRecord{Vote: values["vote"], Weight: 1}
+	if weight, _ := strconv.Atoi(values["weight"]); weight > 0 {
+		record.Weight = weight
+	}
+	if ms, _ := strconv.ParseInt(values["votedAt"], 10, 64); ms > 0 {
+		record.VotedAt = time.UnixMilli(ms)
+	}
+	return record, true
+}
+
+func (s *redisStore) UserVotes() map[string]voteRecord {
+	ctx := context.Background()
+	votes := make(map[string]voteRecord)
+
+	userIDs, err := s.client.SMembers(ctx, s.usersKey()).Result()
+	if err != nil {
+		slog.Error("failed to read user votes from redis", "roomId", s.roomID, "error", err)
+		return votes
+	}
+
+	pipe := s.client.Pipeline()
+	results := make([]*redis.MapStringStringCmd, len(userIDs))
+	for i, userID := range userIDs {
+		results[i] = pipe.HGetAll(ctx, s.userKeyPrefix()+userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("failed to read user votes from redis", "roomId", s.roomID, "error", err)
+		return votes
+	}
+
+	for i, userID := range userIDs {
+		values := results[i].Val()
+		if values["vote"] == "" {
+			// 取り消しと一覧の読み取りが重なった
+			continue
+		}
+		record := voteRecord{Vote: values["vote"], Weight: 1}
+		if weight, _ := strconv.Atoi(values["weight"]); weight > 0 {
+			record.Weight = weight
+		}
+		if ms, _ := strconv.ParseInt(values["votedAt"], 10, 64); ms > 0 {
+			record.VotedAt = time.UnixMilli(ms)
+		}
+		votes[userID] = record
+	}
+	return votes
+}
+
+func (s *redisStore) VoterCount() int {
+	n, err := s.client.SCard(context.Background(), s.usersKey()).Result()
+	if err != nil {
+		slog.Error("failed to count voters in redis", "roomId", s.roomID, "error", err)
+		return 0
+	}
+	return int(n)
+}
+
+func (s *redisStore) Reset(ctx context.Context) error {
+	keys := []string{s.countsKey(), s.usersKey(), s.weightedKey(), s.adjustedKey()}
+	return redisResetScript.Run(ctx, s.client, keys, s.userKeyPrefix()).Err()
+}
+
+func (s *redisStore) AdjustCounts(ctx context.Context, deltas map[string]int, at time.Time) error {
+	args := []any{unixMilli(at)}
+	for option, delta := range deltas {
+		args = append(args, option, delta)
+	}
+	keys := []string{s.countsKey(), s.weightedKey(), s.adjustedKey()}
+	return redisAdjustCountsScript.Run(ctx, s.client, keys, args...).Err()
+}
+
+// 読めなかったときはログに残し、ゼロ値を返す
+func (s *redisStore) countsAdjustedAt() time.Time {
+	ms, err := s.client.Get(context.Background(), s.adjustedKey()).Int64()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("failed to read count adjustment time from redis", "roomId", s.roomID, "error", err)
+		}
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// 表示名で保存されていた投票を選択肢のキーに書き換える (票数を書き換えたときだけユーザーの投票も見る)
+// KEYS: 票数, 重み付きの票数, ユーザー一覧  ARGV: ユーザーの投票のキーの接頭辞, 続けて 表示名, キー の組
+var redisMigrateOptionKeysScript = redis.NewScript(`
+local aliases = {}
+local renamed = 0
+for i = 2, #ARGV, 2 do
+	aliases[ARGV[i]] = ARGV[i + 1]
+	for _, hash in ipairs({KEYS[1], KEYS[2]}) do
+		local n = redis.call('HGET', hash, ARGV[i])
+		if n then
+			redis.call('HINCRBY', hash, ARGV[i + 1], n)
+			redis.call('HDEL', hash, ARGV[i])
+			renamed = renamed + 1
+		end
+	end
+end
+if renamed == 0 then
+	return 0
+end
+for _, userID in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+	local vote = redis.call('HGET', ARGV[1] .. userID, 'vote')
+	if vote and aliases[vote] then
+		redis.call('HSET', ARGV[1] .. userID, 'vote', aliases[vote])
+	end
+end
+return 1
+`)
+
+// 起動時に既定の投票と roomIDs の部屋の投票を選択肢のキーに書き換える
+func migrateRedisOptionKeys(client *redis.Client, prefix string, roomIDs []string, aliases map[string]string) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	for _, roomID := range append([]string{""}, roomIDs...) {
+		s := newRedisStore(client, prefix, roomID)
+		args := []any{s.userKeyPrefix()}
+		for label, key := range aliases {
+			args = append(args, label, key)
+		}
+		keys := []string{s.countsKey(), s.weightedKey(), s.usersKey()}
+		if err := redisMigrateOptionKeysScript.Run(ctx, client, keys, args...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 重み付きの票数を記録する前の部屋は、票数をそのまま重み付きの票数にする (それまでの票はすべて1票)
+// KEYS: 票数, 重み付きの票数
+var redisBackfillWeightedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+local counts = redis.call('HGETALL', KEYS[1])
+if #counts == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[2], unpack(counts))
+return 1
+`)
+
+// 起動時に既定の投票と roomIDs の部屋の重み付きの票数を用意する
+func backfillRedisWeights(client *redis.Client, prefix string, roomIDs []string) error {
+	ctx := context.Background()
+	for _, roomID := range append([]string{""}, roomIDs...) {
+		s := newRedisStore(client, prefix, roomID)
+		if err := redisBackfillWeightedScript.Run(ctx, client, []string{s.countsKey(), s.weightedKey()}).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 投票のあった部屋のID (既定の投票は含まない)
+func loadRedisRoomIDs(client *redis.Client, prefix string) ([]string, error) {
+	return client.SMembers(context.Background(), redisRoomsKey(prefix)).Result()
+}
+
+// 他のインスタンスで作られた部屋かどうか
+func redisRoomExists(client *redis.Client, prefix, roomID string) bool {
+	ok, err := client.SIsMember(context.Background(), redisRoomsKey(prefix), roomID).Result()
+	if err != nil {
+		slog.Error("failed to look up room in redis", "roomId", roomID, "error", err)
+		return false
+	}
+	return ok
+}
+
+// 投票の定義 (POST /polls) を投票IDごとに JSON で持つハッシュのキー
+func redisPollsKey(prefix string) string {
+	return prefix + ":polls"
+}
+
+// 保存済みの投票の定義を読む
+func loadRedisPolls(client *redis.Client, prefix string) ([]pollInfo, error) {
+	values, err := client.HGetAll(context.Background(), redisPollsKey(prefix)).Result()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]pollInfo, 0, len(values))
+	for id, v := range values {
+		var info pollInfo
+		if err := json.Unmarshal([]byte(v), &info); err != nil {
+			return nil, fmt.Errorf("parse poll %q: %w", id, err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// 他のインスタンスで作られた投票の定義を読む
+func fetchRedisPoll(client *redis.Client, prefix, id string) (pollInfo, bool) {
+	v, err := client.HGet(context.Background(), redisPollsKey(prefix), id).Result()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("failed to look up poll in redis", "pollId", id, "error", err)
+		}
+		return pollInfo{}, false
+	}
+	var info pollInfo
+	if err := json.Unmarshal([]byte(v), &info); err != nil {
+		slog.Error("invalid poll definition in redis", "pollId", id, "error", err)
+		return pollInfo{}, false
+	}
+	return info, true
+}
+
+// 投票の定義を書く (同じIDの定義は置き換える)
+func saveRedisPoll(ctx context.Context, client *redis.Client, prefix string, info pollInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return client.HSet(ctx, redisPollsKey(prefix), info.ID, data).Err()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+)
+
+// 選択肢ごとの集計結果
+type OptionResult struct {
+	Label      string  `json:"label"`      // 表示名 (リクエストの言語)
+	Count      int     `json:"count"`      // 投票した人数 (重みに関係なく1人1票)
+	Weighted   int     `json:"weighted"`   // 重み付きの票数
+	Percentage float64 `json:"percentage"` // 全体に対する割合 (%、小数第1位まで。人数で数える)
+
+	Metadata json.RawMessage `json:"metadata,omitempty"` // ?metadata=true のときの選択肢の metadata
+}
+
+// GET /results のレスポンス形式
+type ResultsResponse struct {
+	Options       map[string]OptionResult `json:"options"`
+	Total         int                     `json:"total"`
+	WeightedTotal int                     `json:"weightedTotal"`         // 重み付きの票数の合計
+	Status        string                  `json:"status"`                // 受付状態 (open, closed, scheduled)
+	LastUpdated   string                  `json:"lastUpdated,omitempty"` // 集計が最後に変わった時刻 (RFC3339, UTC。起動後にまだ変わっていなければ省略)
+	ServerTime    string                  `json:"serverTime,omitempty"`  // このレスポンスを作ったサーバーの時刻 (RFC3339, UTC)
+	Final         bool                    `json:"final,omitempty"`       // 終了して確定した結果か
+	ClosedAt      string                  `json:"closedAt,omitempty"`    // 確定した結果の終了時刻 (RFC3339, UTC)
+	FinalHash     string                  `json:"finalHash,omitempty"`   // 確定した票数の改ざん検出用ハッシュ
+	Cohorts       map[string]CohortResult `json:"cohorts,omitempty"`     // ?groupBy=cohort のときのコホートごとの票数
+	AdjustedAt    string                  `json:"adjustedAt,omitempty"`  // 管理者が票数を手で直した最後の時刻 (RFC3339, UTC。直していれば票数がユーザーの投票と合わない)
+	Voters        int                     `json:"voters,omitempty"`      // 複数選択モードで1つ以上選んだ人数 (total は選んだ数の合計)
+}
+
+// 集計と重み付きの票数から割合付きの結果を作る (counts と weighted は snapshotResults などで写したものを渡す)
+//
+// 割合は小数第1位までに丸める。単純に四捨五入すると合計が 99.9 や 100.1 に
+// なることがあるので、最大剰余方式で 0.1% 単位を配分し、合計が必ず 100 になるようにする。
+// 剰余が同じ場合は選択肢名の順で決める。総数が0のときはすべて0。
+func buildResults(set *optionSet, counts, weighted map[string]int, lang string) ResultsResponse {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+
+	res := ResultsResponse{
+		Options: make(map[string]OptionResult, len(counts)),
+		Total:   total,
+	}
+	for option := range counts {
+		res.WeightedTotal += weighted[option]
+	}
+	if total <= 0 {
+		for option, count := range counts {
+			res.Options[option] = OptionResult{Label: set.label(option, lang), Count: count, Weighted: weighted[option]}
+		}
+		return res
+	}
+
+	// 0.1% 単位 (合計1000) で切り捨てた値と剰余を求める
+	type share struct {
+		option    string
+		tenths    int
+		remainder int
+	}
+	shares := make([]share, 0, len(counts))
+	assigned := 0
+	for option, count := range counts {
+		scaled := count * 1000
+		s := share{option: option, tenths: scaled / total, remainder: scaled % total}
+		assigned += s.tenths
+		shares = append(shares, s)
+	}
+
+	// 余った分を剰余の大きい順に1つずつ配る
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].remainder != shares[j].remainder {
+			return shares[i].remainder > shares[j].remainder
+		}
+		return shares[i].option < shares[j].option
+	})
+	for i := 0; assigned < 1000 && i < len(shares); i++ {
+		shares[i].tenths++
+		assigned++
+	}
+
+	for _, s := range shares {
+		res.Options[s.option] = OptionResult{
+			Label:      set.label(s.option, lang),
+			Count:      counts[s.option],
+			Weighted:   weighted[s.option],
+			Percentage: float64(s.tenths) / 10,
+		}
+	}
+	return res
+}
+
+// GET /results?format=list の1要素
+type OptionCount struct {
+	Option     string  `json:"option"`
+	Label      string  `json:"label"`
+	Count      int     `json:"count"`
+	Weighted   int     `json:"weighted"`
+	Percentage float64 `json:"percentage"`
+}
+
+// 結果の並び順 (?sort=)
+const (
+	resultsSortOptions = "options" // 選択肢の設定順 (既定)
+	resultsSortCount   = "count"   // 票数の多い順 (同票なら設定順)
+)
+
+// 集計を並び順の決まった配列にする (counts と weighted は写したものを渡す)
+// JSONのオブジェクトはキーの順序が保証されないので、グラフなど順序に頼るクライアント向け
+func buildResultsList(set *optionSet, counts, weighted map[string]int, lang, order string) []OptionCount {
+	results := buildResults(set, counts, weighted, lang)
+	list := make([]OptionCount, 0, len(set.keys))
+	for _, option := range set.keys {
+		r := results.Options[option]
+		list = append(list, OptionCount{Option: option, Label: r.Label, Count: r.Count, Weighted: r.Weighted, Percentage: r.Percentage})
+	}
+	if order == resultsSortCount {
+		// 安定ソートなので同票の選択肢は設定順のまま
+		slices.SortStableFunc(list, func(a, b OptionCount) int {
+			return cmp.Compare(b.Count, a.Count)
+		})
+	}
+	return list
+}
+
+// GET /results/winner のレスポンス形式
+type WinnerResponse struct {
+	Option      string   `json:"option"`                // 最多票の選択肢 (同票なら設定順で最初のもの)
+	Count       int      `json:"count"`                 // その票数
+	Tie         bool     `json:"tie"`                   // 2つ以上の選択肢が最多票で並んでいるか
+	TiedOptions []string `json:"tiedOptions,omitempty"` // 最多票で並んでいる選択肢 (設定順)
+}
+
+// 最多票の選択肢を求める。まだ1票も無ければ false
+// Goのマップの順序は毎回変わるので、選択肢の設定順に調べて結果が決まるようにしている
+func computeWinner(set *optionSet, counts map[string]int) (WinnerResponse, bool) {
+	var res WinnerResponse
+	for _, option := range set.keys {
+		count := counts[option]
+		switch {
+		case count > res.Count:
+			res = WinnerResponse{Option: option, Count: count, TiedOptions: []string{option}}
+		case count == res.Count && count > 0:
+			res.TiedOptions = append(res.TiedOptions, option)
+		}
+	}
+	if res.Count == 0 {
+		return WinnerResponse{}, false
+	}
+
+	res.Tie = len(res.TiedOptions) > 1
+	if !res.Tie {
+		res.TiedOptions = nil
+	}
+	return res, true
+}
+
+// GET /results/stats のレスポンス形式
+type StatsResponse struct {
+	Total        int                `json:"total"`
+	Mode         *string            `json:"mode"`         // 最多票の選択肢 (同票なら設定順で最初のもの、票が無ければ null)
+	Distribution map[string]float64 `json:"distribution"` // 選択肢ごとの割合 (0〜1、票が無ければすべて0)
+}
+
+// 集計から要約の統計を求める (counts は写したものを渡す)
+func computeStats(set *optionSet, counts map[string]int) StatsResponse {
+	res := StatsResponse{Distribution: make(map[string]float64, len(counts))}
+	for _, count := range counts {
+		res.Total += count
+	}
+	for option, count := range counts {
+		if res.Total > 0 {
+			res.Distribution[option] = float64(count) / float64(res.Total)
+		} else {
+			res.Distribution[option] = 0
+		}
+	}
+	if winner, ok := computeWinner(set, counts); ok {
+		res.Mode = &winner.Option
+	}
+	return res
+}
+
+// 読み出し用に写した部屋の集計
+// 短い読み取りロックの中でコピーだけを作り、結果の組み立てと JSON のエンコードはロックを外してから行う
+// (遅いクライアントへの書き出しやエンコードの間、投票の書き込みを待たせないように)
+type resultsSnapshot struct {
+	set         *optionSet // 選択肢の一式は作り直して差し替えるだけなので、ポインタを持っていれば変わらない
+	counts      map[string]int
+	weighted    map[string]int
+	status      string
+	lastUpdated time.Time
+	final       bool
+	closedAt    time.Time
+	finalHash   string
+	cohorts     map[string]map[string]int // withCohorts のときだけ
+	adjustedAt  time.Time
+
+	aggregateVersion aggregateVersion // 集計の結果を覚えておくときの鍵 (cachedAggregate)
+}
+
+// 結果を返すのに要るものを読み取りロックの中でコピーする (ロックは中で取る)
+func (rm *room) snapshotResults(now time.Time, withCohorts bool) resultsSnapshot {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+
+	snap := resultsSnapshot{set: rm.optionSet(), status: rm.schedule.status(now), lastUpdated: rm.lastUpdated, adjustedAt: storeCountsAdjustedAt(rm.store)}
+	snap.aggregateVersion = aggregateVersion{version: rm.version, final: rm.final != nil, set: snap.set}
+	snap.counts, snap.weighted = rm.resultCounts()
+	if rm.final != nil {
+		snap.final = true
+		snap.closedAt = rm.final.ClosedAt
+		snap.finalHash = rm.final.Hash
+	}
+	if withCohorts {
+		snap.cohorts = cloneCohortCounts(rm.resultCohorts())
+	}
+	return snap
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 票数を読むだけのリクエストどうしがロックで待ち合うか比べる (RWMutex の読み取りロックなら並ぶ)
+func BenchmarkCountsLock(b *testing.B) {
+	counts := map[string]int{"hot": 120, "ok": 340, "cold": 56}
+	b.Run("Mutex", func(b *testing.B) {
+		var mu sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.Lock()
+				json.Marshal(counts)
+				mu.Unlock()
+			}
+		})
+	})
+	b.Run("RWMutex", func(b *testing.B) {
+		var mu sync.RWMutex
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mu.RLock()
+				json.Marshal(counts)
+				mu.RUnlock()
+			}
+		})
+	})
+}
+
+// GET /results を並列に読みながら、ときどき投票を入れる
+func BenchmarkResultsParallel(b *testing.B) {
+	srv := newTestServer(b)
+	handler := srv.Config.Handler
+	for i := range 100 {
+		srv.vote(b, "/v1/vote", fmt.Sprintf("u%d", i), defaultVoteOptions[i%len(defaultVoteOptions)].Key, http.StatusOK)
+	}
+
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var req *http.Request
+			if i := n.Add(1); i%50 == 0 {
+				req = httptest.NewRequest(http.MethodPost, "/v1/vote", voteBody(fmt.Sprintf("u%d", i%100), defaultVoteOptions[i%3].Key))
+				req.Header.Set("Content-Type", "application/json")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "/v1/results", nil)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				b.Errorf("%s %s: status %d: %s", req.Method, req.URL, rec.Code, rec.Body)
+			}
+		}
+	})
+}
+
+// 書き込みを止めてしまう遅いクライアント (release を閉じるまで Write が戻らない)
+type slowWriter struct {
+	header  http.Header
+	writing chan struct{} // 最初の Write で閉じる
+	release chan struct{}
+	once    sync.Once
+}
+
+func newSlowWriter() *slowWriter {
+	return &slowWriter{header: make(http.Header), writing: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *slowWriter) Header() http.Header { return w.header }
+func (w *slowWriter) WriteHeader(int)     {}
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.release
+	return len(p), nil
+}
+
+// 結果を書き出している途中のクライアントが遅くても、そのあいだの投票は待たされない
+func TestSlowReaderDoesNotBlockVoter(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+
+	for _, path := range []string{"/v1/results", "/v1/results?format=list", "/v1/results/winner", "/v1/results/stats", "/v1/results.csv"} {
+		t.Run(path, func(t *testing.T) {
+			w := newSlowWriter()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				srv.Config.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			}()
+			select {
+			case <-w.writing:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("GET %s did not write", path)
+			}
+
+			voted := make(chan struct{})
+			go func() {
+				defer close(voted)
+				srv.vote(t, "/v1/vote", "u2", "cold", http.StatusOK)
+				srv.vote(t, "/v1/vote", "u2", "hot", http.StatusOK)
+			}()
+			select {
+			case <-voted:
+			case <-time.After(5 * time.Second):
+				t.Errorf("vote blocked while GET %s was writing", path)
+			}
+			close(w.release)
+			<-done
+			<-voted
+		})
+	}
+}
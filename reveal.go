@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// 結果を見せ始める票の数 (MIN_REVEAL)。0 なら最初から見せる
+// 研究用の投票で、他の人の票を見てから選ぶ (バンドワゴン効果) のを防ぐ
+// 届くまでは票数の分かるエンドポイント (GET /results とその形式違い、winner, stats, CSV, 履歴, 勢い, 比較, コメント,
+// SSE, WebSocket, ロングポーリング) が 403 を返し、投票のレスポンスの counts は null になる
+// SSE と WebSocket は届く前の接続を 403 で断るので、断られたクライアントは後でつなぎ直すこと
+// つないだ後も送るたびに確かめ直し、リセットや票数の調整で届かなくなれば集計の代わりに null を送る
+var minReveal int
+
+// MIN_REVEAL を読む
+func loadMinReveal() error {
+	var err error
+	if minReveal, err = envInt("MIN_REVEAL", 0); err != nil {
+		return err
+	}
+	if minReveal < 0 {
+		return errors.New("MIN_REVEAL must not be negative")
+	}
+	return nil
+}
+
+// 票数がまだ MIN_REVEAL に届かず、結果を隠しているか (呼び出し側でロックを取っておくこと)
+// 管理用キーのあるリクエストには隠さない。終了した投票でも、票が足りなければ隠したまま
+func (rm *room) resultsHidden(r *http.Request) bool {
+	return rm.countsHidden(isAdmin(r))
+}
+
+// resultsHidden の、管理用キーがあるか (admin) を先に確かめておいたもの (呼び出し側でロックを取っておくこと)
+func (rm *room) countsHidden(admin bool) bool {
+	if minReveal <= 0 || admin {
+		return false
+	}
+	counts, _ := rm.resultCounts()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total < minReveal
+}
+
+// 結果を隠している間は 403 を書いて false を返す (ロックは中で取るので、ロックを取る前に呼ぶこと)
+func (rm *room) checkResultsRevealed(w http.ResponseWriter, r *http.Request) bool {
+	if minReveal > 0 {
+		// 管理用キーの有無で本文が変わるので、キャッシュが取り違えないようにする
+		w.Header().Add("Vary", "X-Admin-Key, Cookie")
+	}
+	rm.mutex.RLock()
+	hidden := rm.resultsHidden(r)
+	rm.mutex.RUnlock()
+	if hidden {
+		writeJSONError(w, http.StatusForbidden, errCodeResultsHidden, fmt.Sprintf("Results are hidden until %d votes are in", minReveal))
+		return false
+	}
+	return true
+}
+
+// 結果を隠している間に、配信中の購読者へ集計の代わりに送るもの (投票のレスポンスの counts と同じく null)
+var hiddenCountsPayload = []byte("null")
+
+// 配信中の購読者に送る集計 (JSON)。送るたびに結果を隠すか確かめ直し、隠していれば hiddenCountsPayload にする
+// 接続したときに見せてよかった購読者にも、リセットなどで MIN_REVEAL を下回った後の票数は見せない (ロックは中で取る)
+func (rm *room) streamCounts(admin bool, data []byte) []byte {
+	if minReveal <= 0 || admin {
+		return data
+	}
+	rm.mutex.RLock()
+	hidden := rm.countsHidden(false)
+	rm.mutex.RUnlock()
+	if hidden {
+		return hiddenCountsPayload
+	}
+	return data
+}
+
+// 投票のレスポンスに載せる集計。結果を隠している間は nil (JSON では null) にする (呼び出し側でロックを取っておくこと)
+func (rm *room) visibleCounts(r *http.Request, counts map[string]int) map[string]int {
+	if rm.resultsHidden(r) {
+		return nil
+	}
+	return counts
+}
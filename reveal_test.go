@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// MIN_REVEAL 票に届くまでは results, winner, stats を 403 にし、投票のレスポンスの counts を null にする
+// 届いたら普段どおり返す。管理用キーがあれば届く前でも読める
+func TestMinRevealBoundary(t *testing.T) {
+	const minVotes = 3
+	srv := newTestServer(t, fmt.Sprintf("MIN_REVEAL=%d", minVotes))
+	paths := []string{"/v1/results", "/v1/results/winner", "/v1/results/stats"}
+
+	check := func(revealed bool) {
+		t.Helper()
+		for _, path := range paths {
+			res, data := srv.do(t, http.MethodGet, path, nil)
+			switch {
+			case revealed && res.StatusCode != http.StatusOK:
+				t.Errorf("GET %s: status %d, want 200: %s", path, res.StatusCode, data)
+			case !revealed && res.StatusCode != http.StatusForbidden:
+				t.Errorf("GET %s: status %d, want 403: %s", path, res.StatusCode, data)
+			case !revealed && errorCode(t, data) != errCodeResultsHidden:
+				t.Errorf("GET %s: %s, want %s", path, data, errCodeResultsHidden)
+			}
+			if res.Header.Get("Vary") == "" {
+				t.Errorf("GET %s: no Vary header", path)
+			}
+			// 票が無ければ winner は 204 なので、隠していないことだけを見る
+			if res, data := srv.do(t, http.MethodGet, path, nil, adminHeader); res.StatusCode == http.StatusForbidden {
+				t.Errorf("admin GET %s: status 403: %s", path, data)
+			}
+		}
+	}
+
+	check(false)
+	for i := 1; i < minVotes; i++ {
+		res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: fmt.Sprintf("u%d", i), Vote: "hot"})
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(data), `"counts":null`) {
+			t.Errorf("vote %d: status %d: %s, want counts null", i, res.StatusCode, data)
+		}
+	}
+	check(false)
+
+	if res := srv.vote(t, "/v1/vote", "last", "cold", http.StatusOK); !sameCounts(res.Counts, map[string]int{"hot": minVotes - 1, "cold": 1}) {
+		t.Errorf("vote %d: counts %v", minVotes, res.Counts)
+	}
+	check(true)
+
+	// 取り消しで下回ったらまた隠す
+	srv.do(t, http.MethodDelete, "/v1/vote?userId=last", nil)
+	check(false)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 1つの部屋で投票できるユーザーの数 (MAX_VOTERS で設定する。0なら無制限)
+var maxVoters int
+
+// 投票済みのユーザーが選択肢を変えたり取り消したりできるか (ALLOW_VOTE_CHANGE で設定する)
+var allowVoteChange = true
+
+// 初めての投票を 201 Created にするか (VOTE_CREATED_STATUS で設定する。false なら変更と同じ 200)
+var voteCreatedStatus bool
+
+// 投票の変更が禁止されていて、投票済みのユーザーが別の選択肢に投票しようとしているなら 409 を書いて false を返す
+// 同じ選択肢への再投票は変更ではないので通す
+func checkVoteChange(w http.ResponseWriter, hasPrevious bool, previousVote, vote string) bool {
+	if allowVoteChange || !hasPrevious || previousVote == vote {
+		return true
+	}
+	writeJSONError(w, http.StatusConflict, errCodeAlreadyVoted, "already voted")
+	return false
+}
+
+// 新しいユーザーの投票で人数の上限を超えるなら 403 を書いて false を返す
+// 投票済みのユーザーは上限に達していても投票を変えられる (呼び出し側でロックを取っておくこと)
+func (rm *room) checkVoterCapacity(w http.ResponseWriter, hasPrevious bool) bool {
+	if rm.canAcceptVoter(hasPrevious) {
+		return true
+	}
+	slog.Info("poll full", "event", "poll_full", "roomId", rm.id, "maxVoters", maxVoters)
+	writeJSONError(w, http.StatusForbidden, errCodePollFull, "poll full")
+	return false
+}
+
+func (rm *room) canAcceptVoter(hasPrevious bool) bool {
+	return maxVoters <= 0 || hasPrevious || rm.store.VoterCount() < maxVoters
+}
+
+// 1つの投票 (部屋) ごとのデータ
+// 部屋ごとに別のロックを持つので、混んでいる部屋が他の部屋の投票を待たせることはない
+type room struct {
+	id string // 既定の投票 (/vote, /results) は空文字
+
+	// 投票数とユーザーごとの投票の保存先
+	store VoteStore
+
+	// 投票の受付期間
+	schedule pollSchedule
+
+	// 受付期間が終わって確定した結果 (終了するまで、または再開した後は nil)
+	final *finalResults
+
+	// GET /results/stream で更新を待っている購読者
+	subscribers map[chan []byte]struct{}
+
+	// 投票が反映されるたびに1つ増える集計のバージョンと、次に増えたときに閉じるチャネル
+	// (GET /results/poll で待っているリクエストを起こす)
+	version uint64
+	changed chan struct{}
+
+	// GET /results/diff のための、選択肢ごとに票数が最後に変わったバージョンと、その時の票数
+	optionVersions map[string]uint64
+	diffCounts     map[string]int
+
+	// 集計が最後に変わった時刻 (投票・取り消し・リセット。起動してからまだ変わっていなければゼロ値)
+	lastUpdated time.Time
+
+	// GET /results/history のための票数の記録
+	history *resultsHistory
+
+	// GET /results/velocity のための直近1分間の票
+	velocity voteVelocity
+
+	// GET /results/throughput のための直近15分間の票の総数とピーク
+	throughput voteThroughput
+
+	// SURGE_MULTIPLIER のときの、票の急増の検知の状態 (GET /admin/surge で返す)
+	surge surgeDetector
+
+	// WEBHOOK_THRESHOLDS のうち通知済みのもの
+	thresholdsFired map[thresholdKey]bool
+
+	// DEVICE_GUARD のときの、端末IDのハッシュごとの最後に投票したユーザー
+	deviceVotes map[string]deviceVote
+
+	// VOTE_CONFIRM_TTL のときの、確定を待っている投票 (確認用のトークンごと)
+	pendingVotes map[string]pendingVote
+
+	// コホートの分かっているユーザーのコホートと、コホートごと・選択肢ごとの票数 (GET /results?groupBy=cohort)
+	userCohorts  map[string]string
+	cohortCounts map[string]map[string]int
+
+	// ユーザーごとの投票の変化 (GET /users/{userId}/history で返す)
+	transitions map[string][]voteTransition
+
+	// ユーザーごとの最新の受付番号 (GET /receipts/{id} で引く)
+	receipts map[string]voteReceipt
+
+	// 投票に付いたコメント (ユーザーIDごと。GET /results/comments で返す)
+	comments map[string]voteComment
+
+	// GET /results/compare の基準にする、名前付きで保存した票数
+	checkpoints map[string]checkpoint
+
+	// 票数から作った集計の結果 (GET /results/stats などで、票数が変わるまで使い回す)
+	aggregates aggregateCache
+
+	// 複数のリクエストが同時にデータを書き換えるのを防ぐためのロック
+	// 集計の読み出しは RLock で並行に行い、投票の書き込みだけが Lock で排他する
+	// (保存先が同時に記録できるときは、投票の保存は Lock の外で行う。castVoteShared を参照)
+	mutex roomMutex
+
+	// 同じユーザーの投票を順番にするロック (userStripe で選ぶ。room.mutex より先に取る)
+	userLocks [userStripeCount]sync.Mutex
+}
+
+// 部屋のロック
+// castVoteShared は保存先への書き込みを store の読み取りロックだけで行うので、
+// Lock (保存先も部屋のデータも書き換えるもの) は store も取って、書き込み中の投票が終わるのを待つ
+type roomMutex struct {
+	sync.RWMutex
+	store sync.RWMutex
+}
+
+func (m *roomMutex) Lock() {
+	m.store.Lock()
+	m.RWMutex.Lock()
+}
+
+func (m *roomMutex) Unlock() {
+	m.RWMutex.Unlock()
+	m.store.Unlock()
+}
+
+// 保存先には書かずに部屋のデータだけを書き換えるロック (保存先への書き込み中の投票を待たない)
+func (m *roomMutex) lockRoom() {
+	m.RWMutex.Lock()
+}
+
+func (m *roomMutex) unlockRoom() {
+	m.RWMutex.Unlock()
+}
+
+// 票数とユーザーごとの投票を揃えて読む読み取りロック (保存先への書き込み中の投票が終わるのを待つ)
+func (m *roomMutex) rlockVotes() {
+	m.store.Lock()
+	m.RWMutex.RLock()
+}
+
+func (m *roomMutex) runlockVotes() {
+	m.RWMutex.RUnlock()
+	m.store.Unlock()
+}
+
+// userID の投票を順番にするロック
+func (rm *room) userLock(userID string) *sync.Mutex {
+	return &rm.userLocks[userStripe(userID)]
+}
+
+func newRoom(id string, store VoteStore) *room {
+	return &room{
+		id:          id,
+		store:       store,
+		subscribers: make(map[chan []byte]struct{}),
+		changed:     make(chan struct{}),
+		history:     &resultsHistory{},
+		checkpoints: make(map[string]checkpoint),
+		deviceVotes: make(map[string]deviceVote),
+		throughput:  voteThroughput{since: time.Now()},
+	}
+}
+
+// 部屋ごとの VoteStore を作る関数 (main で永続化先に合わせて差し替える)
+var openStore = func(roomID string) (VoteStore, error) {
+	return newMemoryStore(roomOptions(roomID).keys), nil
+}
+
+// まだ読み込んでいない部屋が保存先にあるか (複数のインスタンスで保存先を共有するときに差し替える)
+var roomExists = func(roomID string) bool {
+	return false
+}
+
+var (
+	// /vote と /results で使う既定の投票 (選択肢を読み込んでから作る)
+	defaultRoom *room
+
+	// 部屋IDごとの投票 (最初の投票で作られる)
+	rooms = make(map[string]*room)
+
+	// rooms マップ自体の読み書きを守るロック (各部屋のデータは部屋のロックで守る)
+	roomsMutex sync.Mutex
+)
+
+var errRoomNotFound = errors.New("room not found")
+
+// 部屋IDとして使える文字列
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// 部屋を返す。create が true なら無い場合に作成する
+func getRoom(id string, create bool) (*room, error) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	if rm, ok := rooms[id]; ok {
+		return rm, nil
+	}
+	if !create && !roomExists(id) {
+		return nil, errRoomNotFound
+	}
+
+	store, err := openStore(id)
+	if err != nil {
+		return nil, err
+	}
+	rm := newRoom(id, store)
+	// POST /polls で作った投票は、その投票の受付期間を使う
+	if p, ok := lookupPoll(id); ok {
+		pollsMutex.RLock()
+		rm.schedule = p.info.Schedule
+		pollsMutex.RUnlock()
+	}
+	rooms[id] = rm
+	slog.Info("room created", "event", "room_created", "roomId", id)
+	return rm, nil
+}
+
+// パスの {roomId} から部屋を探す。見つからなければエラーレスポンスを書いて nil を返す
+func roomFromRequest(w http.ResponseWriter, r *http.Request, create bool) *room {
+	roomID := r.PathValue("roomId")
+	if !roomIDPattern.MatchString(roomID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		return nil
+	}
+
+	rm, err := getRoom(roomID, create)
+	if errors.Is(err, errRoomNotFound) {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Room not found")
+		return nil
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to open room", "roomId", roomID, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to open room")
+		return nil
+	}
+	return rm
+}
+
+// /rooms/{roomId}/vote エンドポイントの処理
+func roomVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	// 部屋は最初の投票で作る。変更や取り消しでは作らない
+	if r.Method != http.MethodPost {
+		if rm := roomFromRequest(w, r, false); rm != nil {
+			rm.voteRouteHandler(w, r)
+		}
+		return
+	}
+	if roomID := r.PathValue("roomId"); roomIDPattern.MatchString(roomID) {
+		if rm, err := getRoom(roomID, false); err == nil {
+			rm.voteRouteHandler(w, r)
+			return
+		}
+	}
+	limitVotesPerUser(firstRoomVoteHandler)(w, r)
+}
+
+// まだ無い部屋への POST /rooms/{roomId}/vote の処理
+// 認証に失敗した投票や選択肢の誤った投票で部屋を増やさないよう、部屋の状態を見ない確認 (parseVote とセッション) を通ってから作る
+// 空の部屋では他の確認 (checkVote) で断ることはない (POST /polls で作った投票の受付期間の外を除く)
+func firstRoomVoteHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomId")
+	if !roomIDPattern.MatchString(roomID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		return
+	}
+	user, req, device, ok := parseVote(w, r, roomOptions(roomID))
+	if !ok {
+		return
+	}
+	if !checkVoteSession(w, r, roomID, req.UserID) {
+		return
+	}
+	if rm := roomFromRequest(w, r, true); rm != nil {
+		rm.castVote(w, r, user, req, device)
+	}
+}
+
+// /rooms/{roomId}/vote/confirm エンドポイントの処理
+func roomConfirmVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.confirmVoteHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/vote/batch エンドポイントの処理
+func roomBatchVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+	if roomID := r.PathValue("roomId"); roomIDPattern.MatchString(roomID) {
+		if rm, err := getRoom(roomID, false); err == nil {
+			rm.batchVoteHandler(w, r)
+			return
+		}
+	}
+	firstRoomBatchVoteHandler(w, r)
+}
+
+// まだ無い部屋への POST /rooms/{roomId}/vote/batch の処理
+// firstRoomVoteHandler と同じく、認証とボディを確かめ、部屋の状態を見ない確認を通る投票が1つでもあるときだけ部屋を作る (無ければ 404)
+func firstRoomBatchVoteHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("roomId")
+	if !roomIDPattern.MatchString(roomID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		return
+	}
+	user, device, reqs, ok := parseVoteBatch(w, r)
+	if !ok {
+		return
+	}
+	set := roomOptions(roomID)
+	acceptable := slices.ContainsFunc(reqs, func(req VoteRequest) bool {
+		if user.UID != "" {
+			req.UserID = user.UID
+		}
+		return len(validateVoteRequest(set, &req)) == 0 && userAllowed(req.UserID) && hasVoteSession(roomID, req.UserID, time.Now())
+	})
+	if !acceptable {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Room not found")
+		return
+	}
+	if rm := roomFromRequest(w, r, true); rm != nil {
+		rm.applyVoteBatch(w, r, user, device, reqs)
+	}
+}
+
+// /rooms/{roomId}/results エンドポイントの処理
+func roomResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results.csv エンドポイントの処理
+func roomResultsCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsCSVHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/stream エンドポイントの処理
+func roomResultsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsStreamHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/poll エンドポイントの処理
+func roomPollResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.pollResultsHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/winner エンドポイントの処理
+func roomWinnerHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.winnerHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/export エンドポイントの処理
+func roomResultsExportHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsExportHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/me エンドポイントの処理
+func roomMyResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.myResultsHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/at エンドポイントの処理
+func roomResultsAtHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsAtHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/validity エンドポイントの処理
+func roomValidityHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.validityHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/history エンドポイントの処理
+func roomResultsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.resultsHistoryHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/velocity エンドポイントの処理
+func roomVelocityHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.velocityHandler(w, r)
+	}
+}
+
+// 既定の投票と読み込み済みのすべての部屋
+func allRooms() []*room {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	all := make([]*room, 0, len(rooms)+1)
+	all = append(all, defaultRoom)
+	for _, rm := range rooms {
+		all = append(all, rm)
+	}
+	return all
+}
+
+// /rooms/{roomId}/results/throughput エンドポイントの処理
+func roomThroughputHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.throughputHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/stats エンドポイントの処理
+func roomStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.statsHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/{option}/voters エンドポイントの処理
+func roomVotersHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.votersHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/compare エンドポイントの処理
+func roomCompareHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.compareHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/comments エンドポイントの処理
+func roomCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.commentsHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/results/recent エンドポイントの処理
+func roomRecentResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.recentResultsHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/vote/{userId} エンドポイントの処理
+func roomUserVoteHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.userVoteHandler(w, r)
+	}
+}
+
+// /rooms/{roomId}/ws エンドポイントの処理
+func roomWSHandler(w http.ResponseWriter, r *http.Request) {
+	if rm := roomFromRequest(w, r, false); rm != nil {
+		rm.wsHandler(w, r)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// MAX_VOTERS 人目までは受け付け、その次の新しいユーザーは 403。投票済みのユーザーは上限でも変えられる
+func TestMaxVoters(t *testing.T) {
+	const limit = 3
+	srv := newTestServer(t, fmt.Sprintf("MAX_VOTERS=%d", limit))
+
+	for i := 1; i <= limit; i++ {
+		srv.vote(t, "/v1/vote", fmt.Sprintf("u%d", i), "hot", http.StatusOK)
+	}
+	res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u4", Vote: "hot"})
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("voter %d: status %d, want 403: %s", limit+1, res.StatusCode, data)
+	}
+	if code := errorCode(t, data); code != errCodePollFull {
+		t.Errorf("voter %d: code %q, want %q", limit+1, code, errCodePollFull)
+	}
+
+	// 上限に達していても、投票済みのユーザーは変更・再投票できる
+	if res := srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK); res.Status != voteStatusChanged {
+		t.Errorf("existing voter change: status %q, want %q", res.Status, voteStatusChanged)
+	}
+	srv.vote(t, "/v1/vote", "u2", "hot", http.StatusOK)
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, map[string]int{"hot": 2, "cold": 1}) {
+		t.Errorf("counts %v, want hot=2 cold=1", got)
+	}
+
+	// 取り消すと空いた分だけ新しいユーザーが入れる
+	if res, data := srv.do(t, http.MethodDelete, "/v1/vote?userId=u3", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /vote: status %d: %s", res.StatusCode, data)
+	}
+	srv.vote(t, "/v1/vote", "u4", "ok", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u5", "ok", http.StatusForbidden)
+}
+
+// MAX_VOTERS=0 は無制限
+func TestMaxVotersUnlimited(t *testing.T) {
+	srv := newTestServer(t, "MAX_VOTERS=0")
+	for i := range 20 {
+		srv.vote(t, "/v1/vote", fmt.Sprintf("u%d", i), "ok", http.StatusOK)
+	}
+}
+
+// ALLOW_VOTE_CHANGE=false では別の選択肢への投票と取り消しを 409 にし、票は動かさない
+// true (既定) なら今までどおり変えられる
+func TestAllowVoteChange(t *testing.T) {
+	for _, tt := range []struct {
+		allow  bool
+		change int // 別の選択肢への投票と取り消しのステータス
+		counts map[string]int
+	}{
+		{true, http.StatusOK, map[string]int{"cold": 1}},
+		{false, http.StatusConflict, map[string]int{"hot": 1}},
+	} {
+		t.Run(fmt.Sprintf("allow=%v", tt.allow), func(t *testing.T) {
+			srv := newTestServer(t, fmt.Sprintf("ALLOW_VOTE_CHANGE=%v", tt.allow))
+			srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+			// 同じ選択肢への再投票は変更ではないので、どちらでも通す
+			if res := srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK); res.Status != voteStatusUnchanged {
+				t.Errorf("same vote: status %q, want %q", res.Status, voteStatusUnchanged)
+			}
+
+			res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u1", Vote: "cold"})
+			if res.StatusCode != tt.change {
+				t.Fatalf("change: status %d, want %d: %s", res.StatusCode, tt.change, data)
+			}
+			if !tt.allow {
+				if code := errorCode(t, data); code != errCodeAlreadyVoted {
+					t.Errorf("change: code %q, want %q", code, errCodeAlreadyVoted)
+				}
+			}
+			if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, tt.counts) {
+				t.Errorf("counts %v, want %v", got, tt.counts)
+			}
+
+			res, data = srv.do(t, http.MethodDelete, "/v1/vote?userId=u1", nil)
+			if res.StatusCode != tt.change {
+				t.Fatalf("DELETE /vote: status %d, want %d: %s", res.StatusCode, tt.change, data)
+			}
+			if tt.allow {
+				tt.counts = nil
+			}
+			if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, tt.counts) {
+				t.Errorf("after DELETE: counts %v, want %v", got, tt.counts)
+			}
+		})
+	}
+}
+
+// VOTE_CREATED_STATUS=true なら初めての投票だけ 201 と Location、変更・再投票は 200 (既定はすべて 200)
+func TestVoteCreatedStatus(t *testing.T) {
+	steps := []struct {
+		user, vote string
+		created    bool
+	}{
+		{"u1", "hot", true},
+		{"u1", "hot", false},  // 同じ選択肢への再投票
+		{"u1", "cold", false}, // 変更
+		{"u2", "ok", true},
+	}
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			srv := newTestServer(t, fmt.Sprintf("VOTE_CREATED_STATUS=%v", enabled))
+			for _, path := range []string{"/v1/vote", "/v1/rooms/r1/vote"} {
+				for _, step := range steps {
+					res, data := srv.do(t, http.MethodPost, path, VoteRequest{UserID: step.user, Vote: step.vote})
+					want, location := http.StatusOK, ""
+					if enabled && step.created {
+						want, location = http.StatusCreated, path+"/"+step.user
+					}
+					if res.StatusCode != want {
+						t.Errorf("POST %s %s=%s: status %d, want %d: %s", path, step.user, step.vote, res.StatusCode, want, data)
+					}
+					if got := res.Header.Get("Location"); got != location {
+						t.Errorf("POST %s %s=%s: Location %q, want %q", path, step.user, step.vote, got, location)
+					}
+				}
+			}
+		})
+	}
+
+	// Location はその投票を読める URL (ユーザーIDはエスケープする)
+	srv := newTestServer(t, "VOTE_CREATED_STATUS=true")
+	res, _ := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "ユーザー 1", Vote: "hot"})
+	location := res.Header.Get("Location")
+	if location != "/v1/vote/%E3%83%A6%E3%83%BC%E3%82%B6%E3%83%BC%201" {
+		t.Errorf("Location %q", location)
+	}
+	var user UserVoteResponse
+	_, data := srv.do(t, http.MethodGet, location, nil)
+	decodeJSON(t, data, &user)
+	if user.Vote != "hot" {
+		t.Errorf("GET %s: %s", location, data)
+	}
+}
+
+// まだ無い部屋は、記録できる投票が届くまで作らない
+func TestRejectedVotesDoNotCreateRooms(t *testing.T) {
+	roomCreated := func(t *testing.T, id string) bool {
+		t.Helper()
+		roomsMutex.Lock()
+		defer roomsMutex.Unlock()
+		_, ok := rooms[id]
+		return ok
+	}
+	tests := []struct {
+		name    string
+		env     []string
+		method  string
+		path    string
+		body    any
+		headers []header
+		status  int
+	}{
+		{name: "invalid body", method: http.MethodPost, path: "/vote", body: `{"userId":`, status: http.StatusBadRequest},
+		{name: "invalid option", method: http.MethodPost, path: "/vote", body: VoteRequest{UserID: "u1", Vote: "warm"}, status: http.StatusBadRequest},
+		{name: "content type", method: http.MethodPost, path: "/vote", body: `{"userId":"u1","vote":"hot"}`, headers: []header{{"Content-Type": "text/plain"}}, status: http.StatusUnsupportedMediaType},
+		{name: "not allowed", env: []string{"ALLOWED_USERS=u2"}, method: http.MethodPost, path: "/vote", body: VoteRequest{UserID: "u1", Vote: "hot"}, status: http.StatusForbidden},
+		{name: "no session", env: []string{"REQUIRE_SESSION=true"}, method: http.MethodPost, path: "/vote", body: VoteRequest{UserID: "u1", Vote: "hot"}, status: http.StatusPreconditionRequired},
+		{name: "change", method: http.MethodPatch, path: "/vote", body: VoteRequest{UserID: "u1", Vote: "hot"}, status: http.StatusNotFound},
+		{name: "retract", method: http.MethodDelete, path: "/vote?userId=u1", status: http.StatusNotFound},
+		{name: "batch of invalid votes", method: http.MethodPost, path: "/vote/batch", body: []VoteRequest{{UserID: "u1", Vote: "warm"}}, status: http.StatusNotFound},
+		{name: "batch invalid body", method: http.MethodPost, path: "/vote/batch", body: `[]`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.env...)
+			res, data := srv.do(t, tt.method, "/v1/rooms/new-room"+tt.path, tt.body, tt.headers...)
+			if res.StatusCode != tt.status {
+				t.Errorf("status %d, want %d: %s", res.StatusCode, tt.status, data)
+			}
+			if roomCreated(t, "new-room") {
+				t.Error("room was created")
+			}
+		})
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		srv := newTestServer(t)
+		verifier = testVerifier{}
+		t.Cleanup(func() { verifier = nil })
+		srv.vote(t, "/v1/rooms/new-room/vote", "u1", "hot", http.StatusUnauthorized)
+		if status, result := applyTestNATSVote(t, "", NATSVoteMessage{RoomID: "nats-room", Token: "bad", VoteRequest: VoteRequest{Vote: "hot"}}); status != http.StatusUnauthorized {
+			t.Errorf("nats: got %d %s, want 401", status, result)
+		}
+		if roomCreated(t, "new-room") || roomCreated(t, "nats-room") {
+			t.Error("room was created")
+		}
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		srv := newTestServer(t)
+		if status, result := applyTestNATSVote(t, "", NATSVoteMessage{RoomID: "nats-room", VoteRequest: VoteRequest{UserID: "u1", Vote: "warm"}}); status != http.StatusBadRequest {
+			t.Errorf("nats invalid option: got %d %s, want 400", status, result)
+		}
+		if roomCreated(t, "nats-room") {
+			t.Error("room was created by an invalid nats vote")
+		}
+		srv.vote(t, "/v1/rooms/new-room/vote", "u1", "hot", http.StatusOK)
+		res, data := srv.do(t, http.MethodPost, "/v1/rooms/batch-room/vote/batch", []VoteRequest{{UserID: "u1", Vote: "warm"}, {UserID: "u2", Vote: "cold"}})
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("batch: status %d: %s", res.StatusCode, data)
+		}
+		if !roomCreated(t, "new-room") || !roomCreated(t, "batch-room") {
+			t.Error("room not created by an accepted vote")
+		}
+		if got := resultCounts(srv.results(t, "/v1/rooms/batch-room/results")); !sameCounts(got, map[string]int{"cold": 1}) {
+			t.Errorf("batch room counts %v, want cold=1", got)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/cors"
+)
+
+// すべてのルートとミドルウェアをまとめたハンドラーを作る
+// 既定の投票 (defaultRoom) や設定を読み込んだ後に呼ぶ。呼ぶたびに新しいハンドラーを作るので、
+// httptest.NewServer などで defaultRoom を新しいものに差し替えてから作り直せる
+func newRouter() http.Handler {
+	mux := http.NewServeMux()
+
+	// API のルートは /v1 の下に置く。接頭辞の無い旧ルートも当面は残す (deprecatedRoute を参照)
+	// /v2 を作るときは registerV2Routes を用意して prefixed(mux, "/v2") に登録する
+	registerV1Routes(prefixed(mux, "/v1"))
+	registerV1Routes(deprecatedAliases(mux, "/v1"))
+
+	// 運用向けのルートはバージョンを付けない
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/version", versionHandler)
+	// プロジェクターに映す結果のページ (HTML なので API のバージョンは付けない)
+	mux.HandleFunc("/dashboard", instrument("dashboard", defaultRoom.dashboardHandler))
+	mux.HandleFunc("/rooms/{roomId}/dashboard", instrument("room_dashboard", roomDashboardHandler))
+	// 運用者向けの管理ページ (ボタンから /v1/admin/... を呼ぶ)
+	mux.HandleFunc("/admin", instrument("admin_page", adminPageHandler))
+	mux.HandleFunc("/admin/login", instrument("admin_login", limitPerIP(adminLoginHandler)))
+	mux.HandleFunc("/admin/logout", instrument("admin_logout", adminLogoutHandler))
+	// 上のどれにも一致しないパスは JSON の 404 にする (CORS のヘッダーも付く)
+	mux.HandleFunc("/", notFoundHandler)
+
+	// CORSの設定を作成
+	c := cors.New(cors.Options{
+		AllowedOrigins: loadCORSOrigins(),
+		AllowedMethods: loadCORSMethods(),
+		AllowedHeaders: loadCORSHeaders(),
+		ExposedHeaders: []string{"X-Request-ID", "Deprecation", "Sunset", "Link", "Idempotent-Replayed"},
+	})
+
+	// muxをCORSミドルウェアでラップして、最終的なhandlerを作成
+	// 圧縮はCORSの内側に置き、プリフライトのレスポンスは圧縮しない
+	// リクエストIDは一番外側で付け、CORSのプリフライトにも返す
+	// トレースは一番外側で始め、CORS やリクエストIDの処理も含めた時間にする
+	// アクセスログはリクエストIDの内側に置き、ログにIDが付くようにする
+	return traceRequests(withRequestID(logRequests(c.Handler(compressResponses(recoverPanics(mux))))))
+}
+
+// あるバージョンのルートを登録する先 (パターンと処理を受け取る)
+type routeRegistrar func(pattern string, h http.HandlerFunc)
+
+// v1 の API のルート (パターンは接頭辞を除いたもの)
+// JSON の形を変えるときは v1 のハンドラーを変えずに、新しいバージョンの関数を作ってそちらに登録する
+func registerV1Routes(handle routeRegistrar) {
+	handle("/vote", instrument("vote", idempotent(maxVoteBodyBytes, limitPerIP(defaultRoom.voteRouteHandler))))
+	handle("/vote/{userId}", instrument("user_vote", defaultRoom.userVoteHandler))
+	handle("/vote/batch", instrument("vote_batch", idempotent(maxVoteBatchSize*maxVoteBodyBytes, limitPerIP(defaultRoom.batchVoteHandler))))
+	handle("/vote/confirm", instrument("vote_confirm", limitPerIP(defaultRoom.confirmVoteHandler)))
+	handle("/vote/validate", instrument("vote_validate", validateVoteHandler))
+	handle("/session/start", instrument("session_start", limitPerIP(sessionStartHandler)))
+	handle("/options", instrument("options", optionsHandler))
+	handle("/results", instrument("results", defaultRoom.resultsHandler))
+	handle("/results.csv", instrument("results_csv", defaultRoom.resultsCSVHandler))
+	handle("/results/stream", limitPerIP(limitStreams(defaultRoom.resultsStreamHandler)))
+	handle("/ws", limitPerIP(limitStreams(defaultRoom.wsHandler)))
+	handle("/results/poll", limitPerIP(defaultRoom.pollResultsHandler))
+	handle("/results/diff", limitPerIP(defaultRoom.resultsDiffHandler))
+	handle("/results/winner", instrument("results_winner", defaultRoom.winnerHandler))
+	handle("/results/recent", instrument("results_recent", defaultRoom.recentResultsHandler))
+	handle("/results/history", instrument("results_history", defaultRoom.resultsHistoryHandler))
+	handle("/results/at", instrument("results_at", defaultRoom.resultsAtHandler))
+	handle("/results/validity", instrument("results_validity", defaultRoom.validityHandler))
+	handle("/results/velocity", instrument("results_velocity", defaultRoom.velocityHandler))
+	handle("/results/throughput", instrument("results_throughput", defaultRoom.throughputHandler))
+	handle("/results/stats", instrument("results_stats", defaultRoom.statsHandler))
+	handle("/results/compare", instrument("results_compare", defaultRoom.compareHandler))
+	handle("/results/comments", instrument("results_comments", defaultRoom.commentsHandler))
+	handle("/results/me", instrument("results_me", defaultRoom.myResultsHandler))
+	handle("/results/export", instrument("results_export", defaultRoom.resultsExportHandler))
+	handle("/results/{option}/voters", requireAdmin(instrument("results_voters", defaultRoom.votersHandler)))
+	handle("/rooms/{roomId}/vote", instrument("room_vote", idempotent(maxVoteBodyBytes, limitPerIP(roomVoteHandler))))
+	handle("/rooms/{roomId}/vote/{userId}", instrument("room_user_vote", roomUserVoteHandler))
+	handle("/rooms/{roomId}/vote/batch", instrument("room_vote_batch", idempotent(maxVoteBatchSize*maxVoteBodyBytes, limitPerIP(roomBatchVoteHandler))))
+	handle("/rooms/{roomId}/vote/confirm", instrument("room_vote_confirm", limitPerIP(roomConfirmVoteHandler)))
+	handle("/rooms/{roomId}/vote/validate", instrument("room_vote_validate", validateVoteHandler))
+	handle("/rooms/{roomId}/session/start", instrument("room_session_start", limitPerIP(sessionStartHandler)))
+	handle("/rooms/{roomId}/options", instrument("room_options", optionsHandler))
+	handle("/rooms/{roomId}/results", instrument("room_results", roomResultsHandler))
+	handle("/rooms/{roomId}/results.csv", instrument("room_results_csv", roomResultsCSVHandler))
+	handle("/rooms/{roomId}/results/stream", limitPerIP(limitStreams(roomResultsStreamHandler)))
+	handle("/rooms/{roomId}/ws", limitPerIP(limitStreams(roomWSHandler)))
+	handle("/rooms/{roomId}/results/poll", limitPerIP(roomPollResultsHandler))
+	handle("/rooms/{roomId}/results/diff", limitPerIP(roomResultsDiffHandler))
+	handle("/rooms/{roomId}/results/winner", instrument("room_results_winner", roomWinnerHandler))
+	handle("/rooms/{roomId}/results/recent", instrument("room_results_recent", roomRecentResultsHandler))
+	handle("/rooms/{roomId}/results/history", instrument("room_results_history", roomResultsHistoryHandler))
+	handle("/rooms/{roomId}/results/at", instrument("room_results_at", roomResultsAtHandler))
+	handle("/rooms/{roomId}/results/validity", instrument("room_results_validity", roomValidityHandler))
+	handle("/rooms/{roomId}/results/velocity", instrument("room_results_velocity", roomVelocityHandler))
+	handle("/rooms/{roomId}/results/throughput", instrument("room_results_throughput", roomThroughputHandler))
+	handle("/rooms/{roomId}/results/stats", instrument("room_results_stats", roomStatsHandler))
+	handle("/rooms/{roomId}/results/compare", instrument("room_results_compare", roomCompareHandler))
+	handle("/rooms/{roomId}/results/comments", instrument("room_results_comments", roomCommentsHandler))
+	handle("/rooms/{roomId}/results/me", instrument("room_results_me", roomMyResultsHandler))
+	handle("/rooms/{roomId}/results/export", instrument("room_results_export", roomResultsExportHandler))
+	handle("/rooms/{roomId}/results/{option}/voters", requireAdmin(instrument("room_results_voters", roomVotersHandler)))
+	handle("/polls", instrument("polls", pollsHandler))
+	handle("/polls/{pollId}", instrument("poll", pollHandler))
+	handle("/polls/{pollId}/vote", instrument("poll_vote", limitPerIP(pollVoteHandler)))
+	handle("/polls/{pollId}/results", instrument("poll_results", pollResultsHandler))
+	handle("/users/{userId}", instrument("delete_user", deleteUserHandler))
+	handle("/users/{userId}/history", instrument("user_history", userHistoryHandler))
+	handle("/receipts/{id}", instrument("receipt", receiptHandler))
+	handle("/admin/reset", requireAdmin(adminResetHandler))
+	handle("/admin/adjust", requireAdmin(adminAdjustHandler))
+	handle("/admin/backup", requireAdmin(adminBackupHandler))
+	handle("/admin/restore", requireAdmin(adminRestoreHandler))
+	handle("/admin/merge", requireAdmin(adminMergeHandler))
+	handle("/admin/schedule", requireAdmin(adminScheduleHandler))
+	handle("/admin/reopen", requireAdmin(adminReopenHandler))
+	handle("/admin/checkpoints", requireAdmin(adminCheckpointHandler))
+	handle("/admin/surge", requireAdmin(adminSurgeHandler))
+	handle("/admin/options", requireAdmin(adminAddOptionHandler))
+	handle("/admin/options/{option}", requireAdmin(adminRemoveOptionHandler))
+	if devMode {
+		handle("/admin/seed", requireAdmin(adminSeedHandler))
+	}
+}
+
+// prefix を付けたパターンで mux に登録する
+func prefixed(mux *http.ServeMux, prefix string) routeRegistrar {
+	return func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(prefix+pattern, h)
+	}
+}
+
+// 接頭辞の無い旧ルートを非推奨の別名として mux に登録する (successor はその後継のバージョンの接頭辞)
+func deprecatedAliases(mux *http.ServeMux, successor string) routeRegistrar {
+	return func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, deprecatedRoute(successor, h))
+	}
+}
+
+// 接頭辞の無い旧ルートを削除する予定の日時 (Sunset ヘッダーで知らせる)
+// 出荷済みの Flutter アプリは /vote と /results を直接呼んでいるので、次のように進める
+//   - 今: /v1 を追加し、旧ルートは同じ処理のまま Deprecation / Sunset ヘッダーと警告ログを付ける
+//   - /v1 を使うアプリを出した後: 警告ログで旧ルートを呼ぶクライアントが残っていないか確かめる
+//   - この日時以降: 旧ルートを削除する
+const legacyRoutesSunset = "Wed, 31 Mar 2027 00:00:00 GMT"
+
+// 旧ルートへのリクエストに非推奨であることのヘッダーを付け、警告のログを残すミドルウェア
+// 処理自体は後継のバージョンと同じ
+func deprecatedRoute(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", legacyRoutesSunset)
+		w.Header().Set("Link", "<"+successor+r.URL.Path+`>; rel="successor-version"`)
+		slog.WarnContext(r.Context(), "deprecated route called", "event", "deprecated_route", "path", r.URL.Path, "successor", successor+r.URL.Path)
+		next(w, r)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    any
+		headers []header
+		setup   func(t *testing.T, srv *testServer)
+		status  int
+		code    string // エラーレスポンスの code (空なら見ない)
+	}{
+		{name: "vote", method: http.MethodPost, path: "/v1/vote", body: VoteRequest{UserID: "u1", Vote: "hot"}, status: http.StatusOK},
+		{name: "vote by label", method: http.MethodPost, path: "/v1/vote", body: VoteRequest{UserID: "u1", Vote: "あつい"}, status: http.StatusOK},
+		{name: "vote without prefix", method: http.MethodPost, path: "/vote", body: VoteRequest{UserID: "u1", Vote: "hot"}, status: http.StatusOK},
+		{name: "vote wrong method", method: http.MethodGet, path: "/v1/vote", status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed},
+		{name: "vote unknown option", method: http.MethodPost, path: "/v1/vote", body: VoteRequest{UserID: "u1", Vote: "warm"}, status: http.StatusBadRequest, code: errCodeInvalidOption},
+		{name: "vote missing user", method: http.MethodPost, path: "/v1/vote", body: VoteRequest{Vote: "hot"}, status: http.StatusBadRequest},
+		{name: "vote broken body", method: http.MethodPost, path: "/v1/vote", body: `{"userId":"u1",`, status: http.StatusBadRequest, code: errCodeInvalidBody},
+		{name: "vote body too large", method: http.MethodPost, path: "/v1/vote", body: fmt.Sprintf(`{"userId":"u1","vote":"hot","comment":"%0*d"}`, maxVoteBodyBytes, 0), status: http.StatusBadRequest, code: errCodeInvalidBody},
+		{name: "vote wrong content type", method: http.MethodPost, path: "/v1/vote", body: `userId=u1&vote=hot`, headers: []header{{"Content-Type": "application/x-www-form-urlencoded"}}, status: http.StatusUnsupportedMediaType, code: errCodeMediaType},
+		{name: "results", method: http.MethodGet, path: "/v1/results", status: http.StatusOK},
+		{name: "results head", method: http.MethodHead, path: "/v1/results", status: http.StatusOK},
+		{name: "results wrong method", method: http.MethodPost, path: "/v1/results", body: "{}", status: http.StatusMethodNotAllowed, code: errCodeMethodNotAllowed},
+		{name: "options", method: http.MethodGet, path: "/v1/options", status: http.StatusOK},
+		{name: "room vote creates room", method: http.MethodPost, path: "/v1/rooms/r1/vote", body: VoteRequest{UserID: "u1", Vote: "cold"}, status: http.StatusOK},
+		{name: "room results before any vote", method: http.MethodGet, path: "/v1/rooms/r1/results", status: http.StatusNotFound, code: errCodeNotFound},
+		{
+			name: "room results after vote", method: http.MethodGet, path: "/v1/rooms/r1/results", status: http.StatusOK,
+			setup: func(t *testing.T, srv *testServer) { srv.vote(t, "/v1/rooms/r1/vote", "u1", "hot", http.StatusOK) },
+		},
+		{name: "room invalid id", method: http.MethodGet, path: "/v1/rooms/bad.id/results", status: http.StatusBadRequest, code: errCodeInvalidParameter},
+		{name: "admin without key", method: http.MethodPost, path: "/v1/admin/reset", status: http.StatusUnauthorized, code: errCodeUnauthorized},
+		{name: "admin wrong key", method: http.MethodPost, path: "/v1/admin/reset", headers: []header{{"X-Admin-Key": "wrong"}}, status: http.StatusUnauthorized, code: errCodeUnauthorized},
+		{name: "admin reset", method: http.MethodPost, path: "/v1/admin/reset", headers: []header{adminHeader}, status: http.StatusOK},
+		{name: "admin reset wrong method", method: http.MethodGet, path: "/v1/admin/reset", headers: []header{adminHeader}, status: http.StatusMethodNotAllowed},
+		{name: "admin unknown room", method: http.MethodPost, path: "/v1/admin/reset?roomId=missing", headers: []header{adminHeader}, status: http.StatusNotFound, code: errCodeNotFound},
+		{name: "voters require admin", method: http.MethodGet, path: "/v1/results/hot/voters", status: http.StatusUnauthorized},
+		{name: "voters", method: http.MethodGet, path: "/v1/results/hot/voters", headers: []header{adminHeader}, status: http.StatusOK},
+		{name: "unknown path", method: http.MethodGet, path: "/v1/nope", status: http.StatusNotFound, code: errCodeNotFound},
+		{name: "healthz", method: http.MethodGet, path: "/healthz", status: http.StatusOK},
+		{name: "version", method: http.MethodGet, path: "/version", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			if tt.setup != nil {
+				tt.setup(t, srv)
+			}
+			res, data := srv.do(t, tt.method, tt.path, tt.body, tt.headers...)
+			if res.StatusCode != tt.status {
+				t.Fatalf("%s %s: status %d, want %d: %s", tt.method, tt.path, res.StatusCode, tt.status, data)
+			}
+			if tt.code != "" {
+				if code := errorCode(t, data); code != tt.code {
+					t.Errorf("error code %q, want %q", code, tt.code)
+				}
+			}
+			if tt.method == http.MethodHead && len(data) != 0 {
+				t.Errorf("HEAD returned a body: %q", data)
+			}
+		})
+	}
+}
+
+// 投票・変更・同じ選択肢への再投票・取り消しのあいだ、票数と status がずれないこと
+func TestVoteChangeResultsFlow(t *testing.T) {
+	srv := newTestServer(t)
+
+	steps := []struct {
+		user, vote string
+		status     string
+		counts     map[string]int
+	}{
+		{"u1", "hot", voteStatusNew, map[string]int{"hot": 1}},
+		{"u2", "cold", voteStatusNew, map[string]int{"hot": 1, "cold": 1}},
+		{"u1", "ok", voteStatusChanged, map[string]int{"ok": 1, "cold": 1}},
+		{"u1", "ok", voteStatusUnchanged, map[string]int{"ok": 1, "cold": 1}},
+		{"u2", "ok", voteStatusChanged, map[string]int{"ok": 2}},
+	}
+	for _, step := range steps {
+		res := srv.vote(t, "/v1/vote", step.user, step.vote, http.StatusOK)
+		if res.Status != step.status {
+			t.Errorf("%s votes %s: status %q, want %q", step.user, step.vote, res.Status, step.status)
+		}
+		if !sameCounts(res.Counts, step.counts) {
+			t.Errorf("%s votes %s: counts %v, want %v", step.user, step.vote, res.Counts, step.counts)
+		}
+		if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, step.counts) {
+			t.Errorf("%s votes %s: GET /results %v, want %v", step.user, step.vote, got, step.counts)
+		}
+	}
+
+	res, data := srv.do(t, http.MethodDelete, "/v1/vote?userId=u1", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /vote: status %d: %s", res.StatusCode, data)
+	}
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, map[string]int{"ok": 1}) {
+		t.Errorf("after retract: %v", got)
+	}
+}
+
+// 部屋ごとの票は別々に数える
+func TestRoomsAreIsolated(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/rooms/a/vote", "u1", "cold", http.StatusOK)
+	srv.vote(t, "/v1/rooms/b/vote", "u1", "ok", http.StatusOK)
+
+	for path, want := range map[string]map[string]int{
+		"/v1/results":         {"hot": 1},
+		"/v1/rooms/a/results": {"cold": 1},
+		"/v1/rooms/b/results": {"ok": 1},
+	} {
+		if got := resultCounts(srv.results(t, path)); !sameCounts(got, want) {
+			t.Errorf("GET %s: %v, want %v", path, got, want)
+		}
+	}
+}
+
+// 同時に投票・変更しても票を取りこぼさない (go test -race で読み書きの競合も見る)
+func TestConcurrentVotes(t *testing.T) {
+	srv := newTestServer(t)
+	const users = 50
+
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := fmt.Sprintf("u%d", i)
+			srv.vote(t, "/v1/vote", user, "hot", http.StatusOK)
+			// 半分は投票を変える
+			if i%2 == 0 {
+				srv.vote(t, "/v1/vote", user, "cold", http.StatusOK)
+			}
+			srv.results(t, "/v1/results")
+		}()
+	}
+	wg.Wait()
+
+	res := srv.results(t, "/v1/results")
+	if want := map[string]int{"hot": users / 2, "cold": users / 2}; !sameCounts(resultCounts(res), want) {
+		t.Errorf("counts %v, want %v", resultCounts(res), want)
+	}
+	if res.Total != users {
+		t.Errorf("total %d, want %d", res.Total, users)
+	}
+}
+
+// 知らないフィールドは既定では無視し、STRICT_JSON=true なら 400 にする (どちらも /version に出る)
+func TestStrictJSON(t *testing.T) {
+	body := `{"userId":"u1","vote":"hot","newField":1}`
+	for _, tt := range []struct {
+		env    []string
+		strict bool
+		status int
+	}{
+		{nil, false, http.StatusOK},
+		{[]string{"STRICT_JSON=true"}, true, http.StatusBadRequest},
+	} {
+		srv := newTestServer(t, tt.env...)
+		if res, data := srv.do(t, http.MethodPost, "/v1/vote", body); res.StatusCode != tt.status {
+			t.Errorf("STRICT_JSON %v: status %d, want %d: %s", tt.strict, res.StatusCode, tt.status, data)
+		}
+		_, data := srv.do(t, http.MethodGet, "/version", nil)
+		var version VersionResponse
+		decodeJSON(t, data, &version)
+		if version.StrictJSON != tt.strict {
+			t.Errorf("/version strictJson = %v, want %v", version.StrictJSON, tt.strict)
+		}
+	}
+}
+
+// POST /vote は application/json だけを受け付ける (charset は省略してよく、付けるなら utf-8)
+func TestVoteContentType(t *testing.T) {
+	srv := newTestServer(t)
+	for _, tt := range []struct {
+		contentType string // 空なら Content-Type を付けない
+		status      int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"Application/JSON; charset=UTF-8", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json; charset=shift_jis", http.StatusUnsupportedMediaType},
+		{"application/jsonp", http.StatusUnsupportedMediaType},
+		{"application/json;;", http.StatusUnsupportedMediaType},
+	} {
+		res, data := srv.do(t, http.MethodPost, "/v1/vote", `{"userId":"u1","vote":"hot"}`, header{"Content-Type": tt.contentType})
+		if res.StatusCode != tt.status {
+			t.Errorf("Content-Type %q: status %d, want %d: %s", tt.contentType, res.StatusCode, tt.status, data)
+			continue
+		}
+		if tt.status == http.StatusUnsupportedMediaType {
+			if code := errorCode(t, data); code != errCodeMediaType {
+				t.Errorf("Content-Type %q: code %q, want %q", tt.contentType, code, errCodeMediaType)
+			}
+			if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type %q: error response is %q, want JSON", tt.contentType, ct)
+			}
+		}
+	}
+}
+
+// HEAD は GET と同じステータスとヘッダーを返し、ボディは返さない
+func TestHeadRequests(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+
+	for _, path := range []string{"/v1/results", "/results", "/v1/results?format=list", "/v1/results/winner", "/v1/results/stats", "/v1/results.csv", "/v1/options", "/healthz", "/version"} {
+		get, getBody := srv.do(t, http.MethodGet, path, nil, header{"Accept-Encoding": "identity"})
+		head, headBody := srv.do(t, http.MethodHead, path, nil, header{"Accept-Encoding": "identity"})
+		if head.StatusCode != http.StatusOK || head.StatusCode != get.StatusCode {
+			t.Errorf("HEAD %s: status %d, GET %d", path, head.StatusCode, get.StatusCode)
+		}
+		if len(headBody) != 0 {
+			t.Errorf("HEAD %s: body %q", path, headBody)
+		}
+		if head.Header.Get("Content-Type") != get.Header.Get("Content-Type") {
+			t.Errorf("HEAD %s: Content-Type %q, GET %q", path, head.Header.Get("Content-Type"), get.Header.Get("Content-Type"))
+		}
+		if n := head.ContentLength; n >= 0 && n != int64(len(getBody)) {
+			t.Errorf("HEAD %s: Content-Length %d, GET body %d bytes", path, n, len(getBody))
+		}
+	}
+}
+
+// CORS のプリフライトで HEAD を許可する
+func TestCORSAllowsHead(t *testing.T) {
+	srv := newTestServer(t)
+	res, _ := srv.do(t, http.MethodOptions, "/v1/results", nil, header{
+		"Origin":                        "https://example.com",
+		"Access-Control-Request-Method": http.MethodHead,
+	})
+	if got := res.Header.Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodHead) {
+		t.Errorf("Access-Control-Allow-Methods %q, want HEAD", got)
+	}
+}
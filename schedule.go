@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// 投票の受付状態
+const (
+	pollStatusOpen      = "open"      // 受付中
+	pollStatusClosed    = "closed"    // 終了した
+	pollStatusScheduled = "scheduled" // まだ始まっていない
+)
+
+// 投票の受付期間。どちらも nil なら常に受け付ける
+type pollSchedule struct {
+	OpensAt  *time.Time `json:"opensAt"`
+	ClosesAt *time.Time `json:"closesAt"`
+}
+
+// 時刻 now での受付状態
+func (s pollSchedule) status(now time.Time) string {
+	if s.OpensAt != nil && now.Before(*s.OpensAt) {
+		return pollStatusScheduled
+	}
+	if s.ClosesAt != nil && !now.Before(*s.ClosesAt) {
+		return pollStatusClosed
+	}
+	return pollStatusOpen
+}
+
+func (s pollSchedule) validate() error {
+	if s.OpensAt != nil && s.ClosesAt != nil && !s.OpensAt.Before(*s.ClosesAt) {
+		return fmt.Errorf("opensAt must be before closesAt")
+	}
+	return nil
+}
+
+// 既定の投票の受付期間を POLL_OPENS_AT / POLL_CLOSES_AT (RFC3339) から読む
+func loadPollSchedule() (pollSchedule, error) {
+	var s pollSchedule
+	for key, dst := range map[string]**time.Time{"POLL_OPENS_AT": &s.OpensAt, "POLL_CLOSES_AT": &s.ClosesAt} {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return pollSchedule{}, fmt.Errorf("invalid %s %q: %w", key, v, err)
+		}
+		*dst = &t
+	}
+	return s, s.validate()
+}
+
+// 受付期間外なら 403 を書いて false を返す (呼び出し側で書き込みロックを取っておくこと)
+// 終了していれば、その時点の結果を確定させる
+func (rm *room) checkVotingOpen(w http.ResponseWriter) bool {
+	switch rm.schedule.status(time.Now()) {
+	case pollStatusScheduled:
+		writeJSONError(w, http.StatusForbidden, errCodeVotingClosed, "voting not open yet")
+		return false
+	case pollStatusClosed:
+		rm.freezeIfClosed(time.Now())
+		if isArchivedPoll(rm.id) {
+			writeJSONError(w, http.StatusForbidden, errCodePollArchived, "poll archived")
+		} else {
+			writeJSONError(w, http.StatusForbidden, errCodeVotingClosed, "voting closed")
+		}
+		return false
+	}
+	return true
+}
+
+// POST /admin/schedule のレスポンス形式
+type ScheduleResponse struct {
+	pollSchedule
+	Status string `json:"status"`
+}
+
+// POST /admin/schedule エンドポイントの処理
+// { "opensAt": "...", "closesAt": "..." } で受付期間を設定する (null で制限なし)
+// 設定はメモリ上だけで、再起動すると POLL_OPENS_AT / POLL_CLOSES_AT に戻る
+// 終了して結果が確定した投票は変えられない (POST /admin/reopen で再開する)
+func adminScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	var schedule pollSchedule
+	if err := decodeJSONBody(w, r, &schedule, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	if err := schedule.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	rm.mutex.Lock()
+	rm.freezeIfClosed(time.Now())
+	if !rm.checkNotFinal(w) {
+		rm.mutex.Unlock()
+		return
+	}
+	rm.schedule = schedule
+	rm.mutex.Unlock()
+
+	status := schedule.status(time.Now())
+	slog.WarnContext(r.Context(), "poll schedule updated", "event", "schedule", "roomId", rm.id, "opensAt", schedule.OpensAt, "closesAt", schedule.ClosesAt, "status", status)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ScheduleResponse{pollSchedule: schedule, Status: status})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// 開発用のエンドポイントを有効にするか (DEV_MODE=true)
+// 本番では設定しないこと。無効なときは開発用のルート自体を登録しない
+var devMode bool
+
+// POST /admin/seed で1回に入れられる票の数
+const maxSeedVotes = 100000
+
+// POST /admin/seed のリクエスト形式
+type SeedRequest struct {
+	Count int `json:"count"` // 入れる票の数
+}
+
+// POST /admin/seed のレスポンス形式
+type SeedResponse struct {
+	Applied   int            `json:"applied"`   // 実際に入った票の数 (人数の上限に達したらそこで止める)
+	ElapsedMs int64          `json:"elapsedMs"` // 票を入れるのにかかった時間
+	Counts    map[string]int `json:"counts"`
+}
+
+// POST /admin/seed?roomId= エンドポイントの処理 (DEV_MODE のときだけ登録する)
+// 負荷試験のために、ランダムなユーザーIDと選択肢で count 件の票をまとめて入れる
+// ユーザーIDは "seed-" で始まるので、本物のユーザーと重ならない
+// 入れ終わるまで部屋の書き込みロックを持つので、その間の投票は待たされる
+func adminSeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	var req SeedRequest
+	if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	if req.Count < 1 || req.Count > maxSeedVotes {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("count must be 1 to %d", maxSeedVotes))
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	options := rm.optionSet().keys
+	start := time.Now()
+	applied := 0
+	for applied < req.Count {
+		vote := options[rand.IntN(len(options))]
+		ctx, cancel := storeContext(r)
+		var err error
+		if anonymousVoting {
+			err = rm.store.RecordAnonymousVote(ctx, vote, 1, time.Now())
+		} else {
+			if !rm.canAcceptVoter(false) {
+				cancel()
+				break
+			}
+			userID := fmt.Sprintf("seed-%016x", rand.Uint64())
+			err = rm.store.RecordVote(ctx, userID, vote, 1, time.Now())
+		}
+		cancel()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to seed votes", "event", "seed", "roomId", rm.id, "applied", applied, "error", err)
+			writeStoreError(w, err, "Failed to seed votes")
+			return
+		}
+		applied++
+	}
+	elapsed := time.Since(start)
+
+	rm.notifySubscribers()
+	counts := rm.store.Counts()
+	rm.updateVoteGauges(counts)
+	slog.WarnContext(r.Context(), "votes seeded", "event", "seed", "roomId", rm.id, "applied", applied, "elapsed", elapsed.String())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(SeedResponse{Applied: applied, ElapsedMs: elapsed.Milliseconds(), Counts: counts})
+}
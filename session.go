@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SESSION_TTL が未設定のときの、POST /session/start の記録を覚えておく時間
+const defaultSessionTTL = 30 * time.Minute
+
+// 同時に覚えておくセッションの数の上限 (大量の開始でメモリを使い切らないように)
+const maxVoteSessions = 100000
+
+// 投票画面を開いてから投票するまでの時間 (POST /session/start を呼んだユーザーの分だけ)
+var deliberationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "deliberation_seconds",
+	Help:    "Time from POST /session/start to the vote, by room.",
+	Buckets: []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600, 1800},
+}, []string{"room"})
+
+var errTooManySessions = errors.New("too many sessions")
+
+// ユーザーが投票画面を開いた時刻を ttl の間だけ覚えておく
+// 投票が記録されたら、かかった時間を deliberationSeconds に記録する
+// 測った後もセッションは ttl まで残す (REQUIRE_SESSION のとき、同じ画面での投票の変更を断らないように)
+type sessionTracker struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	started map[string]voteSession // 部屋IDとユーザーIDごと
+}
+
+type voteSession struct {
+	at       time.Time // 開始時刻
+	measured bool      // 投票までの時間を記録済み
+}
+
+func newSessionTracker(ttl time.Duration) *sessionTracker {
+	return &sessionTracker{ttl: ttl, started: make(map[string]voteSession)}
+}
+
+func sessionKey(roomID, userID string) string {
+	return roomID + "\x00" + userID
+}
+
+// 開始時刻を記録して返す。ttl 以内に開始済みなら最初の時刻のまま (画面を開き直しても測り直さない)
+// 投票までの時間を記録した後なら、新しいセッションとして測り直す
+func (t *sessionTracker) start(roomID, userID string, now time.Time) (time.Time, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := sessionKey(roomID, userID)
+	session, ok := t.started[key]
+	if ok && !session.measured && now.Sub(session.at) < t.ttl {
+		return session.at, nil
+	}
+	if !ok && len(t.started) >= maxVoteSessions {
+		return time.Time{}, errTooManySessions
+	}
+	t.started[key] = voteSession{at: now}
+	return now, nil
+}
+
+// 今 start を呼ぶと新しいセッションを始めるか (記録はしない。覚えておく数の上限で始められないなら false)
+func (t *sessionTracker) startsFresh(roomID, userID string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.started[sessionKey(roomID, userID)]
+	if !ok {
+		return len(t.started) < maxVoteSessions
+	}
+	return session.measured || now.Sub(session.at) >= t.ttl
+}
+
+// 開始からの時間を返し、記録済みにする。開始していないか、記録済みか、ttl を過ぎていれば false
+func (t *sessionTracker) finish(roomID, userID string, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := sessionKey(roomID, userID)
+	session, ok := t.started[key]
+	if !ok || session.measured {
+		return 0, false
+	}
+	session.measured = true
+	t.started[key] = session
+	elapsed := now.Sub(session.at)
+	return elapsed, elapsed >= 0 && elapsed < t.ttl
+}
+
+// ttl 以内に開始したセッションがあるか (投票までの時間を記録した後も ttl までは有効)
+func (t *sessionTracker) active(roomID, userID string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.started[sessionKey(roomID, userID)]
+	return ok && now.Sub(session.at) < t.ttl
+}
+
+// ttl を過ぎた開始時刻を忘れる (投票しなかったユーザーの分が残り続けないように)
+func (t *sessionTracker) evictExpired(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, session := range t.started {
+		if now.Sub(session.at) >= t.ttl {
+			delete(t.started, key)
+		}
+	}
+}
+
+// 定期的に evictExpired を呼ぶ。サーバーが終了すると止まる
+func (t *sessionTracker) startEviction() {
+	go func() {
+		ticker := time.NewTicker(min(t.ttl, time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				t.evictExpired(now)
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// 投票画面を開いた時刻の記録 (SESSION_TTL で覚えておく時間を変える)
+var voteSessions = newSessionTracker(defaultSessionTTL)
+
+// SESSION_TTL を読む
+func loadSessionTTL() error {
+	ttl, err := envDuration("SESSION_TTL", defaultSessionTTL)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("SESSION_TTL must be positive")
+	}
+	voteSessions = newSessionTracker(ttl)
+	return nil
+}
+
+// true なら POST /session/start を呼んでいないユーザーの投票を 428 で断る (REQUIRE_SESSION=true)
+// 画面を開かずに API を直接呼ぶ投票を減らし、投票までの時間をすべての投票で測れるようにする
+// セッションは SESSION_TTL で切れるので、それより後の投票ではもう一度 POST /session/start を呼ぶ
+var requireSession bool
+
+// REQUIRE_SESSION を読む。匿名投票モードではユーザーごとのセッションを結び付けられないので使えない
+func loadRequireSession() error {
+	var err error
+	if requireSession, err = envBool("REQUIRE_SESSION", false); err != nil {
+		return err
+	}
+	if requireSession && anonymousVoting {
+		return errors.New("REQUIRE_SESSION cannot be used with ANONYMOUS_VOTING")
+	}
+	return nil
+}
+
+// true なら POST /session/start で新しいセッションを始めたときに、そのユーザーの投票を取り消す (SESSION_CLEARS_VOTE=true)
+// 展示会の共用タブレットのように同じユーザーIDを何人も使うとき、来た人ごとに投票していない状態から始められるようにする
+// 同じセッションの中で開き直したとき (まだ投票していない) は取り消さない。ALLOW_VOTE_CHANGE に関係なく取り消す
+// 受け付けていない (終了した、まだ始まっていない) 間は取り消さない
+var sessionClearsVote bool
+
+// SESSION_CLEARS_VOTE を読む。匿名投票モードでは取り消す投票が分からないので使えない
+func loadSessionClearsVote() error {
+	var err error
+	if sessionClearsVote, err = envBool("SESSION_CLEARS_VOTE", false); err != nil {
+		return err
+	}
+	if sessionClearsVote && anonymousVoting {
+		return errors.New("SESSION_CLEARS_VOTE cannot be used with ANONYMOUS_VOTING")
+	}
+	return nil
+}
+
+// 新しいセッションのために、ユーザーのこの部屋での投票を取り消し、取り消した選択肢を返す (投票が無ければ空)
+// 部屋がまだ無ければ何もしない (部屋は作らない)
+func clearVoteForSession(r *http.Request, roomID, userID string) ([]string, error) {
+	rm := defaultRoom
+	if roomID != "" {
+		var err error
+		if rm, err = getRoom(roomID, false); errors.Is(err, errRoomNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if rm.schedule.status(time.Now()) != pollStatusOpen {
+		return nil, nil
+	}
+	ids := map[string]string{} // 保存先のユーザーID → 選択肢
+	if multiSelectVoting {
+		for _, option := range rm.userSelections(userID) {
+			ids[selectionUserID(userID, option)] = option
+		}
+	} else if vote, ok := rm.store.UserVote(userID); ok {
+		ids[userID] = vote
+	}
+	rm.dropPendingVote(userID)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cleared := make([]string, 0, len(ids))
+	for id, vote := range ids {
+		ctx, cancel := storeContext(r)
+		err := rm.deleteVote(ctx, id, vote)
+		cancel()
+		if err != nil {
+			return cleared, err
+		}
+		cleared = append(cleared, vote)
+		delete(rm.comments, id)
+		rm.untallyCohort(id, vote)
+		rm.recordTransition(userID, transitionRetracted, vote, "", time.Now())
+		recordAudit(AuditEntry{
+			Action:    "retract",
+			RoomID:    rm.id,
+			UserID:    userID,
+			OldVote:   vote,
+			RemoteIP:  remoteIP(r),
+			RequestID: requestIDFromContext(r.Context()),
+		})
+	}
+	delete(rm.comments, userID)
+	rm.dropReceipt(userID)
+	rm.notifySubscribers()
+
+	counts := rm.store.Counts()
+	rm.updateVoteGauges(counts)
+	slog.InfoContext(r.Context(), "vote cleared for new session",
+		"event", "session_clear",
+		"roomId", rm.id,
+		"userId", logUserID(userID),
+		"previousVotes", cleared,
+		"counts", counts,
+	)
+	return cleared, nil
+}
+
+// requireSession で、ユーザーにこの部屋の有効なセッションが無ければ false
+func (rm *room) hasSession(userID string, now time.Time) bool {
+	return hasVoteSession(rm.id, userID, now)
+}
+
+// hasSession と同じ (部屋を作る前に確かめるときに使う)
+func hasVoteSession(roomID, userID string, now time.Time) bool {
+	return !requireSession || voteSessions.active(roomID, userID, now)
+}
+
+// requireSession で、ユーザーにこの部屋の有効なセッションが無ければ 428 を書いて false を返す
+func (rm *room) checkSession(w http.ResponseWriter, r *http.Request, userID string) bool {
+	return checkVoteSession(w, r, rm.id, userID)
+}
+
+// checkSession と同じ (部屋を作る前に確かめるときに使う)
+func checkVoteSession(w http.ResponseWriter, r *http.Request, roomID, userID string) bool {
+	if hasVoteSession(roomID, userID, time.Now()) {
+		return true
+	}
+	slog.InfoContext(r.Context(), "vote without session", "event", "session_required", "roomId", roomID, "userId", logUserID(userID))
+	writeJSONError(w, http.StatusPreconditionRequired, errCodeSessionRequired, "Call POST /session/start before voting")
+	return false
+}
+
+// 投票が記録されたときに、開始からの時間をヒストグラムに記録する
+// POST /session/start を呼んでいないユーザーは何もしない
+func (rm *room) observeDeliberation(userID string, now time.Time) {
+	if elapsed, ok := voteSessions.finish(rm.id, userID, now); ok {
+		deliberationSeconds.WithLabelValues(rm.id).Observe(elapsed.Seconds())
+	}
+}
+
+// POST /session/start のリクエスト形式
+type SessionStartRequest struct {
+	UserID string `json:"userId"` // 認証が有効なときはトークンのUIDで上書きされる
+}
+
+// POST /session/start のレスポンス形式
+type SessionStartResponse struct {
+	StartedAt    string   `json:"startedAt"`              // 記録した開始時刻 (RFC3339, UTC)
+	ClearedVotes []string `json:"clearedVotes,omitempty"` // SESSION_CLEARS_VOTE で取り消した投票
+}
+
+// POST /session/start と /rooms/{roomId}/session/start エンドポイントの処理 (任意)
+// 投票画面を開いたときに呼ぶと、投票するまでの時間を deliberation_seconds に記録する
+// REQUIRE_SESSION が無ければ、呼ばなくても投票には影響しない。部屋は作らないので、まだ投票の無い部屋でも呼べる
+// SESSION_CLEARS_VOTE なら、新しいセッションを始めたときにそのユーザーの投票を取り消す
+func sessionStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	roomID := r.PathValue("roomId")
+	if roomID != "" && !roomIDPattern.MatchString(roomID) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid room id")
+		return
+	}
+
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req SessionStartRequest
+	if err := decodeJSONBody(w, r, &req, maxVoteBodyBytes); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	if uid != "" {
+		req.UserID = uid
+	}
+	if !checkUserID(w, req.UserID) {
+		return
+	}
+
+	// 投票を取り消せてから新しいセッションを始める (取り消せなければセッションは前のまま。送り直せばもう一度取り消す)
+	now := time.Now()
+	var cleared []string
+	if sessionClearsVote && voteSessions.startsFresh(roomID, req.UserID, now) {
+		if cleared, err = clearVoteForSession(r, roomID, req.UserID); err != nil {
+			slog.ErrorContext(r.Context(), "failed to clear vote for new session", "event", "session_clear", "roomId", roomID, "userId", logUserID(req.UserID), "error", err)
+			writeStoreError(w, err, "Failed to clear previous vote")
+			return
+		}
+	}
+	startedAt, err := voteSessions.start(roomID, req.UserID, now)
+	if err != nil {
+		slog.WarnContext(r.Context(), "session not recorded", "event", "session_start", "roomId", roomID, "error", err)
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Too many sessions")
+		return
+	}
+	if closeDefaultOption != "" && !closeViewers.add(roomID, req.UserID) {
+		slog.WarnContext(r.Context(), "session viewer not recorded for close default", "event", "session_start", "roomId", roomID, "error", errTooManySessions)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(SessionStartResponse{StartedAt: startedAt.UTC().Format(time.RFC3339), ClearedVotes: cleared})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// DeleteVote だけを失敗させる保存先
+type failingDeleteStore struct {
+	VoteStore
+	err error
+}
+
+func (s *failingDeleteStore) DeleteVote(ctx context.Context, userID string) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.VoteStore.DeleteVote(ctx, userID)
+}
+
+func startSession(t *testing.T, srv *testServer, userID string, want int) SessionStartResponse {
+	t.Helper()
+	res, data := srv.do(t, http.MethodPost, "/v1/session/start", SessionStartRequest{UserID: userID})
+	if res.StatusCode != want {
+		t.Fatalf("session start %s: status %d, want %d: %s", userID, res.StatusCode, want, data)
+	}
+	var body SessionStartResponse
+	if res.StatusCode == http.StatusOK {
+		decodeJSON(t, data, &body)
+	}
+	return body
+}
+
+// 共用の端末で同じユーザーIDのセッションを何度始め直しても、票数はいつも最後の1票だけになる
+func TestSessionClearsVote(t *testing.T) {
+	srv := newTestServer(t, "SESSION_CLEARS_VOTE=true")
+
+	options := []string{"hot", "ok", "cold", "cold", "hot"}
+	for i, option := range options {
+		res := startSession(t, srv, "kiosk", http.StatusOK)
+		var want []string
+		if i > 0 {
+			want = []string{options[i-1]}
+		}
+		if !slices.Equal(res.ClearedVotes, want) {
+			t.Errorf("session %d: clearedVotes %v, want %v", i, res.ClearedVotes, want)
+		}
+		// 同じセッションの中で開き直しても取り消さない
+		if i == 0 {
+			if res := startSession(t, srv, "kiosk", http.StatusOK); len(res.ClearedVotes) != 0 {
+				t.Errorf("reopened session cleared %v", res.ClearedVotes)
+			}
+		}
+
+		if vote := srv.vote(t, "/v1/vote", "kiosk", option, http.StatusOK); vote.Status != voteStatusNew {
+			t.Errorf("session %d: vote status %q, want %q", i, vote.Status, voteStatusNew)
+		}
+		results := srv.results(t, "/v1/results")
+		if got, want := resultCounts(results), map[string]int{option: 1}; !sameCounts(got, want) || results.Total != 1 {
+			t.Errorf("session %d: counts %v (total %d), want %v", i, got, results.Total, want)
+		}
+	}
+}
+
+// 投票を取り消せなければ新しいセッションを始めず、送り直したときにもう一度取り消す
+func TestSessionClearFailureKeepsSession(t *testing.T) {
+	srv := newTestServer(t, "SESSION_CLEARS_VOTE=true")
+
+	startSession(t, srv, "kiosk", http.StatusOK)
+	srv.vote(t, "/v1/vote", "kiosk", "hot", http.StatusOK)
+
+	store := &failingDeleteStore{VoteStore: defaultRoom.store, err: errors.New("disk full")}
+	defaultRoom.store = store
+	startSession(t, srv, "kiosk", http.StatusInternalServerError)
+	if !voteSessions.startsFresh("", "kiosk", time.Now()) {
+		t.Error("failed clear started a new session")
+	}
+
+	store.err = nil
+	if res := startSession(t, srv, "kiosk", http.StatusOK); !slices.Equal(res.ClearedVotes, []string{"hot"}) {
+		t.Errorf("retry: clearedVotes %v, want [hot]", res.ClearedVotes)
+	}
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, nil) {
+		t.Errorf("counts after retry %v, want none", got)
+	}
+}
+
+// REQUIRE_SESSION が無ければ、セッションを始めずにそのまま投票できる
+func TestVoteWithoutSessionUngated(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/rooms/r1/vote", "u1", "hot", http.StatusOK)
+}
+
+// REQUIRE_SESSION=true なら、その部屋のセッションを始めていないユーザーの投票は 428
+func TestRequireSession(t *testing.T) {
+	srv := newTestServer(t, "REQUIRE_SESSION=true")
+
+	res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: "u1", Vote: "hot"})
+	if res.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("vote without session: status %d, want 428: %s", res.StatusCode, data)
+	}
+	if code := errorCode(t, data); code != errCodeSessionRequired {
+		t.Errorf("vote without session: code %q, want %q", code, errCodeSessionRequired)
+	}
+
+	startSession(t, srv, "u1", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	// セッションは投票しても切れないので、続けて変えられる
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK)
+	// ほかのユーザーや、ほかの部屋のセッションにはならない
+	srv.vote(t, "/v1/vote", "u2", "hot", http.StatusPreconditionRequired)
+	srv.vote(t, "/v1/rooms/r1/vote", "u1", "hot", http.StatusPreconditionRequired)
+	if res, data := srv.do(t, http.MethodPost, "/v1/rooms/r1/session/start", SessionStartRequest{UserID: "u1"}); res.StatusCode != http.StatusOK {
+		t.Fatalf("room session start: status %d: %s", res.StatusCode, data)
+	}
+	srv.vote(t, "/v1/rooms/r1/vote", "u1", "hot", http.StatusOK)
+
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, map[string]int{"cold": 1}) {
+		t.Errorf("counts %v, want cold=1", got)
+	}
+}
+
+// セッションは SESSION_TTL で切れ、始め直すまでまた 428 になる
+func TestRequireSessionExpires(t *testing.T) {
+	srv := newTestServer(t, "REQUIRE_SESSION=true", "SESSION_TTL=100ms")
+	startSession(t, srv, "u1", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+
+	time.Sleep(150 * time.Millisecond)
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusPreconditionRequired)
+	startSession(t, srv, "u1", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK)
+}
+
+// REQUIRE_SESSION は匿名投票モードとは一緒に使えない
+func TestRequireSessionAnonymous(t *testing.T) {
+	t.Setenv("REQUIRE_SESSION", "true")
+	anonymousVoting = true
+	t.Cleanup(func() { anonymousVoting = false })
+	if err := loadRequireSession(); err == nil {
+		t.Error("REQUIRE_SESSION with ANONYMOUS_VOTING: no error")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shuttingDown はプロセスで1回しか閉じられないので、終了のテストは別のプロセスで動かす
+const shutdownTestEnv = "MILLE_FEUILLE_SHUTDOWN_TEST"
+
+// 終了するときは SSE と WebSocket に閉じることを知らせ、閉じ終わるのを待ち、goroutine を残さない
+func TestShutdownClosesStreams(t *testing.T) {
+	if os.Getenv(shutdownTestEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestShutdownClosesStreams$", "-test.count=1")
+		cmd.Env = append(os.Environ(), shutdownTestEnv+"=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("shutdown test: %v\n%s", err, out)
+		}
+		return
+	}
+
+	const grace = 300 * time.Millisecond
+	srv := newTestServer(t, "STREAM_CLOSE_GRACE="+grace.String())
+	srv.Client().CloseIdleConnections()
+	baseline := runtime.NumGoroutine()
+
+	polite := openSSE(t, srv, "/v1/results/stream")
+	polite.next()
+	// closing イベントを受け取っても閉じないクライアント
+	ignoring := openSSE(t, srv, "/v1/results/stream")
+	ignoring.next()
+	conn := dialWS(t, srv, "/v1/ws", nil)
+	readWS(t, conn)
+	waitStreams(t, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	closed := make(chan struct{})
+	go func() {
+		closeStreams(ctx)
+		close(closed)
+	}()
+
+	if got := polite.next(); got != `{"reason":"server closing"}` {
+		t.Errorf("SSE closing event %s", got)
+	}
+	polite.close()
+	if got := ignoring.next(); got != `{"reason":"server closing"}` {
+		t.Errorf("SSE closing event %s", got)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "server closing" {
+		t.Errorf("WebSocket close: %v, want %d server closing", err, websocket.CloseGoingAway)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("closeStreams did not return: %d open", activeStreams.Load())
+	}
+	// 閉じないクライアントは STREAM_CLOSE_GRACE だけ待ってから切る
+	if elapsed := time.Since(start); elapsed < grace {
+		t.Errorf("closeStreams returned after %v, want at least %v", elapsed, grace)
+	}
+	if n := activeStreams.Load(); n != 0 {
+		t.Errorf("open streams %d after closeStreams", n)
+	}
+
+	// 終了を始めたら新しい接続は受け付けない
+	for _, path := range []string{"/v1/results/stream", "/v1/ws"} {
+		res, data := srv.do(t, http.MethodGet, path, nil)
+		if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+			t.Errorf("GET %s after shutdown: status %d, Retry-After %q: %s", path, res.StatusCode, res.Header.Get("Retry-After"), data)
+		}
+	}
+
+	ignoring.close()
+	conn.Close()
+	srv.Client().CloseIdleConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			var stacks strings.Builder
+			pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+			t.Fatalf("goroutines %d after shutdown, want at most %d\n%s", runtime.NumGoroutine(), baseline, stacks.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
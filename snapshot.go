@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SNAPSHOT_INTERVAL が未設定のときの書き出し間隔
+const defaultSnapshotInterval = 30 * time.Second
+
+// スナップショットファイルの形式 (部屋IDごと。既定の投票は空文字)
+type snapshotFile struct {
+	SavedAt time.Time               `json:"savedAt"`
+	Rooms   map[string]roomSnapshot `json:"rooms"`
+	Polls   []pollInfo              `json:"polls,omitempty"` // POST /polls で作った投票の定義
+}
+
+type roomSnapshot struct {
+	Counts         map[string]int          `json:"counts"`
+	WeightedCounts map[string]int          `json:"weightedCounts,omitempty"` // 以前のファイルには無い
+	UserVotes      map[string]snapshotVote `json:"userVotes"`
+}
+
+type snapshotVote struct {
+	Vote    string    `json:"vote"`
+	Weight  int       `json:"weight,omitempty"` // 重みを記録する前のファイルには無い (1票として読む)
+	VotedAt time.Time `json:"votedAt"`
+}
+
+// スナップショットを読み、部屋ごとのメモリ上の投票を作る。ファイルが無ければ空
+// ファイルにある投票の定義 (POST /polls) もここで登録する
+// 票数はユーザーごとの投票から数え直す (現在の選択肢に無い票は数えない。匿名投票モードの票は restoreAnonymousCounts で戻す)
+func loadSnapshot(path string) (map[string]*memoryStore, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]*memoryStore{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse snapshot: %w", err)
+	}
+
+	// 投票ごとの選択肢で数え直せるよう、先に投票の定義を登録する
+	registerPolls(file.Polls)
+
+	stores := make(map[string]*memoryStore, len(file.Rooms))
+	for roomID, snap := range file.Rooms {
+		events := make([]VoteEvent, 0, len(snap.UserVotes))
+		for userID, v := range snap.UserVotes {
+			events = append(events, VoteEvent{UserID: userID, Vote: v.Vote, Weight: v.Weight, Timestamp: v.VotedAt})
+		}
+		store := Replay(events, roomOptions(roomID).keys)
+		if anonymousVoting {
+			restoreAnonymousCounts(store, snap)
+		}
+		stores[roomID] = store
+	}
+	return stores, nil
+}
+
+// 匿名投票モードの票はユーザーごとの投票から数え直せないので、
+// 書き出した票数のうちユーザーの投票で説明できない分を匿名の票として足す
+// (匿名の票の重み付きの票数はファイルの weightedCounts から戻す)
+func restoreAnonymousCounts(store *memoryStore, snap roomSnapshot) {
+	counts := store.Counts()
+	weighted := store.WeightedCounts()
+	for option, count := range snap.Counts {
+		extra := count - counts[option]
+		if extra <= 0 {
+			continue
+		}
+		extraWeight := extra
+		if w, ok := snap.WeightedCounts[option]; ok {
+			extraWeight = w - weighted[option]
+		}
+		store.add(option, extra, extraWeight)
+	}
+}
+
+// 部屋の投票をスナップショット用にコピーする (書き込み中の投票を待ってから読むので、途中の投票が混ざらない)
+func (rm *room) snapshot() roomSnapshot {
+	rm.mutex.rlockVotes()
+	defer rm.mutex.runlockVotes()
+
+	snap := roomSnapshot{Counts: rm.store.Counts(), WeightedCounts: rm.store.WeightedCounts(), UserVotes: make(map[string]snapshotVote)}
+	for userID, record := range rm.store.UserVotes() {
+		snap.UserVotes[userID] = snapshotVote{Vote: record.Vote, Weight: record.Weight, VotedAt: record.VotedAt}
+	}
+	return snap
+}
+
+// すべての部屋の投票をファイルに書き出す
+// 一時ファイルに書いてから置き換えるので、途中で落ちても前回のファイルが残る
+func writeSnapshot(path string) error {
+	file := snapshotFile{SavedAt: time.Now().UTC(), Rooms: map[string]roomSnapshot{"": defaultRoom.snapshot()}}
+
+	roomsMutex.Lock()
+	all := make([]*room, 0, len(rooms))
+	for _, rm := range rooms {
+		all = append(all, rm)
+	}
+	roomsMutex.Unlock()
+	for _, rm := range all {
+		file.Rooms[rm.id] = rm.snapshot()
+	}
+	pollsMutex.RLock()
+	for _, p := range polls {
+		file.Polls = append(file.Polls, p.info)
+	}
+	pollsMutex.RUnlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // 置き換えた後は何もしない
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// interval ごとにスナップショットを書き出す。サーバーが終了すると止まる (最後の書き出しは main で行う)
+func startSnapshotter(path string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := writeSnapshot(path); err != nil {
+					slog.Error("failed to write snapshot", "path", path, "error", err)
+				}
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
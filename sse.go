@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// プロキシにアイドル接続を切られないよう、定期的に送るコメントの間隔
+const sseHeartbeatInterval = 15 * time.Second
+
+// 結果の更新を受け取る購読者を登録し、現在の集計と一緒に返す
+func (rm *room) subscribe() (chan []byte, []byte) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	// 最新の集計だけ届けば良いのでバッファは1つ
+	ch := make(chan []byte, 1)
+	rm.subscribers[ch] = struct{}{}
+
+	data, _ := json.Marshal(rm.store.Counts())
+	return ch, data
+}
+
+// 購読者を取り除く
+func (rm *room) unsubscribe(ch chan []byte) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	delete(rm.subscribers, ch)
+}
+
+// 購読者 (SSE と WebSocket) に現在の集計を送り、ロングポーリングで待っているリクエストを起こす
+// (呼び出し側でロックを取っておくこと)
+// 遅い購読者のせいで投票が止まらないよう、未読の古い集計は捨てて最新のものに置き換える
+func (rm *room) notifySubscribers() {
+	rm.bumpVersion()
+	if len(rm.subscribers) == 0 && hub == nil {
+		return
+	}
+
+	data, err := json.Marshal(rm.store.Counts())
+	if err != nil {
+		slog.Error("failed to encode counts for subscribers", "roomId", rm.id, "error", err)
+		return
+	}
+	if hub != nil {
+		hub.publish(rm.id, data)
+	}
+	for ch := range rm.subscribers {
+		select {
+		case ch <- data:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- data
+		}
+	}
+}
+
+// GET /results/stream エンドポイントの処理 (Server-Sent Events)
+// 接続時と投票が変わるたびに、集計を data: イベントとして送る (MIN_REVEAL を下回っている間は data: null)
+func (rm *room) resultsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Streaming unsupported")
+		return
+	}
+
+	// 開きっぱなしの接続なので、サーバー全体の読み書きの期限を外す
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	admin := isAdmin(r)
+	ch, initial := rm.subscribe()
+	defer rm.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "data: %s\n\n", rm.streamCounts(admin, initial))
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// クライアントが切断した
+			return
+		case <-shuttingDown:
+			closeSSEStream(w, r, flusher)
+			return
+		case data := <-ch:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", rm.streamCounts(admin, data)); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// サーバーの終了を SSE のクライアントに知らせる
+// closing イベントは onmessage には届かないので、知らないクライアントにも影響しない
+// retry でつなぎ直すまでの時間を伝え、クライアントが閉じるのを streamCloseGrace だけ待つ
+func closeSSEStream(w http.ResponseWriter, r *http.Request, flusher http.Flusher) {
+	_, err := fmt.Fprintf(w, "retry: %d\nevent: closing\ndata: {\"reason\":\"server closing\"}\n\n", streamRetryAfter.Milliseconds())
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	grace := time.NewTimer(streamCloseGrace)
+	defer grace.Stop()
+	select {
+	case <-r.Context().Done():
+	case <-grace.C:
+	}
+}
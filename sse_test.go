@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SSE の data: イベントを1つずつ読む
+type sseReader struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+	close   func() // 接続を切る (テストの終わりにも切る)
+}
+
+func openSSE(t *testing.T, srv *testServer, path string) *sseReader {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStream := func() {
+		cancel()
+		res.Body.Close()
+	}
+	t.Cleanup(closeStream)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, res.StatusCode)
+	}
+	return &sseReader{t: t, scanner: bufio.NewScanner(res.Body), close: closeStream}
+}
+
+// 次の data: の中身 (届かなければ失敗にする)
+func (s *sseReader) next() string {
+	s.t.Helper()
+	data := make(chan string, 1)
+	go func() {
+		for s.scanner.Scan() {
+			if v, ok := strings.CutPrefix(s.scanner.Text(), "data: "); ok {
+				data <- v
+				return
+			}
+		}
+		close(data)
+	}()
+	select {
+	case v, ok := <-data:
+		if !ok {
+			s.t.Fatal("stream closed")
+		}
+		return v
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no event")
+		return ""
+	}
+}
+
+// つないだ後に MIN_REVEAL を下回ったら票数ではなく null を送る
+func TestSSEHidesCountsBelowMinReveal(t *testing.T) {
+	srv := newTestServer(t, "MIN_REVEAL=2")
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u2", "hot", http.StatusOK)
+
+	stream := openSSE(t, srv, "/v1/results/stream")
+	if got := stream.next(); !strings.Contains(got, `"hot":2`) {
+		t.Fatalf("initial event %s", got)
+	}
+
+	srv.do(t, http.MethodPost, "/v1/admin/reset", nil, adminHeader)
+	if got := stream.next(); got != "null" {
+		t.Errorf("after reset: %s, want null", got)
+	}
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK)
+	if got := stream.next(); got != "null" {
+		t.Errorf("below MIN_REVEAL: %s, want null", got)
+	}
+	srv.vote(t, "/v1/vote", "u2", "cold", http.StatusOK)
+	if got := stream.next(); !strings.Contains(got, `"cold":2`) {
+		t.Errorf("revealed again: %s", got)
+	}
+}
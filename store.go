@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ユーザーがまだ投票していない
+var errVoteNotFound = errors.New("vote not found")
+
+// ユーザー1人分の投票
+type voteRecord struct {
+	Vote string
+	// この票の重み (投票したときのユーザーの重み)
+	Weight int
+	// その選択肢を選んだ時刻
+	// 投票を変えたときは更新し、同じ選択肢にもう一度投票したときは最初の時刻のままにする
+	// (「この時間内に選ばれた票」を数えたいので、選択が変わらない再投票では新しくしない)
+	VotedAt time.Time
+}
+
+// 投票データの保存先
+// 呼び出し側 (room) が room.mutex を取ってから呼ぶので、実装側で排他する必要はない
+// (concurrentVoteRecorder の保存先だけは、違うユーザーの RecordVote を room.mutex の外で同時に呼ぶ)
+// 書き込みは ctx の期限を守る (遅い保存先でロックを持ったまま待ち続けないように)
+type VoteStore interface {
+	// ユーザーの投票を重み weight で時刻 at に記録する (以前の投票があれば置き換える)
+	// 以前と同じ選択肢なら何も変えない
+	RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error
+	// 誰の投票かを残さずに、重み weight の1票を時刻 at に足す (匿名投票モード)
+	RecordAnonymousVote(ctx context.Context, vote string, weight int, at time.Time) error
+	// ユーザーの投票を取り消す。投票していなければ errVoteNotFound
+	DeleteVote(ctx context.Context, userID string) error
+	// 選択肢ごとの票数 (呼び出し側が自由に使えるコピーを返す)
+	Counts() map[string]int
+	// 選択肢ごとの重み付きの票数 (呼び出し側が自由に使えるコピーを返す)
+	WeightedCounts() map[string]int
+	// ユーザーの現在の投票
+	UserVote(userID string) (string, bool)
+	// 全ユーザーの投票 (呼び出し側が自由に使えるコピーを返す)
+	UserVotes() map[string]voteRecord
+	// 投票しているユーザーの数
+	VoterCount() int
+	// すべての票数を0にし、ユーザーごとの投票を消す
+	Reset(ctx context.Context) error
+}
+
+// 違うユーザーの RecordVote を同時に呼んでよい保存先 (room.mutex.store の読み取りロックだけで呼ぶ)
+// 同じユーザーの投票どうしは、呼び出し側が room.userLocks で順番にする
+type concurrentVoteRecorder interface {
+	recordsVotesConcurrently() bool
+}
+
+func recordsVotesConcurrently(store VoteStore) bool {
+	s, ok := store.(concurrentVoteRecorder)
+	return ok && s.recordsVotesConcurrently()
+}
+
+// ユーザーIDで選ぶロックの数 (違うユーザーの投票はたいてい別のロックになる)
+const userStripeCount = 64
+
+var userStripeSeed = maphash.MakeSeed()
+
+// userID のロックの番号
+func userStripe(userID string) int {
+	return int(maphash.String(userStripeSeed, userID) % userStripeCount)
+}
+
+// メモリ上のマップだけで持つ VoteStore (再起動すると消える)
+//
+// 票数は選択肢ごとの atomic なカウンターで持つ。カウンターのマップが変わるのは
+// 管理用エンドポイントで選択肢を足し引きするとき (room.mutex の書き込みロック中) だけなので、
+// 投票どうしは同じカウンターへの加算だけで済み、読み取りロック中の票数の読み出しと競合しない。
+// ユーザーごとの投票はユーザーIDで分けたマップに持ち、それぞれを別のロックで守るので、
+// 違うユーザーの RecordVote は同時に呼べる
+type memoryStore struct {
+	// 選択肢ごとの投票数 (重みに関係なく1人1票)
+	voteCounts map[string]*atomic.Int64
+
+	// 選択肢ごとの重み付きの票数
+	weightedCounts map[string]*atomic.Int64
+
+	// どのユーザーが何に、いつ投票したか (userStripe で分ける) と、投票しているユーザーの数
+	users  [userStripeCount]userVoteShard
+	voters atomic.Int64
+
+	// 最後に票数を手で直した時刻 (POST /admin/adjust。リセットするとゼロ値に戻る)
+	adjustedAt time.Time
+}
+
+func newMemoryStore(options []string) *memoryStore {
+	s := &memoryStore{
+		voteCounts:     make(map[string]*atomic.Int64, len(options)),
+		weightedCounts: make(map[string]*atomic.Int64, len(options)),
+	}
+	for _, option := range options {
+		s.voteCounts[option] = new(atomic.Int64)
+		s.weightedCounts[option] = new(atomic.Int64)
+	}
+	for i := range s.users {
+		s.users[i].votes = make(map[string]voteRecord)
+	}
+	return s
+}
+
+// userStripe が同じユーザーたちの投票
+type userVoteShard struct {
+	mu    sync.Mutex
+	votes map[string]voteRecord
+}
+
+func (s *memoryStore) shard(userID string) *userVoteShard {
+	return &s.users[userStripe(userID)]
+}
+
+func (s *memoryStore) recordsVotesConcurrently() bool {
+	return true
+}
+
+// 選択肢の票数を増減する。作成時の選択肢に無いもの (選択肢から外された古い票) は数えない
+// 外部でのリセットや選択肢の削除で票数と投票がずれていても、票数が0未満にはならないようにする
+// (0で止めて不整合としてログとメトリクスに残す)。MAX_OPTION_COUNT を超えるときも上限で止める
+func (s *memoryStore) add(option string, count, weight int) {
+	c, ok := s.voteCounts[option]
+	if !ok {
+		// 選択肢から外された古い票の増減は起こりうるので、ログは debug にとどめる
+		voteCountAnomalies.WithLabelValues("unknown_option").Inc()
+		slog.Debug("vote count update for unknown option ignored", "event", "vote_count_anomaly", "option", option, "count", count)
+		return
+	}
+	switch max(addClamped(c, int64(count)), addClamped(s.weightedCounts[option], int64(weight))) {
+	case clampedToZero:
+		voteCountAnomalies.WithLabelValues("negative_count").Inc()
+		slog.Warn("vote count would drop below zero; clamped to zero", "event", "vote_count_anomaly", "option", option, "count", count, "weight", weight)
+	case clampedToMax:
+		voteCountAnomalies.WithLabelValues("count_limit").Inc()
+		slog.Warn("vote count would exceed MAX_OPTION_COUNT; clamped", "event", "vote_count_anomaly", "option", option, "count", count, "weight", weight, "max", maxOptionCount)
+	}
+}
+
+// addClamped で範囲の外になったか
+type countClamp int
+
+const (
+	notClamped    countClamp = iota
+	clampedToZero            // 0未満になるので0にした
+	clampedToMax             // maxOptionCount を超えるので上限にした
+)
+
+// カウンターに delta を足す。0 から maxOptionCount の範囲に収まらなければ端で止める
+func addClamped(c *atomic.Int64, delta int64) countClamp {
+	for {
+		old := c.Load()
+		next := old + delta
+		clamped := notClamped
+		switch {
+		case delta < 0 && (next < 0 || next > old):
+			next, clamped = 0, clampedToZero
+		case delta > 0 && (next > int64(maxOptionCount) || next < old): // int64 があふれたときも上限にする
+			next, clamped = int64(maxOptionCount), clampedToMax
+		}
+		if c.CompareAndSwap(old, next) {
+			return clamped
+		}
+	}
+}
+
+// 票数を手で増減できる保存先 (POST /admin/adjust)
+// ユーザーごとの投票は変えないので、票数と投票しているユーザーの数が合わなくなる
+// 呼び出し側で room.mutex の書き込みロックを取っておくこと
+type countAdjuster interface {
+	// 選択肢ごとに deltas を票数と重み付きの票数の両方に足す (0未満になる選択肢は0にする)
+	AdjustCounts(ctx context.Context, deltas map[string]int, at time.Time) error
+	// 最後に票数を手で直した時刻 (リセットの後に直していなければゼロ値)
+	countsAdjustedAt() time.Time
+}
+
+// 票数を手で直せない保存先
+var errCountsNotAdjustable = errors.New("vote store does not support count adjustments")
+
+// 票数を手で直す。countAdjuster でない保存先なら errCountsNotAdjustable
+func adjustStoreCounts(ctx context.Context, store VoteStore, deltas map[string]int, at time.Time) error {
+	s, ok := store.(countAdjuster)
+	if !ok {
+		return errCountsNotAdjustable
+	}
+	return s.AdjustCounts(ctx, deltas, at)
+}
+
+// 最後に票数を手で直した時刻 (直していないか、直せない保存先ならゼロ値)
+func storeCountsAdjustedAt(store VoteStore) time.Time {
+	if s, ok := store.(countAdjuster); ok {
+		return s.countsAdjustedAt()
+	}
+	return time.Time{}
+}
+
+// 0未満で止めるのは手で直すときには想定どおりなので、不整合としては数えない (MAX_OPTION_COUNT で止めたときは警告を残す)
+// 選択肢に無いものは数えない (呼び出し側で確かめておくこと)
+func (s *memoryStore) AdjustCounts(ctx context.Context, deltas map[string]int, at time.Time) error {
+	for option, delta := range deltas {
+		c, ok := s.voteCounts[option]
+		if !ok {
+			continue
+		}
+		if max(addClamped(c, int64(delta)), addClamped(s.weightedCounts[option], int64(delta))) == clampedToMax {
+			voteCountAnomalies.WithLabelValues("count_limit").Inc()
+			slog.Warn("adjusted vote count would exceed MAX_OPTION_COUNT; clamped", "event", "vote_count_anomaly", "option", option, "delta", delta, "max", maxOptionCount)
+		}
+	}
+	s.adjustedAt = at
+	return nil
+}
+
+func (s *memoryStore) countsAdjustedAt() time.Time {
+	return s.adjustedAt
+}
+
+// 選択肢の票数の入れ物を足す・取り除く保存先 (メモリ上に選択肢ごとの票数を持つもの)
+// 選択肢を実行中に変えたときに呼ぶ。呼び出し側で room.mutex の書き込みロックを取っておくこと
+type optionResizer interface {
+	addOption(key string)
+	removeOption(key string)
+}
+
+func (s *memoryStore) addOption(key string) {
+	if _, ok := s.voteCounts[key]; !ok {
+		s.voteCounts[key] = new(atomic.Int64)
+		s.weightedCounts[key] = new(atomic.Int64)
+	}
+}
+
+// 取り除く前に、その選択肢の投票を移すか取り消しておくこと
+func (s *memoryStore) removeOption(key string) {
+	delete(s.voteCounts, key)
+	delete(s.weightedCounts, key)
+}
+
+func (s *memoryStore) RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// ユーザーが以前に投票していたかチェック
+	previous, ok := shard.votes[userID]
+	if ok {
+		// 同じ選択肢への再投票では票数も時刻も変えない
+		if previous.Vote == vote {
+			return nil
+		}
+		// 以前の投票があった場合、その票を1つ減らし、そのときの重みを引く
+		// 取り除かれた選択肢への票はもう集計に無いので引かない
+		if _, counted := s.voteCounts[previous.Vote]; counted {
+			s.add(previous.Vote, -1, -previous.Weight)
+		}
+	}
+
+	// 新しい投票を記録
+	s.add(vote, 1, weight)
+	shard.votes[userID] = voteRecord{Vote: vote, Weight: weight, VotedAt: at}
+	if !ok {
+		s.voters.Add(1)
+	}
+	return nil
+}
+
+func (s *memoryStore) RecordAnonymousVote(ctx context.Context, vote string, weight int, at time.Time) error {
+	s.add(vote, 1, weight)
+	return nil
+}
+
+func (s *memoryStore) DeleteVote(ctx context.Context, userID string) error {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	previous, ok := shard.votes[userID]
+	if !ok {
+		return errVoteNotFound
+	}
+	s.add(previous.Vote, -1, -previous.Weight)
+	delete(shard.votes, userID)
+	s.voters.Add(-1)
+	return nil
+}
+
+func (s *memoryStore) Counts() map[string]int {
+	return loadCounts(s.voteCounts)
+}
+
+func (s *memoryStore) WeightedCounts() map[string]int {
+	return loadCounts(s.weightedCounts)
+}
+
+func loadCounts(counters map[string]*atomic.Int64) map[string]int {
+	counts := make(map[string]int, len(counters))
+	for option, c := range counters {
+		counts[option] = int(c.Load())
+	}
+	return counts
+}
+
+func (s *memoryStore) UserVote(userID string) (string, bool) {
+	record, ok := s.userRecord(userID)
+	return record.Vote, ok
+}
+
+// ユーザーの投票を重みや時刻も含めて返せる保存先 (VOTE_CHANGE_COOLDOWN で前の投票の時刻を見る)
+type userRecordReader interface {
+	userRecord(userID string) (voteRecord, bool)
+}
+
+// ユーザーの投票を重みや時刻も含めて返す。userRecordReader でない保存先は全員分を読んで探す
+func lookupUserRecord(store VoteStore, userID string) (voteRecord, bool) {
+	if s, ok := store.(userRecordReader); ok {
+		return s.userRecord(userID)
+	}
+	record, ok := store.UserVotes()[userID]
+	return record, ok
+}
+
+// 投票の変更のイベントを残している保存先 (GET /results/at で過去の票数を組み立て直す)
+type eventReader interface {
+	// until 以前のイベントを書き込んだ順に返す
+	voteEventsUntil(ctx context.Context, until time.Time) ([]VoteEvent, error)
+}
+
+// イベントを残していない保存先 (メモリ上、スナップショット、Redis)
+var errEventsNotRecorded = errors.New("vote store does not record vote events")
+
+// until 以前のイベントを読む。eventReader でない保存先なら errEventsNotRecorded
+func storeVoteEventsUntil(ctx context.Context, store VoteStore, until time.Time) ([]VoteEvent, error) {
+	s, ok := store.(eventReader)
+	if !ok {
+		return nil, errEventsNotRecorded
+	}
+	return s.voteEventsUntil(ctx, until)
+}
+
+// ユーザーの投票を重みや時刻も含めて返す
+func (s *memoryStore) userRecord(userID string) (voteRecord, bool) {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	record, ok := shard.votes[userID]
+	return record, ok
+}
+
+func (s *memoryStore) UserVotes() map[string]voteRecord {
+	votes := make(map[string]voteRecord, s.VoterCount())
+	for i := range s.users {
+		shard := &s.users[i]
+		shard.mu.Lock()
+		for userID, record := range shard.votes {
+			votes[userID] = record
+		}
+		shard.mu.Unlock()
+	}
+	return votes
+}
+
+func (s *memoryStore) VoterCount() int {
+	return int(s.voters.Load())
+}
+
+// 呼び出し側で room.mutex の書き込みロックを取っておくこと (投票の途中の票数を消さないように)
+func (s *memoryStore) Reset(ctx context.Context) error {
+	for i := range s.users {
+		shard := &s.users[i]
+		shard.mu.Lock()
+		shard.votes = make(map[string]voteRecord)
+		shard.mu.Unlock()
+	}
+	for option := range s.voteCounts {
+		s.voteCounts[option].Store(0)
+		s.weightedCounts[option].Store(0)
+	}
+	s.voters.Store(0)
+	s.adjustedAt = time.Time{}
+	return nil
+}
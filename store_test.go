@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// 多くの goroutine が同時に投票・変更・匿名投票をしても、票数を取りこぼさない
+// (票数を読み出すのも同時に行い、go test -race で競合も見る)
+func TestMemoryStoreConcurrentVotes(t *testing.T) {
+	options := []string{"hot", "ok", "cold"}
+	s := newMemoryStore(options)
+	ctx := context.Background()
+	const users, anonymous = 300, 300
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.Counts()
+				s.WeightedCounts()
+			}
+		}
+	}()
+	for i := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := fmt.Sprintf("u%d", i)
+			s.RecordVote(ctx, user, options[i%3], 2, time.Now())
+			// 3人に1人は別の選択肢に変える
+			if i%3 == 0 {
+				s.RecordVote(ctx, user, options[(i+1)%3], 2, time.Now())
+			}
+		}()
+	}
+	for i := range anonymous {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.RecordAnonymousVote(ctx, options[i%3], 1, time.Now())
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	want := map[string]int{}
+	wantWeighted := map[string]int{}
+	for _, v := range s.UserVotes() {
+		want[v.Vote]++
+		wantWeighted[v.Vote] += v.Weight
+	}
+	for i := range anonymous {
+		want[options[i%3]]++
+		wantWeighted[options[i%3]]++
+	}
+	// 0 番目の選択肢に投票した人はみな変えたので、hot は匿名の票だけ
+	if want["hot"] != anonymous/3 {
+		t.Fatalf("user votes: %v", want)
+	}
+	if got := s.Counts(); !sameCounts(got, want) {
+		t.Errorf("counts %v, want %v", got, want)
+	}
+	if got := s.WeightedCounts(); !sameCounts(got, wantWeighted) {
+		t.Errorf("weighted counts %v, want %v", got, wantWeighted)
+	}
+}
+
+// 違うユーザーの投票は部屋のロックで待たせずに保存先へ同時に書く
+// (保存先は2人目が来るまで1人目を待たせるので、順番に書いていれば期限切れで失敗する)
+func TestVotesRecordConcurrently(t *testing.T) {
+	srv := newTestServer(t)
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	defaultRoom.store = &rendezvousStore{memoryStore: defaultRoom.store.(*memoryStore), arrived: &arrived}
+
+	var wg sync.WaitGroup
+	for _, user := range []string{"u1", "u2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.vote(t, "/v1/vote", user, "hot", http.StatusOK)
+		}()
+	}
+	wg.Wait()
+	if got := resultCounts(srv.results(t, "/v1/results")); got["hot"] != 2 {
+		t.Errorf("counts %v, want hot=2", got)
+	}
+}
+
+// 2人が RecordVote に入るまで待ってから記録する保存先
+type rendezvousStore struct {
+	*memoryStore
+	arrived *sync.WaitGroup
+}
+
+func (s *rendezvousStore) RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error {
+	s.arrived.Done()
+	done := make(chan struct{})
+	go func() {
+		s.arrived.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		return errStoreUnavailable
+	}
+	return s.memoryStore.RecordVote(ctx, userID, vote, weight, at)
+}
+
+// 同じユーザーの投票を並べて送っても、違うユーザーと混ざっても、票数・人数・コホートがユーザーの投票と合う
+func TestConcurrentVotesThroughHandler(t *testing.T) {
+	srv := newTestServer(t)
+	options := []string{"hot", "ok", "cold"}
+	const users, changes = 30, 6
+
+	var wg sync.WaitGroup
+	for i := range users {
+		// 1人のユーザーに2つの goroutine から選択肢を変えながら投票させる
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range changes {
+					body := VoteRequest{UserID: fmt.Sprintf("u%d", i), Vote: options[(i+j)%3], Cohort: "c"}
+					if res, data := srv.do(t, http.MethodPost, "/v1/vote", body); res.StatusCode != http.StatusOK {
+						t.Errorf("status %d: %s", res.StatusCode, data)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	want := map[string]int{}
+	for _, record := range defaultRoom.store.UserVotes() {
+		want[record.Vote]++
+	}
+	res := srv.results(t, "/v1/results?groupBy=cohort")
+	if got := resultCounts(res); !sameCounts(got, want) || res.Total != users {
+		t.Errorf("counts %v total %d, want %v total %d", got, res.Total, want, users)
+	}
+	if n := defaultRoom.store.VoterCount(); n != users {
+		t.Errorf("voters %d, want %d", n, users)
+	}
+	if got := res.Cohorts["c"]; !sameCounts(got.Counts, want) || got.Total != users {
+		t.Errorf("cohort %+v, want %v total %d", got, want, users)
+	}
+}
+
+// 別々のユーザーが同時に投票するときの速さ
+// Handler は POST /v1/vote を部屋のロックも含めてそのまま通し、RecordVote は保存先だけを呼ぶ
+// (どちらも各 goroutine が自分のユーザーたちの投票を選択肢を変えながら繰り返す)
+func BenchmarkParallelVotes(b *testing.B) {
+	options := []string{"hot", "ok", "cold"}
+	const usersPerWorker = 100
+	b.Run("Handler", func(b *testing.B) {
+		srv := newTestServer(b)
+		handler := srv.Config.Handler
+		var workers atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			worker := workers.Add(1)
+			for i := 0; pb.Next(); i++ {
+				body := fmt.Sprintf(`{"userId":"w%d-u%d","vote":%q}`, worker, i%usersPerWorker, options[i%len(options)])
+				r := httptest.NewRequest(http.MethodPost, "/v1/vote", strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Errorf("status %d: %s", w.Code, w.Body)
+					return
+				}
+			}
+		})
+	})
+	// 書き込みに時間のかかる保存先 (SQLite や Redis の代わり)。ロックを持ったまま待つと投票がすべて待たされる
+	b.Run("SlowStore", func(b *testing.B) {
+		srv := newTestServer(b)
+		defaultRoom.store = slowStore{defaultRoom.store.(*memoryStore), 100 * time.Microsecond}
+		handler := srv.Config.Handler
+		var workers atomic.Int64
+		b.SetParallelism(8)
+		b.RunParallel(func(pb *testing.PB) {
+			worker := workers.Add(1)
+			for i := 0; pb.Next(); i++ {
+				body := fmt.Sprintf(`{"userId":"w%d-u%d","vote":%q}`, worker, i%usersPerWorker, options[i%len(options)])
+				r := httptest.NewRequest(http.MethodPost, "/v1/vote", strings.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Errorf("status %d: %s", w.Code, w.Body)
+					return
+				}
+			}
+		})
+	})
+	b.Run("RecordVote", func(b *testing.B) {
+		s := newMemoryStore(options)
+		ctx := context.Background()
+		var workers atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			worker := workers.Add(1)
+			for i := 0; pb.Next(); i++ {
+				s.RecordVote(ctx, fmt.Sprintf("w%d-u%d", worker, i%usersPerWorker), options[i%len(options)], 1, time.Time{})
+			}
+		})
+	})
+}
+
+// 書き込みのたびに delay だけ待つメモリ上の保存先
+type slowStore struct {
+	*memoryStore
+	delay time.Duration
+}
+
+func (s slowStore) RecordVote(ctx context.Context, userID, vote string, weight int, at time.Time) error {
+	time.Sleep(s.delay)
+	return s.memoryStore.RecordVote(ctx, userID, vote, weight, at)
+}
+
+// 外部でリセットされたり選択肢を取り除かれたりして票数とユーザーの投票がずれていても、
+// 投票の変更・取り消しで票数が0未満にならない (0で止めて不整合として数える)
+func TestInconsistentStateNeverNegative(t *testing.T) {
+	srv := newTestServer(t)
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u2", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u3", "ok", http.StatusOK)
+
+	// 票数だけが外部でリセットされた状態にする (ユーザーの投票は残る)
+	s := defaultRoom.store.(*memoryStore)
+	for _, c := range s.voteCounts {
+		c.Store(0)
+	}
+	for _, c := range s.weightedCounts {
+		c.Store(0)
+	}
+	before := testutil.ToFloat64(voteCountAnomalies.WithLabelValues("negative_count"))
+
+	if res := srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK); !sameCounts(res.Counts, map[string]int{"cold": 1}) {
+		t.Errorf("change after reset: counts %v, want cold=1", res.Counts)
+	}
+	if res, data := srv.do(t, http.MethodDelete, "/v1/vote?userId=u2", nil); res.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /vote: status %d: %s", res.StatusCode, data)
+	}
+	for option, count := range s.Counts() {
+		if count < 0 {
+			t.Errorf("%s count %d", option, count)
+		}
+	}
+	for option, count := range s.WeightedCounts() {
+		if count < 0 {
+			t.Errorf("%s weighted count %d", option, count)
+		}
+	}
+	if n := testutil.ToFloat64(voteCountAnomalies.WithLabelValues("negative_count")) - before; n != 2 {
+		t.Errorf("negative_count anomalies %v, want 2", n)
+	}
+
+	// 票数の入れ物が無い選択肢 (取り除かれた選択肢) への投票から変えても、他の選択肢は正しく数える
+	s.removeOption("ok")
+	if res := srv.vote(t, "/v1/vote", "u3", "cold", http.StatusOK); !sameCounts(res.Counts, map[string]int{"cold": 2}) {
+		t.Errorf("change from removed option: counts %v, want cold=2", res.Counts)
+	}
+	if _, ok := s.Counts()["ok"]; ok {
+		t.Error("removed option counted again")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 上限に達して断った接続に Retry-After で伝える、つなぎ直すまでの時間
+const streamRetryAfter = 5 * time.Second
+
+// 終了するときに、閉じることを知らせた配信の接続が自分で閉じるのを待つ時間の既定値
+const defaultStreamCloseGrace = time.Second
+
+// 閉じることを知らせてから接続を切るまでの時間 (STREAM_CLOSE_GRACE)
+var streamCloseGrace = defaultStreamCloseGrace
+
+// 同時に開いておける結果の配信の接続 (SSE, WebSocket, gRPC の WatchResults を合わせた数) の上限 (MAX_STREAMS)
+// 0 なら制限しない。開きっぱなしの接続でファイルディスクリプタを使い切らないよう、ulimit -n より小さくしておく
+var maxStreams int
+
+// 今開いている配信の接続の数
+var activeStreams atomic.Int64
+
+// 開いている配信の接続の数
+var openStreams = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "open_streams",
+	Help: "Number of open SSE, WebSocket and gRPC result streams.",
+}, func() float64 { return float64(activeStreams.Load()) })
+
+// MAX_STREAMS と STREAM_CLOSE_GRACE を読む
+func loadMaxStreams() error {
+	var err error
+	if maxStreams, err = envInt("MAX_STREAMS", 0); err != nil {
+		return err
+	}
+	if maxStreams < 0 {
+		return errors.New("MAX_STREAMS must not be negative")
+	}
+	if streamCloseGrace, err = envDuration("STREAM_CLOSE_GRACE", defaultStreamCloseGrace); err != nil {
+		return err
+	}
+	if streamCloseGrace < 0 {
+		return errors.New("STREAM_CLOSE_GRACE must not be negative")
+	}
+	return nil
+}
+
+// 配信の接続を1つ数える。上限に達していれば数えずに false を返す
+// true なら、接続が終わったときに (異常な切断でも) releaseStream を呼ぶこと
+func acquireStream() bool {
+	n := activeStreams.Add(1)
+	if maxStreams > 0 && n > int64(maxStreams) {
+		activeStreams.Add(-1)
+		return false
+	}
+	return true
+}
+
+func releaseStream() {
+	activeStreams.Add(-1)
+}
+
+// 配信の接続の数を MAX_STREAMS までに抑えるミドルウェア
+// 上限に達していれば、接続を受け付けずに 503 と Retry-After を返す
+// ハンドラーは接続が終わるまで戻らないので、戻ったとき (panic でも) に数を減らす
+func limitStreams(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isShuttingDown() {
+			setRetryAfter(w, streamRetryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Server is shutting down")
+			return
+		}
+		if !acquireStream() {
+			slog.WarnContext(r.Context(), "too many open streams", "event", "stream_limit", "limit", maxStreams, "path", r.URL.Path)
+			setRetryAfter(w, streamRetryAfter)
+			writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Too many open streams")
+			return
+		}
+		defer releaseStream()
+		next(w, r)
+	}
+}
+
+var beginShutdownOnce sync.Once
+
+// サーバーの終了を始める (shuttingDown を閉じる。何度呼んでもよい)
+func beginShutdown() {
+	beginShutdownOnce.Do(func() { close(shuttingDown) })
+}
+
+// サーバーの終了が始まっているか
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// 終了を始め、配信の接続 (SSE, WebSocket, gRPC) に閉じることを知らせて、すべて閉じ終わるまで待つ
+// 接続は streamCloseGrace のあいだクライアントが閉じるのを待ってから切るので、デプロイのたびにクライアントでエラーにならない
+// server.Shutdown は WebSocket に切り替えた接続を待たないので、Shutdown の前に呼ぶこと。ctx の期限が来たら待つのをやめる
+func closeStreams(ctx context.Context) {
+	beginShutdown()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for activeStreams.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			slog.Warn("streams still open at shutdown", "event", "stream_close", "open", activeStreams.Load())
+			return
+		}
+	}
+	slog.Info("streams closed", "event", "stream_close")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 開いている配信の接続が n になるまで待つ (切断はサーバー側で少し遅れて数えられる)
+func waitStreams(t *testing.T, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for activeStreams.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("open streams %d, want %d", activeStreams.Load(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// MAX_STREAMS を超える接続は SSE でも WebSocket でも 503 と Retry-After で断り、
+// 切断されたら (クライアントが黙って切っても) 数を減らしてまた受け付ける
+func TestMaxStreams(t *testing.T) {
+	srv := newTestServer(t, "MAX_STREAMS=2")
+	waitStreams(t, 0)
+
+	sse := openSSE(t, srv, "/v1/results/stream")
+	sse.next()
+	ws := dialWS(t, srv, "/v1/ws", nil)
+	readWS(t, ws)
+	waitStreams(t, 2)
+
+	checkRejected := func() {
+		t.Helper()
+		res, data := srv.do(t, http.MethodGet, "/v1/results/stream", nil)
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("SSE past the limit: status %d, want 503: %s", res.StatusCode, data)
+		}
+		if res.Header.Get("Retry-After") == "" {
+			t.Error("SSE past the limit: no Retry-After")
+		}
+		_, wsRes, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/ws", nil)
+		if err == nil {
+			t.Fatal("WebSocket past the limit: connected")
+		}
+		if wsRes == nil || wsRes.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("WebSocket past the limit: %v, want 503", err)
+		}
+	}
+	checkRejected()
+	// 断った接続は数に残らない
+	waitStreams(t, 2)
+
+	// クライアント側で切断する (SSE はリクエストの取り消し、WebSocket は close フレームを送らずに切る)
+	sse.close()
+	waitStreams(t, 1)
+	sse = openSSE(t, srv, "/v1/results/stream")
+	sse.next()
+	checkRejected()
+
+	ws.Close()
+	waitStreams(t, 1)
+	ws = dialWS(t, srv, "/v1/ws", nil)
+	readWS(t, ws)
+	waitStreams(t, 2)
+
+	sse.close()
+	ws.Close()
+	waitStreams(t, 0)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+// 基準にできる過去の分の数の上限
+const maxSurgeBaselineMinutes = 60
+
+// 票の急増の検知 (SURGE_MULTIPLIER で有効にする。ライブ中の大量投票に気づくため)
+// 選択肢ごとの直近1分間の票 (GET /results/velocity と同じ数) が、過去の数分間の1分あたりの平均の
+// surgeMultiplier 倍を超え、かつ surgeMinVotes 以上になったら警告をログに出す (SURGE_WEBHOOK なら通知も送る)
+// 急増が続くあいだは1回だけ知らせ、倍率を下回ったら終わったとログに出す
+var (
+	// 基準の何倍を急増とみなすか (0 なら検知しない)
+	surgeMultiplier float64
+	// 基準にする過去の分の数 (SURGE_BASELINE_MINUTES)
+	surgeBaselineMinutes int
+	// 急増とみなす1分あたりの最低の票 (SURGE_MIN_VOTES。票の少ない時間帯の 1票→3票 のようなものを無視する)
+	surgeMinVotes int
+	// 急増を WEBHOOK_URL にも通知するか (SURGE_WEBHOOK)
+	surgeWebhook bool
+)
+
+// SURGE_MULTIPLIER, SURGE_BASELINE_MINUTES, SURGE_MIN_VOTES, SURGE_WEBHOOK を読む
+func loadSurgeDetector() error {
+	var err error
+	if surgeMultiplier, err = envFloat("SURGE_MULTIPLIER", 0); err != nil {
+		return err
+	}
+	if surgeMultiplier != 0 && surgeMultiplier <= 1 {
+		return errors.New("SURGE_MULTIPLIER must be greater than 1 (or 0 to disable)")
+	}
+	if surgeBaselineMinutes, err = envInt("SURGE_BASELINE_MINUTES", 10); err != nil {
+		return err
+	}
+	if surgeBaselineMinutes < 1 || surgeBaselineMinutes > maxSurgeBaselineMinutes {
+		return errors.New("SURGE_BASELINE_MINUTES must be between 1 and 60")
+	}
+	if surgeMinVotes, err = envInt("SURGE_MIN_VOTES", 20); err != nil {
+		return err
+	}
+	if surgeMinVotes < 1 {
+		return errors.New("SURGE_MIN_VOTES must be positive")
+	}
+	if surgeWebhook, err = envBool("SURGE_WEBHOOK", false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 部屋ごとの急増の検知の状態。voteVelocity の1分間の票を1分ごとに記録して基準にする
+// 別の保存先は持たず、メモリは 基準の分の数 × 選択肢数 で頭打ちになる。部屋のロックで守る
+// 急増している選択肢の分は基準に入れず (それまでの基準で埋める)、大量投票が続いても基準が引き上げられないようにする
+type surgeDetector struct {
+	minutes [maxSurgeBaselineMinutes]map[string]int // 1分ごとの選択肢ごとの票
+	head    int                                     // 次に記録する位置
+	filled  int                                     // 記録した分の数
+	seconds int                                     // 最後に記録してからの秒数
+	alerts  map[string]surgeAlert                   // 急増している選択肢
+}
+
+// 急増している選択肢の状態
+type surgeAlert struct {
+	since time.Time
+	peak  int // 急増しているあいだの1分あたりの票の最大値
+}
+
+// 選択肢の過去の1分あたりの平均の票 (まだ1分も記録していなければ ok が false)
+func (d *surgeDetector) baseline(option string) (float64, bool) {
+	n := min(d.filled, surgeBaselineMinutes)
+	if n == 0 {
+		return 0, false
+	}
+	sum := 0
+	for i := 1; i <= n; i++ {
+		sum += d.minutes[(d.head-i+maxSurgeBaselineMinutes)%maxSurgeBaselineMinutes][option]
+	}
+	return float64(sum) / float64(n), true
+}
+
+// 急増とみなす1分あたりの票の数
+func surgeThreshold(baseline float64) int {
+	return max(surgeMinVotes, int(math.Floor(baseline*surgeMultiplier))+1)
+}
+
+// 1秒ごとに、直近1分間の票を基準と比べて急増を知らせる (勢いのバケットを進める前に呼ぶ。呼び出し側で書き込みロックを取っておくこと)
+// 60秒ごとに直近1分間の票を基準に記録する
+func (rm *room) checkSurge(now time.Time) {
+	if surgeMultiplier == 0 {
+		return
+	}
+	d := &rm.surge
+	options := rm.optionSet().keys
+	perMinute := rm.velocity.perMinute(options)
+
+	for _, option := range options {
+		baseline, ok := d.baseline(option)
+		if !ok {
+			continue
+		}
+		rate := perMinute[option]
+		alert, alerting := d.alerts[option]
+		threshold := surgeThreshold(baseline)
+		switch {
+		case rate >= threshold && !alerting:
+			if d.alerts == nil {
+				d.alerts = make(map[string]surgeAlert)
+			}
+			d.alerts[option] = surgeAlert{since: now, peak: rate}
+			slog.Warn("vote surge detected", "event", "vote_surge", "roomId", rm.id, "option", option, "votesPerMinute", rate, "baseline", baseline, "threshold", threshold)
+			if surgeWebhook && webhook != nil {
+				webhook.Send(context.Background(), WebhookPayload{
+					Event:     "vote_surge",
+					RoomID:    rm.id,
+					Option:    option,
+					Label:     rm.optionSet().label(option, defaultLabelLanguage),
+					Threshold: threshold,
+					Count:     rate,
+					Timestamp: now.UTC().Format(time.RFC3339),
+				})
+			}
+		case rate >= threshold:
+			alert.peak = max(alert.peak, rate)
+			d.alerts[option] = alert
+		case alerting:
+			delete(d.alerts, option)
+			slog.Info("vote surge ended", "event", "vote_surge", "roomId", rm.id, "option", option, "votesPerMinute", rate, "baseline", baseline, "peak", alert.peak, "duration", now.Sub(alert.since).Round(time.Second).String())
+		}
+	}
+	// 取り除かれた選択肢の急増は終わったことにする
+	for option := range d.alerts {
+		if _, ok := perMinute[option]; !ok {
+			delete(d.alerts, option)
+		}
+	}
+
+	d.seconds++
+	if d.seconds >= velocityBuckets {
+		d.seconds = 0
+		for option := range d.alerts {
+			if baseline, ok := d.baseline(option); ok {
+				perMinute[option] = int(math.Round(baseline))
+			}
+		}
+		d.minutes[d.head] = perMinute
+		d.head = (d.head + 1) % maxSurgeBaselineMinutes
+		d.filled = min(d.filled+1, maxSurgeBaselineMinutes)
+	}
+}
+
+// GET /admin/surge のレスポンスの選択肢ごとの状態
+type SurgeOptionStatus struct {
+	Option         string   `json:"option"`
+	VotesPerMinute int      `json:"votesPerMinute"`
+	Baseline       *float64 `json:"baseline"`  // 過去の1分あたりの平均 (まだ1分も記録していなければ null)
+	Threshold      *int     `json:"threshold"` // 急増とみなす1分あたりの票 (baseline が null なら null)
+	Alerting       bool     `json:"alerting"`
+	Since          string   `json:"since,omitempty"` // 急増が始まった時刻 (RFC3339)
+	Peak           int      `json:"peak,omitempty"`  // 急増しているあいだの1分あたりの最大
+}
+
+// GET /admin/surge のレスポンス形式
+type SurgeResponse struct {
+	Enabled         bool                `json:"enabled"`
+	Multiplier      float64             `json:"multiplier,omitempty"`
+	BaselineMinutes int                 `json:"baselineMinutes,omitempty"`
+	MinVotes        int                 `json:"minVotes,omitempty"`
+	RecordedMinutes int                 `json:"recordedMinutes"` // 基準に使っている分の数
+	Alerting        bool                `json:"alerting"`        // どれかの選択肢が急増している
+	Options         []SurgeOptionStatus `json:"options"`         // 選択肢の順
+}
+
+// GET /admin/surge?roomId= エンドポイントの処理 (急増の検知の今の状態を返す)
+func adminSurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rm := adminTargetRoom(w, r)
+	if rm == nil {
+		return
+	}
+
+	res := SurgeResponse{Enabled: surgeMultiplier > 0, Options: []SurgeOptionStatus{}}
+	if res.Enabled {
+		res.Multiplier = surgeMultiplier
+		res.BaselineMinutes = surgeBaselineMinutes
+		res.MinVotes = surgeMinVotes
+	}
+
+	rm.mutex.RLock()
+	d := &rm.surge
+	res.RecordedMinutes = min(d.filled, surgeBaselineMinutes)
+	options := rm.optionSet().keys
+	perMinute := rm.velocity.perMinute(options)
+	for _, option := range options {
+		status := SurgeOptionStatus{Option: option, VotesPerMinute: perMinute[option]}
+		if baseline, ok := d.baseline(option); ok && res.Enabled {
+			threshold := surgeThreshold(baseline)
+			status.Baseline = &baseline
+			status.Threshold = &threshold
+		}
+		if alert, ok := d.alerts[option]; ok {
+			status.Alerting = true
+			status.Since = alert.since.UTC().Format(time.RFC3339)
+			status.Peak = alert.peak
+			res.Alerting = true
+		}
+		res.Options = append(res.Options, status)
+	}
+	rm.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 1分ぶん (velocityBuckets 秒) 勢いのティッカーを進める。votes は最初の1秒に入れる
+func surgeMinute(rm *room, votes map[string]int) {
+	now := time.Now()
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	for s := range velocityBuckets {
+		if s == 0 {
+			for vote, n := range votes {
+				for range n {
+					rm.velocity.add(vote)
+				}
+			}
+		}
+		rm.checkSurge(now.Add(time.Duration(s) * time.Second))
+		rm.velocity.advance()
+	}
+}
+
+// 急増している選択肢 (と急増しているあいだの最大)
+func surgeAlerts(rm *room) map[string]int {
+	rm.mutex.RLock()
+	defer rm.mutex.RUnlock()
+	out := make(map[string]int)
+	for option, alert := range rm.surge.alerts {
+		out[option] = alert.peak
+	}
+	return out
+}
+
+func TestSurgeThreshold(t *testing.T) {
+	newTestServer(t, "SURGE_MULTIPLIER=3", "SURGE_MIN_VOTES=5")
+	for _, tt := range []struct {
+		baseline float64
+		want     int
+	}{
+		{0, 5},
+		{1, 5}, // 3票は SURGE_MIN_VOTES に届かない
+		{1.5, 5},
+		{2, 7}, // 基準の3倍ちょうどは急増とみなさない
+		{2.4, 8},
+		{10, 31},
+	} {
+		if got := surgeThreshold(tt.baseline); got != tt.want {
+			t.Errorf("surgeThreshold(%v) = %d, want %d", tt.baseline, got, tt.want)
+		}
+	}
+}
+
+// 普段の票の揺れでは知らせず、基準の倍率と SURGE_MIN_VOTES の両方を超えたら1回だけ知らせる
+// 急増しているあいだの分は基準に入れないので、続いても基準は上がらない
+func TestSurgeDetection(t *testing.T) {
+	newTestServer(t, "SURGE_MULTIPLIER=3", "SURGE_BASELINE_MINUTES=3", "SURGE_MIN_VOTES=5")
+	rm := defaultRoom
+
+	// 1分も記録していなければ基準がないので知らせない
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+	if got := surgeAlerts(rm); len(got) != 0 {
+		t.Fatalf("alerts during normal traffic %v", got)
+	}
+
+	// 基準は hot 2票 (閾値 7)、cold 1票 (倍率では 4 だが SURGE_MIN_VOTES の 5)
+	surgeMinute(rm, map[string]int{"hot": 6, "cold": 4})
+	if got := surgeAlerts(rm); len(got) != 0 {
+		t.Errorf("alerts below the threshold %v", got)
+	}
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+
+	surgeMinute(rm, map[string]int{"hot": 7, "cold": 1})
+	if got := surgeAlerts(rm); len(got) != 1 || got["hot"] != 7 {
+		t.Fatalf("alerts at the threshold %v, want hot", got)
+	}
+	rm.mutex.RLock()
+	since := rm.surge.alerts["hot"].since
+	rm.mutex.RUnlock()
+
+	for range 5 {
+		surgeMinute(rm, map[string]int{"hot": 9, "cold": 1})
+	}
+	rm.mutex.RLock()
+	alert := rm.surge.alerts["hot"]
+	baseline, _ := rm.surge.baseline("hot")
+	rm.mutex.RUnlock()
+	if alert.peak != 9 || !alert.since.Equal(since) {
+		t.Errorf("ongoing surge: peak %d since %v, want 9 since %v", alert.peak, alert.since, since)
+	}
+	if baseline != 2 {
+		t.Errorf("baseline during surge %v, want 2", baseline)
+	}
+
+	surgeMinute(rm, map[string]int{"hot": 2, "cold": 1})
+	if got := surgeAlerts(rm); len(got) != 0 {
+		t.Errorf("alerts after surge ended %v", got)
+	}
+}
+
+// 投票は直近1分間の票に入り、GET /admin/surge で急増の状態を返す
+func TestAdminSurge(t *testing.T) {
+	srv := newTestServer(t, "SURGE_MULTIPLIER=3", "SURGE_BASELINE_MINUTES=2", "SURGE_MIN_VOTES=5")
+	rm := defaultRoom
+	surgeMinute(rm, map[string]int{"hot": 2})
+	surgeMinute(rm, map[string]int{"hot": 2})
+
+	users := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, user := range users {
+		srv.vote(t, "/v1/vote", user, "hot", http.StatusOK)
+	}
+	rm.mutex.Lock()
+	rm.checkSurge(time.Now())
+	rm.mutex.Unlock()
+
+	var res SurgeResponse
+	response, data := srv.do(t, http.MethodGet, "/v1/admin/surge", nil, adminHeader)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin/surge: status %d: %s", response.StatusCode, data)
+	}
+	decodeJSON(t, data, &res)
+	if !res.Enabled || !res.Alerting || res.RecordedMinutes != 2 || res.Multiplier != 3 || res.MinVotes != 5 {
+		t.Errorf("surge %s", data)
+	}
+	for _, status := range res.Options {
+		switch status.Option {
+		case "hot":
+			if !status.Alerting || status.VotesPerMinute != len(users) || status.Peak != len(users) || status.Since == "" ||
+				status.Baseline == nil || *status.Baseline != 2 || status.Threshold == nil || *status.Threshold != 7 {
+				t.Errorf("hot %+v", status)
+			}
+		default:
+			if status.Alerting || status.VotesPerMinute != 0 || status.Threshold == nil || *status.Threshold != 5 {
+				t.Errorf("%s %+v", status.Option, status)
+			}
+		}
+	}
+
+	if res, data := srv.do(t, http.MethodGet, "/v1/admin/surge", nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without admin key: status %d: %s", res.StatusCode, data)
+	}
+}
+
+// SURGE_MULTIPLIER がなければ記録も検知もしない
+func TestSurgeDisabled(t *testing.T) {
+	srv := newTestServer(t)
+	rm := defaultRoom
+	surgeMinute(rm, map[string]int{"hot": 1})
+	surgeMinute(rm, map[string]int{"hot": 1000})
+
+	var res SurgeResponse
+	_, data := srv.do(t, http.MethodGet, "/v1/admin/surge", nil, adminHeader)
+	decodeJSON(t, data, &res)
+	if res.Enabled || res.Alerting || res.RecordedMinutes != 0 {
+		t.Errorf("disabled surge %s", data)
+	}
+	for _, status := range res.Options {
+		if status.Baseline != nil || status.Threshold != nil {
+			t.Errorf("%s %+v", status.Option, status)
+		}
+	}
+}
+
+func TestLoadSurgeDetectorInvalid(t *testing.T) {
+	for _, env := range []string{"SURGE_MULTIPLIER=1", "SURGE_MULTIPLIER=0.5", "SURGE_MULTIPLIER=-2", "SURGE_BASELINE_MINUTES=0", "SURGE_BASELINE_MINUTES=61", "SURGE_MIN_VOTES=0"} {
+		t.Run(env, func(t *testing.T) {
+			newTestServer(t)
+			key, value, _ := strings.Cut(env, "=")
+			t.Setenv(key, value)
+			if err := loadSurgeDetector(); err == nil {
+				t.Errorf("%s: no error", env)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 投票の流量を数える期間 (1秒ごとのバケットを15分ぶん持つ)
+const throughputBuckets = 15 * 60
+
+// GET /results/throughput で返す期間 (秒)
+var throughputWindows = []struct {
+	name    string
+	seconds int
+}{
+	{"1m", 60},
+	{"5m", 5 * 60},
+	{"15m", 15 * 60},
+}
+
+// 直近1分間に選ばれた票の数 (選択肢に関係なく全体)
+var votesPerMinute = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "votes_per_minute",
+	Help: "Votes chosen in the last minute, by room.",
+}, []string{"room"})
+
+// 直近1分間の票数のピーク (起動してから、または POST /admin/reset から)
+var votesPerMinutePeak = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "votes_per_minute_peak",
+	Help: "Highest number of votes chosen within one minute since startup or the last reset, by room.",
+}, []string{"room"})
+
+// 選ばれた票の総数を1秒ごとのバケットのリングで数え、直近1分間の票数のピークを覚えておく
+// voteVelocity と同じく投票ごとに add し、1秒ごとのティッカーで advance する。部屋のロックで守る
+// 読み出しではピークを変えないので、リセットされるのは POST /admin/reset のときだけ
+type voteThroughput struct {
+	buckets    [throughputBuckets]int
+	head       int       // 今の1秒の票を数えるバケット
+	total      int       // since からの票の総数
+	lastMinute int       // 直近60個のバケットの合計
+	peak       int       // lastMinute の最大値
+	peakAt     time.Time // peak になった時刻
+	since      time.Time // 数え始めた時刻
+}
+
+// 今のバケットに1票足し、ピークを更新する (呼び出し側で書き込みロックを取っておくこと)
+func (t *voteThroughput) add(now time.Time) {
+	t.buckets[t.head]++
+	t.total++
+	t.lastMinute++
+	if t.lastMinute > t.peak {
+		t.peak = t.lastMinute
+		t.peakAt = now
+	}
+}
+
+// 次のバケットに進み、15分前の票を捨てる (呼び出し側で書き込みロックを取っておくこと)
+func (t *voteThroughput) advance() {
+	t.head = (t.head + 1) % throughputBuckets
+	// 1分の窓から外れるバケット
+	t.lastMinute -= t.buckets[(t.head-60+throughputBuckets)%throughputBuckets]
+	t.buckets[t.head] = 0
+}
+
+// 直近 seconds 秒の票の数 (呼び出し側でロックを取っておくこと)
+func (t *voteThroughput) sum(seconds int) int {
+	n := 0
+	for i := range min(seconds, throughputBuckets) {
+		n += t.buckets[(t.head-i+throughputBuckets)%throughputBuckets]
+	}
+	return n
+}
+
+// すべて0に戻して now から数え直す (呼び出し側で書き込みロックを取っておくこと)
+func (t *voteThroughput) reset(now time.Time) {
+	*t = voteThroughput{since: now}
+}
+
+// 流量のゲージを今の値に合わせる (呼び出し側でロックを取っておくこと)
+func (rm *room) updateThroughputGauges() {
+	votesPerMinute.WithLabelValues(rm.id).Set(float64(rm.throughput.lastMinute))
+	votesPerMinutePeak.WithLabelValues(rm.id).Set(float64(rm.throughput.peak))
+}
+
+// GET /results/throughput のレスポンス形式
+type ThroughputResponse struct {
+	Windows       map[string]int `json:"windows"`          // 直近 1m, 5m, 15m に選ばれた票の数
+	Total         int            `json:"total"`            // since から選ばれた票の総数
+	PeakPerMinute int            `json:"peakPerMinute"`    // 1分間に選ばれた票の数の最大値
+	PeakAt        string         `json:"peakAt,omitempty"` // ピークになった時刻 (RFC3339, UTC。まだ票が無ければ省略)
+	Since         string         `json:"since"`            // 数え始めた時刻 (起動時か POST /admin/reset の時刻)
+}
+
+// GET /results/throughput エンドポイントの処理 (キャパシティの見積もり用)
+// 投票の変更も1票として数え、取り消しは数えない (GET /results/velocity と同じ)
+// 数えるのはメモリ上だけなので、再起動すると0から数え直す
+func (rm *room) throughputHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	rm.mutex.RLock()
+	t := &rm.throughput
+	res := ThroughputResponse{
+		Windows:       make(map[string]int, len(throughputWindows)),
+		Total:         t.total,
+		PeakPerMinute: t.peak,
+		Since:         t.since.UTC().Format(time.RFC3339),
+	}
+	for _, window := range throughputWindows {
+		res.Windows[window.name] = t.sum(window.seconds)
+	}
+	if !t.peakAt.IsZero() {
+		res.PeakAt = t.peakAt.UTC().Format(time.RFC3339)
+	}
+	rm.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
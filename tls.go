@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS_AUTOCERT_CACHE_DIR が未設定のときの、取得した証明書の保存先
+const defaultAutocertCacheDir = "autocert-cache"
+
+// HTTPSで待ち受けるための設定 (何も設定されていなければ nil で、これまでどおりHTTP)
+type tlsSettings struct {
+	// TLS_CERT_FILE / TLS_KEY_FILE で指定した証明書
+	certFile, keyFile string
+	// TLS_AUTOCERT_DOMAINS を指定したときの Let's Encrypt の証明書の管理
+	manager *autocert.Manager
+	// HTTP-01 チャレンジ用のHTTPサーバー (TLS_AUTOCERT_HTTP_ADDR を指定したときだけ)
+	challengeAddr string
+}
+
+// TLS_CERT_FILE / TLS_KEY_FILE か TLS_AUTOCERT_DOMAINS を読む
+// autocert は TLS-ALPN-01 で検証するので、待ち受けは443番 (PORT=443) にする
+func loadTLSSettings() (*tlsSettings, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	domains := envList("TLS_AUTOCERT_DOMAINS", nil)
+
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	case certFile != "" && len(domains) > 0:
+		return nil, errors.New("TLS_CERT_FILE and TLS_AUTOCERT_DOMAINS cannot both be set")
+	case certFile != "":
+		return &tlsSettings{certFile: certFile, keyFile: keyFile}, nil
+	case len(domains) > 0:
+		cacheDir := os.Getenv("TLS_AUTOCERT_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = defaultAutocertCacheDir
+		}
+		return &tlsSettings{
+			manager: &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(domains...),
+				Cache:      autocert.DirCache(cacheDir),
+				Email:      os.Getenv("TLS_AUTOCERT_EMAIL"),
+			},
+			challengeAddr: os.Getenv("TLS_AUTOCERT_HTTP_ADDR"),
+		}, nil
+	}
+	return nil, nil
+}
+
+// サーバーを起動し、Shutdown されるまで待つ。tls が nil ならHTTPで待ち受ける
+// 返すエラーは http.ErrServerClosed 以外の起動時のエラー
+func serve(server *http.Server, tls *tlsSettings) error {
+	var err error
+	switch {
+	case tls == nil:
+		slog.Info("server starting", "addr", server.Addr)
+		err = server.ListenAndServe()
+	case tls.manager != nil:
+		server.TLSConfig = tls.manager.TLSConfig()
+		if tls.challengeAddr != "" {
+			startChallengeServer(tls.challengeAddr, tls.manager)
+		}
+		slog.Info("server starting", "addr", server.Addr, "tls", "autocert")
+		err = server.ListenAndServeTLS("", "")
+	default:
+		slog.Info("server starting", "addr", server.Addr, "tls", "file", "certFile", tls.certFile)
+		err = server.ListenAndServeTLS(tls.certFile, tls.keyFile)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// HTTP-01 チャレンジに答え、それ以外はHTTPSへリダイレクトするサーバー
+// メインのサーバーの終了が始まると一緒に止める
+func startChallengeServer(addr string, manager *autocert.Manager) {
+	challenge := &http.Server{
+		Addr:              addr,
+		Handler:           manager.HTTPHandler(nil),
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+	go func() {
+		if err := challenge.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("could not start acme challenge server", "addr", addr, "error", err)
+		}
+	}()
+	go func() {
+		<-shuttingDown
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		challenge.Shutdown(ctx)
+	}()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OTEL_SERVICE_NAME が未設定のときのサービス名
+const defaultTraceServiceName = "mille-feuille-app"
+
+// スパンを作るトレーサー
+// トレースを設定していなければ otel の既定 (何もしない) のままなので、スパンを作っても記録されない
+var tracer = otel.Tracer("mille-feuille-app")
+
+// トレースを送っているか (OTEL_EXPORTER_OTLP_ENDPOINT か OTEL_EXPORTER_OTLP_TRACES_ENDPOINT で有効にする)
+var tracingEnabled bool
+
+// OTLP (HTTP) でトレースを送る設定をする。エンドポイントが未設定なら何もしない
+// 送り先やヘッダーなどは OTEL_EXPORTER_OTLP_* の標準の環境変数で指定する
+// 返した関数は終了時に呼び、送り待ちのスパンを送り切る
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return noop, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return noop, err
+	}
+	name := os.Getenv("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = defaultTraceServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(name),
+		semconv.ServiceVersion(buildCommit),
+	))
+	if err != nil {
+		return noop, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// トレースが有効ならハンドラーを otelhttp で包む (呼び出し元の traceparent を引き継ぐ)
+// スパン名はルートが決まった後に instrument で付け直す
+func traceRequests(next http.Handler) http.Handler {
+	if !tracingEnabled {
+		return next
+	}
+	return otelhttp.NewHandler(next, "http.request")
+}
+
+// 外に出す HTTP リクエストに traceparent を付ける Transport (トレースが無効なら base のまま)
+func traceTransport(base http.RoundTripper) http.RoundTripper {
+	if !tracingEnabled {
+		return base
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// 子スパンを始める
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// スパンを終える。失敗していればエラーとして記録する
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// 投票のスパンに付ける属性
+func voteSpanAttributes(rm *room, vote, status string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("room.id", rm.id),
+		attribute.String("vote.option", vote),
+		attribute.String("vote.status", status),
+		attribute.Bool("vote.change", status == voteStatusChanged),
+	}
+}
+
+// 保存先への投票の書き込みを子スパンで囲む (呼び出し側でロックを取っておくこと)
+func (rm *room) recordVote(ctx context.Context, userID, vote string, weight int, status string) error {
+	ctx, span := startSpan(ctx, "store.RecordVote", voteSpanAttributes(rm, vote, status)...)
+	err := rm.store.RecordVote(ctx, userID, vote, weight, time.Now())
+	endSpan(span, err)
+	return err
+}
+
+func (rm *room) recordAnonymousVote(ctx context.Context, vote string, weight int) error {
+	ctx, span := startSpan(ctx, "store.RecordAnonymousVote", voteSpanAttributes(rm, vote, voteStatusNew)...)
+	err := rm.store.RecordAnonymousVote(ctx, vote, weight, time.Now())
+	endSpan(span, err)
+	return err
+}
+
+func (rm *room) deleteVote(ctx context.Context, userID, previousVote string) error {
+	ctx, span := startSpan(ctx, "store.DeleteVote", attribute.String("room.id", rm.id), attribute.String("vote.option", previousVote))
+	err := rm.store.DeleteVote(ctx, userID)
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// 1人のユーザーにつき1つの部屋で覚えておく投票の変化の数 (古いものから捨てる)
+const maxUserHistory = 50
+
+// ユーザーの投票の変化 (GET /users/{userId}/history)
+const (
+	transitionNew        = voteStatusNew     // 初めての投票
+	transitionChanged    = voteStatusChanged // 別の選択肢に変えた
+	transitionRetracted  = "retracted"       // 取り消した
+	transitionReassigned = "reassigned"      // 選択肢が取り除かれて別の選択肢に移された
+	transitionRemoved    = "removed"         // 選択肢が取り除かれて投票が消された
+)
+
+// 投票の変化の1件
+type voteTransition struct {
+	Action string
+	From   string
+	To     string
+	At     time.Time
+}
+
+// ユーザーの投票の変化を覚える (呼び出し側で書き込みロックを取っておくこと)
+// 監査ログと違ってユーザーごとに引けるよう、部屋ごと・ユーザーごとにメモリ上に持つ (再起動すると消える)
+func (rm *room) recordTransition(userID, action, from, to string, at time.Time) {
+	if userID == "" {
+		return
+	}
+	if rm.transitions == nil {
+		rm.transitions = make(map[string][]voteTransition)
+	}
+	list := append(rm.transitions[userID], voteTransition{Action: action, From: from, To: to, At: at})
+	if len(list) > maxUserHistory {
+		list = slices.Clone(list[len(list)-maxUserHistory:])
+	}
+	rm.transitions[userID] = list
+}
+
+// 部屋で別々に覚えている変化をひとまとめにした形式
+type UserHistoryEntry struct {
+	RoomID string `json:"roomId,omitempty"` // 既定の投票なら省略
+	Action string `json:"action"`           // transitionNew などのいずれか
+	From   string `json:"from,omitempty"`   // 前の投票 (初めての投票なら省略)
+	To     string `json:"to,omitempty"`     // 新しい投票 (取り消しなら省略)
+	At     string `json:"at"`               // RFC3339, UTC
+}
+
+// GET /users/{userId}/history のレスポンス形式
+type UserHistoryResponse struct {
+	UserID  string             `json:"userId"`
+	History []UserHistoryEntry `json:"history"` // 古い順 (部屋をまたいで時刻順)
+}
+
+// GET /users/{userId}/history エンドポイントの処理
+// ユーザーが投票をどう変えてきたかを返す。管理用キーか、本人のトークンで呼べる
+// 部屋ごとに新しい maxUserHistory 件だけを持つ。DELETE /users/{userId} とリセットで消える
+func userHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	userID := r.PathValue("userId")
+	if !checkUserIDParameter(w, userID) {
+		return
+	}
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	type item struct {
+		entry UserHistoryEntry
+		at    time.Time
+	}
+	var items []item
+	for _, rm := range allRooms() {
+		rm.mutex.RLock()
+		for _, t := range rm.transitions[userID] {
+			items = append(items, item{UserHistoryEntry{RoomID: rm.id, Action: t.Action, From: t.From, To: t.To, At: t.At.UTC().Format(time.RFC3339)}, t.At})
+		}
+		rm.mutex.RUnlock()
+	}
+	if len(items) == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "User not found")
+		return
+	}
+	slices.SortStableFunc(items, func(a, b item) int { return cmp.Compare(a.at.UnixNano(), b.at.UnixNano()) })
+
+	res := UserHistoryResponse{UserID: userID, History: make([]UserHistoryEntry, 0, len(items))}
+	for _, it := range items {
+		res.History = append(res.History, it.entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MAX_USER_ID_LENGTH が未設定のときの、ユーザーIDの長さの上限 (文字数。Firebase の UID は128文字まで)
+const defaultMaxUserIDLength = 128
+
+// ユーザーIDの長さの上限 (文字数)
+// ユーザーIDはマップのキーやログ、保存先のキーになるので、大きすぎる値や壊れた値は受け付けない
+var maxUserIDLength = defaultMaxUserIDLength
+
+// MAX_USER_ID_LENGTH を読む
+func loadMaxUserIDLength() error {
+	var err error
+	if maxUserIDLength, err = envInt("MAX_USER_ID_LENGTH", defaultMaxUserIDLength); err != nil {
+		return err
+	}
+	if maxUserIDLength < 1 {
+		return errors.New("MAX_USER_ID_LENGTH must be positive")
+	}
+	return nil
+}
+
+// ユーザーIDとして受け付けられるか確かめ、だめなら理由を返す
+// 空、UTF-8 として壊れている、改行や NUL などの制御文字を含む、長すぎる (maxUserIDLength 文字を超える) ものは受け付けない
+// (JSON のボディの壊れた UTF-8 はデコードで U+FFFD になるので、UTF-8 の確認が効くのはパスとクエリの値)
+func validateUserID(userID string) (reason string, ok bool) {
+	switch {
+	case userID == "":
+		return "userId is required", false
+	case len(userID) > maxUserIDLength*utf8.UTFMax, utf8.RuneCountInString(userID) > maxUserIDLength:
+		return fmt.Sprintf("userId must be at most %d characters", maxUserIDLength), false
+	case !utf8.ValidString(userID):
+		return "userId must be valid UTF-8", false
+	case strings.IndexFunc(userID, unicode.IsControl) >= 0:
+		return "userId must not contain control characters", false
+	}
+	return "", true
+}
+
+// ボディやクエリのユーザーIDを確かめ、だめなら 400 を書いて false を返す
+func checkUserID(w http.ResponseWriter, userID string) bool {
+	if reason, ok := validateUserID(userID); !ok {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, reason)
+		return false
+	}
+	return true
+}
+
+// パスの {userId} を確かめ、だめなら 400 を書いて false を返す
+func checkUserIDParameter(w http.ResponseWriter, userID string) bool {
+	if reason, ok := validateUserID(userID); !ok {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParameter, reason)
+		return false
+	}
+	return true
+}
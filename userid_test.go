@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateUserID(t *testing.T) {
+	tests := []struct {
+		name   string
+		userID string
+		ok     bool
+	}{
+		{"ascii", "user-1", true},
+		{"japanese", "ゆーざー", true},
+		{"max length", strings.Repeat("あ", defaultMaxUserIDLength), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", defaultMaxUserIDLength+1), false},
+		{"too long multibyte", strings.Repeat("あ", defaultMaxUserIDLength+1), false},
+		{"multi-megabyte", strings.Repeat("a", 4<<20), false},
+		{"newline", "u1\nlevel=ERROR msg=forged", false},
+		{"carriage return", "u1\r", false},
+		{"nul", "u1\x00", false},
+		{"escape", "u1\x1b[31m", false},
+		{"invalid utf-8", "u1\xff\xfe", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason, ok := validateUserID(tt.userID); ok != tt.ok {
+				t.Errorf("validateUserID = %v (%s), want %v", ok, reason, tt.ok)
+			}
+		})
+	}
+}
+
+// おかしなユーザーIDの投票は 400 にして、票も数えない
+func TestPathologicalUserIDs(t *testing.T) {
+	srv := newTestServer(t, "MAX_USER_ID_LENGTH=16")
+
+	for _, userID := range []string{"u1\nforged", "u1\x00", strings.Repeat("a", 17)} {
+		res, data := srv.do(t, http.MethodPost, "/v1/vote", VoteRequest{UserID: userID, Vote: "hot"})
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("userId %q: status %d, want 400: %s", userID, res.StatusCode, data)
+		}
+	}
+	// ボディの上限を超える大きさのユーザーIDは読む前に断る
+	res, data := srv.do(t, http.MethodPost, "/v1/vote", `{"userId":"`+strings.Repeat("a", 4<<20)+`","vote":"hot"}`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("multi-megabyte userId: status %d, want 400", res.StatusCode)
+	} else if code := errorCode(t, data); code != errCodeInvalidBody {
+		t.Errorf("multi-megabyte userId: code %q, want %q", code, errCodeInvalidBody)
+	}
+	// パスとクエリの値は壊れた UTF-8 のまま届く
+	for _, path := range []string{"/v1/vote/u1%0A", "/v1/vote/u1%FF", "/v1/vote/u1%00"} {
+		if res, data := srv.do(t, http.MethodGet, path, nil); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400: %s", path, res.StatusCode, data)
+		}
+	}
+	if res, data := srv.do(t, http.MethodDelete, "/v1/vote?userId=u1%0D%0A", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("DELETE with CRLF userId: status %d, want 400: %s", res.StatusCode, data)
+	}
+
+	if got := resultCounts(srv.results(t, "/v1/results")); !sameCounts(got, nil) {
+		t.Errorf("counts %v, want none", got)
+	}
+}
+
+// ログに出すときは制御文字を置き換えて1行に収める
+func TestSanitizeLogValue(t *testing.T) {
+	for in, want := range map[string]string{
+		"u1":              "u1",
+		"u1\nlevel=ERROR": "u1?level=ERROR",
+		"u1\r\n":          "u1??",
+		"u1\x00\x1b":      "u1??",
+		"ゆーざー\t":          "ゆーざー?",
+	} {
+		if got := sanitizeLogValue(in); got != want {
+			t.Errorf("sanitizeLogValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// ユーザーの記録を過去の投票の履歴ごと消せる保存先 (DELETE /users/{userId})
+// 実装していない保存先は現在の投票を取り消すだけ
+type userEraser interface {
+	// 記録が何も無ければ errVoteNotFound
+	EraseUser(ctx context.Context, userID string) error
+}
+
+func eraseUserVotes(ctx context.Context, store VoteStore, userID string) error {
+	if e, ok := store.(userEraser); ok {
+		return e.EraseUser(ctx, userID)
+	}
+	return store.DeleteVote(ctx, userID)
+}
+
+// 管理用キーか本人のトークンのリクエストか。違えば 401 か 403 を書いて false を返す
+// (認証が無効なときはトークンが無いので、誰でも通る)
+func authorizeUser(w http.ResponseWriter, r *http.Request, userID string) bool {
+	if isAdmin(r) {
+		return true
+	}
+	uid, err := authenticate(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "authentication failed", "event", "auth", "error", err)
+		writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized")
+		return false
+	}
+	if uid != "" && uid != userID {
+		writeJSONError(w, http.StatusForbidden, errCodeForbidden, "Forbidden")
+		return false
+	}
+	return true
+}
+
+// DELETE /users/{userId} のレスポンス形式
+type DeleteUserResponse struct {
+	UserID string   `json:"userId"`
+	Rooms  []string `json:"rooms"` // 記録を消した部屋 (既定の投票は空文字)
+}
+
+// DELETE /users/{userId} エンドポイントの処理 (本人からの削除依頼に応じてデータを消す)
+// 管理用キーか、本人のトークンで呼べる
+// 投票の取り消しとは別の操作なので、受付期間や ALLOW_VOTE_CHANGE に関係なく消し、監査ログにも別の action で残す
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	// 上限を変える前に記録された長いユーザーIDも消せるよう、validateUserID では確かめない
+	userID := r.PathValue("userId")
+	if !authorizeUser(w, r, userID) {
+		return
+	}
+
+	all := allRooms()
+
+	res := DeleteUserResponse{UserID: userID, Rooms: []string{}}
+	for _, rm := range all {
+		erased, err := rm.eraseUser(r, userID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to erase user data", "event", "erase", "roomId", rm.id, "userId", logUserID(userID), "error", err)
+			writeStoreError(w, err, "Failed to delete user data")
+			return
+		}
+		if erased {
+			res.Rooms = append(res.Rooms, rm.id)
+		}
+	}
+	if len(res.Rooms) == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "User not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// 部屋からユーザーの記録を消す。記録が無ければ false
+func (rm *room) eraseUser(r *http.Request, userID string) (bool, error) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	previousVote, _ := rm.store.UserVote(userID)
+	rm.dropPendingVote(userID)
+	closeViewers.remove(rm.id, userID)
+
+	ctx, cancel := storeContext(r)
+	defer cancel()
+	err := eraseUserVotes(ctx, rm.store, userID)
+	if multiSelectVoting {
+		selected, selErr := rm.eraseSelections(r, userID)
+		switch {
+		case selErr != nil:
+			err = selErr
+		case selected:
+			err = nil
+		}
+	}
+	if err == nil || errors.Is(err, errVoteNotFound) {
+		delete(rm.comments, userID)
+		delete(rm.transitions, userID)
+		rm.untallyCohort(userID, previousVote)
+		rm.dropReceipt(userID)
+	}
+	if errors.Is(err, errVoteNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rm.notifySubscribers()
+
+	// 削除の印。元のユーザーIDは残さず、以前の行と突き合わせられるようハッシュにする
+	recordAudit(AuditEntry{
+		Action:    "erase",
+		RoomID:    rm.id,
+		UserID:    hashUserID(userID),
+		OldVote:   previousVote,
+		RemoteIP:  remoteIP(r),
+		RequestID: requestIDFromContext(r.Context()),
+	})
+
+	rm.updateVoteGauges(rm.store.Counts())
+	slog.WarnContext(r.Context(), "user data erased", "event", "erase", "roomId", rm.id, "userId", logUserID(userID))
+	return true, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// リクエストの1つのフィールドの問題
+type FieldError struct {
+	Field   string `json:"field"`   // JSON のフィールド名 (userId, vote など)
+	Code    string `json:"code"`    // errCodeInvalidBody などのいずれか
+	Message string `json:"message"` // 理由
+}
+
+// 投票リクエストの内容を確かめ、問題のあるフィールドをすべて返す (問題が無ければ nil)
+// 表示名で送られた投票は選択肢のキーに置き換え、コメントとコホートも保存する形に揃える
+// POST /vote、POST /vote/batch、POST /vote/validate で同じものを使う (set はその部屋の選択肢)
+func validateVoteRequest(set *optionSet, req *VoteRequest) []FieldError {
+	var errs []FieldError
+	invalid := func(field, code, message string) {
+		errs = append(errs, FieldError{Field: field, Code: code, Message: message})
+	}
+
+	// 空のユーザーIDで userVotes に "" のキーができないようにする (匿名投票モードではユーザーIDを使わない)
+	if anonymousVoting {
+		req.UserID = ""
+	} else if reason, ok := validateUserID(req.UserID); !ok {
+		invalid("userId", errCodeInvalidBody, reason)
+	}
+	if normalizeVote(req.Vote) == "" {
+		invalid("vote", errCodeInvalidBody, "vote is required")
+	} else if key, ok := resolveVoteLogged(set, req.Vote); ok {
+		req.Vote = key
+	} else {
+		invalid("vote", errCodeInvalidOption, "Invalid vote option")
+	}
+	if comment, err := sanitizeComment(req.Comment); err != nil {
+		invalid("comment", errCodeInvalidBody, err.Error())
+	} else {
+		req.Comment = comment
+	}
+	if cohort, ok := normalizeCohort(req.Cohort); ok {
+		req.Cohort = cohort
+	} else {
+		invalid("cohort", errCodeInvalidBody, "Invalid cohort")
+	}
+	return errs
+}
+
+// フィールドの問題をまとめたエラー。code は最初の問題のもの、message はすべての理由をつなげたもの
+// (問題が1つなら、フィールドごとに分ける前と同じ code と message になる)
+func fieldErrorDetail(errs []FieldError) ErrorDetail {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Message
+	}
+	return ErrorDetail{Code: errs[0].Code, Message: strings.Join(messages, "; "), Fields: errs}
+}
+
+// フィールドの問題をすべて並べた 400 を書く
+func writeFieldErrors(w http.ResponseWriter, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: fieldErrorDetail(errs)})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 問題のあるフィールドの名前と code
+func fieldCodes(errs []FieldError) []string {
+	codes := make([]string, len(errs))
+	for i, e := range errs {
+		codes[i] = e.Field + ":" + e.Code
+	}
+	return codes
+}
+
+func TestValidateVoteRequest(t *testing.T) {
+	newTestServer(t)
+	set := currentOptions.Load()
+	tests := []struct {
+		name string
+		req  VoteRequest
+		want []string // 問題のあるフィールドと code (順番どおり)
+	}{
+		{name: "valid", req: VoteRequest{UserID: "u1", Vote: "hot"}},
+		{name: "valid with label, comment and cohort", req: VoteRequest{UserID: "u1", Vote: "さむい", Comment: "寒すぎる", Cohort: "3F"}},
+		{name: "missing user", req: VoteRequest{Vote: "hot"}, want: []string{"userId:" + errCodeInvalidBody}},
+		{name: "user with newline", req: VoteRequest{UserID: "u1\n", Vote: "hot"}, want: []string{"userId:" + errCodeInvalidBody}},
+		{name: "missing vote", req: VoteRequest{UserID: "u1", Vote: "  "}, want: []string{"vote:" + errCodeInvalidBody}},
+		{name: "unknown option", req: VoteRequest{UserID: "u1", Vote: "warm"}, want: []string{"vote:" + errCodeInvalidOption}},
+		{name: "comment too long", req: VoteRequest{UserID: "u1", Vote: "hot", Comment: strings.Repeat("あ", maxCommentLength+1)}, want: []string{"comment:" + errCodeInvalidBody}},
+		{name: "comment at the limit", req: VoteRequest{UserID: "u1", Vote: "hot", Comment: strings.Repeat("あ", maxCommentLength)}},
+		{name: "cohort too long", req: VoteRequest{UserID: "u1", Vote: "hot", Cohort: strings.Repeat("c", maxCohortLength+1)}, want: []string{"cohort:" + errCodeInvalidBody}},
+		{
+			name: "everything invalid",
+			req:  VoteRequest{Vote: "warm", Comment: strings.Repeat("x", maxCommentLength+1), Cohort: strings.Repeat("c", maxCohortLength+1)},
+			want: []string{"userId:" + errCodeInvalidBody, "vote:" + errCodeInvalidOption, "comment:" + errCodeInvalidBody, "cohort:" + errCodeInvalidBody},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			if got := fieldCodes(validateVoteRequest(set, &req)); !slices.Equal(got, tt.want) {
+				t.Errorf("fields %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 確かめた後のリクエストは保存する形になっている
+func TestValidateVoteRequestNormalizes(t *testing.T) {
+	newTestServer(t)
+	req := VoteRequest{UserID: "u1", Vote: " あつい ", Comment: "  一行目\n二行目\u200b  "} // 改行は空白に、書式文字 (ゼロ幅スペース) は取り除く
+	if errs := validateVoteRequest(currentOptions.Load(), &req); errs != nil {
+		t.Fatalf("errors %v", errs)
+	}
+	if req.Vote != "hot" {
+		t.Errorf("vote %q, want hot", req.Vote)
+	}
+	if req.Comment != "一行目 二行目" {
+		t.Errorf("comment %q", req.Comment)
+	}
+}
+
+// POST /vote と POST /vote/validate は、問題のあるフィールドをまとめて 400 で返す
+func TestVoteFieldErrors(t *testing.T) {
+	srv := newTestServer(t)
+	req := VoteRequest{Vote: "warm", Comment: strings.Repeat("x", maxCommentLength+1)}
+	want := []string{"userId:" + errCodeInvalidBody, "vote:" + errCodeInvalidOption, "comment:" + errCodeInvalidBody}
+
+	res, data := srv.do(t, http.MethodPost, "/v1/vote", req)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("POST /vote: status %d, want 400: %s", res.StatusCode, data)
+	}
+	var body ErrorResponse
+	decodeJSON(t, data, &body)
+	if got := fieldCodes(body.Error.Fields); !slices.Equal(got, want) {
+		t.Errorf("POST /vote fields %v, want %v", got, want)
+	}
+	// 最初の問題の code をエラー全体の code にする
+	if body.Error.Code != errCodeInvalidBody {
+		t.Errorf("POST /vote code %q, want %q", body.Error.Code, errCodeInvalidBody)
+	}
+
+	res, data = srv.do(t, http.MethodPost, "/v1/vote/validate", req)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("POST /vote/validate: status %d, want 400: %s", res.StatusCode, data)
+	}
+	var validate ValidateVoteResponse
+	decodeJSON(t, data, &validate)
+	if validate.Valid || !slices.Equal(fieldCodes(validate.Fields), want) {
+		t.Errorf("POST /vote/validate: %s", data)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 結果を有効とみなす条件 (GET /results/validity)。投票の受付は止めず、結果を信頼してよいかを知らせるだけ
+// 選択肢ごとの最低票数をすべての選択肢が満たすか、票数の合計が quorumTotal 以上なら有効
+// どちらも設定していなければ常に有効
+var (
+	// すべての選択肢に求める最低の票数 (QUORUM_OPTION_MIN。0 なら求めない)
+	quorumOptionMin int
+	// 選択肢ごとの最低の票数 (QUORUM_OPTION_MINS。quorumOptionMin より優先する)
+	quorumOptionMins map[string]int
+	// 票数の合計の定足数 (QUORUM_TOTAL。0 なら使わない)
+	quorumTotal int
+)
+
+// QUORUM_OPTION_MIN, QUORUM_OPTION_MINS ("選択肢=票数" のカンマ区切り。例: さむい=10,あつい=5), QUORUM_TOTAL を読む
+// 選択肢は表示名でもよい。選択肢を読み込んだ後に呼ぶこと
+func loadQuorum() error {
+	var err error
+	if quorumOptionMin, err = envInt("QUORUM_OPTION_MIN", 0); err != nil {
+		return err
+	}
+	if quorumOptionMin < 0 {
+		return errors.New("QUORUM_OPTION_MIN must not be negative")
+	}
+	if quorumTotal, err = envInt("QUORUM_TOTAL", 0); err != nil {
+		return err
+	}
+	if quorumTotal < 0 {
+		return errors.New("QUORUM_TOTAL must not be negative")
+	}
+	quorumOptionMins = make(map[string]int)
+	for _, item := range envList("QUORUM_OPTION_MINS", nil) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid QUORUM_OPTION_MINS entry %q: want option=votes", item)
+		}
+		key, ok := canonicalOption(name)
+		if !ok {
+			return fmt.Errorf("invalid QUORUM_OPTION_MINS entry %q: unknown vote option", item)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid QUORUM_OPTION_MINS votes for %q: must be a non-negative integer", key)
+		}
+		quorumOptionMins[key] = n
+	}
+	return nil
+}
+
+// 選択肢に求める最低の票数 (求めなければ0)
+func optionMinimum(option string) int {
+	if n, ok := quorumOptionMins[option]; ok {
+		return n
+	}
+	return quorumOptionMin
+}
+
+// 最低の票数に届いていない選択肢
+type OptionShortfall struct {
+	Option   string `json:"option"`
+	Count    int    `json:"count"`
+	Required int    `json:"required"`
+	Missing  int    `json:"missing"` // あと何票で届くか
+}
+
+// GET /results/validity のレスポンス形式
+type ValidityResponse struct {
+	Valid         bool              `json:"valid"`
+	Total         int               `json:"total"`
+	QuorumTotal   int               `json:"quorumTotal,omitempty"`   // 票数の合計の定足数 (設定していなければ省略)
+	QuorumMet     bool              `json:"quorumMet"`               // 合計が定足数に届いたか (設定していなければ false)
+	OptionsMet    bool              `json:"optionsMet"`              // すべての選択肢が最低の票数に届いたか (設定していなければ false)
+	ShortOptions  []OptionShortfall `json:"shortOptions"`            // 最低の票数に届いていない選択肢 (選択肢の順)
+	Unconstrained bool              `json:"unconstrained,omitempty"` // 条件を何も設定していない (常に有効)
+}
+
+// 票数が結果を有効とみなす条件を満たすか (選択肢は set の順に見る)
+func evaluateValidity(set *optionSet, counts map[string]int) ValidityResponse {
+	res := ValidityResponse{QuorumTotal: quorumTotal, ShortOptions: []OptionShortfall{}}
+	for _, count := range counts {
+		res.Total += count
+	}
+
+	perOption := false
+	for _, option := range set.keys {
+		required := optionMinimum(option)
+		if required <= 0 {
+			continue
+		}
+		perOption = true
+		if counts[option] < required {
+			res.ShortOptions = append(res.ShortOptions, OptionShortfall{
+				Option:   option,
+				Count:    counts[option],
+				Required: required,
+				Missing:  required - counts[option],
+			})
+		}
+	}
+
+	res.QuorumMet = quorumTotal > 0 && res.Total >= quorumTotal
+	res.OptionsMet = perOption && len(res.ShortOptions) == 0
+	res.Unconstrained = quorumTotal == 0 && !perOption
+	res.Valid = res.Unconstrained || res.QuorumMet || res.OptionsMet
+	return res
+}
+
+// GET /results/validity エンドポイントの処理
+// 票数と選択肢を読み取りロックの中で読み、結果を有効とみなす条件を満たすかと、最低の票数に届かない選択肢を返す
+// 条件は人数の票数で見る (重み付きの票数では見ない)。終了した投票は確定した票数で見る
+func (rm *room) validityHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	rm.mutex.RLock()
+	counts, _ := rm.resultCounts()
+	res := evaluateValidity(rm.optionSet(), counts)
+	rm.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 届いていない選択肢の名前
+func shortOptions(res ValidityResponse) []string {
+	var options []string
+	for _, s := range res.ShortOptions {
+		options = append(options, s.Option)
+	}
+	return options
+}
+
+func TestEvaluateValidity(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		counts map[string]int
+		valid  bool
+		short  []string
+	}{
+		{name: "unconstrained", counts: nil, valid: true},
+		{name: "total one short", env: []string{"QUORUM_TOTAL=10"}, counts: map[string]int{"hot": 5, "cold": 4}, valid: false},
+		{name: "total exactly", env: []string{"QUORUM_TOTAL=10"}, counts: map[string]int{"hot": 5, "cold": 5}, valid: true},
+		{name: "option min one short", env: []string{"QUORUM_OPTION_MIN=2"}, counts: map[string]int{"hot": 2, "ok": 2, "cold": 1}, valid: false, short: []string{"cold"}},
+		{name: "option min exactly", env: []string{"QUORUM_OPTION_MIN=2"}, counts: map[string]int{"hot": 2, "ok": 2, "cold": 2}, valid: true},
+		{name: "option min none voted", env: []string{"QUORUM_OPTION_MIN=1"}, counts: nil, valid: false, short: []string{"hot", "ok", "cold"}},
+		// 選択肢ごとの設定は全体の設定より優先し、0 ならその選択肢には求めない
+		{name: "per-option overrides", env: []string{"QUORUM_OPTION_MIN=2", "QUORUM_OPTION_MINS=さむい=3,ok=0"}, counts: map[string]int{"hot": 2, "cold": 2}, valid: false, short: []string{"cold"}},
+		{name: "per-option met", env: []string{"QUORUM_OPTION_MIN=2", "QUORUM_OPTION_MINS=さむい=3,ok=0"}, counts: map[string]int{"hot": 2, "cold": 3}, valid: true},
+		// どちらかの条件を満たせば有効
+		{name: "total met, options short", env: []string{"QUORUM_TOTAL=5", "QUORUM_OPTION_MIN=1"}, counts: map[string]int{"hot": 5}, valid: true, short: []string{"ok", "cold"}},
+		{name: "options met, total short", env: []string{"QUORUM_TOTAL=100", "QUORUM_OPTION_MIN=1"}, counts: map[string]int{"hot": 1, "ok": 1, "cold": 1}, valid: true},
+		{name: "neither met", env: []string{"QUORUM_TOTAL=5", "QUORUM_OPTION_MIN=2"}, counts: map[string]int{"hot": 3, "cold": 1}, valid: false, short: []string{"ok", "cold"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestServer(t, tt.env...)
+			res := evaluateValidity(currentOptions.Load(), tt.counts)
+			if res.Valid != tt.valid {
+				t.Errorf("valid %v, want %v: %+v", res.Valid, tt.valid, res)
+			}
+			if got := shortOptions(res); !slices.Equal(got, tt.short) {
+				t.Errorf("short options %v, want %v", got, tt.short)
+			}
+			for _, s := range res.ShortOptions {
+				if s.Missing != s.Required-s.Count || s.Missing <= 0 {
+					t.Errorf("%s: missing %d, required %d, count %d", s.Option, s.Missing, s.Required, s.Count)
+				}
+			}
+		})
+	}
+}
+
+// 定足数の1票前までは無効で、届いた票で有効になる。投票は止めない
+func TestValidityEndpointBoundary(t *testing.T) {
+	const quorum = 3
+	srv := newTestServer(t, fmt.Sprintf("QUORUM_TOTAL=%d", quorum))
+	check := func(valid bool, total int) {
+		t.Helper()
+		var res ValidityResponse
+		_, data := srv.do(t, http.MethodGet, "/v1/results/validity", nil)
+		decodeJSON(t, data, &res)
+		if res.Valid != valid || res.QuorumMet != valid || res.Total != total || res.QuorumTotal != quorum {
+			t.Errorf("total %d: %s, want valid=%v", total, data, valid)
+		}
+	}
+
+	check(false, 0)
+	for i := 1; i < quorum; i++ {
+		srv.vote(t, "/v1/vote", fmt.Sprintf("u%d", i), "hot", http.StatusOK)
+		check(false, i)
+	}
+	srv.vote(t, "/v1/vote", "last", "hot", http.StatusOK)
+	check(true, quorum)
+	srv.vote(t, "/v1/vote", "extra", "hot", http.StatusOK)
+	check(true, quorum+1)
+
+	if res, data := srv.do(t, http.MethodPost, "/v1/results/validity", nil); res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d: %s", res.StatusCode, data)
+	}
+}
+
+func TestLoadQuorumInvalid(t *testing.T) {
+	for _, env := range []string{"QUORUM_TOTAL=-1", "QUORUM_OPTION_MIN=-1", "QUORUM_OPTION_MINS=warm=1", "QUORUM_OPTION_MINS=hot", "QUORUM_OPTION_MINS=hot=-2"} {
+		t.Run(env, func(t *testing.T) {
+			newTestServer(t)
+			key, value, _ := strings.Cut(env, "=")
+			t.Setenv(key, value)
+			if err := loadQuorum(); err == nil {
+				t.Errorf("%s: no error", env)
+			}
+		})
+	}
+}
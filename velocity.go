@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// 投票の勢いを数える期間 (1秒ごとのバケットを60個持つ)
+const velocityBuckets = 60
+
+// 直近1分間に選ばれた票の数を選択肢ごとに数える
+// 1秒ごとのバケットのリングで持ち、ティッカーで1つずつ進める (古いバケットは空にして使い回す)
+// メモリは バケット数 × 選択肢数 で頭打ちになる。部屋のロックで守る
+type voteVelocity struct {
+	buckets [velocityBuckets]map[string]int
+	head    int // 今の1秒の票を数えるバケット
+}
+
+// 今のバケットに1票足す (呼び出し側でロックを取っておくこと)
+func (v *voteVelocity) add(vote string) {
+	if v.buckets[v.head] == nil {
+		v.buckets[v.head] = make(map[string]int)
+	}
+	v.buckets[v.head][vote]++
+}
+
+// 次のバケットに進み、1分前の票を捨てる (呼び出し側でロックを取っておくこと)
+func (v *voteVelocity) advance() {
+	v.head = (v.head + 1) % velocityBuckets
+	clear(v.buckets[v.head])
+}
+
+// 直近1分間の選択肢ごとの票 (呼び出し側でロックを取っておくこと)
+func (v *voteVelocity) perMinute(options []string) map[string]int {
+	out := make(map[string]int, len(options))
+	for _, option := range options {
+		out[option] = 0
+	}
+	for _, bucket := range v.buckets {
+		for vote, n := range bucket {
+			// 取り除かれた選択肢の票は含めない
+			if _, ok := out[vote]; ok {
+				out[vote] += n
+			}
+		}
+	}
+	return out
+}
+
+// 1秒ごとにすべての部屋の勢いと流量のバケットを進める (進める前に票の急増を調べる)。サーバーが終了すると止まる
+func startVelocityTicker() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				roomsMutex.Lock()
+				all := make([]*room, 0, len(rooms)+1)
+				all = append(all, defaultRoom)
+				for _, rm := range rooms {
+					all = append(all, rm)
+				}
+				roomsMutex.Unlock()
+
+				now := time.Now()
+				for _, rm := range all {
+					rm.mutex.Lock()
+					rm.checkSurge(now)
+					rm.velocity.advance()
+					rm.throughput.advance()
+					rm.updateThroughputGauges()
+					rm.mutex.Unlock()
+				}
+			case <-shuttingDown:
+				return
+			}
+		}
+	}()
+}
+
+// GET /results/velocity のレスポンス形式
+type VelocityResponse struct {
+	WindowSeconds  int            `json:"windowSeconds"`
+	VotesPerMinute map[string]int `json:"votesPerMinute"` // 直近1分間に選ばれた票の数
+}
+
+// GET /results/velocity エンドポイントの処理 (UIで伸びている選択肢に矢印を出すため)
+// 投票の変更は変更先の選択肢の1票として数え、取り消しは数えない
+func (rm *room) velocityHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+
+	rm.mutex.RLock()
+	perMinute := rm.velocity.perMinute(rm.optionSet().keys)
+	rm.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(VelocityResponse{WindowSeconds: velocityBuckets, VotesPerMinute: perMinute})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// ビルド時に -ldflags で埋め込む情報
+// 例: go build -ldflags "-X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildCommit = "unknown"
+	buildTime   = "unknown"
+)
+
+// 使用中の投票の保存先 (main で設定する。memory は再起動で消える)
+var storeBackend = "memory"
+
+// GET /version のレスポンス形式
+type VersionResponse struct {
+	Commit      string   `json:"commit"`
+	BuildTime   string   `json:"buildTime"`
+	GoVersion   string   `json:"goVersion"`
+	VoteOptions []string `json:"voteOptions"`
+	Persistence bool     `json:"persistence"` // 再起動しても投票が残るか
+	Store       string   `json:"store"`       // redis, snapshot, sqlite のいずれか
+	StrictJSON  bool     `json:"strictJson"`  // 知らないフィールドのあるボディを 400 にするか (false なら無視する)
+
+	VoteLogSample    float64 `json:"voteLogSample"`    // 投票のログを残す割合 (1 ならすべて)
+	VoteLogUnchanged bool    `json:"voteLogUnchanged"` // 同じ選択肢への再投票のログを出すか
+}
+
+// GET /version エンドポイントの処理 (どのビルドが動いているかをデプロイ後に確かめる用)
+// 認証なしで読めるので、接続先などの秘密は含めない
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if !isGetOrHead(r) {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(VersionResponse{
+		Commit:      buildCommit,
+		BuildTime:   buildTime,
+		GoVersion:   runtime.Version(),
+		VoteOptions: voteOptions(),
+		Persistence: storeBackend != "memory",
+		Store:       storeBackend,
+		StrictJSON:  strictJSON,
+
+		VoteLogSample:    voteLogSample,
+		VoteLogUnchanged: voteLogUnchanged,
+	})
+}
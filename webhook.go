@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 送り待ちの通知の数
+// 溢れたときは通知を捨てる (遅い送り先が投票を待たせないことを優先する)
+const webhookBufferSize = 256
+
+// 通知の1回の送信の制限時間と、失敗したときの再送
+// 再送の間隔は1秒から倍々に伸ばす (最大 webhookMaxAttempts 回まで送る)
+const (
+	webhookTimeout        = 5 * time.Second
+	webhookMaxAttempts    = 4
+	webhookInitialBackoff = time.Second
+)
+
+// 選択肢ごとの通知する票数 (WEBHOOK_THRESHOLDS。小さい順)
+var webhookThresholds map[string][]int
+
+// WEBHOOK_URL に送る通知の内容
+type WebhookPayload struct {
+	Event     string `json:"event"` // "threshold_reached" か、SURGE_WEBHOOK のときの "vote_surge" (Threshold と Count は1分あたりの票)
+	RoomID    string `json:"roomId,omitempty"`
+	Option    string `json:"option"`
+	Label     string `json:"label"`
+	Threshold int    `json:"threshold"`
+	Count     int    `json:"count"`
+	Timestamp string `json:"timestamp"` // RFC3339
+}
+
+// 通知を WEBHOOK_URL に POST する
+// 送信は専用のゴルーチンが行うので、投票のロック中に呼んでも送り先の応答を待たない
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+
+	jobs chan webhookJob
+	done chan struct{}
+}
+
+// 送り待ちの通知と、その通知を出した投票のスパン (送信のスパンからたどれるようにする)
+type webhookJob struct {
+	payload WebhookPayload
+	origin  trace.SpanContext
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	n := &webhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout, Transport: traceTransport(http.DefaultTransport)},
+		jobs:   make(chan webhookJob, webhookBufferSize),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+	for job := range n.jobs {
+		n.deliver(job)
+	}
+}
+
+// 成功するか回数の上限になるまで送る。サーバーの終了中は再送を待たずにあきらめる
+func (n *webhookNotifier) deliver(job webhookJob) {
+	payload := job.payload
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("failed to encode webhook payload", "event", "webhook", "error", err)
+		return
+	}
+
+	ctx, span := tracer.Start(context.Background(), "webhook.deliver",
+		trace.WithLinks(trace.Link{SpanContext: job.origin}),
+		trace.WithAttributes(attribute.String("room.id", payload.RoomID), attribute.String("vote.option", payload.Option), attribute.Int("webhook.threshold", payload.Threshold)))
+	defer span.End()
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := n.post(ctx, body)
+		span.SetAttributes(attribute.Int("webhook.attempts", attempt))
+		if err == nil {
+			slog.Info("webhook delivered", "event", "webhook", "roomId", payload.RoomID, "option", payload.Option, "threshold", payload.Threshold, "attempt", attempt)
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			span.SetStatus(codes.Error, err.Error())
+			slog.Error("webhook delivery failed", "event", "webhook", "roomId", payload.RoomID, "option", payload.Option, "threshold", payload.Threshold, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("webhook delivery failed; retrying", "event", "webhook", "attempt", attempt, "retryIn", backoff.String(), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-shuttingDown:
+			slog.Error("webhook delivery abandoned during shutdown", "event", "webhook", "roomId", payload.RoomID, "option", payload.Option, "threshold", payload.Threshold)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// 通知を送り待ちに入れる (ctx は通知を出した投票のリクエストのもの)
+func (n *webhookNotifier) Send(ctx context.Context, payload WebhookPayload) {
+	select {
+	case n.jobs <- webhookJob{payload: payload, origin: trace.SpanContextFromContext(ctx)}:
+	default:
+		slog.Warn("webhook queue full; dropping notification", "event", "webhook", "roomId", payload.RoomID, "option", payload.Option, "threshold", payload.Threshold)
+	}
+}
+
+// 送り待ちの通知を送り終えてから止める
+func (n *webhookNotifier) Close() {
+	close(n.jobs)
+	<-n.done
+}
+
+// 使用中の通知先 (nilなら通知しない。WEBHOOK_URL で有効にする)
+var webhook *webhookNotifier
+
+// WEBHOOK_THRESHOLDS を読む ("選択肢=票数" のカンマ区切り。例: さむい=50,hot=100)
+// 選択肢は表示名でも書ける。同じ選択肢を複数回書けば、それぞれの票数で通知する
+func loadWebhookThresholds() (map[string][]int, error) {
+	thresholds := make(map[string][]int)
+	for _, item := range envList("WEBHOOK_THRESHOLDS", nil) {
+		name, value, ok := strings.Cut(item, "=")
+		key, known := canonicalOption(strings.TrimSpace(name))
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid WEBHOOK_THRESHOLDS entry %q: want option=count", item)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid WEBHOOK_THRESHOLDS count for %q: must be a positive integer", name)
+		}
+		if !slices.Contains(thresholds[key], count) {
+			thresholds[key] = append(thresholds[key], count)
+		}
+	}
+	for _, counts := range thresholds {
+		slices.Sort(counts)
+	}
+	return thresholds, nil
+}
+
+// 通知済みの選択肢と票数の組
+type thresholdKey struct {
+	option    string
+	threshold int
+}
+
+// 選択肢の票数がちょうど設定の票数に達したら通知する (呼び出し側でロックを取っておくこと)
+// 票数の前後を行き来しても通知は1回だけで、POST /admin/reset で票数を0に戻すとまた通知する
+// 起動時にすでに超えている票数は、達した時点をこのサーバーが見ていないので通知しない
+func (rm *room) checkThresholds(ctx context.Context, option string, count int) {
+	if webhook == nil {
+		return
+	}
+	for _, threshold := range webhookThresholds[option] {
+		key := thresholdKey{option: option, threshold: threshold}
+		if count != threshold || rm.thresholdsFired[key] {
+			continue
+		}
+		if rm.thresholdsFired == nil {
+			rm.thresholdsFired = make(map[thresholdKey]bool)
+		}
+		rm.thresholdsFired[key] = true
+		slog.Info("vote threshold reached", "event", "threshold", "roomId", rm.id, "option", option, "threshold", threshold)
+		webhook.Send(ctx, WebhookPayload{
+			Event:     "threshold_reached",
+			RoomID:    rm.id,
+			Option:    option,
+			Label:     rm.optionSet().label(option, defaultLabelLanguage),
+			Threshold: threshold,
+			Count:     count,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+}
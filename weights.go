@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 票の重みの設定 (未設定のユーザーは1票)
+var (
+	// ユーザーIDごとの重み (USER_WEIGHTS)
+	userWeights map[string]int
+	// トークンの "role" クレームごとの重み (ROLE_WEIGHTS)
+	roleWeights map[string]int
+)
+
+// USER_WEIGHTS と ROLE_WEIGHTS を読む (どちらも "名前=重み" のカンマ区切り。例: staff=3,guest=1)
+func loadVoteWeights() error {
+	var err error
+	if userWeights, err = parseWeights("USER_WEIGHTS"); err != nil {
+		return err
+	}
+	roleWeights, err = parseWeights("ROLE_WEIGHTS")
+	return err
+}
+
+func parseWeights(key string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range envList(key, nil) {
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: want name=weight", key, item)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid %s weight for %q: must be a positive integer", key, name)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+// ユーザーの票の重み。ユーザーIDの設定を優先し、次にロールの設定、どちらも無ければ1
+func voteWeight(userID, role string) int {
+	if weight, ok := userWeights[userID]; ok {
+		return weight
+	}
+	if weight, ok := roleWeights[role]; ok && role != "" {
+		return weight
+	}
+	return 1
+}
+
+// 保存された重みを読むとき用。重みを記録する前のデータ (0) は1票として扱う
+func normalizeWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// 1クライアントあたりの送信待ちの数 (溢れたクライアントは切断する)
+	wsSendBufferSize = 16
+	// 書き込みにかけてよい時間
+	wsWriteWait = 10 * time.Second
+	// クライアントからの pong を待つ時間と、ping を送る間隔
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// WebSocketで接続しているクライアント
+type wsClient struct {
+	roomID string
+	room   *room
+	admin  bool // 管理用キーでつないだ (MIN_REVEAL で隠さない)
+	conn   *websocket.Conn
+	send   chan []byte
+	read   chan struct{} // readPump が終わると閉じる (クライアントが閉じた)
+}
+
+// ある部屋の集計が変わったという通知
+type wsMessage struct {
+	roomID string
+	data   []byte
+}
+
+// 接続中のクライアントを管理するハブ
+// クライアントの集合はハブのゴルーチンだけが触るので、投票の側はチャネルに送るだけで済む
+type wsHub struct {
+	clients    map[*wsClient]struct{}
+	register   chan *wsClient
+	unregister chan *wsClient
+	broadcast  chan wsMessage
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		clients:    make(map[*wsClient]struct{}),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		broadcast:  make(chan wsMessage, 256),
+	}
+}
+
+// ハブのゴルーチン。サーバーが終了すると全クライアントを切断して止まる
+func (h *wsHub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = struct{}{}
+		case c := <-h.unregister:
+			h.remove(c)
+		case msg := <-h.broadcast:
+			for c := range h.clients {
+				if c.roomID != msg.roomID {
+					continue
+				}
+				select {
+				case c.send <- msg.data:
+				default:
+					// 送信が追いつかないクライアントは切る
+					slog.Info("dropping slow websocket client", "event", "ws_drop", "roomId", c.roomID)
+					h.remove(c)
+				}
+			}
+		case <-shuttingDown:
+			for c := range h.clients {
+				h.remove(c)
+			}
+			return
+		}
+	}
+}
+
+func (h *wsHub) remove(c *wsClient) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// 部屋の最新の集計を接続中のクライアントへ送る (ハブのチャネルに入れるだけ)
+func (h *wsHub) publish(roomID string, data []byte) {
+	select {
+	case h.broadcast <- wsMessage{roomID: roomID, data: data}:
+	case <-shuttingDown:
+	}
+}
+
+// 集計の更新を配るハブ (main で起動する。nilなら配らない)
+var hub *wsHub
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkWSOrigin,
+}
+
+// ブラウザからの接続は CORS と同じオリジンだけを許可する
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	origins := loadCORSOrigins()
+	return slices.Contains(origins, "*") || slices.Contains(origins, origin)
+}
+
+// GET /ws エンドポイントの処理
+// WebSocketに切り替え、接続時と投票が確定するたびに集計のJSONを送る (MIN_REVEAL を下回っている間は null)
+func (rm *room) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	if !rm.checkResultsRevealed(w, r) {
+		return
+	}
+	if hub == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeInternal, "WebSocket is not available")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade がエラーレスポンスを書いている
+		slog.InfoContext(r.Context(), "websocket upgrade failed", "event", "ws", "error", err)
+		return
+	}
+
+	client := &wsClient{roomID: rm.id, room: rm, admin: isAdmin(r), conn: conn, send: make(chan []byte, wsSendBufferSize), read: make(chan struct{})}
+
+	// 集計の通知は書き込みロック中に送られるので、読み取りロック中に登録すれば取りこぼさない
+	rm.mutex.RLock()
+	initial, _ := json.Marshal(rm.store.Counts())
+	client.send <- initial
+	select {
+	case hub.register <- client:
+	case <-shuttingDown:
+		rm.mutex.RUnlock()
+		conn.Close()
+		return
+	}
+	rm.mutex.RUnlock()
+
+	// 書き込み側が閉じ終わるまで戻らない (配信の接続の数を、接続を閉じ終えてから減らすため)
+	written := make(chan struct{})
+	go func() {
+		client.writePump()
+		close(written)
+	}()
+	client.readPump()
+	<-written
+}
+
+// クライアントからのメッセージは使わないが、切断と pong を検知するために読み続ける
+func (c *wsClient) readPump() {
+	defer func() {
+		select {
+		case hub.unregister <- c:
+		case <-shuttingDown:
+		}
+		c.conn.Close()
+		close(c.read)
+	}()
+
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// 送信待ちの集計と定期的な ping を書き込む
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				// ハブに切断された
+				if isShuttingDown() {
+					c.close()
+					return
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, c.room.streamCounts(c.admin, data)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// サーバーの終了をクライアントに close フレーム (1001 Going Away) で知らせる
+// クライアントが close で応える (readPump が終わる) のを streamCloseGrace だけ待ってから切る
+func (c *wsClient) close() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server closing")
+	if err := c.conn.WriteMessage(websocket.CloseMessage, msg); err != nil {
+		return
+	}
+	grace := time.NewTimer(streamCloseGrace)
+	defer grace.Stop()
+	select {
+	case <-c.read:
+	case <-grace.C:
+	}
+}
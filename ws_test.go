@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialWS(t *testing.T, srv *testServer, path string, headers http.Header) *websocket.Conn {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, headers)
+	if err != nil {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// 次のメッセージ (届かなければ失敗にする)
+func readWS(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(data)
+}
+
+// つないだ後に MIN_REVEAL を下回ったら票数ではなく null を送る (管理用キーでつないだクライアントには票数を送る)
+func TestWSHidesCountsBelowMinReveal(t *testing.T) {
+	srv := newTestServer(t, "MIN_REVEAL=2")
+	srv.vote(t, "/v1/vote", "u1", "hot", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u2", "hot", http.StatusOK)
+
+	conn := dialWS(t, srv, "/v1/ws", nil)
+	admin := dialWS(t, srv, "/v1/ws", http.Header{"X-Admin-Key": {testAdminKey}})
+	for _, c := range []*websocket.Conn{conn, admin} {
+		if got := readWS(t, c); !strings.Contains(got, `"hot":2`) {
+			t.Fatalf("initial message %s", got)
+		}
+	}
+
+	srv.do(t, http.MethodPost, "/v1/admin/reset", nil, adminHeader)
+	if got := readWS(t, conn); got != "null" {
+		t.Errorf("after reset: %s, want null", got)
+	}
+	if got := readWS(t, admin); got == "null" {
+		t.Errorf("admin after reset: %s, want counts", got)
+	}
+
+	srv.vote(t, "/v1/vote", "u1", "cold", http.StatusOK)
+	srv.vote(t, "/v1/vote", "u2", "cold", http.StatusOK)
+	// 2票目までのどちらかの通知は null のこともあるので、票数の届くまで読む
+	for got := readWS(t, conn); !strings.Contains(got, `"cold":2`); got = readWS(t, conn) {
+		if got != "null" && !strings.Contains(got, `"cold":1`) {
+			t.Fatalf("unexpected message %s", got)
+		}
+	}
+}